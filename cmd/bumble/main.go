@@ -26,12 +26,15 @@ const DEFAULT_PORT int = 8335
 
 // Listens for SIGINT or SIGTERM and calls table.CloseDB().
 func setupCloseHandler(database *db.Database) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		fmt.Println("closehandler invoked")
-		database.Close()
+		if err := database.Close(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}()
 }
@@ -73,14 +76,58 @@ func main() {
 	var portFlag = flag.Int("p", DEFAULT_PORT, "port number")
 	var promptFlag = flag.Bool("c", true, "use prompt?")
 	var projectFlag = flag.String("project", "", "choose project: [go,pager,db,query,concurrency,recovery] (required)")
+	var pagesFlag = flag.Int("pages", config.PoolPages, "number of frames in the buffer pool")
+	var pageSizeFlag = flag.Int64("pagesize", pager.PAGESIZE, "page size in bytes for new tables (a multiple of 4096)")
+	var policyFlag = flag.String("policy", pager.LRU_POLICY, "buffer replacement policy: [lru,clock,lru-k,2q]")
+	var readAheadFlag = flag.Int("readahead", config.ReadAheadPages, "pages to read ahead of sequential scans (0 disables)")
+	var dirtyRatioFlag = flag.Float64("dirtyratio", 0, "start background write-back once this fraction of frames is dirty (0 disables)")
+	var doubleWriteFlag = flag.Bool("doublewrite", config.DoubleWrite, "protect page and header writes against tearing with a double-write side file (two fsyncs per write)")
+	var syncFlag = flag.String("sync", string(pager.SYNC_CHECKPOINT), "when to fsync: [none,checkpoint,flush]")
+	var addHeadersFlag = flag.Bool("addheaders", false, "give table files written before pagers kept a header one when they are opened")
+	var trackPinsFlag = flag.Bool("trackpins", false, "record where pages are pinned, to trace leaked pins (slow)")
+	var keyFileFlag = flag.String("keyfile", "", "file holding an AES key to encrypt tables and the log with (optional)")
 	flag.Parse()
+	// Set up the buffer pool shared by all tables.
+	policy, err := pager.NewPolicy(*policyFlag, *pagesFlag)
+	if err != nil {
+		panic(err)
+	}
+	pool, err := pager.NewBufferPoolWithOptions(*pagesFlag, *pageSizeFlag, policy)
+	if err != nil {
+		panic(err)
+	}
+	pool.SetReadAhead(*readAheadFlag)
+	syncMode, err := pager.ParseSyncMode(*syncFlag)
+	if err != nil {
+		panic(err)
+	}
+	pool.SetSyncMode(syncMode)
+	pool.SetDoubleWrite(*doubleWriteFlag)
+	pool.SetAddHeaders(*addHeadersFlag)
+	pool.SetPinTracking(*trackPinsFlag)
+	var key []byte
+	if *keyFileFlag != "" {
+		if key, err = pager.ReadKeyFile(*keyFileFlag); err != nil {
+			panic(err)
+		}
+		if err = pool.SetEncryptionKey(key); err != nil {
+			panic(err)
+		}
+	}
+	if *dirtyRatioFlag > 0 {
+		opts := pager.DefaultFlusherOptions
+		opts.HighWater = *dirtyRatioFlag
+		opts.LowWater = *dirtyRatioFlag / 2
+		if err = pool.StartFlusher(opts); err != nil {
+			panic(err)
+		}
+	}
 	// Open the db; if recovery, prime the database.
 	var database *db.Database
-	var err error
 	if *projectFlag == "recovery" {
-		database, err = recovery.Prime(*dbFlag)
+		database, err = recovery.PrimeWithPool(*dbFlag, pool)
 	} else {
-		database, err = db.Open(*dbFlag)
+		database, err = db.OpenWithPool(*dbFlag, pool)
 	}
 	if err != nil {
 		panic(err)
@@ -105,7 +152,7 @@ func main() {
 		l := list.NewList()
 		repls = append(repls, list.ListRepl(l))
 	case "pager":
-		pRepl, err := pager.PagerRepl()
+		pRepl, err := pager.PagerRepl(*trackPinsFlag)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -130,6 +177,12 @@ func main() {
 			fmt.Println(err)
 			return
 		}
+		if key != nil {
+			if err = rm.SetEncryptionKey(key); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
 		repls = append(repls, recovery.RecoveryREPL(database, tm, rm))
 		// Recover in this case!
 		err = rm.Recover()
@@ -23,7 +23,7 @@ var MAX_DELAY int64 = 10
 
 // Listens for SIGINT or SIGTERM and calls table.CloseDB().
 func setupCloseHandler(database *db.Database) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -80,7 +80,7 @@ func main() {
 	}
 	// Set up the log file.
 	os.Remove("./data/db.log")
-	err = database.CreateLogFile()
+	err = database.CreateLogFile("./data/db.log")
 	if err != nil {
 		panic(err)
 	}
@@ -1,6 +1,7 @@
 package btree
 
 import (
+	"bytes"
 	"errors"
 	"io"
 
@@ -10,18 +11,55 @@ import (
 
 // Tables are an abstraction over the entries stored in our database.
 type BTreeIndex struct {
-	pager  *pager.Pager // The page handler to read from files.
-	rootPN int64        // The root page number.
+	pager        *pager.Pager  // The page handler to read from files.
+	rootPN       int64         // The root page number.
+	superNode    *InternalNode // The root's parent, locked while the root may split.
+	duplicates   bool          // Whether entries may share keys.
+	compressKeys bool          // Whether keys in internal nodes are compressed.
+}
+
+// TableOptions controls what kind of table a new file holds. An existing
+// file must hold the same kind of table.
+type TableOptions struct {
+	Duplicates   bool // Let entries share keys, as long as their values differ. Values count toward the key size limit.
+	CompressKeys bool // Store keys in internal nodes without the prefix they share, and cut them short; see compress.go.
 }
 
 // OpenTable returns a table associated with the given database filename.
+// The table gets a private buffer pool.
 func OpenTable(filename string) (table *BTreeIndex, err error) {
-	// Create a pager for the table
-	pager := pager.NewPager()
+	return openTable(filename, pager.NewPager(), TableOptions{})
+}
+
+// OpenTableWithPool returns a table associated with the given database filename
+// whose pages are cached in the given buffer pool.
+func OpenTableWithPool(filename string, pool *pager.BufferPool) (table *BTreeIndex, err error) {
+	return openTable(filename, pager.NewPagerWithPool(pool), TableOptions{})
+}
+
+// OpenTableWithOptions returns a table of the given kind associated with the
+// given database filename, whose pages are cached in the given buffer pool,
+// or in a private one if it is nil.
+func OpenTableWithOptions(filename string, pool *pager.BufferPool, opts TableOptions) (table *BTreeIndex, err error) {
+	if pool == nil {
+		return openTable(filename, pager.NewPager(), opts)
+	}
+	return openTable(filename, pager.NewPagerWithPool(pool), opts)
+}
+
+// openTable opens the given database filename with the given pager.
+func openTable(filename string, pager *pager.Pager, opts TableOptions) (table *BTreeIndex, err error) {
+	if err = upgradeTable(filename, pager.GetPool()); err != nil {
+		return nil, err
+	}
 	err = pager.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkIndexType(pager, opts); err != nil {
+		pager.Close()
+		return nil, err
+	}
 	// Initialize the pager if it's new.
 	if pager.GetNumPages() == 0 {
 		rootPage, err := pager.GetPage(ROOT_PN)
@@ -32,8 +70,46 @@ func OpenTable(filename string) (table *BTreeIndex, err error) {
 		initPage(rootPage, LEAF_NODE)
 		rootNode := pageToLeafNode(rootPage)
 		rootNode.setRightSibling(-1)
+		rootNode.setLeftSibling(-1)
+	}
+	return &BTreeIndex{
+		pager:        pager,
+		rootPN:       ROOT_PN,
+		superNode:    newSuperNode(),
+		duplicates:   opts.Duplicates,
+		compressKeys: opts.CompressKeys,
+	}, nil
+}
+
+// Index types of the kinds of B+tree, by whether they allow duplicate keys
+// and whether they compress their keys.
+var btreeIndexTypes = map[TableOptions]int64{
+	{}:                                     pager.INDEX_BTREE,
+	{Duplicates: true}:                     pager.INDEX_BTREE_DUPLICATES,
+	{CompressKeys: true}:                   pager.INDEX_BTREE_COMPRESSED,
+	{Duplicates: true, CompressKeys: true}: pager.INDEX_BTREE_DUPLICATES_COMPRESSED,
+}
+
+// checkIndexType records that a new file holds the given kind of B+tree, or
+// checks that an existing one does.
+func checkIndexType(tablePager *pager.Pager, opts TableOptions) error {
+	return tablePager.CheckIndexType(btreeIndexTypes[opts], pager.HASH_NONE)
+}
+
+// OptionsOf returns the options of the B+tree held by a file of the given
+// index type, and false if such a file doesn't hold a B+tree.
+func OptionsOf(indexType int64) (TableOptions, bool) {
+	for opts, t := range btreeIndexTypes {
+		if t == indexType {
+			return opts, true
+		}
 	}
-	return &BTreeIndex{pager: pager, rootPN: ROOT_PN}, nil
+	return TableOptions{}, false
+}
+
+// options returns the options that this table was opened with.
+func (table *BTreeIndex) options() TableOptions {
+	return TableOptions{Duplicates: table.duplicates, CompressKeys: table.compressKeys}
 }
 
 // Get this index's filename.
@@ -52,123 +128,213 @@ func (table *BTreeIndex) Close() (err error) {
 	return err
 }
 
-// Finds the given key.
+// Finds the given key. In a table with duplicate keys, this finds the entry
+// with the key that has the smallest value.
 func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
-	// Get the root node.
-	rootPage, err := table.pager.GetPage(table.rootPN)
+	value, err := table.FindBytes(encodeInt(key))
 	if err != nil {
 		return nil, err
 	}
-	// [CONCURRENCY] Lock and eventually unlock the root node.
-	lockRoot(rootPage)
-	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
-	defer unsafeUnlockRoot(rootNode)
-	defer rootPage.Put()
-	// Insert the entry into the root node.
-	value, found := rootNode.get(key)
-	if found {
-		return BTreeEntry{key: key, value: value}, nil
-	}
-	return nil, errors.New("entry could not be found")
+	return BTreeEntry{key: encodeInt(key), value: value}, nil
 }
 
 // Inserts an entry to the table.
 func (table *BTreeIndex) Insert(key int64, value int64) error {
+	return table.InsertBytes(encodeInt(key), encodeInt(value))
+}
+
+// Update modifies an existing entry.
+func (table *BTreeIndex) Update(key int64, value int64) error {
+	return table.UpdateBytes(encodeInt(key), encodeInt(value))
+}
+
+// Delete removes a key, and in a table with duplicate keys every entry with it, from the table.
+func (table *BTreeIndex) Delete(key int64) error {
+	return table.DeleteBytes(encodeInt(key))
+}
+
+// FindBytes returns the value stored under the given key, or in a table with
+// duplicate keys, the smallest value stored under it.
+func (table *BTreeIndex) FindBytes(key []byte) ([]byte, error) {
+	if table.duplicates {
+		it, err := table.RangeIteratorBytes(key, key, RangeOptions{Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		defer it.Close()
+		entry, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, errors.New("entry could not be found")
+		}
+		return entry.(BTreeEntry).value, nil
+	}
+	// [CONCURRENCY] Read-lock the leaf that holds the key.
+	leaf, err := table.lockLeaf(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer leaf.page.Put()
+	defer leaf.page.RUnlock()
+	index := leaf.search(key)
+	if index >= leaf.numKeys || !bytes.Equal(leaf.keyRef(index), key) {
+		return nil, errors.New("entry could not be found")
+	}
+	entry, err := leaf.getEntry(index)
+	if err != nil {
+		return nil, err
+	}
+	return entry.value, nil
+}
+
+// InsertBytes inserts an entry with the given key and value to the table.
+func (table *BTreeIndex) InsertBytes(key []byte, value []byte) error {
+	stored := table.toStored(key, value)
+	key, value = stored.key, stored.value
+	if err := table.checkStoredSize(stored); err != nil {
+		return err
+	}
+	// [CONCURRENCY] Insert into the leaf on its own if it can't split.
+	if done, err := table.writeLeaf(key, (*LeafNode).hasRoom, func(leaf *LeafNode) error {
+		return leaf.insert(key, value, false).err
+	}); done {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
 		return err
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
-	lockRoot(rootPage)
+	table.lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
-	defer unsafeUnlockRoot(rootNode)
+	table.initRootNode(rootNode)
+	defer table.unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
 	result := rootNode.insert(key, value, false)
-	// Check if we need to split the root node.
-	// Remember to preserve the invariant that the root node occupies page 0.
 	if result.isSplit {
-		// [CONCURRENCY] Unlock the root node.
-		defer SUPER_NODE.unlock()
-		// Ensure that our left PN hasn't changed.
-		if result.leftPN != 0 {
-			return errors.New("splitting was corrupted")
-		}
-		// Create a new node to transfer our data.
-		var newNodePN int64
-		// Depending on whether the root is a leaf or an internal node...
-		if rootNode.getNodeType() == LEAF_NODE {
-			// Create a new leaf node.
-			newNode, err := createLeafNode(table.pager)
-			if err != nil {
-				return errors.New("failed to split root node")
-			}
-			defer newNode.page.Put()
-			// Copy the attributes from the root node.
-			leafyRoot := pageToLeafNode(rootNode.getPage())
-			newNode.copy(leafyRoot)
-			newNodePN = newNode.page.GetPageNum()
-		} else {
-			// Create a new internal node.
-			newNode, err := createInternalNode(table.pager)
-			if err != nil {
-				return errors.New("failed to split root node")
-			}
-			defer newNode.page.Put()
-			// Copy the attributes from the root node.
-			internedRoot := pageToInternalNode(rootNode.getPage())
-			newNode.copy(internedRoot)
-			newNodePN = newNode.page.GetPageNum()
-		}
-		// Reinitialize the root node.
-		initPage(rootNode.getPage(), INTERNAL_NODE)
-		newRoot := pageToInternalNode(rootNode.getPage())
-		// Populate the pointers to children.
-		newRoot.updateKeyAt(0, result.key)
-		newRoot.updatePNAt(0, newNodePN)
-		newRoot.updatePNAt(1, result.rightPN)
-		newRoot.updateNumKeys(1)
+		return table.splitRoot(rootNode, result)
 	}
 	return result.err
 }
 
-// Update modifies an existing entry.
-func (table *BTreeIndex) Update(key int64, value int64) error {
+// UpdateBytes replaces the value stored under the given key.
+// Entries of a table with duplicate keys can't be updated by key.
+func (table *BTreeIndex) UpdateBytes(key []byte, value []byte) error {
+	if table.duplicates {
+		return errors.New("cannot update by key in a table with duplicate keys")
+	}
+	if err := checkKeySize(table.pager.GetDataSize(), key); err != nil {
+		return err
+	}
+	// [CONCURRENCY] Update the leaf on its own if it can't split.
+	if done, err := table.writeLeaf(key, (*LeafNode).hasRoom, func(leaf *LeafNode) error {
+		return leaf.insert(key, value, true).err
+	}); done {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
 		return err
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
-	lockRoot(rootPage)
+	table.lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
-	defer unsafeUnlockRoot(rootNode)
+	table.initRootNode(rootNode)
+	defer table.unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
-	// Update the entry.
+	// Update the entry. A larger value can split the leaf it is in.
 	result := rootNode.insert(key, value, true)
+	if result.isSplit {
+		return table.splitRoot(rootNode, result)
+	}
 	return result.err
 }
 
-// Delete removes a key from the table.
-func (table *BTreeIndex) Delete(key int64) error {
+// DeleteBytes removes the given key, and in a table with duplicate keys every
+// entry with it, from the table.
+func (table *BTreeIndex) DeleteBytes(key []byte) error {
+	if table.duplicates {
+		return table.deleteAll(key)
+	}
+	return table.deleteStored(key)
+}
+
+// deleteStored removes the entry stored under the given key from the table.
+func (table *BTreeIndex) deleteStored(key []byte) error {
+	// [CONCURRENCY] Delete from the leaf on its own if it can't underflow.
+	if done, err := table.writeLeaf(key, (*LeafNode).hasSpare, func(leaf *LeafNode) error {
+		_, err := leaf.delete(key)
+		return err
+	}); done {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
 		return err
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
-	lockRoot(rootPage)
+	table.lockRoot(rootPage)
 	rootNode := pageToNode(rootPage)
-	initRootNode(rootNode)
-	defer unsafeUnlockRoot(rootNode)
+	table.initRootNode(rootNode)
+	defer table.unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
-	// Delete the key.
-	rootNode.delete(key)
-	return nil
+	// Delete the key. The root keeps page 0 even if the tree shrinks.
+	_, err = rootNode.delete(key)
+	return err
+}
+
+// splitRoot moves the root's contents to a new node after it has split, and
+// makes the root the parent of the two halves.
+// Remember to preserve the invariant that the root node occupies page 0.
+func (table *BTreeIndex) splitRoot(rootNode Node, result Split) error {
+	// [CONCURRENCY] Unlock the root node.
+	defer table.superNode.unlock()
+	// Ensure that our left PN hasn't changed.
+	if result.leftPN != 0 {
+		return errors.New("splitting was corrupted")
+	}
+	// Create a new node to transfer our data.
+	var newNodePN int64
+	// Depending on whether the root is a leaf or an internal node...
+	if rootNode.getNodeType() == LEAF_NODE {
+		// Create a new leaf node.
+		newNode, err := createLeafNode(table.pager)
+		if err != nil {
+			return errors.New("failed to split root node")
+		}
+		defer newNode.page.Put()
+		// Copy the attributes from the root node.
+		leafyRoot := pageToLeafNode(rootNode.getPage())
+		newNode.copy(leafyRoot)
+		newNodePN = newNode.page.GetPageNum()
+		// The new right node still points back at the root's page.
+		if err := newNode.relinkLeft(result.rightPN, newNodePN); err != nil {
+			return err
+		}
+	} else {
+		// Create a new internal node.
+		newNode, err := createInternalNode(table.pager)
+		if err != nil {
+			return errors.New("failed to split root node")
+		}
+		defer newNode.page.Put()
+		// Copy the attributes from the root node.
+		internedRoot := pageToInternalNode(rootNode.getPage())
+		newNode.copy(internedRoot)
+		newNodePN = newNode.page.GetPageNum()
+	}
+	// Reinitialize the root node.
+	initPage(rootNode.getPage(), INTERNAL_NODE)
+	newRoot := pageToInternalNode(rootNode.getPage())
+	// Populate the pointers to children.
+	fillInternal(newRoot, []childRef{{pn: newNodePN}, {pn: result.rightPN, key: result.key}})
+	return result.err
 }
 
 // Select returns a slice of all entries in the table.
@@ -189,8 +355,10 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 			}
 			entries = append(entries, entry)
 		}
-		if err := cursor.StepForward(); err != nil {
+		if err := cursor.StepForward(); err == ErrCursorAtEnd {
 			break
+		} else if err != nil {
+			return nil, err
 		}
 	}
 	return entries, nil
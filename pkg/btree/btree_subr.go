@@ -1,6 +1,7 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,31 +14,90 @@ import (
 // we open the database.
 var ROOT_PN int64 = 0
 
+// Nodes are slotted pages. After the header comes an array of fixed-size
+// slots, one per cell, in key order, each holding the offset of its cell.
+// Cells are written from the end of the page towards the slots, and the space
+// a removed cell leaves behind is reclaimed by compacting the node once a new
+// cell doesn't fit in the gap between the slots and the cells. Header fields
+// and pagenumbers are fixed-width big-endian integers.
+//
+// Every node's header holds its type, its number of keys, and the offset of
+// its lowest cell. A leaf's header goes on with the pagenumbers of its right
+// and left siblings, or -1 where it has none; an internal node's goes on with
+// the pagenumber of its first child. Leaf cells are laid out as described in
+// Marshal; an internal cell holds the key's length as a uvarint, the key, and
+// the pagenumber of the child to its right. Files written in older layouts
+// are rebuilt in this one when they're opened; see upgradeTable.
+//
+// The lowest bit of a node's type byte is set in leaves. The next one is set
+// in internal nodes that store their keys without the prefix they all share;
+// see compress.go. Such a node holds the prefix between its header and its
+// slots, as the prefix's length, then its bytes.
+
+// Field constants.
+var FIELD_SIZE int64 = 8
+
 // Node header constants.
 var NODETYPE_OFFSET int64 = 0
 var NODETYPE_SIZE int64 = 1
 var NUM_KEYS_OFFSET int64 = NODETYPE_OFFSET + NODETYPE_SIZE
-var NUM_KEYS_SIZE int64 = binary.MaxVarintLen64
-var NODE_HEADER_SIZE int64 = NODETYPE_SIZE + NUM_KEYS_SIZE
+var NUM_KEYS_SIZE int64 = FIELD_SIZE
+var CELLS_START_OFFSET int64 = NUM_KEYS_OFFSET + NUM_KEYS_SIZE
+var CELLS_START_SIZE int64 = FIELD_SIZE
+var NODE_HEADER_SIZE int64 = NODETYPE_SIZE + NUM_KEYS_SIZE + CELLS_START_SIZE
 
 // Leaf node header constants.
 var RIGHT_SIBLING_PN_OFFSET int64 = NODE_HEADER_SIZE
-var RIGHT_SIBLING_PN_SIZE int64 = binary.MaxVarintLen64
-var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE
-var ENTRIES_PER_LEAF_NODE int64 = ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / ENTRYSIZE) - 1
-
-// Internal node header constants.
-var KEY_SIZE int64 = binary.MaxVarintLen64
-var PN_SIZE int64 = binary.MaxVarintLen64
-var INTERNAL_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE
-var ptrSpace int64 = pager.PAGESIZE - INTERNAL_NODE_HEADER_SIZE - KEY_SIZE
-var KEYS_PER_INTERNAL_NODE int64 = (ptrSpace / (KEY_SIZE + PN_SIZE)) - 1
-var KEYS_OFFSET int64 = INTERNAL_NODE_HEADER_SIZE
-var KEYS_SIZE int64 = KEY_SIZE * (KEYS_PER_INTERNAL_NODE + 1)
-var PNS_OFFSET int64 = KEYS_OFFSET + KEYS_SIZE
-
-// [CONCURRENCY]
-var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}}, nil}
+var RIGHT_SIBLING_PN_SIZE int64 = FIELD_SIZE
+var LEFT_SIBLING_PN_OFFSET int64 = RIGHT_SIBLING_PN_OFFSET + RIGHT_SIBLING_PN_SIZE
+var LEFT_SIBLING_PN_SIZE int64 = FIELD_SIZE
+var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE + LEFT_SIBLING_PN_SIZE
+
+// Internal node header constants. The first child's pagenumber is kept in the
+// header; every other child's is kept in the cell of the key to its left.
+var PN_SIZE int64 = FIELD_SIZE
+var FIRST_PN_OFFSET int64 = NODE_HEADER_SIZE
+var INTERNAL_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + PN_SIZE
+
+// Key prefix constants.
+var KEY_PREFIX_BIT byte = 2
+var KEY_PREFIX_SIZE_OFFSET int64 = INTERNAL_NODE_HEADER_SIZE
+var KEY_PREFIX_SIZE_SIZE int64 = FIELD_SIZE
+var KEY_PREFIX_OFFSET int64 = KEY_PREFIX_SIZE_OFFSET + KEY_PREFIX_SIZE_SIZE
+
+// Slot constants.
+var SLOT_SIZE int64 = 4
+
+// The fanout of a node depends on the page size of its table and on the sizes
+// of its keys, so nodes are filled by bytes rather than by entries. To leave
+// room for several entries in every node, a cell and its slot can take up at
+// most an eighth of a node.
+
+// maxLeafCellSize returns the most space one entry can take in a leaf node on a page of the given size.
+func maxLeafCellSize(pageSize int64) int64 {
+	return (pageSize - LEAF_NODE_HEADER_SIZE) / 8
+}
+
+// maxInternalCellSize returns the most space one key can take in an internal node on a page of the given size.
+func maxInternalCellSize(pageSize int64) int64 {
+	return (pageSize - INTERNAL_NODE_HEADER_SIZE) / 8
+}
+
+// internalCellSize returns the size of the internal node cell holding the given key.
+func internalCellSize(key []byte) int64 {
+	return uvarintSize(uint64(len(key))) + int64(len(key)) + PN_SIZE
+}
+
+// checkKeySize returns an error if the given key is too long to store in a
+// table with pages of the given size. A value that doesn't fit in a leaf is
+// kept in overflow pages, but its key must still fit beside the pointer to them.
+func checkKeySize(pageSize int64, key []byte) error {
+	if internalCellSize(key)+SLOT_SIZE > maxInternalCellSize(pageSize) ||
+		leafCellSize(key, make([]byte, OVERFLOW_REF_SIZE))+SLOT_SIZE > maxLeafCellSize(pageSize) {
+		return fmt.Errorf("key of %d bytes is too long", len(key))
+	}
+	return nil
+}
 
 // NodeType identifies if a node is a leaf node or internal node.
 type NodeType bool
@@ -49,15 +109,17 @@ const (
 
 // NodeHeaders contain metadata common to all types of nodes
 type NodeHeader struct {
-	nodeType NodeType
-	numKeys  int64
-	page     *pager.Page
+	nodeType     NodeType
+	numKeys      int64
+	page         *pager.Page
+	compressKeys bool // Whether keys in internal nodes are compressed.
 }
 
 // Leaf Node definition
 type LeafNode struct {
 	NodeHeader           // Include header information
 	rightSiblingPN int64 // Page number of the right sibling node
+	leftSiblingPN  int64 // Page number of the left sibling node
 	parent         Node  // Pointer to the parent node for unlocking.
 }
 
@@ -71,10 +133,22 @@ type InternalNode struct {
 //////////////////////// Generic Helper Functions ///////////////////////////
 /////////////////////////////////////////////////////////////////////////////
 
+// getField returns the field at the given offset of the given page data.
+func getField(data []byte, offset int64) int64 {
+	return int64(binary.BigEndian.Uint64(data[offset : offset+FIELD_SIZE]))
+}
+
+// encodeField returns the given field as it is written to a page.
+func encodeField(x int64) []byte {
+	data := make([]byte, FIELD_SIZE)
+	binary.BigEndian.PutUint64(data, uint64(x))
+	return data
+}
+
 // initPage resets the page then sets the nodeType variable.
 func initPage(page *pager.Page, nodeType NodeType) {
 	page.SetDirty(true)
-	copy(*page.GetData(), make([]byte, pager.PAGESIZE))
+	copy(*page.GetData(), make([]byte, len(*page.GetData())))
 	if nodeType == LEAF_NODE {
 		(*page.GetData())[int(NODETYPE_OFFSET)] = 1 // Set the nodeType bit
 	}
@@ -92,14 +166,12 @@ func pageToNode(page *pager.Page) Node {
 // pageToNodeHeader returns node header data from the given page.
 func pageToNodeHeader(page *pager.Page) NodeHeader {
 	var nodeType NodeType
-	if (*page.GetData())[NODETYPE_OFFSET] == 0 {
+	if (*page.GetData())[NODETYPE_OFFSET]&1 == 0 {
 		nodeType = INTERNAL_NODE
 	} else {
 		nodeType = LEAF_NODE
 	}
-	numKeys, _ := binary.Varint(
-		(*page.GetData())[NUM_KEYS_OFFSET : NUM_KEYS_OFFSET+NUM_KEYS_SIZE],
-	)
+	numKeys := getField(*page.GetData(), NUM_KEYS_OFFSET)
 	return NodeHeader{
 		nodeType: nodeType,
 		numKeys:  numKeys,
@@ -107,19 +179,174 @@ func pageToNodeHeader(page *pager.Page) NodeHeader {
 	}
 }
 
-// cellPos computes the position of a cell within a page given a headersize.
-func cellPos(headersize int64, cellnum int64) int64 {
-	return headersize + cellnum*ENTRYSIZE
+// leftmostLeafPN returns the pagenumber of the leftmost leaf of the tree in the given pager.
+func leftmostLeafPN(p *pager.Pager) (int64, error) {
+	pn := ROOT_PN
+	for {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			return 0, err
+		}
+		header := pageToNodeHeader(page)
+		if header.nodeType == LEAF_NODE {
+			page.Put()
+			return pn, nil
+		}
+		pn = pageToInternalNode(page).getPNAt(0)
+		page.Put()
+	}
+}
+
+// pageSize returns the size of the page backing this node.
+func (node *NodeHeader) pageSize() int64 {
+	return int64(len(*node.page.GetData()))
+}
+
+// headerSize returns the size of this node's header, which its slots follow.
+func (node *NodeHeader) headerSize() int64 {
+	if node.nodeType == LEAF_NODE {
+		return LEAF_NODE_HEADER_SIZE
+	}
+	return INTERNAL_NODE_HEADER_SIZE
+}
+
+// capacity returns the space this node has for slots and cells.
+func (node *NodeHeader) capacity() int64 {
+	return node.pageSize() - node.headerSize()
 }
 
-// keyPos returns the offset in the page to the internal node's ith key.
-func keyPos(index int64) int64 {
-	return KEYS_OFFSET + index*KEY_SIZE
+// cellsStart returns the page offset of this node's lowest cell.
+// A new node has no cells, so they start at the end of its page.
+func (node *NodeHeader) cellsStart() int64 {
+	start := getField(*node.page.GetData(), CELLS_START_OFFSET)
+	if start == 0 {
+		return node.pageSize()
+	}
+	return start
 }
 
-// pnPos returns the page offset to the internal node's ith child's pagenumber
-func pnPos(index int64) int64 {
-	return PNS_OFFSET + index*PN_SIZE
+// setCellsStart updates the page offset of this node's lowest cell.
+func (node *NodeHeader) setCellsStart(start int64) {
+	node.page.Update(encodeField(start), CELLS_START_OFFSET, CELLS_START_SIZE)
+}
+
+// nodePrefix returns the prefix that this node's keys are stored without, if
+// any. It shares memory with the page.
+func (node *NodeHeader) nodePrefix() []byte {
+	data := *node.page.GetData()
+	if data[NODETYPE_OFFSET]&KEY_PREFIX_BIT == 0 {
+		return nil
+	}
+	size := getField(data, KEY_PREFIX_SIZE_OFFSET)
+	return data[KEY_PREFIX_OFFSET : KEY_PREFIX_OFFSET+size]
+}
+
+// slotPos returns the page offset of the slot at the given index.
+func (node *NodeHeader) slotPos(index int64) int64 {
+	return node.headerSize() + prefixSpace(node.nodePrefix()) + index*SLOT_SIZE
+}
+
+// setSlot points the slot at the given index at the given page offset.
+func (node *NodeHeader) setSlot(index int64, offset int64) {
+	data := make([]byte, SLOT_SIZE)
+	binary.BigEndian.PutUint32(data, uint32(offset))
+	node.page.Update(data, node.slotPos(index), SLOT_SIZE)
+}
+
+// cellAt returns the cell at the given index. It shares memory with the page.
+func (node *NodeHeader) cellAt(index int64) []byte {
+	pos := node.slotPos(index)
+	data := *node.page.GetData()
+	cell := data[binary.BigEndian.Uint32(data[pos:pos+SLOT_SIZE]):]
+	keyLen, n := binary.Uvarint(cell)
+	size := int64(n) + int64(keyLen)
+	if node.nodeType == LEAF_NODE {
+		field, m := binary.Uvarint(cell[n:])
+		size += int64(m) + int64(field>>1)
+	} else {
+		size += PN_SIZE
+	}
+	return cell[:size:size]
+}
+
+// keyRef returns the key of the cell at the given index, without the node's
+// key prefix. It shares memory with the page.
+func (node *NodeHeader) keyRef(index int64) []byte {
+	cell := node.cellAt(index)
+	keyLen, n := binary.Uvarint(cell)
+	if node.nodeType == LEAF_NODE {
+		_, m := binary.Uvarint(cell[n:])
+		n += m
+	}
+	return cell[n : n+int(keyLen)]
+}
+
+// usedBytes returns the space taken by this node's key prefix, slots and cells.
+func (node *NodeHeader) usedBytes() int64 {
+	used := prefixSpace(node.nodePrefix()) + node.numKeys*SLOT_SIZE
+	for i := int64(0); i < node.numKeys; i++ {
+		used += int64(len(node.cellAt(i)))
+	}
+	return used
+}
+
+// freeBytes returns the space left in this node, counting the space that
+// compacting it would reclaim.
+func (node *NodeHeader) freeBytes() int64 {
+	return node.capacity() - node.usedBytes()
+}
+
+// insertCell inserts the given cell at the given index, shifting the cells
+// after it to the right. The cell and its slot must fit in the node's free space.
+func (node *NodeHeader) insertCell(index int64, cell []byte) {
+	size := int64(len(cell))
+	if node.cellsStart()-node.slotPos(node.numKeys+1) < size {
+		node.compact()
+	}
+	start := node.cellsStart() - size
+	node.page.Update(cell, start, size)
+	node.setCellsStart(start)
+	// Shift slots to the right.
+	from, to := node.slotPos(index), node.slotPos(node.numKeys)
+	slots := append([]byte(nil), (*node.page.GetData())[from:to]...)
+	node.page.Update(slots, from+SLOT_SIZE, to-from)
+	node.setSlot(index, start)
+	node.updateNumKeys(node.numKeys + 1)
+}
+
+// removeCell removes the cell at the given index, shifting the cells after it
+// to the left. Its space is reclaimed the next time the node is compacted.
+func (node *NodeHeader) removeCell(index int64) {
+	from, to := node.slotPos(index+1), node.slotPos(node.numKeys)
+	slots := append([]byte(nil), (*node.page.GetData())[from:to]...)
+	node.page.Update(slots, from-SLOT_SIZE, to-from)
+	node.updateNumKeys(node.numKeys - 1)
+}
+
+// compact moves this node's cells up against the end of its page, reclaiming
+// the space left by removed cells.
+func (node *NodeHeader) compact() {
+	cells := make([][]byte, node.numKeys)
+	for i := range cells {
+		cells[i] = append([]byte(nil), node.cellAt(int64(i))...)
+	}
+	node.clearCells()
+	for _, cell := range cells {
+		node.insertCell(node.numKeys, cell)
+	}
+}
+
+// clearCells removes all of this node's cells.
+func (node *NodeHeader) clearCells() {
+	node.updateNumKeys(0)
+	node.setCellsStart(node.pageSize())
+}
+
+// updateNumKeys updates the numKeys field in the node struct and the page.
+func (node *NodeHeader) updateNumKeys(nKeys int64) {
+	node.numKeys = nKeys
+	// Write the new data to the page
+	node.page.Update(encodeField(nKeys), NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -129,17 +356,17 @@ func pnPos(index int64) int64 {
 // pageToLeafNode returns the leaf node at the corresponding page.
 func pageToLeafNode(page *pager.Page) *LeafNode {
 	nodeHeader := pageToNodeHeader(page)
-	rightSiblingPN, _ := binary.Varint(
-		(*page.GetData())[RIGHT_SIBLING_PN_OFFSET : RIGHT_SIBLING_PN_OFFSET+RIGHT_SIBLING_PN_SIZE],
-	)
+	rightSiblingPN := getField(*page.GetData(), RIGHT_SIBLING_PN_OFFSET)
+	leftSiblingPN := getField(*page.GetData(), LEFT_SIBLING_PN_OFFSET)
 	return &LeafNode{
 		nodeHeader,
 		rightSiblingPN,
+		leftSiblingPN,
 		nil,
 	}
 }
 
-// createLeafNode creates and returns a new leaf node.
+// createLeafNode creates and returns a new leaf node without siblings.
 // Nodes created with this function must be `Put()` accordingly after use.
 func createLeafNode(pager *pager.Pager) (*LeafNode, error) {
 	newPN := pager.GetFreePN()
@@ -148,7 +375,10 @@ func createLeafNode(pager *pager.Pager) (*LeafNode, error) {
 		return &LeafNode{}, err
 	}
 	initPage(newPage, LEAF_NODE)
-	return pageToLeafNode(newPage), nil
+	newNode := pageToLeafNode(newPage)
+	newNode.setRightSibling(-1)
+	newNode.setLeftSibling(-1)
+	return newNode, nil
 }
 
 // getPage returns a pointer to the leaf node's page.
@@ -166,6 +396,7 @@ func (node *LeafNode) copy(toCopy *LeafNode) {
 	copy(*node.page.GetData(), *toCopy.page.GetData())
 	node.updateNumKeys(toCopy.numKeys)
 	node.setRightSibling(toCopy.rightSiblingPN)
+	node.setLeftSibling(toCopy.leftSiblingPN)
 }
 
 // isRoot returns true if the current node is the root node.
@@ -180,67 +411,85 @@ func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
 	oldSiblingPN := node.rightSiblingPN
 	// Write the new sibling data to the page
 	node.rightSiblingPN = siblingPN
-	siblingData := make([]byte, RIGHT_SIBLING_PN_SIZE)
-	binary.PutVarint(siblingData, node.rightSiblingPN)
 	node.page.Update(
-		siblingData,
+		encodeField(node.rightSiblingPN),
 		RIGHT_SIBLING_PN_OFFSET,
 		RIGHT_SIBLING_PN_SIZE,
 	)
 	return oldSiblingPN
 }
 
-// cellPos returns the page offset to the cell at the given index.
-func (node *LeafNode) cellPos(index int64) int64 {
-	return cellPos(LEAF_NODE_HEADER_SIZE, index)
+// setLeftSibling sets the left sibling pagenumber attribute of the leaf node
+// and updates the leaf node's page accordingly. returns the old left sibling.
+func (node *LeafNode) setLeftSibling(siblingPN int64) int64 {
+	oldSiblingPN := node.leftSiblingPN
+	node.leftSiblingPN = siblingPN
+	node.page.Update(
+		encodeField(node.leftSiblingPN),
+		LEFT_SIBLING_PN_OFFSET,
+		LEFT_SIBLING_PN_SIZE,
+	)
+	return oldSiblingPN
 }
 
-// modifyCell updates the data stored in the cell at the given index.
-func (node *LeafNode) modifyCell(index int64, entry BTreeEntry) {
-	newdata := entry.Marshal()
-	startPos := node.cellPos(index)
-	node.page.Update(newdata, startPos, ENTRYSIZE)
+// maxCellSize returns the most space one entry can take in this leaf node.
+func (node *LeafNode) maxCellSize() int64 {
+	return maxLeafCellSize(node.pageSize())
 }
 
-// getCell returns the entry stored in the cell at the given index.
-func (node *LeafNode) getCell(index int64) BTreeEntry {
-	startPos := node.cellPos(index)
-	// Deserialize the entry.
-	entry := unmarshalEntry((*node.page.GetData())[startPos : startPos+ENTRYSIZE])
-	return entry
+// minBytes returns the space this leaf node's entries must fill, unless it is the root.
+// Both halves of a split fill at least this much.
+func (node *LeafNode) minBytes() int64 {
+	return node.capacity()/2 - node.maxCellSize()
 }
 
-// getKeyAt returns the key stored at the given index of the leaf node.
-func (node *LeafNode) getKeyAt(index int64) int64 {
-	return node.getCell(index).GetKey()
+// hasRoom returns true if any entry can be inserted into the leaf node without it splitting.
+func (node *LeafNode) hasRoom() bool {
+	return node.usedBytes()+node.maxCellSize() <= node.capacity()
+}
+
+// hasSpare returns true if any entry can be deleted from the leaf node without it underflowing.
+func (node *LeafNode) hasSpare() bool {
+	return node.isRoot() || node.usedBytes()-node.maxCellSize() >= node.minBytes()
 }
 
-// updateKeyAt updates the key at the given index of the leaf node.
-func (node *LeafNode) updateKeyAt(index int64, key int64) {
-	entry := node.getCell(index)
-	entry.SetKey(key)
-	node.modifyCell(index, entry)
+// underflows returns true if the leaf node holds too little.
+func (node *LeafNode) underflows() bool {
+	return !node.isRoot() && node.usedBytes() < node.minBytes()
 }
 
-// getValueAt returns the value stored at the given index of the leaf node.
-func (node *LeafNode) getValueAt(index int64) int64 {
-	return node.getCell(index).GetValue()
+// getCell returns the entry stored in the cell at the given index.
+func (node *LeafNode) getCell(index int64) BTreeEntry {
+	return unmarshalEntry(node.cellAt(index))
 }
 
-// updateValueAt updates the value at the given index of the leaf node.
-func (node *LeafNode) updateValueAt(index int64, value int64) {
-	entry := node.getCell(index)
-	entry.SetValue(value)
-	node.modifyCell(index, entry)
+// getEntry returns the entry at the given index, with its value read in from
+// its overflow pages if it has any.
+func (node *LeafNode) getEntry(index int64) (BTreeEntry, error) {
+	return loadEntry(node.page.GetPager(), node.getCell(index))
 }
 
-// updateNumKeys updates the numKeys field in the node struct and the page.
-func (node *LeafNode) updateNumKeys(nKeys int64) {
-	node.numKeys = nKeys
-	// Write the new data to the page
-	nKeysData := make([]byte, NUM_KEYS_SIZE)
-	binary.PutVarint(nKeysData, nKeys)
-	node.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
+// getKeyAt returns the key stored at the given index of the leaf node.
+func (node *LeafNode) getKeyAt(index int64) []byte {
+	return append([]byte(nil), node.keyRef(index)...)
+}
+
+// getEntries returns all entries stored in the leaf node.
+func (node *LeafNode) getEntries() []BTreeEntry {
+	entries := make([]BTreeEntry, node.numKeys)
+	for i := range entries {
+		entries[i] = node.getCell(int64(i))
+	}
+	return entries
+}
+
+// entrySizes returns the space each of the given entries takes in a leaf node.
+func entrySizes(entries []BTreeEntry) []int64 {
+	sizes := make([]int64, len(entries))
+	for i, entry := range entries {
+		sizes[i] = leafCellSize(entry.key, entry.value) + SLOT_SIZE
+	}
+	return sizes
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -286,36 +535,142 @@ func (node *InternalNode) isRoot() bool {
 	return node.page.GetPageNum() == ROOT_PN
 }
 
+// maxCellSize returns the most space one key can take in this internal node.
+func (node *InternalNode) maxCellSize() int64 {
+	return maxInternalCellSize(node.pageSize())
+}
+
+// limit returns the space this internal node's keys may fill before it splits.
+// It leaves room for one more key, so that a key of any size can take the
+// place of another when the children on either side of it are rebalanced.
+func (node *InternalNode) limit() int64 {
+	return node.capacity() - node.maxCellSize()
+}
+
+// minBytes returns the space this internal node's keys must fill, unless it is the root.
+// Both halves of a split fill at least this much.
+func (node *InternalNode) minBytes() int64 {
+	return node.capacity()/2 - 2*node.maxCellSize()
+}
+
+// An internal node's keys may take more space when a new key makes it store
+// them with a shorter prefix, so how full it is is measured by the space they
+// would take without one.
+
+// hasRoom returns true if any key can be inserted into the internal node without it splitting.
+func (node *InternalNode) hasRoom() bool {
+	return node.rawBytes()+node.maxCellSize() <= node.limit()
+}
+
+// hasSpare returns true if any key can be removed from the internal node
+// without it underflowing. The root must keep at least one key.
+func (node *InternalNode) hasSpare() bool {
+	if node.isRoot() {
+		return node.numKeys > 1
+	}
+	return node.rawBytes()-node.maxCellSize() >= node.minBytes()
+}
+
+// underflows returns true if the internal node holds too little.
+func (node *InternalNode) underflows() bool {
+	return !node.isRoot() && node.rawBytes() < node.minBytes()
+}
+
+// rawBytes returns the space this internal node's slots and cells would take
+// if its keys were stored in full.
+func (node *InternalNode) rawBytes() int64 {
+	prefixLen := int64(len(node.nodePrefix()))
+	used := int64(0)
+	for i := int64(0); i < node.numKeys; i++ {
+		keyLen := prefixLen + int64(len(node.keyRef(i)))
+		used += uvarintSize(uint64(keyLen)) + keyLen + PN_SIZE + SLOT_SIZE
+	}
+	return used
+}
+
+// fits returns true if the given children fit into an internal node like
+// this one without it splitting. The first child's key isn't stored.
+func (node *InternalNode) fits(children []childRef) bool {
+	return internalBytes(children, sharedPrefix(children, node.compressKeys)) <= node.limit()
+}
+
+// setKeyPrefix sets the prefix that this internal node's keys are stored
+// without. The node must have no keys.
+func (node *InternalNode) setKeyPrefix(prefix []byte) {
+	data := *node.page.GetData()
+	if len(prefix) == 0 {
+		node.page.Update([]byte{data[NODETYPE_OFFSET] &^ KEY_PREFIX_BIT}, NODETYPE_OFFSET, NODETYPE_SIZE)
+		return
+	}
+	node.page.Update([]byte{data[NODETYPE_OFFSET] | KEY_PREFIX_BIT}, NODETYPE_OFFSET, NODETYPE_SIZE)
+	node.page.Update(encodeField(int64(len(prefix))), KEY_PREFIX_SIZE_OFFSET, KEY_PREFIX_SIZE_SIZE)
+	node.page.Update(prefix, KEY_PREFIX_OFFSET, int64(len(prefix)))
+}
+
+// internalCell returns the cell holding the given key and the pagenumber of the child to its right.
+func internalCell(key []byte, pagenum int64) []byte {
+	cell := make([]byte, 0, internalCellSize(key))
+	cell = appendUvarint(cell, uint64(len(key)))
+	cell = append(cell, key...)
+	return append(cell, encodeField(pagenum)...)
+}
+
 // getKeyAt returns the key stored at the given index of the internal node.
-func (node *InternalNode) getKeyAt(index int64) int64 {
-	startPos := keyPos(index)
-	key, _ := binary.Varint((*node.page.GetData())[startPos : startPos+KEY_SIZE])
-	return key
+func (node *InternalNode) getKeyAt(index int64) []byte {
+	return append(append([]byte(nil), node.nodePrefix()...), node.keyRef(index)...)
 }
 
-// updateKeyAt updates the key at the given index of the internal node.
-func (node *InternalNode) updateKeyAt(index int64, key int64) {
-	// Serialize the key data
-	data := make([]byte, KEY_SIZE)
-	binary.PutVarint(data, key)
-	startPos := keyPos(int64(index))
-	node.page.Update(data, startPos, KEY_SIZE)
+// keyFits returns true if the key at the given index of the internal node can
+// be replaced by the given key.
+func (node *InternalNode) keyFits(index int64, key []byte) bool {
+	prefix := node.nodePrefix()
+	if bytes.HasPrefix(key, prefix) {
+		room := node.freeBytes() + internalCellSize(node.keyRef(index))
+		return internalCellSize(key[len(prefix):]) <= room
+	}
+	children := node.getChildren(nil)
+	children[index+1].key = key
+	return internalBytes(children, sharedPrefix(children, node.compressKeys)) <= node.capacity()
+}
+
+// updateKeyAt replaces the key at the given index of the internal node.
+// The new key must fit; see keyFits. A key without the node's key prefix
+// makes the node store all of its keys anew.
+func (node *InternalNode) updateKeyAt(index int64, key []byte) {
+	prefix := node.nodePrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		children := node.getChildren(nil)
+		children[index+1].key = key
+		fillInternal(node, children)
+		return
+	}
+	pagenum := node.getPNAt(index + 1)
+	cell := internalCell(key[len(prefix):], pagenum)
+	node.removeCell(index)
+	node.insertCell(index, cell)
+}
+
+// pnPos returns the page offset to the internal node's ith child's pagenumber.
+func (node *InternalNode) pnPos(index int64) int64 {
+	if index == 0 {
+		return FIRST_PN_OFFSET
+	}
+	pos := node.slotPos(index - 1)
+	data := *node.page.GetData()
+	return int64(binary.BigEndian.Uint32(data[pos:pos+SLOT_SIZE])) +
+		int64(len(node.cellAt(index-1))) - PN_SIZE
 }
 
 // getPNAt returns the pagenumber stored at the given index of the internal node.
 func (node *InternalNode) getPNAt(index int64) int64 {
-	startPos := pnPos(index)
-	pagenum, _ := binary.Varint((*node.page.GetData())[startPos : startPos+PN_SIZE])
-	return pagenum
+	startPos := node.pnPos(index)
+	return getField(*node.page.GetData(), startPos)
 }
 
 // updatePNAt updates the pagenumber at the given index of the internal node.
 func (node *InternalNode) updatePNAt(index int64, pagenum int64) {
-	// Serialize the pagenum data
-	data := make([]byte, PN_SIZE)
-	binary.PutVarint(data, pagenum)
-	startPos := pnPos(int64(index))
-	node.page.Update(data, startPos, PN_SIZE)
+	startPos := node.pnPos(index)
+	node.page.Update(encodeField(pagenum), startPos, PN_SIZE)
 }
 
 // getChildAt returns the internal node's ith child.
@@ -334,37 +689,68 @@ func (node *InternalNode) getChildAt(index int64, lock bool) (Node, error) {
 	return pageToNode(page), nil
 }
 
-// updateNumKeys updates the numKeys field in the node struct and the page.
-func (node *InternalNode) updateNumKeys(nKeys int64) {
-	node.numKeys = nKeys
-	// Write the new data to the page
-	nKeysData := make([]byte, NUM_KEYS_SIZE)
-	binary.PutVarint(nKeysData, nKeys)
-	node.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
+// getChildren returns the internal node's children, each with the key that
+// separates it from the child before it. The first child gets firstKey.
+func (node *InternalNode) getChildren(firstKey []byte) []childRef {
+	children := make([]childRef, node.numKeys+1)
+	for i := range children {
+		children[i].pn = node.getPNAt(int64(i))
+		if i == 0 {
+			children[i].key = firstKey
+		} else {
+			children[i].key = node.getKeyAt(int64(i - 1))
+		}
+	}
+	return children
+}
+
+// childSizes returns the space each of the given children takes in an
+// internal node, which is that of the key to its left. The first child
+// takes none, as its pagenumber is kept in the header.
+func childSizes(children []childRef) []int64 {
+	sizes := make([]int64, len(children))
+	for i := 1; i < len(children); i++ {
+		sizes[i] = internalCellSize(children[i].key) + SLOT_SIZE
+	}
+	return sizes
+}
+
+// removeChild removes the key at the given index and the child to its right.
+func (node *InternalNode) removeChild(index int64) {
+	node.removeCell(index)
 }
 
 /////////////////////////////////////////////////////////////////////////////
 ////////////////////////// Lock  Helper Functions ///////////////////////////
 /////////////////////////////////////////////////////////////////////////////
 
-func initRootNode(root Node) {
+// newSuperNode returns the node that a table's root reports to. Locking it
+// keeps other writers from locking the root until the root can't split. It
+// lives only in memory, and isn't backed by a page of the table's file.
+func newSuperNode() *InternalNode {
+	return &InternalNode{NodeHeader: NodeHeader{nodeType: INTERNAL_NODE, page: &pager.Page{}}}
+}
+
+func (table *BTreeIndex) initRootNode(root Node) {
 	switch castedRootNode := root.(type) {
 	case *InternalNode:
-		castedRootNode.parent = SUPER_NODE
+		castedRootNode.parent = table.superNode
+		castedRootNode.compressKeys = table.compressKeys
 	case *LeafNode:
-		castedRootNode.parent = SUPER_NODE
+		castedRootNode.parent = table.superNode
+		castedRootNode.compressKeys = table.compressKeys
 	}
 }
 
 // locks the super node and the root node.
-func lockRoot(page *pager.Page) {
-	SUPER_NODE.page.WLock()
+func (table *BTreeIndex) lockRoot(page *pager.Page) {
+	table.superNode.page.WLock()
 	page.WLock()
 }
 
 // unlocks the super node and the root node. should only be called
 // if the student has not finished concurrency yet.
-func unsafeUnlockRoot(root Node) {
+func (table *BTreeIndex) unsafeUnlockRoot(root Node) {
 	// Lock the root node.
 	switch castedRootNode := root.(type) {
 	case *InternalNode:
@@ -373,7 +759,7 @@ func unsafeUnlockRoot(root Node) {
 			fmt.Println("WARNING: unsafeUnlockRoot was called. This function will only be called if theroot node is not being unlocked properly.")
 			castedRootNode.parent = nil
 			castedRootNode.page.WUnlock()
-			SUPER_NODE.page.WUnlock()
+			table.superNode.page.WUnlock()
 		}
 	case *LeafNode:
 		if castedRootNode.parent != nil {
@@ -381,7 +767,7 @@ func unsafeUnlockRoot(root Node) {
 			fmt.Println("WARNING: unsafeUnlockRoot was called. This function will only be called if the root node is not being unlocked properly.")
 			castedRootNode.parent = nil
 			castedRootNode.page.WUnlock()
-			SUPER_NODE.page.WUnlock()
+			table.superNode.page.WUnlock()
 		}
 	}
 }
@@ -391,8 +777,10 @@ func (node *InternalNode) initChild(child Node) {
 	switch castedChild := child.(type) {
 	case *InternalNode:
 		castedChild.parent = node
+		castedChild.compressKeys = node.compressKeys
 	case *LeafNode:
 		castedChild.parent = node
+		castedChild.compressKeys = node.compressKeys
 	}
 }
 
@@ -401,7 +789,7 @@ func (node *InternalNode) initChild(child Node) {
 // only checks if force == false
 func (node *InternalNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == KEYS_PER_INTERNAL_NODE {
+	if !force && !node.hasRoom() {
 		return nil
 	}
 	// Else, unlock the parents recursively, and remove parent pointers.
@@ -430,7 +818,7 @@ func (node *InternalNode) unlock() {
 // only checks if force == false
 func (node *LeafNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == ENTRIES_PER_LEAF_NODE {
+	if !force && !node.hasRoom() {
 		return nil
 	}
 	// Unlock the parents recursively, and remove parent pointers.
@@ -0,0 +1,289 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Rather than inserting entries one at a time, which leaves nodes about half
+// full, a table can be built bottom-up from entries in sorted order: leaves
+// are packed in order and linked up, then each level of internal nodes is
+// built over the one below until a single node, the root, is left. Nodes are
+// filled to a fraction of their capacity, leaving room for later inserts, but
+// never below the occupancy that deletes keep them at. If the last node of a
+// level would fall below it, it is merged into the one before it, or the two
+// share their entries evenly. If loading fails partway, the pages built so
+// far are freed again, and the table is left empty.
+
+// A child of a node being built, and the smallest key in its subtree.
+type childRef struct {
+	pn  int64
+	key []byte
+}
+
+// EntryIterator returns entries one at a time, then nil once it runs out.
+type EntryIterator interface {
+	Next() (utils.Entry, error)
+}
+
+// BulkLoad fills an empty table with the entries from the given iterator,
+// which must come in strictly increasing key order, or in a table with
+// duplicate keys, in increasing key order and in strictly increasing value
+// order among those with the same key. Nodes are filled to the given fraction
+// of their capacity, which must be between 0.5 and 1.
+func BulkLoad(table *BTreeIndex, entries EntryIterator, fillFactor float64) error {
+	if fillFactor < 0.5 || fillFactor > 1 {
+		return fmt.Errorf("bulk load: fill factor %v is not between 0.5 and 1", fillFactor)
+	}
+	return table.bulkLoad(entries.Next, fillFactor)
+}
+
+// bulkLoad fills an empty table with the entries returned by next, which must
+// come in strictly increasing key order. next returns nil once it runs out.
+// Nodes are filled to the given fraction of their capacity.
+func (table *BTreeIndex) bulkLoad(next func() (utils.Entry, error), fill float64) (err error) {
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	inUse := table.pager.GetNumPages() - table.pager.GetNumFreePages()
+	empty := inUse == 1 && pageToNodeHeader(rootPage).numKeys == 0
+	rootPage.Put()
+	if !empty {
+		return errors.New("bulk load: table is not empty")
+	}
+	// The root is only written once everything else is built, so on failure
+	// the table is still empty once the nodes and overflow chains are freed.
+	var built, chains []int64
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, pn := range chains {
+			freeOverflow(table.pager, pn)
+		}
+		for _, pn := range built {
+			table.pager.FreePage(pn)
+		}
+	}()
+	// Pack the leaves, holding back a full leaf's worth of entries beyond the
+	// next one, so that the last few leaves can be evenly filled.
+	pageSize := table.pager.GetDataSize()
+	leafCap := pageSize - LEAF_NODE_HEADER_SIZE
+	leafMin := leafCap/2 - maxLeafCellSize(pageSize)
+	perLeaf := fillTarget(leafCap, leafMin+maxLeafCellSize(pageSize), fill)
+	var leaves []childRef
+	var prev *LeafNode
+	var buffer []BTreeEntry
+	var sizes []int64
+	var lastKey []byte
+	buffered := int64(0)
+	defer func() {
+		if prev != nil {
+			prev.page.Put()
+		}
+	}()
+	writeLeaf := func(n int) error {
+		leaf, err := createLeafNode(table.pager)
+		if err != nil {
+			return err
+		}
+		built = append(built, leaf.page.GetPageNum())
+		fillLeaf(leaf, buffer[:n])
+		if prev != nil {
+			prev.setRightSibling(leaf.page.GetPageNum())
+			leaf.setLeftSibling(prev.page.GetPageNum())
+			prev.page.Put()
+		}
+		prev = leaf
+		key := buffer[0].key
+		if table.compressKeys && lastKey != nil {
+			key = separator(lastKey, key)
+		}
+		lastKey = buffer[n-1].key
+		leaves = append(leaves, childRef{pn: leaf.page.GetPageNum(), key: key})
+		buffered -= sumSizes(sizes[:n])
+		buffer, sizes = buffer[n:], sizes[n:]
+		return nil
+	}
+	for {
+		item, err := next()
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			break
+		}
+		entry := toBTreeEntry(item)
+		entry = table.toStored(entry.key, entry.value)
+		if err := table.checkStoredSize(entry); err != nil {
+			return fmt.Errorf("bulk load: %v", err)
+		}
+		if n := len(buffer); n > 0 && bytes.Compare(entry.key, buffer[n-1].key) <= 0 {
+			return errors.New("bulk load: entries are not in strictly increasing key order")
+		}
+		if entry, err = storeEntry(table.pager, entry.key, entry.value); err != nil {
+			return err
+		}
+		if entry.overflow {
+			_, pagenum := parseOverflowRef(entry.value)
+			chains = append(chains, pagenum)
+		}
+		size := leafCellSize(entry.key, entry.value) + SLOT_SIZE
+		buffer, sizes, buffered = append(buffer, entry), append(sizes, size), buffered+size
+		if buffered >= perLeaf+leafCap {
+			if err := writeLeaf(packSizes(sizes, perLeaf, leafCap, leafMin, 1)[0]); err != nil {
+				return err
+			}
+		}
+	}
+	// A table that fits in one leaf keeps it in the root.
+	if len(leaves) == 0 && buffered <= leafCap {
+		rootPage, err := table.pager.GetPage(table.rootPN)
+		if err != nil {
+			return err
+		}
+		defer rootPage.Put()
+		initPage(rootPage, LEAF_NODE)
+		root := pageToLeafNode(rootPage)
+		fillLeaf(root, buffer)
+		root.setRightSibling(-1)
+		root.setLeftSibling(-1)
+		return nil
+	}
+	for _, n := range packSizes(sizes, perLeaf, leafCap, leafMin, 1) {
+		if err := writeLeaf(n); err != nil {
+			return err
+		}
+	}
+	prev.setRightSibling(-1)
+	prev.page.Put()
+	prev = nil
+	// Build internal levels until one node is left, and write that one into the root.
+	// A node's first child takes no space in it, but is counted anyway, so
+	// nodes are packed as if they must hold one more key than they do.
+	maxCell := maxInternalCellSize(pageSize)
+	nodeLimit := pageSize - INTERNAL_NODE_HEADER_SIZE - maxCell
+	nodeMin := (pageSize-INTERNAL_NODE_HEADER_SIZE)/2 - 2*maxCell
+	perNode := fillTarget(nodeLimit, nodeMin+2*maxCell, fill)
+	level := leaves
+	for sumSizes(childSizes(level)) > nodeLimit {
+		parents := make([]childRef, 0)
+		sizes := childSizes(level)
+		sizes[0] = internalCellSize(level[0].key) + SLOT_SIZE
+		for _, n := range packSizes(sizes, perNode, nodeLimit, nodeMin+maxCell, 2) {
+			node, err := createInternalNode(table.pager)
+			if err != nil {
+				return err
+			}
+			built = append(built, node.page.GetPageNum())
+			node.compressKeys = table.compressKeys
+			fillInternal(node, level[:n])
+			node.page.Put()
+			parents = append(parents, childRef{pn: node.page.GetPageNum(), key: level[0].key})
+			level = level[n:]
+		}
+		level = parents
+	}
+	rootPage, err = table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	defer rootPage.Put()
+	initPage(rootPage, INTERNAL_NODE)
+	root := pageToInternalNode(rootPage)
+	root.compressKeys = table.compressKeys
+	fillInternal(root, level)
+	return nil
+}
+
+// toBTreeEntry returns the given entry as stored in a B+tree.
+func toBTreeEntry(entry utils.Entry) BTreeEntry {
+	if entry, ok := entry.(BTreeEntry); ok {
+		return entry
+	}
+	return BTreeEntry{key: encodeInt(entry.GetKey()), value: encodeInt(entry.GetValue())}
+}
+
+// Get the space to fill in a node of the given capacity, which must be filled
+// at least to min.
+func fillTarget(capacity int64, min int64, fill float64) int64 {
+	target := int64(float64(capacity) * fill)
+	if target < min {
+		target = min
+	}
+	if target > capacity {
+		target = capacity
+	}
+	return target
+}
+
+// Split items of the given sizes into nodes, returning how many items go into
+// each. Nodes are filled up to the target size. If the last node would be
+// filled less than min, it is merged into the one before it if they fit
+// together, or else the two share their items evenly.
+func packSizes(sizes []int64, target int64, capacity int64, min int64, minItems int) []int {
+	var counts []int
+	var filled []int64
+	count, size := 0, int64(0)
+	for _, itemSize := range sizes {
+		if count > 0 && size+itemSize > target {
+			counts, filled = append(counts, count), append(filled, size)
+			count, size = 0, 0
+		}
+		count, size = count+1, size+itemSize
+	}
+	counts, filled = append(counts, count), append(filled, size)
+	if last := len(counts) - 1; last > 0 && filled[last] < min {
+		both := counts[last-1] + counts[last]
+		if filled[last-1]+filled[last] <= capacity {
+			counts = append(counts[:last-1], both)
+		} else {
+			half := splitPoints(sizes[len(sizes)-both:], minItems, false)[0].index
+			counts[last-1], counts[last] = half, both-half
+		}
+	}
+	return counts
+}
+
+// Write the given entries into a leaf, replacing the ones in it.
+func fillLeaf(leaf *LeafNode, entries []BTreeEntry) {
+	leaf.clearCells()
+	for _, entry := range entries {
+		leaf.insertCell(leaf.numKeys, entry.Marshal())
+	}
+}
+
+// Point an internal node at the given children, replacing the ones it has.
+// Their keys are stored without the prefix that sharedPrefix picks for them.
+func fillInternal(node *InternalNode, children []childRef) {
+	prefix := sharedPrefix(children, node.compressKeys)
+	node.clearCells()
+	node.setKeyPrefix(prefix)
+	node.updatePNAt(0, children[0].pn)
+	for _, child := range children[1:] {
+		node.insertCell(node.numKeys, internalCell(child.key[len(prefix):], child.pn))
+	}
+}
+
+// CompactTo writes a copy of the table with densely packed nodes to a new
+// file, which caches its pages in the same buffer pool.
+func (table *BTreeIndex) CompactTo(filename string) error {
+	dst, err := OpenTableWithOptions(filename, table.pager.GetPool(), table.options())
+	if err != nil {
+		return err
+	}
+	it, err := table.RangeIterator(0, 0, RangeOptions{NoStart: true, NoEnd: true})
+	if err == nil {
+		err = dst.bulkLoad(it.Next, 1)
+		it.Close()
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,87 @@
+package btree
+
+// When a table compresses its keys, the keys in its internal nodes take less
+// space in two ways, so that an internal node holds more of them and the tree
+// is shallower when keys share long prefixes.
+//
+// First, an internal node stores its keys without the longest prefix that
+// they all share, which it holds once instead. The prefix is picked whenever
+// the node's keys are written anew, as when it is split, rebalanced or
+// bulk-loaded, and only if it saves space. A key that is inserted later and
+// lacks the prefix makes the node write its keys anew with a shorter one, or
+// split if they no longer fit. Internal nodes of tables that don't compress
+// their keys never have a prefix. Tables that do are told apart by their
+// index type, as readers that predate key prefixes can't read their nodes.
+//
+// Second, a key in an internal node only has to separate the subtrees on
+// either side of it: it must be greater than every key to its left, and no
+// greater than any key to its right. So the key that separates two leaves is
+// cut down to the shortest prefix of the right leaf's first key that is still
+// greater than the left leaf's last key. Keys are only cut where leaves are
+// split, shared, or bulk-loaded; internal nodes pass them up as they are.
+
+// separator returns the shortest key that separates the given keys, where left is less than right.
+func separator(left []byte, right []byte) []byte {
+	i := 0
+	for i < len(left) && left[i] == right[i] {
+		i++
+	}
+	return right[:i+1]
+}
+
+// leafKeys returns the key that would go into the parent of the given
+// entries' leaf if it were split before each entry. The first entry gets its
+// own key.
+func leafKeys(entries []BTreeEntry, compress bool) [][]byte {
+	keys := make([][]byte, len(entries))
+	for i, entry := range entries {
+		if compress && i > 0 {
+			keys[i] = separator(entries[i-1].key, entry.key)
+		} else {
+			keys[i] = entry.key
+		}
+	}
+	return keys
+}
+
+// commonPrefix returns the longest prefix of both given keys.
+func commonPrefix(a []byte, b []byte) []byte {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
+
+// sharedPrefix returns the prefix that an internal node pointing at the given
+// children stores their keys without: the longest one they share if compress
+// is set and it saves space, or else none. The first child's key isn't stored.
+func sharedPrefix(children []childRef, compress bool) []byte {
+	if !compress || len(children) < 2 {
+		return nil
+	}
+	// The keys are sorted, so the first and last share the prefix that all do.
+	prefix := commonPrefix(children[1].key, children[len(children)-1].key)
+	if internalBytes(children, prefix) >= internalBytes(children, nil) {
+		return nil
+	}
+	return prefix
+}
+
+// prefixSpace returns the space that the given key prefix takes in an internal node.
+func prefixSpace(prefix []byte) int64 {
+	if len(prefix) == 0 {
+		return 0
+	}
+	return KEY_PREFIX_SIZE_SIZE + int64(len(prefix))
+}
+
+// internalBytes returns the space that the given children take in an internal
+// node that stores their keys without the given prefix, counting the prefix.
+func internalBytes(children []childRef, prefix []byte) int64 {
+	used := prefixSpace(prefix)
+	for _, child := range children[1:] {
+		used += internalCellSize(child.key[len(prefix):]) + SLOT_SIZE
+	}
+	return used
+}
@@ -6,12 +6,19 @@ import (
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
+// ErrCursorAtStart is returned when stepping a cursor back from the first entry of a table.
+var ErrCursorAtStart = errors.New("cannot move the cursor back further")
+
+// ErrCursorAtEnd is returned when stepping a cursor forward from the end of a table.
+var ErrCursorAtEnd = errors.New("cannot advance the cursor further")
+
 // Cursors are an abstration to represent locations in a table.
 type BTreeCursor struct {
 	table   *BTreeIndex // The table that this cursor point to.
 	cellnum int64       // The cell number within a leaf node.
 	isEnd   bool        // Indicates that this cursor points beyond the table/at the end of the table.
 	curNode *LeafNode   // Current node.
+	curPN   int64       // The current node's pagenumber.
 }
 
 // TableStart returns a cursor pointing to the first entry of the table.
@@ -39,12 +46,14 @@ func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
 	leftmostNode := pageToLeafNode(curPage)
 	cursor.isEnd = (leftmostNode.numKeys == 0)
 	cursor.curNode = leftmostNode
+	cursor.curPN = leftmostNode.page.GetPageNum()
+	cursor.prefetch()
 	return &cursor, nil
 }
 
 // TableEnd returns a cursor pointing to the last entry in the db.
 // If the db is empty, returns a cursor to the new insertion position.
-func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
+func (table *BTreeIndex) TableEnd() (utils.BidirectionalCursor, error) {
 	/* SOLUTION {{{ */
 	cursor := BTreeCursor{table: table, cellnum: 0}
 	// Get the root page.
@@ -67,18 +76,31 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 	}
 	// Set the cursor to point to the last entry in the rightmost leaf node.
 	rightmostNode := pageToLeafNode(curPage)
-	cursor.isEnd = false
-	cursor.cellnum = rightmostNode.numKeys - 1
+	cursor.isEnd = (rightmostNode.numKeys == 0)
+	if !cursor.isEnd {
+		cursor.cellnum = rightmostNode.numKeys - 1
+	}
 	cursor.curNode = rightmostNode
+	cursor.curPN = rightmostNode.page.GetPageNum()
 	return &cursor, nil
 	/* SOLUTION }}} */
 }
 
 // TableFind returns a cursor pointing to the given key.
 // If the key is not found, returns a cursor to the new insertion position.
+func (table *BTreeIndex) TableFind(key int64) (utils.BidirectionalCursor, error) {
+	return table.TableFindBytes(encodeInt(key))
+}
+
+// TableFindBytes returns a cursor pointing to the given key, or in a table
+// with duplicate keys, to its first entry.
+// If the key is not found, returns a cursor to the new insertion position.
 // Hint: use keyToNodeEntry
-func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
+func (table *BTreeIndex) TableFindBytes(key []byte) (utils.BidirectionalCursor, error) {
 	/* SOLUTION {{{ */
+	if table.duplicates {
+		key = keyPrefix(key)
+	}
 	cursor := BTreeCursor{table: table}
 	// Get the root page.
 	rootPage, err := table.pager.GetPage(table.rootPN)
@@ -96,34 +118,28 @@ func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
 	cursor.cellnum = cellnum
 	cursor.isEnd = (cellnum == leaf.numKeys)
 	cursor.curNode = leaf
+	cursor.curPN = leaf.page.GetPageNum()
 	return &cursor, nil
 	/* SOLUTION }}} */
 }
 
 // TableFindRange returns a slice of Entries with keys between the startKey and endKey.
+// The endKey itself is left out.
 func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
-	// Initialize entries array, get starting cursor.
 	entries := make([]utils.Entry, 0)
-	cursor, err := table.TableFind(startKey)
+	it, err := table.RangeIterator(startKey, endKey, RangeOptions{EndExclusive: true})
 	if err != nil {
 		return entries, err
 	}
-	// Keep advancing the cursor and adding the current entry to the list of
-	// entries until reaching the end key.
-	curEntry, err := cursor.GetEntry()
-	if err != nil {
-		return entries, err
-	}
-	for endKey > curEntry.GetKey() && !cursor.IsEnd() {
-		entries = append(entries, curEntry)
-		cursor.StepForward()
-		curEntry, err = cursor.GetEntry()
-		if err != nil {
+	defer it.Close()
+	for {
+		entry, err := it.Next()
+		if err != nil || entry == nil {
 			return entries, err
 		}
+		entries = append(entries, entry)
 	}
-	return entries, nil
 	/* SOLUTION }}} */
 }
 
@@ -134,7 +150,7 @@ func (cursor *BTreeCursor) StepForward() error {
 		// Get the next node's page number.
 		nextPN := cursor.curNode.rightSiblingPN
 		if nextPN < 0 {
-			return errors.New("cannot advance the cursor further")
+			return ErrCursorAtEnd
 		}
 		// Convert the page into a node.
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
@@ -147,19 +163,56 @@ func (cursor *BTreeCursor) StepForward() error {
 		cursor.cellnum = 0
 		cursor.isEnd = (cursor.cellnum == nextNode.numKeys)
 		cursor.curNode = nextNode
+		cursor.curPN = nextNode.page.GetPageNum()
+		cursor.prefetch()
 		if cursor.isEnd {
 			return cursor.StepForward()
 		}
 		return nil
 	}
-	// Else, just move forward one, potentially marking that we are at the end.
+	// Else, just move forward one, moving on to the next node past the end of this one.
 	cursor.cellnum++
 	if cursor.cellnum >= cursor.curNode.numKeys {
 		cursor.isEnd = true
+		// Only the end of the table is past every entry.
+		if err := cursor.StepForward(); err != ErrCursorAtEnd {
+			return err
+		}
 	}
 	return nil
 }
 
+// StepBackward moves the cursor back by one entry.
+func (cursor *BTreeCursor) StepBackward() error {
+	// If the cursor is at the start of the node, try visiting the previous node.
+	if cursor.cellnum == 0 {
+		// Get the previous node's page number.
+		prevPN := cursor.curNode.leftSiblingPN
+		if prevPN < 0 {
+			return ErrCursorAtStart
+		}
+		// Convert the page into a node.
+		prevPage, err := cursor.table.pager.GetPage(prevPN)
+		if err != nil {
+			return err
+		}
+		defer prevPage.Put()
+		prevNode := pageToLeafNode(prevPage)
+		// Reinitialize the cursor just past the node's last entry.
+		cursor.cellnum = prevNode.numKeys
+		cursor.isEnd = true
+		cursor.curNode = prevNode
+		cursor.curPN = prevNode.page.GetPageNum()
+		if cursor.cellnum == 0 {
+			return cursor.StepBackward()
+		}
+	}
+	// Move back one, which always lands on an entry.
+	cursor.cellnum--
+	cursor.isEnd = false
+	return nil
+}
+
 // IsEnd returns true if at end.
 func (cursor *BTreeCursor) IsEnd() bool {
 	return cursor.isEnd
@@ -171,6 +224,24 @@ func (cursor *BTreeCursor) GetEntry() (utils.Entry, error) {
 	if cursor.isEnd {
 		return BTreeEntry{}, errors.New("getEntry: entry is non-existent")
 	}
-	entry := cursor.curNode.getCell(cursor.cellnum)
-	return entry, nil
+	// The cursor doesn't keep its node pinned, and reading a value from
+	// overflow pages can evict it, so pin it again while reading from it.
+	page, err := cursor.table.pager.GetPage(cursor.curPN)
+	if err != nil {
+		return BTreeEntry{}, err
+	}
+	defer page.Put()
+	entry, err := pageToLeafNode(page).getEntry(cursor.cellnum)
+	if err != nil {
+		return BTreeEntry{}, err
+	}
+	return cursor.table.fromStored(entry), nil
+}
+
+// Start reading the next leaf in while the cursor works through the current one.
+func (cursor *BTreeCursor) prefetch() {
+	nextPN := cursor.curNode.rightSiblingPN
+	if nextPN >= 0 && cursor.table.pager.GetReadAhead() > 0 {
+		cursor.table.pager.Prefetch([]int64{nextPN})
+	}
 }
@@ -0,0 +1,177 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// A table with duplicate keys can hold several entries under one key, as long
+// as their values differ. Each entry is stored under a composite key made of
+// its key and its value, which is unique, and keeps no value of its own. The
+// key part is escaped so that composite keys sort by key, then by value: each
+// zero byte in it is followed by 0xFF, and it ends with a zero byte followed
+// by 0x01. All the composite keys of a key lie between its prefix, the escaped
+// key with its end marker, and the same with the marker's last byte raised.
+// Since the value is part of the composite key, values can't be kept in
+// overflow pages: the escaped key and the value together are limited to the
+// size of a key, about an eighth of a page.
+
+// Bytes that escape a zero byte in a key, and that end a key.
+var ESCAPED_ZERO = []byte{0x00, 0xFF}
+var KEY_END = []byte{0x00, 0x01}
+
+// compositeKey returns the key that the given entry is stored under in a table with duplicate keys.
+func compositeKey(key []byte, value []byte) []byte {
+	composite := make([]byte, 0, len(key)+len(KEY_END)+len(value))
+	for _, b := range key {
+		if b == 0 {
+			composite = append(composite, ESCAPED_ZERO...)
+		} else {
+			composite = append(composite, b)
+		}
+	}
+	composite = append(composite, KEY_END...)
+	return append(composite, value...)
+}
+
+// splitCompositeKey returns the key and value that the given composite key is made of.
+func splitCompositeKey(composite []byte) (key []byte, value []byte) {
+	key = make([]byte, 0, len(composite))
+	for i := 0; i+1 < len(composite); i++ {
+		if composite[i] != 0 {
+			key = append(key, composite[i])
+			continue
+		}
+		if composite[i+1] == KEY_END[1] {
+			return key, append([]byte(nil), composite[i+2:]...)
+		}
+		key = append(key, 0)
+		i++
+	}
+	return key, nil
+}
+
+// keyPrefix returns the smallest composite key of the given key.
+func keyPrefix(key []byte) []byte {
+	return compositeKey(key, nil)
+}
+
+// keyPrefixEnd returns the smallest composite key of all keys greater than the given key.
+func keyPrefixEnd(key []byte) []byte {
+	prefix := keyPrefix(key)
+	prefix[len(prefix)-1]++
+	return prefix
+}
+
+// checkStoredSize returns an error if the given entry, as stored in this
+// table, is too large to store.
+func (table *BTreeIndex) checkStoredSize(stored BTreeEntry) error {
+	err := checkKeySize(table.pager.GetDataSize(), stored.key)
+	if err != nil && table.duplicates {
+		return fmt.Errorf("key and value of %d bytes together are too long for a table with duplicate keys", len(stored.key))
+	}
+	return err
+}
+
+// toStored returns the entry as stored in this table.
+func (table *BTreeIndex) toStored(key []byte, value []byte) BTreeEntry {
+	if table.duplicates {
+		return BTreeEntry{key: compositeKey(key, value), value: []byte{}}
+	}
+	return BTreeEntry{key: key, value: value}
+}
+
+// fromStored returns the entry that the given one, as stored in this table, holds.
+func (table *BTreeIndex) fromStored(entry BTreeEntry) BTreeEntry {
+	if !table.duplicates {
+		return entry
+	}
+	key, value := splitCompositeKey(entry.key)
+	return BTreeEntry{key: key, value: value}
+}
+
+// storedRange returns the bounds, as stored in this table, of the range of
+// keys between start and end that the given options describe.
+func (table *BTreeIndex) storedRange(start []byte, end []byte, opts RangeOptions) ([]byte, []byte, RangeOptions) {
+	if !table.duplicates {
+		return start, end, opts
+	}
+	// Every composite key of start comes after its prefix, and before the prefix of the key after it.
+	if opts.StartExclusive {
+		start, opts.StartExclusive = keyPrefixEnd(start), false
+	} else {
+		start = keyPrefix(start)
+	}
+	if opts.EndExclusive {
+		end = keyPrefix(end)
+	} else {
+		end, opts.EndExclusive = keyPrefixEnd(end), true
+	}
+	return start, end, opts
+}
+
+// AllowsDuplicates returns true if entries of this table may share keys.
+func (table *BTreeIndex) AllowsDuplicates() bool {
+	return table.duplicates
+}
+
+// FindAll returns an iterator over the entries with the given key, in value order.
+func (table *BTreeIndex) FindAll(key int64) (*BTreeRangeIterator, error) {
+	return table.FindAllBytes(encodeInt(key))
+}
+
+// FindAllBytes returns an iterator over the entries with the given key, in value order.
+func (table *BTreeIndex) FindAllBytes(key []byte) (*BTreeRangeIterator, error) {
+	return table.RangeIteratorBytes(key, key, RangeOptions{})
+}
+
+// DeletePair removes the entry with the given key and value from the table.
+// It isn't called Delete because Delete, which every index has, takes only a
+// key, and in a table with duplicate keys removes all of its entries.
+func (table *BTreeIndex) DeletePair(key int64, value int64) error {
+	return table.DeletePairBytes(encodeInt(key), encodeInt(value))
+}
+
+// DeletePairBytes removes the entry with the given key and value from the
+// table. In a table without duplicate keys, the key's entry is only removed
+// if it has the given value.
+func (table *BTreeIndex) DeletePairBytes(key []byte, value []byte) error {
+	if table.duplicates {
+		return table.deleteStored(compositeKey(key, value))
+	}
+	found, err := table.FindBytes(key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(found, value) {
+		return errors.New("entry could not be found")
+	}
+	return table.deleteStored(key)
+}
+
+// deleteAll removes every entry with the given key from a table with duplicate keys.
+func (table *BTreeIndex) deleteAll(key []byte) error {
+	it, err := table.FindAllBytes(key)
+	if err != nil {
+		return err
+	}
+	var composites [][]byte
+	for {
+		entry, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		pair := entry.(BTreeEntry)
+		composites = append(composites, compositeKey(pair.key, pair.value))
+	}
+	for _, composite := range composites {
+		if err := table.deleteStored(composite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,55 +2,134 @@ package btree
 
 import (
 	"encoding/binary"
+	"fmt"
+	"strconv"
 )
 
-// Global size for Entries.
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2
+// Keys and values are byte strings, and keys are ordered byte by byte. The
+// int64 API stores each integer as 8 big-endian bytes with the sign bit
+// flipped, so that integer keys sort in numeric order.
 
 // Entry is a struct of one unit of information in our table.
 type BTreeEntry struct {
-	key   int64
-	value int64
+	key      []byte
+	value    []byte
+	overflow bool // Whether value points at overflow pages instead of being the value.
 }
 
-// Get key.
+// Get key, as stored through the int64 API.
 func (entry BTreeEntry) GetKey() int64 {
-	return entry.key
+	return decodeInt(entry.key)
 }
 
-// Get value.
+// Get value, as stored through the int64 API.
 func (entry BTreeEntry) GetValue() int64 {
+	return decodeInt(entry.value)
+}
+
+// Get key bytes.
+func (entry BTreeEntry) GetKeyBytes() []byte {
+	return entry.key
+}
+
+// Get value bytes.
+func (entry BTreeEntry) GetValueBytes() []byte {
 	return entry.value
 }
 
 // Set key.
 func (entry *BTreeEntry) SetKey(key int64) {
-	entry.key = key
+	entry.key = encodeInt(key)
 }
 
 // Set value.
 func (entry *BTreeEntry) SetValue(value int64) {
+	entry.value = encodeInt(value)
+}
+
+// Set key bytes.
+func (entry *BTreeEntry) SetKeyBytes(key []byte) {
+	entry.key = key
+}
+
+// Set value bytes.
+func (entry *BTreeEntry) SetValueBytes(value []byte) {
 	entry.value = value
 }
 
-// Marshal serializes a given entry into a byte array.
+// Marshal serializes a given entry into a leaf cell: the length of the key
+// and the value field as uvarints, then the key and value themselves. The
+// value field holds the value's length shifted left by one, with the low bit
+// set if the value is kept in overflow pages.
 func (entry BTreeEntry) Marshal() []byte {
-	// Marshall the key field.
-	var newdata []byte
-	bin := make([]byte, binary.MaxVarintLen64)
-	binary.PutVarint(bin, entry.GetKey())
-	newdata = bin
-	// Marshall the value field.
-	bin = make([]byte, binary.MaxVarintLen64)
-	binary.PutVarint(bin, entry.GetValue())
-	newdata = append(newdata, bin...)
-	// Return the combined byte array.
-	return newdata
-}
-
-// unmarshalEntry deserializes a byte array into an entry.
+	newdata := make([]byte, 0, leafCellSize(entry.key, entry.value))
+	newdata = appendUvarint(newdata, uint64(len(entry.key)))
+	newdata = appendUvarint(newdata, valueField(len(entry.value), entry.overflow))
+	newdata = append(newdata, entry.key...)
+	return append(newdata, entry.value...)
+}
+
+// unmarshalEntry deserializes a leaf cell into an entry that doesn't share
+// memory with it.
 func unmarshalEntry(data []byte) (entry BTreeEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return BTreeEntry{key: k, value: v}
+	keyLen, n1 := binary.Uvarint(data)
+	field, n2 := binary.Uvarint(data[n1:])
+	valueLen := field >> 1
+	start := int64(n1 + n2)
+	body := make([]byte, keyLen+valueLen)
+	copy(body, data[start:start+int64(keyLen+valueLen)])
+	return BTreeEntry{key: body[:keyLen:keyLen], value: body[keyLen:], overflow: field&1 == 1}
+}
+
+// valueField returns the value field of a leaf cell holding a value of the given length.
+func valueField(valueLen int, overflow bool) uint64 {
+	field := uint64(valueLen) << 1
+	if overflow {
+		field |= 1
+	}
+	return field
+}
+
+// leafCellSize returns the size of the leaf cell holding the given key and value.
+func leafCellSize(key []byte, value []byte) int64 {
+	return uvarintSize(uint64(len(key))) + uvarintSize(valueField(len(value), false)) +
+		int64(len(key)) + int64(len(value))
+}
+
+// appendUvarint appends x to buf as a uvarint.
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// uvarintSize returns the number of bytes x takes as a uvarint.
+func uvarintSize(x uint64) int64 {
+	var tmp [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(tmp[:], x))
+}
+
+// encodeInt returns the bytes that the int64 API stores an integer as.
+func encodeInt(x int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(x)^(1<<63))
+	return data
+}
+
+// decodeInt returns the integer stored as the given bytes by the int64 API,
+// or 0 if they aren't 8 bytes long.
+func decodeInt(data []byte) int64 {
+	if len(data) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(data) ^ (1 << 63))
+}
+
+// formatBytes formats a key or value for printing: as an integer if it is 8
+// bytes long, as the int64 API stores integers, and as a quoted string otherwise.
+func formatBytes(data []byte) string {
+	if len(data) == 8 {
+		return strconv.FormatInt(decodeInt(data), 10)
+	}
+	return fmt.Sprintf("%q", data)
 }
@@ -1,6 +1,7 @@
 package btree
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -12,23 +13,23 @@ import (
 
 // Split is a supporting data structure to propagate keys up our B+ tree.
 type Split struct {
-	isSplit bool  // A flag that's set if a split occurs.
-	key     int64 // The key to promote.
-	leftPN  int64 // The pagenumber for the left node.
-	rightPN int64 // The pagenumber for the right node.
-	err     error // Used to propagate errors upwards.
+	isSplit bool   // A flag that's set if a split occurs.
+	key     []byte // The key to promote.
+	leftPN  int64  // The pagenumber for the left node.
+	rightPN int64  // The pagenumber for the right node.
+	err     error  // Used to propagate errors upwards.
 }
 
 // Node defines a common interface for leaf and internal nodes.
 type Node interface {
 	// Interface for main node functions.
-	search(int64) int64
-	insert(int64, int64, bool) Split
-	delete(int64)
-	get(int64) (int64, bool)
+	search([]byte) int64
+	insert([]byte, []byte, bool) Split
+	delete([]byte) (bool, error)
+	get([]byte) ([]byte, bool, error)
 
 	// Interface for helper functions.
-	keyToNodeEntry(int64) (*LeafNode, int64, error)
+	keyToNodeEntry([]byte) (*LeafNode, int64, error)
 	printNode(io.Writer, string, string)
 	getPage() *pager.Page
 	getNodeType() NodeType
@@ -40,13 +41,13 @@ type Node interface {
 
 // search returns the first index where key >= given key.
 // If no key satisfies this condition, returns numKeys.
-func (node *LeafNode) search(key int64) int64 {
+func (node *LeafNode) search(key []byte) int64 {
 	/* SOLUTION {{{ */
 	// Binary search for the key.
 	minIndex := sort.Search(
 		int(node.numKeys),
 		func(idx int) bool {
-			return node.getKeyAt(int64(idx)) >= key
+			return bytes.Compare(node.keyRef(int64(idx)), key) >= 0
 		},
 	)
 	return int64(minIndex)
@@ -55,67 +56,93 @@ func (node *LeafNode) search(key int64) int64 {
 
 // insert finds the appropriate place in a leaf node to insert a new tuple.
 // if update is true, allow overwriting existing keys. else, error.
-func (node *LeafNode) insert(key int64, value int64, update bool) Split {
+func (node *LeafNode) insert(key []byte, value []byte, update bool) Split {
 	node.unlockParent(false)
 	defer node.unlock()
 	/* SOLUTION {{{ */
 	// Get insert position.
 	insertPos := node.search(key)
 	// Check if this is a duplicate entry.
-	if insertPos < node.numKeys && node.getKeyAt(insertPos) == key {
-		if update {
-			defer node.unlockParent(true)
-			node.updateValueAt(insertPos, value)
-			return Split{}
-		} else {
-			defer node.unlockParent(true)
-			return Split{err: errors.New("cannot insert duplicate key")}
-		}
+	found := insertPos < node.numKeys && bytes.Equal(node.keyRef(insertPos), key)
+	if found && !update {
+		defer node.unlockParent(true)
+		return Split{err: errors.New("cannot insert duplicate key")}
 	}
 	// Return an error if we're updating a non-existent entry.
-	if update {
+	if !found && update {
 		defer node.unlockParent(true)
 		return Split{err: errors.New("cannot update non-existent entry")}
 	}
-	// Shift entries to the right if needed.
-	for i := node.numKeys - 1; i >= insertPos; i-- {
-		node.updateKeyAt(i+1, node.getKeyAt(i))
-		node.updateValueAt(i+1, node.getValueAt(i))
+	// A value too large for the leaf is written to overflow pages first.
+	p := node.page.GetPager()
+	entry, err := storeEntry(p, key, value)
+	if err != nil {
+		defer node.unlockParent(true)
+		return Split{err: err}
+	}
+	cell := entry.Marshal()
+	// Write the entry in place if it fits, or else split the node.
+	room := node.freeBytes()
+	var old BTreeEntry
+	if found {
+		old = node.getCell(insertPos)
+		room += int64(len(node.cellAt(insertPos))) + SLOT_SIZE
+	}
+	var result Split
+	if int64(len(cell))+SLOT_SIZE > room {
+		result = node.split(insertPos, entry, found)
+	} else {
+		if found {
+			node.removeCell(insertPos)
+		}
+		node.insertCell(insertPos, cell)
+		defer node.unlockParent(true)
 	}
-	node.updateNumKeys(node.numKeys + 1)
-	// Modify the cell at this position.
-	node.modifyCell(insertPos, BTreeEntry{key: key, value: value})
-	// Check if we need to split the node.
-	if node.numKeys > ENTRIES_PER_LEAF_NODE {
-		return node.split()
+	// Free the overflow pages of whichever value didn't end up in the leaf.
+	if result.err != nil {
+		discardEntry(p, entry)
+	} else if err := discardEntry(p, old); err != nil {
+		result.err = err
 	}
-	defer node.unlockParent(true) // ?
-	return Split{}
+	return result
 	/* SOLUTION }}} */
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *LeafNode) delete(key int64) {
-	node.unlockParent(true)
+// It reports whether the node was left with too few entries, in which case
+// its parents are still locked so that it can be rebalanced.
+func (node *LeafNode) delete(key []byte) (bool, error) {
+	// [CONCURRENCY] Keep our parents locked only if we could underflow.
+	if node.hasSpare() {
+		node.unlockParent(true)
+	}
 	defer node.unlock()
 	/* SOLUTION {{{ */
 	// Find entry.
 	deletePos := node.search(key)
-	if deletePos >= node.numKeys || node.getKeyAt(deletePos) != key {
+	if deletePos >= node.numKeys || !bytes.Equal(node.keyRef(deletePos), key) {
 		// Thank you Mario! But our key is in another castle!
-		return
+		node.unlockParent(true)
+		return false, nil
+	}
+	entry := node.getCell(deletePos)
+	node.removeCell(deletePos)
+	// Free the value's overflow pages, if it has any.
+	if err := discardEntry(node.page.GetPager(), entry); err != nil {
+		node.unlockParent(true)
+		return false, err
 	}
-	// Shift entries to the left.
-	for i := deletePos; i < node.numKeys-1; i++ {
-		node.updateKeyAt(i, node.getKeyAt(i+1))
-		node.updateValueAt(i, node.getValueAt(i+1))
+	if node.underflows() {
+		return true, nil
 	}
-	node.updateNumKeys(node.numKeys - 1)
+	node.unlockParent(true)
+	return false, nil
 	/* SOLUTION }}} */
 }
 
 // split is a helper function to split a leaf node, then propagate the split upwards.
-func (node *LeafNode) split() Split {
+// The given entry is inserted at the given index, or replaces the entry there.
+func (node *LeafNode) split(index int64, entry BTreeEntry, replace bool) Split {
 	/* SOLUTION {{{ */
 	// Create a new leaf node to split our keys.
 	newNode, err := createLeafNode(node.page.GetPager())
@@ -123,43 +150,73 @@ func (node *LeafNode) split() Split {
 		return Split{err: err}
 	}
 	defer newNode.getPage().Put()
-	// Set the right sibling for our two nodes.
+	// Link the new node in between us and our right sibling.
 	prevSiblingPN := node.setRightSibling(newNode.page.GetPageNum())
 	newNode.setRightSibling(prevSiblingPN)
-	// Transfer entries to the new node (plus the new entry) accordingly.
-	midpoint := node.numKeys / 2
-	for i := midpoint; i < node.numKeys; i++ {
-		newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
-		newNode.updateValueAt(newNode.numKeys, node.getValueAt(i))
-		newNode.updateNumKeys(newNode.numKeys + 1)
-	}
-	node.updateNumKeys(midpoint)
+	newNode.setLeftSibling(node.page.GetPageNum())
+	if err := node.relinkLeft(prevSiblingPN, newNode.page.GetPageNum()); err != nil {
+		return Split{err: err}
+	}
+	// Transfer entries to the new node (plus the new entry) accordingly,
+	// splitting them as evenly by size as we can.
+	entries := node.getEntries()
+	if replace {
+		entries[index] = entry
+	} else {
+		entries = append(entries[:index], append([]BTreeEntry{entry}, entries[index:]...)...)
+	}
+	midpoint := splitPoints(entrySizes(entries), 1, false)[0].index
+	fillLeaf(node, entries[:midpoint])
+	fillLeaf(newNode, entries[midpoint:])
+	// Pass up the right node's first key, or the shortest key that separates it from ours.
+	key := leafKeys(entries[midpoint-1:midpoint+1], node.compressKeys)[1]
 	return Split{
 		isSplit: true,
-		key:     newNode.getKeyAt(0), // Get the right node's first key
+		key:     key,
 		leftPN:  node.page.GetPageNum(),
 		rightPN: newNode.page.GetPageNum(),
 	}
 	/* SOLUTION }}} */
 }
 
+// relinkLeft points the left sibling link of the leaf at the given pagenumber,
+// if there is one, to the given leaf.
+// [CONCURRENCY] Siblings are always locked left to right, so we lock it while holding our own lock.
+func (node *LeafNode) relinkLeft(pagenum int64, leftPN int64) error {
+	if pagenum < 0 {
+		return nil
+	}
+	page, err := node.page.GetPager().GetPage(pagenum)
+	if err != nil {
+		return err
+	}
+	defer page.Put()
+	page.WLock()
+	defer page.WUnlock()
+	pageToLeafNode(page).setLeftSibling(leftPN)
+	return nil
+}
+
 // get returns the value associated with a given key from the leaf node.
-func (node *LeafNode) get(key int64) (value int64, found bool) {
+func (node *LeafNode) get(key []byte) (value []byte, found bool, err error) {
 	// Unlock parents, eventually unlock this node.
 	node.unlockParent(true)
 	defer node.unlock()
 	// Find index.
 	index := node.search(key)
-	if index >= node.numKeys || node.getKeyAt(index) != key {
+	if index >= node.numKeys || !bytes.Equal(node.keyRef(index), key) {
 		// Thank you Mario! But our key is in another castle!
-		return 0, false
+		return nil, false, nil
 	}
-	entry := node.getCell(index)
-	return entry.GetValue(), true
+	entry, err := node.getEntry(index)
+	if err != nil {
+		return nil, false, err
+	}
+	return entry.value, true, nil
 }
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
-func (node *LeafNode) keyToNodeEntry(key int64) (*LeafNode, int64, error) {
+func (node *LeafNode) keyToNodeEntry(key []byte) (*LeafNode, int64, error) {
 	return node, node.search(key), nil
 }
 
@@ -178,8 +235,13 @@ func (node *LeafNode) printNode(w io.Writer, firstPrefix string, prefix string)
 	// Print entries.
 	for cellnum := int64(0); cellnum < node.numKeys; cellnum++ {
 		entry := node.getCell(cellnum)
+		value := formatBytes(entry.value)
+		if entry.overflow {
+			size, pagenum := parseOverflowRef(entry.value)
+			value = fmt.Sprintf("<%v bytes @ [%v]>", size, pagenum)
+		}
 		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)\n",
-			prefix, entry.GetKey(), entry.GetValue()))
+			prefix, formatBytes(entry.key), value))
 	}
 	if node.rightSiblingPN > 0 {
 		io.WriteString(w, fmt.Sprintf("%v |--+\n", prefix))
@@ -195,13 +257,23 @@ func (node *LeafNode) printNode(w io.Writer, firstPrefix string, prefix string)
 
 // search returns the first index where key > given key.
 // If no such index exists, it returns numKeys.
-func (node *InternalNode) search(key int64) int64 {
+func (node *InternalNode) search(key []byte) int64 {
 	/* SOLUTION {{{ */
+	// Every key in the node starts with its key prefix, so a key that doesn't
+	// comes before or after all of them.
+	prefix := node.nodePrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			return 0
+		}
+		return node.numKeys
+	}
+	suffix := key[len(prefix):]
 	// Binary search for the key.
 	minIndex := sort.Search(
 		int(node.numKeys),
 		func(idx int) bool {
-			return node.getKeyAt(int64(idx)) > key
+			return bytes.Compare(node.keyRef(int64(idx)), suffix) > 0
 		},
 	)
 	return int64(minIndex)
@@ -209,7 +281,7 @@ func (node *InternalNode) search(key int64) int64 {
 }
 
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-func (node *InternalNode) insert(key int64, value int64, update bool) Split {
+func (node *InternalNode) insert(key []byte, value []byte, update bool) Split {
 	node.unlockParent(false)
 	/* SOLUTION {{{ */
 	// Insert the entry into the appropriate child node.
@@ -225,6 +297,9 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 	// Insert a new key into our node if necessary.
 	if result.isSplit {
 		split := node.insertSplit(result)
+		if split.err == nil {
+			split.err = result.err
+		}
 		defer node.unlock()
 		if split.isSplit {
 			return split
@@ -242,45 +317,179 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 func (node *InternalNode) insertSplit(split Split) Split {
 	/* SOLUTION {{{ */
 	insertPos := node.search(split.key)
-	// Shift keys to the right.
-	for i := node.numKeys - 1; i >= insertPos; i-- {
-		node.updateKeyAt(i+1, node.getKeyAt(i))
-	}
-	// Shift children to the right.
-	for i := node.numKeys; i > insertPos; i-- {
-		node.updatePNAt(i+1, node.getPNAt(i))
-	}
-	// Insert the new key and pagenumber at this position.
-	node.updateKeyAt(insertPos, split.key)
-	node.updatePNAt(insertPos+1, split.rightPN)
-	node.updateNumKeys(node.numKeys + 1)
-	// Check if we need to split.
-	if node.numKeys > KEYS_PER_INTERNAL_NODE {
-		return node.split()
-	}
-	return Split{}
+	// Insert the new key, and the pagenumber to its right, at this position if it fits.
+	if prefix := node.nodePrefix(); bytes.HasPrefix(split.key, prefix) {
+		cell := internalCell(split.key[len(prefix):], split.rightPN)
+		if node.usedBytes()+int64(len(cell))+SLOT_SIZE <= node.limit() {
+			node.insertCell(insertPos, cell)
+			return Split{}
+		}
+	}
+	// Otherwise, write the keys anew, with a shorter key prefix if the new
+	// key lacks the node's, or split the node if they don't fit.
+	// The new right node goes after the child that was split, to the right of the new key.
+	children := node.getChildren(nil)
+	newChild := childRef{pn: split.rightPN, key: split.key}
+	children = append(children[:insertPos+1], append([]childRef{newChild}, children[insertPos+1:]...)...)
+	if node.fits(children) {
+		fillInternal(node, children)
+		return Split{}
+	}
+	return node.split(children)
 	/* SOLUTION }}} */
 }
 
-// delete removes a given tuple from the leaf node, if the given key exists.
-func (node *InternalNode) delete(key int64) {
-	node.unlockParent(true)
+// delete removes a given tuple from the subtree under this node, if the given
+// key exists, rebalancing any child that is left with too few entries.
+// It reports whether this node was then left with too few keys itself.
+func (node *InternalNode) delete(key []byte) (bool, error) {
+	// [CONCURRENCY] Keep our parents locked only if we could underflow.
+	if node.hasSpare() {
+		node.unlockParent(true)
+	}
 	/* SOLUTION {{{ */
 	// Get child.
 	childIdx := node.search(key)
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
-		return
+		node.unlockParent(true)
+		node.unlock()
+		return false, err
 	}
 	node.initChild(child)
-	defer child.getPage().Put()
-	// Delete from child.
-	child.delete(key)
+	// Delete from child. Unless it underflowed, it has unlocked us already.
+	underflow, err := child.delete(key)
+	child.getPage().Put()
+	if err != nil || !underflow {
+		return false, err
+	}
+	defer node.unlock()
+	if err = node.rebalance(childIdx); err == nil && node.isRoot() && node.numKeys == 0 {
+		err = node.collapseRoot()
+	}
+	if err == nil && node.underflows() {
+		return true, nil
+	}
+	node.unlockParent(true)
+	return false, err
 	/* SOLUTION }}} */
 }
 
+// rebalance refills the underflowed child at the given index by merging it
+// with a sibling, or, if the two don't fit in one node, by sharing their
+// entries evenly between them. If no key to separate them by fits into this
+// node, the child is left as it is, and rebalanced again on a later delete.
+func (node *InternalNode) rebalance(childIdx int64) error {
+	/* SOLUTION {{{ */
+	// Pair the child with its left sibling, or with its right one if it has none.
+	sepIdx := childIdx - 1
+	if childIdx == 0 {
+		sepIdx = 0
+	}
+	left, err := node.getChildAt(sepIdx, true)
+	if err != nil {
+		return err
+	}
+	defer left.getPage().Put()
+	defer left.getPage().WUnlock()
+	right, err := node.getChildAt(sepIdx+1, true)
+	if err != nil {
+		return err
+	}
+	rightPage := right.getPage()
+	rightPN := rightPage.GetPageNum()
+	merged := false
+	switch left := left.(type) {
+	case *LeafNode:
+		right := right.(*LeafNode)
+		entries := append(left.getEntries(), right.getEntries()...)
+		sizes := entrySizes(entries)
+		keys := leafKeys(entries, node.compressKeys)
+		if sumSizes(sizes) <= left.capacity() {
+			fillLeaf(left, entries)
+			left.setRightSibling(right.rightSiblingPN)
+			if err := left.relinkLeft(right.rightSiblingPN, left.page.GetPageNum()); err != nil {
+				rightPage.WUnlock()
+				rightPage.Put()
+				return err
+			}
+			merged = true
+		} else if half, ok := node.rebalancePoint(sepIdx, sizes, keys, 1, false, left.minBytes(), nil); ok {
+			fillLeaf(left, entries[:half])
+			fillLeaf(right, entries[half:])
+			node.updateKeyAt(sepIdx, keys[half])
+		}
+	case *InternalNode:
+		right := right.(*InternalNode)
+		children := append(left.getChildren(nil), right.getChildren(node.getKeyAt(sepIdx))...)
+		left.compressKeys, right.compressKeys = node.compressKeys, node.compressKeys
+		sizes := childSizes(children)
+		keys := make([][]byte, len(children))
+		for i, child := range children {
+			keys[i] = child.key
+		}
+		fits := func(half int) bool {
+			return left.fits(children[:half]) && left.fits(children[half:])
+		}
+		if left.fits(children) {
+			fillInternal(left, children)
+			merged = true
+		} else if half, ok := node.rebalancePoint(sepIdx, sizes, keys, 2, true, left.minBytes(), fits); ok {
+			fillInternal(left, children[:half])
+			fillInternal(right, children[half:])
+			node.updateKeyAt(sepIdx, children[half].key)
+		}
+	}
+	rightPage.WUnlock()
+	rightPage.Put()
+	if !merged {
+		return nil
+	}
+	// Drop the right node, which is now empty.
+	node.removeChild(sepIdx)
+	return node.page.GetPager().FreePage(rightPN)
+	/* SOLUTION }}} */
+}
+
+// collapseRoot replaces a root that has a single child with that child,
+// shrinking the tree by one level.
+func (node *InternalNode) collapseRoot() error {
+	child, err := node.getChildAt(0, false)
+	if err != nil {
+		return err
+	}
+	childPage := child.getPage()
+	childPN := childPage.GetPageNum()
+	switch child := child.(type) {
+	case *LeafNode:
+		pageToLeafNode(node.page).copy(child)
+	case *InternalNode:
+		pageToInternalNode(node.page).copy(child)
+	}
+	childPage.Put()
+	return node.page.GetPager().FreePage(childPN)
+}
+
+// rebalancePoint returns where to split the given entries or children of two
+// siblings so that both are left full enough, as evenly as possible given
+// that the key at the split must fit into this node in place of the key at
+// sepIdx. If fits is given, it must also accept the split, as siblings whose
+// keys are compressed may not fit every split that leaves them full enough.
+// It returns false if there is no such place.
+func (node *InternalNode) rebalancePoint(sepIdx int64, sizes []int64, keys [][]byte,
+	minItems int, promote bool, minBytes int64, fits func(int) bool) (int, bool) {
+	for _, point := range splitPoints(sizes, minItems, promote) {
+		if point.left >= minBytes && point.right >= minBytes &&
+			(fits == nil || fits(point.index)) && node.keyFits(sepIdx, keys[point.index]) {
+			return point.index, true
+		}
+	}
+	return 0, false
+}
+
 // split is a helper function that splits an internal node, then propagates the split upwards.
-func (node *InternalNode) split() Split {
+// The node's children are replaced by the given ones, which don't fit into one node.
+func (node *InternalNode) split(children []childRef) Split {
 	/* SOLUTION {{{ */
 	// Create a new internal node to split our keys.
 	newNode, err := createInternalNode(node.page.GetPager())
@@ -288,18 +497,13 @@ func (node *InternalNode) split() Split {
 		return Split{err: err}
 	}
 	defer newNode.getPage().Put()
-	// Compute the midpoint based on the number of children to move.
-	midpoint := (node.numKeys - 1) / 2
-	// Transfer the keys to the new node.
-	for i := midpoint; i <= node.numKeys; i++ {
-		newNode.updatePNAt(newNode.numKeys, node.getPNAt(i))
-		if i < node.numKeys {
-			newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
-			newNode.updateNumKeys(newNode.numKeys + 1)
-		}
-	}
-	middleKey := node.getKeyAt(midpoint - 1)
-	node.updateNumKeys(midpoint - 1)
+	newNode.compressKeys = node.compressKeys
+	// Compute the midpoint based on the sizes of the keys on either side, and
+	// promote the key at the midpoint rather than keeping it in either node.
+	midpoint := node.splitPoint(children)
+	middleKey := children[midpoint].key
+	fillInternal(node, children[:midpoint])
+	fillInternal(newNode, children[midpoint:])
 	// Propagate the split.
 	return Split{
 		isSplit: true,
@@ -310,15 +514,36 @@ func (node *InternalNode) split() Split {
 	/* SOLUTION }}} */
 }
 
+// splitPoint returns where to split the given children, as evenly as possible
+// such that both halves are full enough. Halves are weighed by the space their
+// keys would take in full, and compressed keys may leave one of them too full
+// to hold anyway, so the halves must also fit.
+func (node *InternalNode) splitPoint(children []childRef) int {
+	points := splitPoints(childSizes(children), 2, true)
+	for _, point := range points {
+		if point.left >= node.minBytes() && point.right >= node.minBytes() &&
+			node.fits(children[:point.index]) && node.fits(children[point.index:]) {
+			return point.index
+		}
+	}
+	// Failing that, the halves must at least fit.
+	for _, point := range points {
+		if node.fits(children[:point.index]) && node.fits(children[point.index:]) {
+			return point.index
+		}
+	}
+	return points[0].index
+}
+
 // get returns the value associated with a given key from the leaf node.
-func (node *InternalNode) get(key int64) (value int64, found bool) {
+func (node *InternalNode) get(key []byte) (value []byte, found bool, err error) {
 	// [CONCURRENCY] Unlock parents.
 	node.unlockParent(true)
 	// Find the child.
 	childIdx := node.search(key)
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
-		return 0, false
+		return nil, false, err
 	}
 	node.initChild(child)
 	defer child.getPage().Put()
@@ -326,7 +551,7 @@ func (node *InternalNode) get(key int64) (value int64, found bool) {
 }
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
-func (node *InternalNode) keyToNodeEntry(key int64) (*LeafNode, int64, error) {
+func (node *InternalNode) keyToNodeEntry(key []byte) (*LeafNode, int64, error) {
 	index := node.search(key)
 	child, err := node.getChildAt(index, false)
 	if err != nil {
@@ -360,7 +585,60 @@ func (node *InternalNode) printNode(w io.Writer, firstPrefix string, prefix stri
 		defer child.getPage().Put()
 		child.printNode(w, nextFirstPrefix, nextPrefix)
 		if idx != node.numKeys {
-			io.WriteString(w, fmt.Sprintf("\n%v[KEY] %v\n", nextPrefix, node.getKeyAt(idx)))
+			io.WriteString(w, fmt.Sprintf("\n%v[KEY] %v\n", nextPrefix, formatBytes(node.getKeyAt(idx))))
+		}
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+///////////////////////////// Split Helpers /////////////////////////////////
+/////////////////////////////////////////////////////////////////////////////
+
+// A place to split a run of entries or children between two nodes, and the
+// space each node is then left with.
+type splitPoint struct {
+	index int   // The index of the first item in the right node.
+	left  int64 // The space the items in the left node take.
+	right int64 // The space the items in the right node take.
+}
+
+// splitPoints returns the places to split items of the given sizes between
+// two nodes such that each gets at least minItems items, from the most even
+// split to the least. If promote is set, the item at the split doesn't take
+// space in the right node, as its key moves up to the parent.
+func splitPoints(sizes []int64, minItems int, promote bool) []splitPoint {
+	total := sumSizes(sizes)
+	points := make([]splitPoint, 0, len(sizes))
+	prefix := int64(0)
+	for i, size := range sizes {
+		if i >= minItems && len(sizes)-i >= minItems {
+			right := total - prefix
+			if promote {
+				right -= size
+			}
+			points = append(points, splitPoint{index: i, left: prefix, right: right})
 		}
+		prefix += size
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return imbalance(points[i]) < imbalance(points[j])
+	})
+	return points
+}
+
+// imbalance returns how much more space one side of a split takes than the other.
+func imbalance(point splitPoint) int64 {
+	if point.left > point.right {
+		return point.left - point.right
+	}
+	return point.right - point.left
+}
+
+// sumSizes returns the total of the given sizes.
+func sumSizes(sizes []int64) int64 {
+	total := int64(0)
+	for _, size := range sizes {
+		total += size
 	}
+	return total
 }
@@ -0,0 +1,111 @@
+package btree
+
+import (
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+// Most operations only read or change a single leaf, so they find it without
+// holding locks on the nodes above it. Each internal node on the way down is
+// read-locked just long enough to pick the child to follow, and unlocked
+// before the child is locked. Once the child is locked, the node's version is
+// checked: if a writer locked the node in between, the child may no longer
+// be the right one, and the search starts over from the root. After a few
+// restarts, nodes are instead kept read-locked until their child is locked,
+// which can't fail. Writers change the leaf on their own if it can't split or
+// underflow, and otherwise lock their way down from the root as before.
+
+// How many times a search restarts before keeping nodes locked on the way down.
+const OPTIMISTIC_RETRIES = 4
+
+// lockLeaf returns the leaf that the given key belongs in, pinned and locked
+// for writing if write is set, or for reading otherwise. A nil key finds the
+// leftmost leaf.
+func (table *BTreeIndex) lockLeaf(key []byte, write bool) (*LeafNode, error) {
+	for attempt := 0; ; attempt++ {
+		leaf, err := table.descend(key, write, attempt >= OPTIMISTIC_RETRIES)
+		if leaf != nil || err != nil {
+			return leaf, err
+		}
+	}
+}
+
+// descend makes one attempt at finding the leaf that the given key belongs
+// in, as lockLeaf does. Unless coupled is set, each node is unlocked before
+// its child is locked, and nil is returned if a writer got to it in between.
+func (table *BTreeIndex) descend(key []byte, write bool, coupled bool) (*LeafNode, error) {
+	// [CONCURRENCY] The root is only read while no writer could be splitting it.
+	page, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return nil, err
+	}
+	table.superNode.page.RLock()
+	page.RLock()
+	table.superNode.page.RUnlock()
+	var parent *pager.Page
+	releaseParent := func() {
+		if parent != nil {
+			parent.RUnlock()
+			parent.Put()
+			parent = nil
+		}
+	}
+	for pageToNodeHeader(page).nodeType != LEAF_NODE {
+		node := pageToInternalNode(page)
+		version := page.GetVersion()
+		child, err := table.pager.GetPage(node.getPNAt(node.search(key)))
+		if err != nil {
+			releaseParent()
+			page.RUnlock()
+			page.Put()
+			return nil, err
+		}
+		if coupled {
+			child.RLock()
+			releaseParent()
+			parent = page
+		} else {
+			page.RUnlock()
+			child.RLock()
+			changed := page.GetVersion() != version
+			page.Put()
+			if changed {
+				child.RUnlock()
+				child.Put()
+				return nil, nil
+			}
+		}
+		page = child
+	}
+	if write {
+		// Trade the read lock for a write lock. Unless the leaf's parent is
+		// still locked, the leaf must not have been written to in between.
+		version := page.GetVersion()
+		page.RUnlock()
+		page.WLock()
+		if parent == nil && page.GetVersion() != version+1 {
+			page.WUnlock()
+			page.Put()
+			return nil, nil
+		}
+	}
+	releaseParent()
+	leaf := pageToLeafNode(page)
+	leaf.compressKeys = table.compressKeys
+	return leaf, nil
+}
+
+// writeLeaf applies the given change to the leaf that the given key belongs
+// in, if the leaf is safe for it. It returns false, having changed nothing,
+// if the leaf isn't safe. The change must unlock the leaf.
+func (table *BTreeIndex) writeLeaf(key []byte, safe func(*LeafNode) bool, change func(*LeafNode) error) (bool, error) {
+	leaf, err := table.lockLeaf(key, true)
+	if err != nil {
+		return true, err
+	}
+	defer leaf.page.Put()
+	if !safe(leaf) {
+		leaf.unlock()
+		return false, nil
+	}
+	return true, change(leaf)
+}
@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+// A value too large to keep in a leaf is stored in a chain of overflow pages,
+// and the leaf keeps a pointer to the chain in its place: the value's length,
+// then the pagenumber of the chain's first page. Each overflow page starts
+// with the pagenumber of the next one, or -1 on the last, followed by as much
+// of the value as fits. Overflow pages are only reached through the leaf that
+// points at them, so they are read and written under that leaf's lock.
+
+// Overflow page constants.
+var OVERFLOW_NEXT_PN_OFFSET int64 = 0
+var OVERFLOW_HEADER_SIZE int64 = PN_SIZE
+
+// Overflow pointer constants.
+var OVERFLOW_LENGTH_SIZE int64 = FIELD_SIZE
+var OVERFLOW_REF_SIZE int64 = OVERFLOW_LENGTH_SIZE + PN_SIZE
+
+// valueOverflows returns true if the given value must be kept out of the leaf
+// it belongs in, as the entry would be too large otherwise.
+func valueOverflows(pageSize int64, key []byte, value []byte) bool {
+	return leafCellSize(key, value)+SLOT_SIZE > maxLeafCellSize(pageSize)
+}
+
+// storeEntry returns the entry to keep in a leaf for the given key and value,
+// writing the value to a chain of overflow pages first if it doesn't fit.
+func storeEntry(p *pager.Pager, key []byte, value []byte) (BTreeEntry, error) {
+	if !valueOverflows(p.GetDataSize(), key, value) {
+		return BTreeEntry{key: key, value: value}, nil
+	}
+	pagenum, err := writeOverflow(p, value)
+	if err != nil {
+		return BTreeEntry{}, err
+	}
+	return BTreeEntry{key: key, value: overflowRef(int64(len(value)), pagenum), overflow: true}, nil
+}
+
+// loadEntry returns the given entry, as stored in a leaf, with its value read
+// in from its overflow pages if it has any.
+func loadEntry(p *pager.Pager, entry BTreeEntry) (BTreeEntry, error) {
+	if !entry.overflow {
+		return entry, nil
+	}
+	size, pagenum := parseOverflowRef(entry.value)
+	value, err := readOverflow(p, size, pagenum)
+	if err != nil {
+		return BTreeEntry{}, err
+	}
+	return BTreeEntry{key: entry.key, value: value}, nil
+}
+
+// discardEntry frees the overflow pages of the given entry, as stored in a
+// leaf, once it has been removed from the leaf.
+func discardEntry(p *pager.Pager, entry BTreeEntry) error {
+	if !entry.overflow {
+		return nil
+	}
+	_, pagenum := parseOverflowRef(entry.value)
+	return freeOverflow(p, pagenum)
+}
+
+// overflowRef returns the pointer to a chain of overflow pages, starting at the
+// given pagenumber, that holds a value of the given length.
+func overflowRef(size int64, pagenum int64) []byte {
+	return append(encodeField(size), encodeField(pagenum)...)
+}
+
+// parseOverflowRef returns the length of the value that the given pointer
+// points at, and the pagenumber of the first page of its chain.
+func parseOverflowRef(ref []byte) (size int64, pagenum int64) {
+	return getField(ref, 0), getField(ref, OVERFLOW_LENGTH_SIZE)
+}
+
+// writeOverflow writes the given value to a new chain of overflow pages, and
+// returns the pagenumber of its first page. The chain is written from its end
+// back to its start, so that each page knows the next one when it's written.
+func writeOverflow(p *pager.Pager, value []byte) (int64, error) {
+	perPage := p.GetDataSize() - OVERFLOW_HEADER_SIZE
+	nextPN := int64(-1)
+	for end := int64(len(value)); end > 0; {
+		start := (end - 1) / perPage * perPage
+		page, err := p.GetPage(p.GetFreePN())
+		if err != nil {
+			if nextPN >= 0 {
+				freeOverflow(p, nextPN)
+			}
+			return 0, err
+		}
+		page.Update(encodeField(nextPN), OVERFLOW_NEXT_PN_OFFSET, PN_SIZE)
+		page.Update(value[start:end], OVERFLOW_HEADER_SIZE, end-start)
+		nextPN = page.GetPageNum()
+		page.Put()
+		end = start
+	}
+	return nextPN, nil
+}
+
+// readOverflow reads the value of the given length from the chain of overflow
+// pages starting at the given pagenumber.
+func readOverflow(p *pager.Pager, size int64, pagenum int64) ([]byte, error) {
+	perPage := p.GetDataSize() - OVERFLOW_HEADER_SIZE
+	value := make([]byte, 0, size)
+	for int64(len(value)) < size {
+		if pagenum < 0 || pagenum >= p.GetNumPages() {
+			return nil, fmt.Errorf("overflow chain of a %d byte value ends after %d bytes", size, len(value))
+		}
+		page, err := p.GetPage(pagenum)
+		if err != nil {
+			return nil, err
+		}
+		data := *page.GetData()
+		n := size - int64(len(value))
+		if n > perPage {
+			n = perPage
+		}
+		value = append(value, data[OVERFLOW_HEADER_SIZE:OVERFLOW_HEADER_SIZE+n]...)
+		pagenum = getField(data, OVERFLOW_NEXT_PN_OFFSET)
+		page.Put()
+	}
+	return value, nil
+}
+
+// freeOverflow frees the chain of overflow pages starting at the given pagenumber.
+func freeOverflow(p *pager.Pager, pagenum int64) error {
+	for visited := int64(0); pagenum >= 0; visited++ {
+		if pagenum >= p.GetNumPages() || visited >= p.GetNumPages() {
+			return errors.New("overflow chain is corrupted")
+		}
+		page, err := p.GetPage(pagenum)
+		if err != nil {
+			return err
+		}
+		nextPN := getField(*page.GetData(), OVERFLOW_NEXT_PN_OFFSET)
+		page.Put()
+		if err = p.FreePage(pagenum); err != nil {
+			return err
+		}
+		pagenum = nextPN
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package btree
+
+import (
+	"bytes"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// A range iterator walks the leaves from the start of a key range to its end,
+// returning one entry at a time. It keeps only the leaf it is on pinned, and
+// only read-locks it while reading from it, so the table can change while the
+// iterator is open. To stay in place regardless, it finds its position in the
+// leaf anew on every step, from the last key it returned, and finds the leaf
+// anew from the root if it was written to in between.
+
+// RangeOptions controls which entries a range iterator returns.
+type RangeOptions struct {
+	StartExclusive bool  // Leave out the entry at the start key.
+	EndExclusive   bool  // Leave out the entry at the end key.
+	NoStart        bool  // Ignore the start key, and begin at the first entry.
+	NoEnd          bool  // Ignore the end key, and go on to the last entry.
+	Limit          int64 // The most entries to return, or 0 for no limit.
+}
+
+// BTreeRangeIterator returns the entries of a key range in order.
+type BTreeRangeIterator struct {
+	table       *BTreeIndex
+	page        *pager.Page // The pinned leaf, or nil once the iterator is done.
+	version     uint64      // The leaf's version when it was last unlocked.
+	lo          []byte      // The key to resume from.
+	loExclusive bool        // Whether the entry at lo was returned already.
+	hasLo       bool        // Whether there is a key to resume from at all.
+	end         []byte
+	opts        RangeOptions
+	count       int64 // The number of entries returned so far.
+}
+
+// RangeIterator returns an iterator over the entries with keys between start
+// and end, inclusive unless the options say otherwise. It must be closed
+// unless it has run out.
+func (table *BTreeIndex) RangeIterator(start int64, end int64, opts RangeOptions) (*BTreeRangeIterator, error) {
+	return table.RangeIteratorBytes(encodeInt(start), encodeInt(end), opts)
+}
+
+// RangeIteratorBytes returns an iterator over the entries with keys between
+// start and end, inclusive unless the options say otherwise. It must be
+// closed unless it has run out.
+func (table *BTreeIndex) RangeIteratorBytes(start []byte, end []byte, opts RangeOptions) (*BTreeRangeIterator, error) {
+	start, end, opts = table.storedRange(start, end, opts)
+	it := &BTreeRangeIterator{
+		table:       table,
+		lo:          start,
+		loExclusive: opts.StartExclusive,
+		hasLo:       !opts.NoStart,
+		end:         end,
+		opts:        opts,
+	}
+	// [CONCURRENCY] Find the leaf that holds the start key, or the leftmost one.
+	var key []byte
+	if it.hasLo {
+		key = start
+	}
+	leaf, err := table.lockLeaf(key, false)
+	if err != nil {
+		return nil, err
+	}
+	it.page, it.version = leaf.page, leaf.page.GetVersion()
+	leaf.page.RUnlock()
+	return it, nil
+}
+
+// Next returns the next entry in the range, or nil once there are no more.
+func (it *BTreeRangeIterator) Next() (utils.Entry, error) {
+	if it.page == nil {
+		return nil, nil
+	}
+	if it.opts.Limit > 0 && it.count >= it.opts.Limit {
+		it.Close()
+		return nil, nil
+	}
+	it.page.RLock()
+	// [CONCURRENCY] A leaf that was written to may have been merged away.
+	if it.page.GetVersion() != it.version {
+		it.page.RUnlock()
+		it.page.Put()
+		it.page = nil
+		var key []byte
+		if it.hasLo {
+			key = it.lo
+		}
+		leaf, err := it.table.lockLeaf(key, false)
+		if err != nil {
+			return nil, err
+		}
+		it.page = leaf.page
+	}
+	leaf := pageToLeafNode(it.page)
+	cellnum := it.seek(leaf)
+	// Move right until we find a leaf with entries left, keeping hold of the
+	// current leaf until the next one is locked.
+	for cellnum >= leaf.numKeys {
+		nextPN := leaf.rightSiblingPN
+		if nextPN < 0 {
+			it.page.RUnlock()
+			it.Close()
+			return nil, nil
+		}
+		nextPage, err := it.table.pager.GetPage(nextPN)
+		if err != nil {
+			it.page.RUnlock()
+			it.Close()
+			return nil, err
+		}
+		nextPage.RLock()
+		it.page.RUnlock()
+		it.page.Put()
+		it.page = nextPage
+		leaf = pageToLeafNode(nextPage)
+		cellnum = it.seek(leaf)
+		if leaf.rightSiblingPN >= 0 && it.table.pager.GetReadAhead() > 0 {
+			it.table.pager.Prefetch([]int64{leaf.rightSiblingPN})
+		}
+	}
+	// Read the value in while the leaf is locked, as its overflow pages are
+	// freed once it's overwritten.
+	entry, err := leaf.getEntry(cellnum)
+	it.version = it.page.GetVersion()
+	it.page.RUnlock()
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	// Stop once we're past the end of the range.
+	if cmp := bytes.Compare(entry.key, it.end); !it.opts.NoEnd && (cmp > 0 || (it.opts.EndExclusive && cmp == 0)) {
+		it.Close()
+		return nil, nil
+	}
+	it.lo, it.loExclusive, it.hasLo = entry.key, true, true
+	it.count++
+	return it.table.fromStored(entry), nil
+}
+
+// Close releases the iterator's pin. Next returns nil after it is closed.
+func (it *BTreeRangeIterator) Close() {
+	if it.page != nil {
+		it.page.Put()
+		it.page = nil
+	}
+}
+
+// seek returns the index of the first entry in the leaf that comes after the
+// iterator's position.
+func (it *BTreeRangeIterator) seek(leaf *LeafNode) int64 {
+	if !it.hasLo {
+		return 0
+	}
+	cellnum := leaf.search(it.lo)
+	if it.loExclusive && cellnum < leaf.numKeys && bytes.Equal(leaf.keyRef(cellnum), it.lo) {
+		cellnum++
+	}
+	return cellnum
+}
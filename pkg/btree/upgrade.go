@@ -0,0 +1,296 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Files written before format version 5 keep node fields and pagenumbers as
+// padded varints, files written before format version 4 don't mark which
+// values are kept in overflow pages, files written before format version 3
+// hold int64 entries in fixed-size cells, and files written before format
+// version 2 also lack left sibling links in their leaves. Such a table is
+// rebuilt in the current format the first time it is opened: its entries are
+// bulk-loaded into a new file, which is then renamed over the old one. A
+// rebuild that is interrupted leaves the old file in place, to be rebuilt
+// again. The new file keeps the old one's index type, so a table with
+// duplicate keys stays one.
+
+// The first format version whose leaves link to their left sibling.
+const LEFT_LINKS_VERSION int64 = 2
+
+// The first format version whose nodes are slotted pages of byte string keys.
+const SLOTTED_PAGES_VERSION int64 = 3
+
+// The first format version that keeps large values in overflow pages.
+const OVERFLOW_PAGES_VERSION int64 = 4
+
+// The first format version whose node fields are fixed-width integers.
+const FIXED_WIDTH_VERSION int64 = 5
+
+// Suffix of a table file that is being rebuilt in the current format.
+const UPGRADE_SUFFIX = ".upgrade"
+
+// Node layout before format version 3. Every field is a varint padded to
+// binary.MaxVarintLen64 bytes. Internal nodes hold their keys, then their
+// pagenumbers, in two arrays sized for the most keys a node can hold.
+var LEGACY_FIELD_SIZE int64 = binary.MaxVarintLen64
+var LEGACY_NODE_HEADER_SIZE int64 = NODETYPE_SIZE + LEGACY_FIELD_SIZE
+var LEGACY_ENTRYSIZE int64 = 2 * LEGACY_FIELD_SIZE
+
+// The leaf node header size before format version 2, and before format version 3.
+var LEAF_NODE_HEADER_SIZE_V1 int64 = LEGACY_NODE_HEADER_SIZE + LEGACY_FIELD_SIZE
+var LEAF_NODE_HEADER_SIZE_V2 int64 = LEAF_NODE_HEADER_SIZE_V1 + LEGACY_FIELD_SIZE
+
+// Node layout in format versions 3 and 4. Nodes are slotted pages as they are
+// now, but every header field and pagenumber is a varint padded to
+// binary.MaxVarintLen64 bytes, as are the fields of an overflow pointer and
+// the header of an overflow page.
+var SLOTTED_NUM_KEYS_OFFSET int64 = NODETYPE_OFFSET + NODETYPE_SIZE
+var SLOTTED_CELLS_START_OFFSET int64 = SLOTTED_NUM_KEYS_OFFSET + LEGACY_FIELD_SIZE
+var SLOTTED_NODE_HEADER_SIZE int64 = SLOTTED_CELLS_START_OFFSET + LEGACY_FIELD_SIZE
+var SLOTTED_RIGHT_SIBLING_PN_OFFSET int64 = SLOTTED_NODE_HEADER_SIZE
+var SLOTTED_LEFT_SIBLING_PN_OFFSET int64 = SLOTTED_RIGHT_SIBLING_PN_OFFSET + LEGACY_FIELD_SIZE
+var SLOTTED_LEAF_NODE_HEADER_SIZE int64 = SLOTTED_LEFT_SIBLING_PN_OFFSET + LEGACY_FIELD_SIZE
+var SLOTTED_FIRST_PN_OFFSET int64 = SLOTTED_NODE_HEADER_SIZE
+var SLOTTED_INTERNAL_NODE_HEADER_SIZE int64 = SLOTTED_FIRST_PN_OFFSET + LEGACY_FIELD_SIZE
+var SLOTTED_OVERFLOW_REF_SIZE int64 = 2 * LEGACY_FIELD_SIZE
+
+// upgradeTable rebuilds the given table file in the current format if it was
+// written in an older one. The file shouldn't be open.
+func upgradeTable(filename string, pool *pager.BufferPool) error {
+	fs := pool.GetFileSystem()
+	building := filename + UPGRADE_SUFFIX
+	fs.Remove(building)
+	info, err := pager.ReadFileInfo(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Leave new files, current ones, and ones that don't hold a B+tree alone.
+	opts, isBTree := OptionsOf(info.IndexType)
+	if info.PageSize == 0 || info.Version >= FIXED_WIDTH_VERSION ||
+		(!isBTree && info.IndexType != pager.INDEX_NONE) {
+		return nil
+	}
+	src := pager.NewPagerWithPool(pool)
+	if err = src.Open(filename); err != nil {
+		return err
+	}
+	dst, err := OpenTableWithOptions(building, pool, opts)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	if info.Version >= SLOTTED_PAGES_VERSION {
+		next := slottedEntries(src, info.Version)
+		// The entries are read as they are stored, but loaded as they are inserted.
+		err = dst.bulkLoad(func() (utils.Entry, error) {
+			entry, err := next()
+			if entry == nil || err != nil {
+				return entry, err
+			}
+			return dst.fromStored(entry.(BTreeEntry)), nil
+		}, 1)
+	} else {
+		err = dst.bulkLoad(legacyEntries(src, info.Version), 1)
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := src.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(building)
+		fs.Remove(building + ".dwb")
+		return err
+	}
+	// The old file's double-write file doesn't apply to the new one.
+	fs.Remove(filename + ".dwb")
+	fs.Remove(building + ".dwb")
+	return fs.Rename(building, filename)
+}
+
+// slottedEntries returns a function that returns the entries of a table
+// written in format version 3 or 4 in key order, then nil. In version 3, the
+// value field of a leaf cell is the value's length, with no overflow flag.
+func slottedEntries(src *pager.Pager, version int64) func() (utils.Entry, error) {
+	nextPN := int64(-1)
+	var data []byte
+	var cellnum, numKeys, visited int64
+	started := false
+	return func() (utils.Entry, error) {
+		if !started {
+			started = true
+			if src.GetNumPages() == 0 {
+				return nil, nil
+			}
+			pn, err := legacyLeftmostLeafPN(src, SLOTTED_FIRST_PN_OFFSET)
+			if err != nil {
+				return nil, err
+			}
+			nextPN = pn
+		}
+		// Move on to the next leaf with entries left.
+		for cellnum >= numKeys {
+			if nextPN < 0 {
+				return nil, nil
+			}
+			if visited++; nextPN >= src.GetNumPages() || visited > src.GetNumPages() {
+				return nil, errors.New("leaves don't link up into a list")
+			}
+			page, err := src.GetPage(nextPN)
+			if err != nil {
+				return nil, err
+			}
+			// Copy the leaf out, so that it needn't stay pinned.
+			data = append(data[:0], *page.GetData()...)
+			page.Put()
+			numKeys = legacyField(data, SLOTTED_NUM_KEYS_OFFSET)
+			cellnum, nextPN = 0, legacyField(data, SLOTTED_RIGHT_SIBLING_PN_OFFSET)
+		}
+		pos := SLOTTED_LEAF_NODE_HEADER_SIZE + cellnum*SLOT_SIZE
+		cell := data[binary.BigEndian.Uint32(data[pos:pos+SLOT_SIZE]):]
+		cellnum++
+		keyLen, n1 := binary.Uvarint(cell)
+		valueField, n2 := binary.Uvarint(cell[n1:])
+		cell = cell[n1+n2:]
+		key := append([]byte(nil), cell[:keyLen]...)
+		if version < OVERFLOW_PAGES_VERSION {
+			return BTreeEntry{key: key, value: append([]byte(nil), cell[keyLen:keyLen+valueField]...)}, nil
+		}
+		ref := cell[keyLen : keyLen+valueField>>1]
+		if valueField&1 == 0 {
+			return BTreeEntry{key: key, value: append([]byte(nil), ref...)}, nil
+		}
+		if int64(len(ref)) != SLOTTED_OVERFLOW_REF_SIZE {
+			return nil, errors.New("malformed overflow pointer")
+		}
+		value, err := slottedOverflow(src, legacyField(ref, 0), legacyField(ref, LEGACY_FIELD_SIZE))
+		if err != nil {
+			return nil, err
+		}
+		return BTreeEntry{key: key, value: value}, nil
+	}
+}
+
+// slottedOverflow reads the value of the given length from the chain of
+// overflow pages, written in format version 4, that starts at the given pagenumber.
+func slottedOverflow(src *pager.Pager, size int64, pagenum int64) ([]byte, error) {
+	perPage := src.GetDataSize() - LEGACY_FIELD_SIZE
+	value := make([]byte, 0, size)
+	for int64(len(value)) < size {
+		if pagenum < 0 || pagenum >= src.GetNumPages() {
+			return nil, fmt.Errorf("overflow chain of a %d byte value ends after %d bytes", size, len(value))
+		}
+		page, err := src.GetPage(pagenum)
+		if err != nil {
+			return nil, err
+		}
+		data := *page.GetData()
+		n := size - int64(len(value))
+		if n > perPage {
+			n = perPage
+		}
+		value = append(value, data[LEGACY_FIELD_SIZE:LEGACY_FIELD_SIZE+n]...)
+		pagenum = legacyField(data, 0)
+		page.Put()
+	}
+	return value, nil
+}
+
+// legacyEntries returns a function that returns the entries of a table
+// written before format version 3 in key order, then nil.
+func legacyEntries(src *pager.Pager, version int64) func() (utils.Entry, error) {
+	headerSize := LEAF_NODE_HEADER_SIZE_V2
+	if version < LEFT_LINKS_VERSION {
+		headerSize = LEAF_NODE_HEADER_SIZE_V1
+	}
+	nextPN := int64(-1)
+	var data []byte
+	var cellnum, numKeys, visited int64
+	started := false
+	return func() (utils.Entry, error) {
+		if !started {
+			started = true
+			if src.GetNumPages() == 0 {
+				return nil, nil
+			}
+			pn, err := legacyLeftmostLeafPN(src, legacyFirstPNPos(src))
+			if err != nil {
+				return nil, err
+			}
+			nextPN = pn
+		}
+		// Move on to the next leaf with entries left.
+		for cellnum >= numKeys {
+			if nextPN < 0 {
+				return nil, nil
+			}
+			if visited++; nextPN >= src.GetNumPages() || visited > src.GetNumPages() {
+				return nil, errors.New("leaves don't link up into a list")
+			}
+			page, err := src.GetPage(nextPN)
+			if err != nil {
+				return nil, err
+			}
+			// Copy the leaf out, so that it needn't stay pinned.
+			data = append(data[:0], *page.GetData()...)
+			page.Put()
+			numKeys = legacyField(data, NUM_KEYS_OFFSET)
+			cellnum, nextPN = 0, legacyField(data, LEGACY_NODE_HEADER_SIZE)
+		}
+		pos := headerSize + cellnum*LEGACY_ENTRYSIZE
+		cellnum++
+		return BTreeEntry{
+			key:   encodeInt(legacyField(data, pos)),
+			value: encodeInt(legacyField(data, pos+LEGACY_FIELD_SIZE)),
+		}, nil
+	}
+}
+
+// legacyFirstPNPos returns the offset of an internal node's first pagenumber
+// in a tree written before format version 3.
+func legacyFirstPNPos(p *pager.Pager) int64 {
+	// The first pagenumber follows the keys, of which a node holds one more than it may keep.
+	maxKeys := (p.GetPageSize()-LEGACY_NODE_HEADER_SIZE-LEGACY_FIELD_SIZE)/(2*LEGACY_FIELD_SIZE) - 1
+	return LEGACY_NODE_HEADER_SIZE + LEGACY_FIELD_SIZE*(maxKeys+1)
+}
+
+// legacyLeftmostLeafPN returns the pagenumber of the leftmost leaf of a tree
+// written before format version 5, whose internal nodes keep their first
+// pagenumber at the given offset.
+func legacyLeftmostLeafPN(p *pager.Pager, firstPNPos int64) (int64, error) {
+	pn := ROOT_PN
+	for {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			return 0, err
+		}
+		data := *page.GetData()
+		isLeaf := data[NODETYPE_OFFSET] != 0
+		childPN := legacyField(data, firstPNPos)
+		page.Put()
+		if isLeaf {
+			return pn, nil
+		}
+		if childPN <= ROOT_PN || childPN >= p.GetNumPages() {
+			return 0, fmt.Errorf("page %d points at a child that doesn't exist", pn)
+		}
+		pn = childPN
+	}
+}
+
+// legacyField returns the varint field at the given offset of a page written
+// before format version 5.
+func legacyField(data []byte, offset int64) int64 {
+	x, _ := binary.Varint(data[offset : offset+LEGACY_FIELD_SIZE])
+	return x
+}
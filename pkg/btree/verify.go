@@ -1,37 +1,78 @@
 package btree
 
 import (
+	"bytes"
 	"errors"
 )
 
-func IsBTree(index *BTreeIndex) (l int64, r int64, isbtree bool, err error) {
+func IsBTree(index *BTreeIndex) (l []byte, r []byte, isbtree bool, err error) {
 	// Get the node from the page
 	rootPage, err := index.pager.GetPage(index.rootPN)
 	if err != nil {
-		return 0, 0, false, err
+		return nil, nil, false, err
 	}
+	defer rootPage.Put()
 	n := pageToNode(rootPage)
-	return isBTree(n)
+	l, r, isbtree, err = isBTree(n)
+	if err != nil || !isbtree {
+		return l, r, isbtree, err
+	}
+	linked, err := hasLeafLinks(index)
+	return l, r, linked, err
+}
+
+// hasLeafLinks checks that the leaves link to each other in both directions, in key order.
+func hasLeafLinks(index *BTreeIndex) (bool, error) {
+	pn, err := leftmostLeafPN(index.pager)
+	if err != nil {
+		return false, err
+	}
+	// Walk right, checking that each leaf points back at the one before it.
+	prevPN := int64(-1)
+	var prevKey []byte
+	for pn >= 0 {
+		page, err := index.pager.GetPage(pn)
+		if err != nil {
+			return false, err
+		}
+		leaf := pageToLeafNode(page)
+		ok := leaf.leftSiblingPN == prevPN &&
+			(prevPN < 0 || leaf.numKeys == 0 || bytes.Compare(leaf.keyRef(0), prevKey) > 0)
+		if leaf.numKeys > 0 {
+			prevKey = leaf.getKeyAt(leaf.numKeys - 1)
+		}
+		prevPN, pn = pn, leaf.rightSiblingPN
+		page.Put()
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
-func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
+func isBTree(n Node) (l []byte, r []byte, isbtree bool, err error) {
 	// Depending on the node type...
 	switch n := n.(type) {
 	case *InternalNode:
+		// Check that the node is full enough; the root only needs two children.
+		if n.numKeys < 1 || n.underflows() {
+			return nil, nil, false, nil
+		}
 		// Check that each key is less than the bounds of the node it goes around.
-		var lowest, highest int64
+		var lowest, highest []byte
 		for i := int64(0); i < n.numKeys+1; i++ {
 			// Get child
 			c, err := n.getChildAt(i, false)
 			if err != nil {
-				return -1, -1, false, err
+				return nil, nil, false, err
 			}
 			// Check if child is BTree
 			cl, cr, cisbtree, err := isBTree(c)
+			c.getPage().Put()
 			if err != nil {
-				return -1, -1, false, err
+				return nil, nil, false, err
 			} else if !cisbtree {
-				return -1, -1, false, nil
+				return nil, nil, false, nil
 			}
 			// Set conditions.
 			if i == 0 {
@@ -43,29 +84,36 @@ func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
 			// If it is, check that the key bounds work out.
 			if i-1 >= 0 {
 				k := n.getKeyAt(i - 1)
-				if k > cl {
-					return -1, -1, false, nil
+				if bytes.Compare(k, cl) > 0 {
+					return nil, nil, false, nil
 				}
 			}
 			if i < n.numKeys {
 				k := n.getKeyAt(i)
-				if k < cr {
-					return -1, -1, false, nil
+				if bytes.Compare(k, cr) < 0 {
+					return nil, nil, false, nil
 				}
 			}
 		}
 		// Return bounds.
 		return lowest, highest, true, nil
 	case *LeafNode:
+		// Check that the node is full enough.
+		if n.underflows() {
+			return nil, nil, false, nil
+		}
 		// Check that each key is less than the one after it.
 		for i := int64(0); i < n.numKeys-1; i++ {
-			if n.getKeyAt(i) > n.getKeyAt(i+1) {
-				return -1, -1, false, nil
+			if bytes.Compare(n.keyRef(i), n.keyRef(i+1)) > 0 {
+				return nil, nil, false, nil
 			}
 		}
 		// If good, return bounds.
+		if n.numKeys == 0 {
+			return nil, nil, true, nil
+		}
 		return n.getKeyAt(0), n.getKeyAt(n.numKeys - 1), true, nil
 	default:
-		return -1, -1, false, errors.New("should not have gotten here")
+		return nil, nil, false, errors.New("should not have gotten here")
 	}
 }
@@ -34,7 +34,7 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	}, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Select elements from a table. usage: select from <table>")
+	}, "Select elements from a table. usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]")
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Joins two tables. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
@@ -181,9 +181,9 @@ func HandleDelete(d *db.Database, tm *TransactionManager, payload string, client
 func HandleSelect(d *db.Database, tm *TransactionManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: select from <table>
-	if numFields != 3 || fields[1] != "from" {
-		return fmt.Errorf("usage: select from <table>")
+	// Usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]
+	if numFields < 3 || fields[1] != "from" {
+		return fmt.Errorf("usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]")
 	}
 	// NOTE: Select is unsafe; not locking anything. May provide an inconsistent view of the database.
 	if err = db.HandleSelect(d, payload, w); err != nil {
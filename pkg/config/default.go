@@ -10,6 +10,16 @@ const Prompt = DBName + "> "
 // Number of pages.
 const NumPages = 32
 
+// Number of frames in a database's shared buffer pool.
+const PoolPages = 256
+
+// Number of pages read ahead of sequential scans.
+const ReadAheadPages = 8
+
+// Whether page writes go through a double-write side file. Each batch then
+// costs two fsyncs instead of none, so it is opt-in.
+const DoubleWrite = false
+
 // Name of log file.
 const LogFileName = "./db.log"
 
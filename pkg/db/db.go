@@ -2,13 +2,16 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 
 	btree "github.com/brown-csci1270/db/pkg/btree"
+	config "github.com/brown-csci1270/db/pkg/config"
 	hash "github.com/brown-csci1270/db/pkg/hash"
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
@@ -18,6 +21,8 @@ import (
 type Database struct {
 	basepath string
 	tables   map[string]Index
+	pool     *pager.BufferPool // Buffer pool shared by all tables.
+	filesMtx sync.Mutex        // Held while table files are being rebuilt or copied.
 }
 
 // Index interface.
@@ -33,9 +38,11 @@ type Index interface {
 	Print(io.Writer)
 	PrintPN(int, io.Writer)
 	TableStart() (utils.Cursor, error)
+	CompactTo(string) error
 }
 
-// An index can either be a B+Tree or a Hash Table.
+// An index can either be a B+Tree or a Hash Table. B+trees may also allow
+// duplicate keys, or compress their keys; see btree.TableOptions.
 type IndexType int64
 
 const (
@@ -43,8 +50,13 @@ const (
 	HashIndexType  IndexType = 1
 )
 
-// Opens a database given a data folder.
+// Opens a database given a data folder, with a default shared buffer pool.
 func Open(folder string) (*Database, error) {
+	return OpenWithPool(folder, pager.NewBufferPool(config.PoolPages, pager.NewLRUPolicy()))
+}
+
+// Opens a database given a data folder; all tables cache their pages in the given pool.
+func OpenWithPool(folder string, pool *pager.BufferPool) (*Database, error) {
 	// Ensure folder is of the form */
 	if !strings.HasSuffix(folder, "/") {
 		folder += "/"
@@ -58,6 +70,7 @@ func Open(folder string) (*Database, error) {
 	return &Database{
 		basepath: folder,
 		tables:   make(map[string]Index),
+		pool:     pool,
 	}, nil
 }
 
@@ -69,6 +82,7 @@ func (db *Database) Close() (err error) {
 			err = curErr
 		}
 	}
+	db.pool.StopFlusher()
 	return err
 }
 
@@ -84,8 +98,8 @@ func (db *Database) CreateLogFile(filename string) error {
 	return file.Close()
 }
 
-// Create a table with the given type.
-func (db *Database) createTable(name string, indexType IndexType) (index Index, err error) {
+// Create a table with the given type. B+trees are created with the given options.
+func (db *Database) createTable(name string, indexType IndexType, opts btree.TableOptions) (index Index, err error) {
 	// Ensure the db name is alphanumeric.
 	alphanumeric, _ := regexp.Compile(`\W`)
 	if alphanumeric.MatchString(name) {
@@ -99,12 +113,12 @@ func (db *Database) createTable(name string, indexType IndexType) (index Index,
 	// Open the right type of index.
 	switch indexType {
 	case BTreeIndexType:
-		index, err = btree.OpenTable(path)
+		index, err = btree.OpenTableWithOptions(path, db.pool, opts)
 		if err != nil {
 			return nil, err
 		}
 	case HashIndexType:
-		index, err = hash.OpenTable(path)
+		index, err = hash.OpenTableWithPool(path, db.pool)
 		if err != nil {
 			return nil, err
 		}
@@ -123,32 +137,55 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	}
 	// Check if file exists; if not, error.
 	path := filepath.Join(db.basepath, name)
+	if err := db.finishVacuum(path); err != nil {
+		return nil, fmt.Errorf("cannot open table %s: %v", name, err)
+	}
 	if _, err := os.Stat(path); err != nil {
 		return nil, errors.New("table not found")
 	}
-	// Else, open from disk.
-	// NOTE: This is janky; assumes that if a .meta file exists, then it is a hash index,
-	// else, it is a btree index.
-	if _, err := os.Stat(path + ".meta"); err == nil {
-		index, err = hash.OpenTable(path)
-		if err != nil {
-			return nil, err
+	// Else, open from disk, as whatever kind of index its header says it holds.
+	info, err := pager.ReadFileInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open table %s: %v", name, err)
+	}
+	indexType := info.IndexType
+	if indexType == pager.INDEX_NONE {
+		// Files written before the index type was recorded: hash indexes have a .meta file.
+		indexType = pager.INDEX_BTREE
+		if _, err := os.Stat(path + ".meta"); err == nil {
+			indexType = pager.INDEX_HASH
 		}
+	}
+	if opts, ok := btree.OptionsOf(indexType); ok {
+		index, err = btree.OpenTableWithOptions(path, db.pool, opts)
+	} else if indexType == pager.INDEX_HASH {
+		index, err = hash.OpenTableWithPool(path, db.pool)
 	} else {
-		index, err = btree.OpenTable(path)
-		if err != nil {
-			return nil, err
-		}
+		return nil, fmt.Errorf("cannot open table %s: file holds a %s", name, pager.IndexTypeName(indexType))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open table %s: %v", name, err)
 	}
 	db.tables[name] = index
 	return index, nil
 }
 
+// Returns true if the given table may hold several entries with the same key.
+func allowsDuplicates(index Index) bool {
+	bt, ok := index.(*btree.BTreeIndex)
+	return ok && bt.AllowsDuplicates()
+}
+
 // Get a database's tables.
 func (db *Database) GetTables() map[string]Index {
 	return db.tables
 }
 
+// Get the database's shared buffer pool.
+func (db *Database) GetPool() *pager.BufferPool {
+	return db.pool
+}
+
 // Returns the basepath of the database.
 func (db *Database) GetBasePath() string {
 	return db.basepath
@@ -4,9 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
 	repl "github.com/brown-csci1270/db/pkg/repl"
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
@@ -16,7 +19,7 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r := repl.NewRepl()
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(db, payload, replConfig.GetWriter())
-	}, "Create a table. usage: create table <table>")
+	}, "Create a table. usage: create <btree|hash> table <table>, or create btree table <table> [duplicates] [compressed]")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(db, payload, replConfig.GetWriter())
 	}, "Find an element. usage: find <key> from <table>")
@@ -25,23 +28,51 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r.AddCommand("delete", func(payload string, replConfig *repl.REPLConfig) error { return HandleDelete(db, payload) }, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(db, payload, replConfig.GetWriter())
-	}, "Select elements from a table. usage: select from <table>")
+	}, "Select elements from a table. usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(db, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.AddCommand("stats", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleStats(db, payload, replConfig.GetWriter())
+	}, "Print buffer pool statistics for a table. usage: stats <table>")
+	r.AddCommand("vacuum", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleVacuum(db, payload, replConfig.GetWriter())
+	}, "Rebuild a table with densely packed pages. usage: vacuum <table>")
+	r.AddCommand("load", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleLoad(db, payload, replConfig.GetWriter())
+	}, "Load entries from a file of <key> <value> lines. usage: load <file> into <table>")
 	return r
 }
 
+// Parse a create table command into the kind of table, its name, and the
+// options of a B+tree: create <type> table <table> [duplicates] [compressed].
+func ParseCreateTable(payload string) (tblType string, tblName string, opts btree.TableOptions, err error) {
+	fields := strings.Fields(payload)
+	usage := errors.New("usage: create <btree|hash> table <table>, or create btree table <table> [duplicates] [compressed]")
+	if len(fields) < 4 || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
+		return "", "", opts, usage
+	}
+	for _, option := range fields[4:] {
+		switch {
+		case fields[1] == "btree" && option == "duplicates" && !opts.Duplicates:
+			opts.Duplicates = true
+		case fields[1] == "btree" && option == "compressed" && !opts.CompressKeys:
+			opts.CompressKeys = true
+		default:
+			return "", "", btree.TableOptions{}, usage
+		}
+	}
+	return fields[1], fields[3], opts, nil
+}
+
 // Handle create table.
 func HandleCreateTable(d *Database, payload string, w io.Writer) (err error) {
-	fields := strings.Fields(payload)
-	numFields := len(fields)
-	// Usage: create <type> table <table>
-	if numFields != 4 || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
-		return fmt.Errorf("usage: create <btree|hash> table <table>")
+	tblType, tableName, opts, err := ParseCreateTable(payload)
+	if err != nil {
+		return err
 	}
 	var tableType IndexType
-	switch fields[1] {
+	switch tblType {
 	case "btree":
 		tableType = BTreeIndexType
 	case "hash":
@@ -49,12 +80,11 @@ func HandleCreateTable(d *Database, payload string, w io.Writer) (err error) {
 	default:
 		return errors.New("create error: internal error")
 	}
-	tableName := fields[3]
-	_, err = d.createTable(tableName, tableType)
+	_, err = d.createTable(tableName, tableType, opts)
 	if err != nil {
 		return err
 	}
-	io.WriteString(w, fmt.Sprintf("%s table %s created.\n", fields[1], tableName))
+	io.WriteString(w, fmt.Sprintf("%s table %s created.\n", tblType, tableName))
 	return nil
 }
 
@@ -104,9 +134,12 @@ func HandleInsert(d *Database, payload string) (err error) {
 	if err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
-	val, _ := table.Find(int64(key))
-	if val != nil {
-		return fmt.Errorf("insert error: key already in table")
+	// A table with duplicate keys only refuses an entry it already holds.
+	if !allowsDuplicates(table) {
+		val, _ := table.Find(int64(key))
+		if val != nil {
+			return fmt.Errorf("insert error: key already in table")
+		}
 	}
 	err = table.Insert(int64(key), int64(value))
 	if err != nil {
@@ -169,24 +202,133 @@ func HandleDelete(d *Database, payload string) (err error) {
 // Handle select.
 func HandleSelect(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
-	numFields := len(fields)
-	// Usage: select from <table>
-	if numFields != 3 || fields[1] != "from" {
-		return fmt.Errorf("usage: select from <table>")
+	// Usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]
+	usage := fmt.Errorf("usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]")
+	if len(fields) < 3 || fields[1] != "from" {
+		return usage
+	}
+	clauses := fields[3:]
+	var lo, hi int64 = math.MinInt64, math.MaxInt64
+	if len(clauses) >= 6 && clauses[0] == "where" {
+		if clauses[1] != "key" || clauses[2] != "between" || clauses[4] != "and" {
+			return usage
+		}
+		if lo, err = strconv.ParseInt(clauses[3], 10, 64); err != nil {
+			return fmt.Errorf("select error: %v", err)
+		}
+		if hi, err = strconv.ParseInt(clauses[5], 10, 64); err != nil {
+			return fmt.Errorf("select error: %v", err)
+		}
+		clauses = clauses[6:]
+	}
+	order := ""
+	if len(clauses) == 4 && clauses[0] == "order" && clauses[1] == "by" && clauses[2] == "key" &&
+		(clauses[3] == "asc" || clauses[3] == "desc") {
+		order = clauses[3]
+		clauses = clauses[4:]
+	}
+	if len(clauses) != 0 {
+		return usage
 	}
 	tableName := fields[2]
 	table, err := d.GetTable(tableName)
 	if err != nil {
 		return fmt.Errorf("select error: %v", err)
 	}
-	var results []utils.Entry
-	if results, err = table.Select(); err != nil {
-		return err
+	if len(fields) == 3 {
+		var results []utils.Entry
+		if results, err = table.Select(); err != nil {
+			return err
+		}
+		printResults(results, w)
+		return nil
+	}
+	if err = selectRange(table, lo, hi, order, w); err != nil {
+		return fmt.Errorf("select error: %v", err)
 	}
-	printResults(results, w)
 	return nil
 }
 
+// Print the entries of a table with keys between lo and hi, inclusive, in
+// the given order of keys: "asc", "desc", or "" for the table's own order.
+func selectRange(table Index, lo int64, hi int64, order string, w io.Writer) error {
+	bt, ok := table.(*btree.BTreeIndex)
+	if !ok {
+		// Other indexes aren't ordered, so look through every entry.
+		results, err := table.Select()
+		if err != nil {
+			return err
+		}
+		inRange := make([]utils.Entry, 0)
+		for _, entry := range results {
+			if entry.GetKey() >= lo && entry.GetKey() <= hi {
+				inRange = append(inRange, entry)
+			}
+		}
+		if order != "" {
+			sort.Slice(inRange, func(i, j int) bool {
+				return (inRange[i].GetKey() < inRange[j].GetKey()) == (order == "asc")
+			})
+		}
+		printResults(inRange, w)
+		return nil
+	}
+	if order == "desc" {
+		return selectRangeBackward(bt, lo, hi, w)
+	}
+	it, err := bt.RangeIterator(lo, hi, btree.RangeOptions{})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for {
+		entry, err := it.Next()
+		if err != nil || entry == nil {
+			return err
+		}
+		printEntry(entry, w)
+	}
+}
+
+// Print the entries of a B+tree with keys between lo and hi, inclusive, from the highest key down.
+func selectRangeBackward(bt *btree.BTreeIndex, lo int64, hi int64, w io.Writer) error {
+	cursor, err := bt.TableFind(hi)
+	if err != nil {
+		return err
+	}
+	// Step back onto the last entry at or below hi.
+	past := cursor.IsEnd()
+	if !past {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			return err
+		}
+		past = entry.GetKey() > hi
+	}
+	if past {
+		if err = cursor.StepBackward(); err == btree.ErrCursorAtStart {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	for {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			return err
+		}
+		if entry.GetKey() < lo {
+			return nil
+		}
+		printEntry(entry, w)
+		if err = cursor.StepBackward(); err == btree.ErrCursorAtStart {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 // Handle pretty printing.
 func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
@@ -216,10 +358,73 @@ func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
+// Handle printing buffer pool statistics.
+func HandleStats(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: stats <table>
+	if numFields != 2 {
+		return fmt.Errorf("usage: stats <table>")
+	}
+	table, err := d.GetTable(fields[1])
+	if err != nil {
+		return fmt.Errorf("stats error: %v", err)
+	}
+	table.GetPager().Stats().Print(w)
+	return nil
+}
+
+// Handle vacuum.
+func HandleVacuum(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: vacuum <table>
+	if numFields != 2 {
+		return fmt.Errorf("usage: vacuum <table>")
+	}
+	tableName := fields[1]
+	table, err := d.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("vacuum error: %v", err)
+	}
+	before := table.GetPager().GetNumPages()
+	if err = d.Vacuum(tableName); err != nil {
+		return fmt.Errorf("vacuum error: %v", err)
+	}
+	if table, err = d.GetTable(tableName); err != nil {
+		return fmt.Errorf("vacuum error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("table %s vacuumed: %d pages, down from %d.\n",
+		tableName, table.GetPager().GetNumPages(), before))
+	return nil
+}
+
+// Handle load.
+func HandleLoad(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: load <file> into <table>
+	if numFields != 4 || fields[2] != "into" {
+		return fmt.Errorf("usage: load <file> into <table>")
+	}
+	tableName := fields[3]
+	n, err := d.Load(tableName, fields[1])
+	if err != nil {
+		return fmt.Errorf("load error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("loaded %d entries into %s.\n", n, tableName))
+	return nil
+}
+
 // printResults prints all given entries in a standard format.
 func printResults(entries []utils.Entry, w io.Writer) {
 	for _, entry := range entries {
-		io.WriteString(w, fmt.Sprintf("(%v, %v)\n",
-			entry.GetKey(), entry.GetValue()))
+		printEntry(entry, w)
 	}
 }
+
+// Print an entry.
+func printEntry(entry utils.Entry, w io.Writer) {
+	io.WriteString(w, fmt.Sprintf("(%v, %v)\n",
+		entry.GetKey(), entry.GetValue()))
+}
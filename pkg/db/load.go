@@ -0,0 +1,133 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Loading reads a file of entries, one "<key> <value>" pair per line, and
+// adds them all to a table. Entries are sorted by key first, so an empty
+// B+tree can be built bottom-up instead of one insert at a time. Blank lines
+// and lines starting with '#' are skipped.
+//
+// Loading writes to the table directly, without going through the recovery
+// log, so it isn't crash-safe: after a crash partway through, recovery knows
+// nothing of the entries that were loaded, and the table may hold some of
+// them. A database that is recovered from a log must be checkpointed once
+// loading is done, so that recovery starts from the loaded table; for this
+// reason, the recovery REPL doesn't offer loading. A bulk load that fails
+// partway frees the pages it built, and leaves the table empty.
+
+// The fraction of each node that loading fills, leaving room for later inserts.
+const LOAD_FILL_FACTOR = 0.9
+
+// Load adds the entries in the given file to the named table, and returns how
+// many it added. No entry is added if the file can't be read, or if it holds
+// the same key twice, or for a table with duplicate keys, the same entry
+// twice. Loads aren't logged; see above.
+func (db *Database) Load(name string, filename string) (int, error) {
+	table, err := db.GetTable(name)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := readEntries(filename)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].GetKey() != entries[j].GetKey() {
+			return entries[i].GetKey() < entries[j].GetKey()
+		}
+		return entries[i].GetValue() < entries[j].GetValue()
+	})
+	duplicates := allowsDuplicates(table)
+	for i := 1; i < len(entries); i++ {
+		if entries[i].GetKey() != entries[i-1].GetKey() {
+			continue
+		}
+		if !duplicates {
+			return 0, fmt.Errorf("%s: key %d appears more than once", filename, entries[i].GetKey())
+		}
+		if entries[i].GetValue() == entries[i-1].GetValue() {
+			return 0, fmt.Errorf("%s: entry %d %d appears more than once", filename, entries[i].GetKey(), entries[i].GetValue())
+		}
+	}
+	// Only an empty B+tree can be built bottom-up.
+	if bt, ok := table.(*btree.BTreeIndex); ok {
+		cursor, err := bt.TableStart()
+		if err != nil {
+			return 0, err
+		}
+		if cursor.IsEnd() {
+			if err = btree.BulkLoad(bt, &sliceIterator{entries: entries}, LOAD_FILL_FACTOR); err != nil {
+				return 0, err
+			}
+			return len(entries), nil
+		}
+	}
+	for i, entry := range entries {
+		if err = table.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			return i, fmt.Errorf("cannot insert key %d: %v", entry.GetKey(), err)
+		}
+	}
+	return len(entries), nil
+}
+
+// Read the entries in the given file, in the order they appear in.
+func readEntries(filename string) ([]utils.Entry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []utils.Entry
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <key> <value>", filename, lineNum)
+		}
+		key, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		entry := btree.BTreeEntry{}
+		entry.SetKey(key)
+		entry.SetValue(value)
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// An iterator over a slice of entries.
+type sliceIterator struct {
+	entries []utils.Entry
+}
+
+// Return the next entry, or nil once there are none left.
+func (it *sliceIterator) Next() (utils.Entry, error) {
+	if len(it.entries) == 0 {
+		return nil, nil
+	}
+	entry := it.entries[0]
+	it.entries = it.entries[1:]
+	return entry, nil
+}
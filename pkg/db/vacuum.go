@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Vacuuming rebuilds a table into a new file with densely packed pages, then
+// swaps it in for the old one. The new table is built under a temporary name
+// and only renamed to VACUUM_SUFFIX once it is complete; that rename commits
+// the swap. A vacuum that is interrupted before it commits is thrown away the
+// next time the table is opened, and one that is interrupted after is
+// finished then. A hash table's .meta file is renamed ahead of its table file,
+// so it is in place whenever the table file is. Operations and cursors keep
+// the pages they are using pinned, so a vacuum refuses to start, or to swap
+// the files, while any page of the table is pinned.
+
+// Suffix of a rebuilt table file that is waiting to be swapped in.
+const VACUUM_SUFFIX = ".vacuum"
+
+// Suffix of a table file that is still being rebuilt.
+const VACUUM_TEMP_SUFFIX = VACUUM_SUFFIX + ".tmp"
+
+// Suffixes of the side files that belong to a table file.
+var tableSideSuffixes = []string{".meta", ".dwb"}
+
+// Vacuum rebuilds the named table with densely packed pages, shrinking its
+// file. It fails if the table is in use.
+func (db *Database) Vacuum(name string) error {
+	db.LockFiles()
+	defer db.UnlockFiles()
+	table, err := db.GetTable(name)
+	if err != nil {
+		return err
+	}
+	if tableInUse(table) {
+		return fmt.Errorf("table %s is in use", name)
+	}
+	fs := db.pool.GetFileSystem()
+	path := filepath.Join(db.basepath, name)
+	building, built := path+VACUUM_TEMP_SUFFIX, path+VACUUM_SUFFIX
+	db.removeTableFiles(building)
+	if err = table.CompactTo(building); err != nil {
+		db.removeTableFiles(building)
+		return err
+	}
+	if tableInUse(table) {
+		db.removeTableFiles(building)
+		return fmt.Errorf("table %s is in use", name)
+	}
+	// Close the old table first: the new one was built from its cached pages,
+	// so if those can't be written back, the old file is out of date and the
+	// new one must win.
+	delete(db.tables, name)
+	closeErr := table.Close()
+	if _, err := os.Stat(building + ".meta"); err == nil {
+		if err = fs.Rename(building+".meta", built+".meta"); err != nil {
+			return err
+		}
+	}
+	if err = fs.Rename(building, built); err != nil {
+		return err
+	}
+	if err = syncDir(db.basepath); err != nil {
+		return err
+	}
+	if err = db.finishVacuum(path); err != nil {
+		return err
+	}
+	if _, err = db.GetTable(name); err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("old table could not be closed cleanly, but was replaced: %v", closeErr)
+	}
+	return nil
+}
+
+// Finish or throw away a vacuum of the given table file that was interrupted.
+func (db *Database) finishVacuum(path string) error {
+	fs := db.pool.GetFileSystem()
+	built := path + VACUUM_SUFFIX
+	db.removeTableFiles(path + VACUUM_TEMP_SUFFIX)
+	if _, err := os.Stat(built); os.IsNotExist(err) {
+		// The swap wasn't committed, so the old table is still current.
+		fs.Remove(built + ".meta")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(built + ".meta"); err == nil {
+		if err = fs.Rename(built+".meta", path+".meta"); err != nil {
+			return err
+		}
+	}
+	// A side file of the old table doesn't apply to the new one.
+	fs.Remove(path + ".dwb")
+	if err := fs.Rename(built, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Check whether any of the table's pages are pinned.
+func tableInUse(table Index) bool {
+	return table.GetPager().Stats().PinnedFrames > 0
+}
+
+// Remove a table file and its side files, if they exist.
+func (db *Database) removeTableFiles(path string) {
+	fs := db.pool.GetFileSystem()
+	fs.Remove(path)
+	for _, suffix := range tableSideSuffixes {
+		fs.Remove(path + suffix)
+	}
+}
+
+// Fsync a directory, so that renames in it are durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// [RECOVERY] Keep table files from being rebuilt, so that they can be copied.
+func (db *Database) LockFiles() {
+	db.filesMtx.Lock()
+}
+
+// [RECOVERY] Allow table files to be rebuilt again.
+func (db *Database) UnlockFiles() {
+	db.filesMtx.Unlock()
+}
@@ -38,6 +38,11 @@ func (bucket *HashBucket) GetPage() *pager.Page {
 	return bucket.page
 }
 
+// Get the number of entries this bucket can hold before it must split.
+func (bucket *HashBucket) capacity() int64 {
+	return bucketSize(int64(len(*bucket.page.GetData())))
+}
+
 // Finds the entry with the given key.
 func (bucket *HashBucket) Find(key int64) (utils.Entry, bool) {
 	/* SOLUTION {{{ */
@@ -55,7 +60,7 @@ func (bucket *HashBucket) Insert(key int64, value int64) (bool, error) {
 	/* SOLUTION {{{ */
 	bucket.modifyCell(bucket.numKeys, HashEntry{key: key, value: value})
 	bucket.updateNumKeys(bucket.numKeys + 1)
-	return bucket.numKeys >= BUCKETSIZE, nil
+	return bucket.numKeys >= bucket.capacity(), nil
 	/* SOLUTION }}} */
 }
 
@@ -79,7 +84,7 @@ func (bucket *HashBucket) Update(key int64, value int64) error {
 	/* SOLUTION }}} */
 }
 
-// Delete the given key-value pair, does not coalesce.
+// Delete the given key-value pair, does not coalesce (see HashTable.Coalesce).
 func (bucket *HashBucket) Delete(key int64) error {
 	/* SOLUTION {{{ */
 	// Get the index to delete.
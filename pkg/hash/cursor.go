@@ -9,6 +9,8 @@ import (
 // HashCursor points to a spot in the hash table.
 type HashCursor struct {
 	table     *HashIndex
+	bucketPNs []int64 // Page numbers of the buckets to visit.
+	bucketIdx int     // Index of the current bucket in bucketPNs.
 	cellnum   int64
 	isEnd     bool
 	curBucket *HashBucket
@@ -16,13 +18,16 @@ type HashCursor struct {
 
 // TableStart returns a cursor to the first entry in the hash table.
 func (table *HashIndex) TableStart() (utils.Cursor, error) {
-	cursor := HashCursor{table: table, cellnum: 0}
+	table.table.RLock()
+	cursor := HashCursor{table: table, bucketPNs: table.table.bucketPNs(), cellnum: 0}
+	table.table.RUnlock()
 
-	curPage, err := table.pager.GetPage(ROOT_PN)
+	curPage, err := table.pager.GetPage(cursor.bucketPNs[0])
 	if err != nil {
 		return nil, err
 	}
 	defer curPage.Put()
+	cursor.prefetch()
 	cursor.curBucket = pageToBucket(curPage)
 	cursor.isEnd = (cursor.curBucket.numKeys == 0)
 	return &cursor, nil
@@ -32,17 +37,19 @@ func (table *HashIndex) TableStart() (utils.Cursor, error) {
 func (cursor *HashCursor) StepForward() error {
 	// If the cursor is at the end of the bucket, try visiting the next bucket.
 	if cursor.isEnd {
-		// Get the next page number.
-		nextPN := cursor.curBucket.page.GetPageNum() + 1
-		if nextPN >= cursor.curBucket.page.GetPager().GetNumPages() {
+		// Get the next bucket's page number.
+		if cursor.bucketIdx+1 >= len(cursor.bucketPNs) {
 			return errors.New("cannot advance the cursor further")
 		}
+		cursor.bucketIdx++
+		nextPN := cursor.bucketPNs[cursor.bucketIdx]
 		// Convert the page to a bucket.
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
 		if err != nil {
 			return err
 		}
 		defer nextPage.Put()
+		cursor.prefetch()
 		nextBucket := pageToBucket(nextPage)
 		// Reinitialize the cursor.
 		cursor.cellnum = 0
@@ -74,3 +81,16 @@ func (cursor *HashCursor) GetEntry() (utils.Entry, error) {
 	entry := cursor.curBucket.getCell(cursor.cellnum)
 	return entry, nil
 }
+
+// Start reading the next window of buckets in once the cursor enters a new window.
+func (cursor *HashCursor) prefetch() {
+	n := cursor.table.pager.GetReadAhead()
+	if n == 0 || cursor.bucketIdx%n != 0 {
+		return
+	}
+	end := cursor.bucketIdx + 1 + n
+	if end > len(cursor.bucketPNs) {
+		end = len(cursor.bucketPNs)
+	}
+	cursor.table.pager.Prefetch(cursor.bucketPNs[cursor.bucketIdx+1 : end])
+}
@@ -13,14 +13,39 @@ type HashIndex struct {
 	pager *pager.Pager
 }
 
-// Opens the pager with the given table name.
+// Opens the pager with the given table name. The table gets a private buffer pool.
 func OpenTable(filename string) (*HashIndex, error) {
-	// Create a pager for the table.
+	return openTable(filename, pager.NewPager())
+}
+
+// Opens the pager with the given table name, caching pages in the given buffer pool.
+func OpenTableWithPool(filename string, pool *pager.BufferPool) (*HashIndex, error) {
+	return openTable(filename, pager.NewPagerWithPool(pool))
+}
+
+// Opens a temporary table that isn't backed by a database file. Its pages are
+// kept in a private buffer pool and spill to an anonymous temp file once the
+// pool fills up; everything is discarded on Close.
+func OpenTempTable() (*HashIndex, error) {
 	pager := pager.NewPager()
+	table, err := NewHashTable(pager)
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return &HashIndex{table: table, pager: pager}, nil
+}
+
+// Opens the given table name with the given pager.
+func openTable(filename string, pager *pager.Pager) (*HashIndex, error) {
 	err := pager.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkIndexType(pager); err != nil {
+		pager.Close()
+		return nil, err
+	}
 	// Return index.
 	var table *HashTable
 	if pager.GetNumPages() == 0 {
@@ -34,6 +59,11 @@ func OpenTable(filename string) (*HashIndex, error) {
 	return &HashIndex{table: table, pager: pager}, nil
 }
 
+// checkIndexType records that a new file holds a hash index, or checks that an existing one does.
+func checkIndexType(bucketPager *pager.Pager) error {
+	return bucketPager.CheckIndexType(pager.INDEX_HASH, HASH_FUNC)
+}
+
 // Get name.
 func (table *HashIndex) GetName() string {
 	return table.pager.GetFileName()
@@ -54,6 +84,36 @@ func (index *HashIndex) Close() error {
 	return WriteHashTable(index.pager, index.table)
 }
 
+// CompactTo writes a copy of the table with freshly packed buckets and a
+// minimal directory to a new file, which caches its pages in the same buffer pool.
+func (index *HashIndex) CompactTo(filename string) error {
+	dst, err := OpenTableWithPool(filename, index.pager.GetPool())
+	if err != nil {
+		return err
+	}
+	// Copy one bucket at a time, so that only one is held in memory.
+	for _, pn := range index.table.bucketPNs() {
+		bucket, err := index.table.GetBucketByPN(pn, NO_LOCK)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		entries, err := bucket.Select()
+		bucket.page.Put()
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		for _, entry := range entries {
+			if err = dst.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+				dst.Close()
+				return err
+			}
+		}
+	}
+	return dst.Close()
+}
+
 // Find element by key.
 func (index *HashIndex) Find(key int64) (utils.Entry, error) {
 	return index.table.Find(key)
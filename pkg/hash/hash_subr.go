@@ -10,15 +10,18 @@ import (
 
 // Hash table variables
 var ROOT_PN int64 = 0
-var PAGESIZE int64 = pager.PAGESIZE
 var DIRECTORY_HEADER_SIZE int64 = binary.MaxVarintLen64 * 2 // Must store global depth and next pointer
 var DEPTH_OFFSET int64 = 0
 var DEPTH_SIZE int64 = binary.MaxVarintLen64
 var NUM_KEYS_OFFSET int64 = DEPTH_OFFSET + DEPTH_SIZE
 var NUM_KEYS_SIZE int64 = binary.MaxVarintLen64
 var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2                    // int64 key, int64 value
-var BUCKETSIZE int64 = (PAGESIZE - BUCKET_HEADER_SIZE) / ENTRYSIZE // num entries
+var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2 // int64 key, int64 value
+
+// bucketSize returns the number of entries a bucket on a page of the given size can hold.
+func bucketSize(pageSize int64) int64 {
+	return (pageSize - BUCKET_HEADER_SIZE) / ENTRYSIZE
+}
 
 // Lock Types
 type BucketLockType int
@@ -50,6 +53,9 @@ func MurmurHasher(key int64, size int64) uint {
 	return getHash(murmur3.Sum64, key, size)
 }
 
+// The hash function used by Hasher, recorded in the header of hash index files.
+var HASH_FUNC = pager.HASH_XXHASH
+
 // Hasher returns the hash of a key, modded by 2^depth.
 func Hasher(key int64, depth int64) int64 {
 	return int64(XxHasher(key, powInt(2, depth)))
@@ -156,11 +162,15 @@ func (table *HashTable) GetBucket(hash int64, lock BucketLockType) (*HashBucket,
 
 // Read hash table in from memory.
 func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
-	indexPager := pager.NewPager()
-	err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+	indexPager := pager.NewPagerWithPool(bucketPager.GetPool())
+	err := indexPager.Open(bucketPager.GetFilePath() + ".meta")
 	if err != nil {
 		return nil, err
 	}
+	if err = indexPager.CheckIndexType(pager.INDEX_HASH_META, pager.HASH_NONE); err != nil {
+		indexPager.Close()
+		return nil, err
+	}
 	metaPN := int64(0)
 	page, err := indexPager.GetPage(metaPN)
 	if err != nil {
@@ -174,7 +184,7 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	numHashes := powInt(2, depth)
 	buckets := make([]int64, numHashes)
 	for i := int64(0); i < numHashes; i++ {
-		if bytesRead+pnSize > PAGESIZE {
+		if bytesRead+pnSize > int64(len(*page.GetData())) {
 			page.Put()
 			metaPN++
 			page, err = indexPager.GetPage(metaPN)
@@ -195,12 +205,17 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 // Write hash table out to memory.
 func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 	if bucketPager.HasFile() {
-		indexPager := pager.NewPager()
-		err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+		indexPager := pager.NewPagerWithPool(bucketPager.GetPool())
+		err := indexPager.Open(bucketPager.GetFilePath() + ".meta")
 		if err != nil {
 			return err
 		}
-		metaPN := indexPager.GetFreePN()
+		if err = indexPager.CheckIndexType(pager.INDEX_HASH_META, pager.HASH_NONE); err != nil {
+			indexPager.Close()
+			return err
+		}
+		// Overwrite the meta file from its first page.
+		metaPN := int64(0)
 		page, err := indexPager.GetPage(metaPN)
 		if err != nil {
 			return err
@@ -215,9 +230,9 @@ func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 		pnSize := int64(binary.MaxVarintLen64)
 		pnData := make([]byte, pnSize)
 		for _, pn := range table.buckets {
-			if bytesWritten+pnSize > PAGESIZE {
+			if bytesWritten+pnSize > int64(len(*page.GetData())) {
 				page.Put()
-				metaPN = indexPager.GetFreePN()
+				metaPN++
 				page, err = indexPager.GetPage(metaPN)
 				if err != nil {
 					return err
@@ -230,7 +245,10 @@ func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 			bytesWritten += pnSize
 		}
 		page.Put()
-		indexPager.Close()
+		if err = indexPager.Close(); err != nil {
+			bucketPager.Close()
+			return err
+		}
 	}
 	return bucketPager.Close()
 }
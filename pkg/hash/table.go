@@ -69,6 +69,19 @@ func (table *HashTable) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get the page numbers of the table's distinct buckets, in directory order.
+func (table *HashTable) bucketPNs() []int64 {
+	seen := make(map[int64]bool)
+	pns := make([]int64, 0)
+	for _, pn := range table.buckets {
+		if !seen[pn] {
+			seen[pn] = true
+			pns = append(pns, pn)
+		}
+	}
+	return pns
+}
+
 // Finds the entry with the given key.
 func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	/* SOLUTION {{{ */
@@ -146,10 +159,10 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 		i += powInt(2, power)
 	}
 	// Check if recursive splitting is required
-	if oldNKeys >= BUCKETSIZE {
+	if oldNKeys >= bucket.capacity() {
 		return table.Split(bucket, oldHash)
 	}
-	if newNKeys >= BUCKETSIZE {
+	if newNKeys >= newBucket.capacity() {
 		return table.Split(newBucket, newHash)
 	}
 	return nil
@@ -197,7 +210,39 @@ func (table *HashTable) Update(key int64, value int64) error {
 	/* SOLUTION }}} */
 }
 
-// Delete the given key-value pair, does not coalesce.
+// Coalesce merges an empty bucket into its buddy if both have the same local
+// depth, and points the directory at the buddy. Returns whether the empty
+// bucket is no longer referenced.
+func (table *HashTable) Coalesce(bucket *HashBucket, hash int64) (bool, error) {
+	if bucket.depth == 0 {
+		return false, nil
+	}
+	// The buddy differs from this bucket in the highest bit of its local hash.
+	localHash := hash % powInt(2, bucket.depth)
+	buddyHash := localHash ^ powInt(2, bucket.depth-1)
+	buddyPN := table.buckets[buddyHash]
+	if buddyPN == bucket.page.GetPageNum() {
+		return false, nil
+	}
+	buddy, err := table.GetBucketByPN(buddyPN, WRITE_LOCK)
+	if err != nil {
+		return false, err
+	}
+	defer buddy.page.Put()
+	defer buddy.WUnlock()
+	if buddy.depth != bucket.depth {
+		return false, nil
+	}
+	// Point every directory entry of the merged bucket at the buddy.
+	buddy.updateDepth(bucket.depth - 1)
+	power := powInt(2, buddy.depth)
+	for i := localHash % power; i < powInt(2, table.depth); i += power {
+		table.buckets[i] = buddyPN
+	}
+	return true, nil
+}
+
+// Delete the given key-value pair, coalescing the bucket if it empties.
 func (table *HashTable) Delete(key int64) error {
 	table.WLock()
 	defer table.WUnlock()
@@ -207,9 +252,19 @@ func (table *HashTable) Delete(key int64) error {
 	if err != nil {
 		return err
 	}
-	defer bucket.page.Put()
-	defer bucket.WUnlock()
-	return bucket.Delete(key)
+	err = bucket.Delete(key)
+	merged := false
+	if err == nil && bucket.numKeys == 0 {
+		merged, err = table.Coalesce(bucket, hash)
+	}
+	pn := bucket.page.GetPageNum()
+	bucket.WUnlock()
+	bucket.page.Put()
+	// Give the emptied bucket's page back to the pager.
+	if merged {
+		return table.pager.FreePage(pn)
+	}
+	return err
 	/* SOLUTION }}} */
 }
 
@@ -219,13 +274,13 @@ func (table *HashTable) Select() ([]utils.Entry, error) {
 	defer table.RUnlock()
 	/* SOLUTION {{{ */
 	ret := make([]utils.Entry, 0)
-	for i := int64(0); i < table.pager.GetNumPages(); i++ {
-		bucket, err := table.GetBucketByPN(i, READ_LOCK)
-		defer bucket.RUnlock()
+	for _, pn := range table.bucketPNs() {
+		bucket, err := table.GetBucketByPN(pn, READ_LOCK)
 		if err != nil {
 			return nil, err
 		}
 		entries, err := bucket.Select()
+		bucket.RUnlock()
 		bucket.GetPage().Put()
 		if err != nil {
 			return nil, err
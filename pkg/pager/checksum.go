@@ -0,0 +1,54 @@
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Every page on disk ends with a trailer holding a CRC32C checksum of the
+// rest of the page. Pages handed out by the pager exclude the trailer.
+const CHECKSUM_SIZE = int64(crc32.Size)
+
+// Castagnoli polynomial table, which has hardware support on most platforms.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrPageCorrupt is returned when a page read from disk fails its checksum.
+type ErrPageCorrupt struct {
+	File    string // Name of the file the page was read from.
+	PageNum int64  // The page number of the corrupted page.
+}
+
+func (e ErrPageCorrupt) Error() string {
+	return fmt.Sprintf("page %d of %s is corrupt (checksum mismatch)", e.PageNum, e.File)
+}
+
+// Get the whole on-disk image of the page, including its trailer.
+func (page *Page) image() []byte {
+	return page.frame[:page.pager.pageSize]
+}
+
+// Compute the checksum of the page's data and store it in the trailer.
+func (page *Page) sealChecksum() {
+	sealImage(page.image())
+}
+
+// Compute the checksum of a page image's data and store it in its trailer.
+func sealImage(image []byte) {
+	n := int64(len(image)) - CHECKSUM_SIZE
+	binary.LittleEndian.PutUint32(image[n:], crc32.Checksum(image[:n], crcTable))
+}
+
+// Check the page's data against the checksum in its trailer.
+func (page *Page) verifyChecksum() error {
+	if !checksumMatches(page.image()) {
+		return ErrPageCorrupt{File: page.pager.GetFileName(), PageNum: page.pagenum}
+	}
+	return nil
+}
+
+// Check a page image against the checksum in its trailer.
+func checksumMatches(image []byte) bool {
+	n := int64(len(image)) - CHECKSUM_SIZE
+	return binary.LittleEndian.Uint32(image[n:]) == crc32.Checksum(image[:n], crcTable)
+}
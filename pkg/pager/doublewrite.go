@@ -0,0 +1,268 @@
+package pager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sync"
+
+	directio "github.com/ncw/directio"
+)
+
+// A page write that is cut short by a crash can leave a page half old and
+// half new. With double-write enabled, each batch of pages is first written
+// and synced to a side file next to the database file, and only then written
+// in place and synced. When a file is opened, any page of the last batch that
+// fails its checksum in place is restored from the side file. The file header
+// goes through the side file the same way, as a batch of its own. Both syncs
+// are skipped when the pool doesn't sync at all, which leaves writes
+// protected against the process crashing, but not the machine.
+
+// Suffix of the double-write side file.
+const DWB_SUFFIX = ".dwb"
+
+// Magic bytes identifying a double-write file.
+var DWB_MAGIC = []byte("BUMBLDWB")
+
+// Double-write file layout: a header holding the magic bytes, the number of
+// pages in the batch and a checksum of the slots, followed by one slot per
+// page holding its page number and on-disk image.
+var DWB_MAGIC_OFFSET int64 = 0
+var DWB_MAGIC_SIZE int64 = int64(len(DWB_MAGIC))
+var DWB_COUNT_OFFSET int64 = DWB_MAGIC_OFFSET + DWB_MAGIC_SIZE
+var DWB_COUNT_SIZE int64 = 8
+var DWB_CHECKSUM_OFFSET int64 = DWB_COUNT_OFFSET + DWB_COUNT_SIZE
+var DWB_CHECKSUM_SIZE int64 = CHECKSUM_SIZE
+var DWB_SLOTS_OFFSET int64 = DWB_CHECKSUM_OFFSET + DWB_CHECKSUM_SIZE
+var DWB_PN_SIZE int64 = 8
+
+// Page number of the slot holding the file header.
+const DWB_HEADER_PN int64 = NOPAGE
+
+// The side file of a pager with double-write enabled.
+type doubleWriter struct {
+	mtx  sync.Mutex // Held from the side file write until the batch is synced in place.
+	file Storage
+}
+
+// SetDoubleWrite sets whether files opened on this pool protect their page
+// writes against tearing with a double-write side file.
+func (pool *BufferPool) SetDoubleWrite(enabled bool) {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	pool.doubleWrite = enabled
+}
+
+// GetDoubleWrite returns whether files opened on this pool use a double-write side file.
+func (pool *BufferPool) GetDoubleWrite() bool {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	return pool.doubleWrite
+}
+
+// Get the size of a double-write slot.
+func (pager *Pager) dwbSlotSize() int64 {
+	return DWB_PN_SIZE + pager.pageSize
+}
+
+// Get the offset in the file of the page or header with the given slot page number.
+func (pager *Pager) imageOffset(pagenum int64) int64 {
+	if pagenum == DWB_HEADER_PN {
+		return 0
+	}
+	return pager.pageOffset(pagenum)
+}
+
+// Write page images in place, going through the double-write side file first
+// if there is one. The images must be aligned for direct I/O.
+func (pager *Pager) writeImages(pns []int64, images [][]byte) error {
+	dwb := pager.dwb
+	if dwb == nil {
+		for i, image := range images {
+			if _, err := pager.file.WriteAt(image, pager.imageOffset(pns[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dwb.mtx.Lock()
+	defer dwb.mtx.Unlock()
+	// Write the batch to the side file.
+	slotSize := pager.dwbSlotSize()
+	batch := make([]byte, DWB_SLOTS_OFFSET+int64(len(images))*slotSize)
+	copy(batch[DWB_MAGIC_OFFSET:DWB_MAGIC_OFFSET+DWB_MAGIC_SIZE], DWB_MAGIC)
+	binary.LittleEndian.PutUint64(batch[DWB_COUNT_OFFSET:], uint64(len(images)))
+	for i, image := range images {
+		slot := batch[DWB_SLOTS_OFFSET+int64(i)*slotSize:]
+		binary.LittleEndian.PutUint64(slot, uint64(pns[i]))
+		copy(slot[DWB_PN_SIZE:slotSize], image)
+	}
+	binary.LittleEndian.PutUint32(batch[DWB_CHECKSUM_OFFSET:], crc32.Checksum(batch[DWB_SLOTS_OFFSET:], crcTable))
+	sync := pager.pool.syncMode != SYNC_NONE
+	if _, err := dwb.file.WriteAt(batch, 0); err != nil {
+		return err
+	}
+	if sync {
+		if err := dwb.file.Sync(); err != nil {
+			return err
+		}
+	}
+	// Then write it in place. The batch must be durable before the side file is reused.
+	for i, image := range images {
+		if _, err := pager.file.WriteAt(image, pager.imageOffset(pns[i])); err != nil {
+			return err
+		}
+	}
+	if sync {
+		return pager.file.Sync()
+	}
+	return nil
+}
+
+// Restore pages that were torn while being written from the double-write side
+// file, then open the side file for writing if double-write is enabled. A side
+// file left next to a new file belonged to an old one, and is ignored.
+func (pager *Pager) openDoubleWrite(restore bool) error {
+	name := pager.file.Name() + DWB_SUFFIX
+	if restore {
+		if err := pager.restoreTornPages(name); err != nil {
+			return err
+		}
+	}
+	if !pager.pool.doubleWrite {
+		pager.pool.fs.Remove(name)
+		return nil
+	}
+	// Start from an empty side file, so that a stale batch can never be restored.
+	if err := pager.pool.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := pager.pool.fs.OpenFile(name, false)
+	if err != nil {
+		return err
+	}
+	pager.dwb = &doubleWriter{file: file}
+	return nil
+}
+
+// Close the double-write side file. It is removed if every page made it to disk.
+func (pager *Pager) closeDoubleWrite(clean bool) {
+	if pager.dwb == nil {
+		return
+	}
+	pager.dwb.file.Close()
+	if clean {
+		pager.pool.fs.Remove(pager.dwb.file.Name())
+	}
+	pager.dwb = nil
+}
+
+// Read the double-write side file with the given name. Reading a side file
+// that isn't there creates it empty, so it is removed again, in case the file
+// fails to open and never gets to clean it up.
+func (pager *Pager) readDoubleWrite(name string) ([]byte, error) {
+	batch, err := readFile(pager.pool.fs, name)
+	if err == nil && len(batch) == 0 {
+		pager.pool.fs.Remove(name)
+	}
+	return batch, err
+}
+
+// Restore the pages of the last double-write batch that fail their checksum in place.
+func (pager *Pager) restoreTornPages(name string) error {
+	batch, err := pager.readDoubleWrite(name)
+	if err != nil {
+		return err
+	}
+	// A batch that didn't make it to the side file intact was never written in place.
+	if int64(len(batch)) < DWB_SLOTS_OFFSET || !bytes.Equal(batch[DWB_MAGIC_OFFSET:DWB_MAGIC_OFFSET+DWB_MAGIC_SIZE], DWB_MAGIC) {
+		return nil
+	}
+	slotSize := pager.dwbSlotSize()
+	count := int64(binary.LittleEndian.Uint64(batch[DWB_COUNT_OFFSET:]))
+	if count < 0 || count > (int64(len(batch))-DWB_SLOTS_OFFSET)/slotSize {
+		return nil
+	}
+	slots := batch[DWB_SLOTS_OFFSET : DWB_SLOTS_OFFSET+count*slotSize]
+	if binary.LittleEndian.Uint32(batch[DWB_CHECKSUM_OFFSET:]) != crc32.Checksum(slots, crcTable) {
+		return nil
+	}
+	image := directio.AlignedBlock(int(pager.pageSize))
+	restored := false
+	for i := int64(0); i < count; i++ {
+		slot := slots[i*slotSize : (i+1)*slotSize]
+		pagenum := int64(binary.LittleEndian.Uint64(slot))
+		if pagenum == DWB_HEADER_PN {
+			continue
+		}
+		for j := range image {
+			image[j] = 0
+		}
+		pager.file.ReadAt(image, pager.pageOffset(pagenum))
+		if pager.imageIntact(image, pagenum) {
+			continue
+		}
+		copy(image, slot[DWB_PN_SIZE:])
+		if !pager.imageIntact(image, pagenum) {
+			continue
+		}
+		if _, err := pager.file.WriteAt(image, pager.pageOffset(pagenum)); err != nil {
+			return err
+		}
+		restored = true
+	}
+	if restored {
+		return pager.file.Sync()
+	}
+	return nil
+}
+
+// Restore the file header from the double-write side file if the last batch
+// was the header and the header fails its checksum in place. This is done
+// before the header is read, so the page size is taken from the header in the
+// side file.
+func (pager *Pager) restoreTornHeader() error {
+	batch, err := pager.readDoubleWrite(pager.file.Name() + DWB_SUFFIX)
+	if err != nil {
+		return err
+	}
+	slot := DWB_SLOTS_OFFSET + DWB_PN_SIZE
+	if int64(len(batch)) < slot+HEADERSIZE ||
+		!bytes.Equal(batch[DWB_MAGIC_OFFSET:DWB_MAGIC_OFFSET+DWB_MAGIC_SIZE], DWB_MAGIC) ||
+		binary.LittleEndian.Uint64(batch[DWB_COUNT_OFFSET:]) != 1 ||
+		int64(binary.LittleEndian.Uint64(batch[DWB_SLOTS_OFFSET:])) != DWB_HEADER_PN {
+		return nil
+	}
+	header := batch[slot : slot+HEADERSIZE]
+	if !headerIntact(header) {
+		return nil
+	}
+	pageSize, _ := binary.Varint(header[HEADER_PAGESIZE_OFFSET : HEADER_PAGESIZE_OFFSET+HEADER_PAGESIZE_SIZE])
+	if ValidatePageSize(pageSize) != nil || int64(len(batch)) < slot+pageSize {
+		return nil
+	}
+	if binary.LittleEndian.Uint32(batch[DWB_CHECKSUM_OFFSET:]) != crc32.Checksum(batch[DWB_SLOTS_OFFSET:slot+pageSize], crcTable) {
+		return nil
+	}
+	image := directio.AlignedBlock(int(HEADERSIZE))
+	pager.file.ReadAt(image, 0)
+	if headerIntact(image) {
+		return nil
+	}
+	copy(image, header)
+	if _, err := pager.file.WriteAt(image, 0); err != nil {
+		return err
+	}
+	return pager.file.Sync()
+}
+
+// Check an on-disk page image against its trailer without changing it.
+func (pager *Pager) imageIntact(image []byte, pagenum int64) bool {
+	if pager.aead == nil {
+		return checksumMatches(image)
+	}
+	n := pager.dataSize()
+	_, err := pager.aead.Open(nil, image[n+TAG_SIZE:], image[:n+TAG_SIZE], pageAAD(pagenum))
+	return err == nil
+}
@@ -0,0 +1,65 @@
+package pager
+
+import (
+	"fmt"
+)
+
+// SyncMode decides when files are fsynced, trading durability for speed.
+type SyncMode string
+
+const (
+	SYNC_NONE       SyncMode = "none"       // Never fsync; the OS writes pages back when it likes.
+	SYNC_CHECKPOINT SyncMode = "checkpoint" // Fsync on checkpoints and when files are closed.
+	SYNC_FLUSH      SyncMode = "flush"      // Also fsync after every page flush.
+)
+
+// ParseSyncMode returns the sync mode with the given name.
+func ParseSyncMode(name string) (SyncMode, error) {
+	switch mode := SyncMode(name); mode {
+	case SYNC_NONE, SYNC_CHECKPOINT, SYNC_FLUSH:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown sync mode %q: must be one of [%s,%s,%s]", name, SYNC_NONE, SYNC_CHECKPOINT, SYNC_FLUSH)
+}
+
+// SetSyncMode sets when files using this pool are fsynced.
+func (pool *BufferPool) SetSyncMode(mode SyncMode) error {
+	if _, err := ParseSyncMode(string(mode)); err != nil {
+		return err
+	}
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	pool.syncMode = mode
+	return nil
+}
+
+// GetSyncMode returns when files using this pool are fsynced.
+func (pool *BufferPool) GetSyncMode() SyncMode {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	return pool.syncMode
+}
+
+// Sync fsyncs the files of every pager using this pool, unless the sync mode
+// is SYNC_NONE. Like FlushAllPages, it should be called with updates locked.
+func (pool *BufferPool) Sync() error {
+	if pool.syncMode == SYNC_NONE {
+		return nil
+	}
+	var err error
+	for pager := range pool.pagers {
+		if curErr := pager.file.Sync(); err == nil {
+			err = curErr
+		}
+	}
+	return err
+}
+
+// Fsync the pager's file after a flush if the sync mode is SYNC_FLUSH. Writes
+// through a double-write side file are synced already.
+func (pager *Pager) syncFlush() error {
+	if !pager.HasFile() || pager.pool.syncMode != SYNC_FLUSH || pager.dwb != nil {
+		return nil
+	}
+	return pager.file.Sync()
+}
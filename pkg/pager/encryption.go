@@ -0,0 +1,168 @@
+package pager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	directio "github.com/ncw/directio"
+)
+
+// Pages can optionally be encrypted at rest with AES-GCM. An encrypted page
+// ends with a trailer holding the GCM tag followed by the nonce, in place of
+// the checksum trailer; the tag authenticates the page, so corruption is still
+// detected. The page number is passed as additional data, so that pages can't
+// be swapped around undetected. The file header stays in plaintext, but
+// records whether the file is encrypted along with a tag of the key.
+
+// Sizes of the GCM nonce and tag.
+const NONCE_SIZE = 12
+const TAG_SIZE = 16
+
+// Size of the trailer of an encrypted page.
+const ENCRYPTION_TRAILER_SIZE = int64(TAG_SIZE + NONCE_SIZE)
+
+// NewCipher returns an AES-GCM cipher for the given 16, 24 or 32 byte key.
+func NewCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadKeyFile reads an AES key from the given file. The file holds either the
+// raw 16, 24 or 32 byte key, or the key in hex.
+func ReadKeyFile(filename string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(contents))); err == nil {
+		contents = key
+	}
+	switch len(contents) {
+	case 16, 24, 32:
+		return contents, nil
+	}
+	return nil, fmt.Errorf("key file %s must hold a 16, 24 or 32 byte key", filename)
+}
+
+// SetEncryptionKey makes pagers using this pool encrypt the files they create,
+// and requires the files they open to be encrypted with the same key.
+// It should be called before any pager is created on the pool.
+func (pool *BufferPool) SetEncryptionKey(key []byte) error {
+	aead, err := NewCipher(key)
+	if err != nil {
+		return err
+	}
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	if len(pool.pagers) > 0 {
+		return errors.New("the encryption key must be set before any file is opened")
+	}
+	pool.aead = aead
+	return nil
+}
+
+// IsEncrypted checks if the pager's pages are encrypted at rest.
+func (pager *Pager) IsEncrypted() bool {
+	return pager.aead != nil
+}
+
+// Get the size of the trailer at the end of each of this pager's pages.
+func (pager *Pager) trailerSize() int64 {
+	if pager.aead != nil {
+		return ENCRYPTION_TRAILER_SIZE
+	}
+	return CHECKSUM_SIZE
+}
+
+// Get the usable size of this pager's pages.
+func (pager *Pager) dataSize() int64 {
+	return pager.pageSize - pager.trailerSize()
+}
+
+// Get the on-disk image of the page, sealed with its trailer.
+// Encrypted images are built in a new buffer; the cached page stays in plaintext.
+func (page *Page) seal() []byte {
+	pager := page.pager
+	if pager.aead == nil {
+		page.sealChecksum()
+		return page.image()
+	}
+	image := directio.AlignedBlock(int(pager.pageSize))
+	n := pager.dataSize()
+	nonce := image[n+TAG_SIZE:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	pager.aead.Seal(image[:0], nonce, (*page.data)[:n], pageAAD(page.pagenum))
+	return image
+}
+
+// Check and decrypt the image of the page that was just read into its frame.
+func (page *Page) unseal() error {
+	pager := page.pager
+	if pager.aead == nil {
+		return page.verifyChecksum()
+	}
+	image := page.image()
+	n := pager.dataSize()
+	nonce := image[n+TAG_SIZE:]
+	if _, err := pager.aead.Open(image[:0], nonce, image[:n+TAG_SIZE], pageAAD(page.pagenum)); err != nil {
+		return ErrPageCorrupt{File: pager.GetFileName(), PageNum: page.pagenum}
+	}
+	return nil
+}
+
+// Get the additional data that a page is authenticated with.
+func pageAAD(pagenum int64) []byte {
+	aad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(aad, uint64(pagenum))
+	return aad
+}
+
+// Fill in the header fields that record how the file is encrypted.
+func (pager *Pager) writeEncryptionHeader(header []byte) {
+	if pager.aead == nil {
+		return
+	}
+	header[HEADER_CIPHER_OFFSET] = CIPHER_AES_GCM
+	keyCheck := header[HEADER_KEYCHECK_OFFSET : HEADER_KEYCHECK_OFFSET+HEADER_KEYCHECK_SIZE]
+	nonce := keyCheck[TAG_SIZE:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	pager.aead.Seal(keyCheck[:0], nonce, nil, MAGIC)
+}
+
+// Check the header's encryption fields against the pool's key.
+func (pager *Pager) readEncryptionHeader(header []byte) error {
+	aead := pager.pool.aead
+	switch header[HEADER_CIPHER_OFFSET] {
+	case CIPHER_NONE:
+		if aead != nil {
+			return errors.New("open: file is not encrypted, but an encryption key was given")
+		}
+		pager.aead = nil
+		return nil
+	case CIPHER_AES_GCM:
+		if aead == nil {
+			return errors.New("open: file is encrypted, but no encryption key was given")
+		}
+		keyCheck := header[HEADER_KEYCHECK_OFFSET : HEADER_KEYCHECK_OFFSET+HEADER_KEYCHECK_SIZE]
+		if _, err := aead.Open(nil, keyCheck[TAG_SIZE:], keyCheck[:TAG_SIZE], MAGIC); err != nil {
+			return errors.New("open: wrong encryption key")
+		}
+		pager.aead = aead
+		return nil
+	}
+	return fmt.Errorf("open: corrupted file header: unknown cipher %d", header[HEADER_CIPHER_OFFSET])
+}
@@ -0,0 +1,284 @@
+package pager
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// FaultyFS is a FileSystem for testing how the database copes with a failing
+// disk. Files live on the OS, but writes are held back in memory until their
+// file is synced, so that a simulated crash can drop them. It can also be told
+// to fail or tear upcoming writes, to fail upcoming syncs and to return short
+// reads. Every random choice is drawn from a seeded source, so a failure can be
+// reproduced by replaying the same operations with the same seed.
+type FaultyFS struct {
+	mtx        sync.Mutex
+	rand       *rand.Rand
+	inodes     map[string]*faultyInode // Unsynced writes, by file name.
+	epoch      int                     // Bumped by every crash; files opened before it are dead.
+	nWrites    int                     // The number of writes so far.
+	failAt     int                     // The write to fail, or 0.
+	tearAt     int                     // The write to tear, or 0.
+	tearOffset int                     // Where to tear it; negative picks an offset at random.
+	nSyncs     int                     // The number of syncs so far.
+	failSyncAt int                     // The sync to fail, or 0.
+	shortReads float64                 // The probability that a read comes back short.
+}
+
+// ErrInjectedFault is returned by writes that a FaultyFS was told to fail or tear.
+var ErrInjectedFault = errors.New("injected I/O fault")
+
+// ErrCrashed is returned by files that were open when a FaultyFS crashed.
+var ErrCrashed = errors.New("file was lost in a simulated crash")
+
+// The writes to a file that haven't been synced yet.
+type faultyInode struct {
+	pending []faultyWrite
+}
+
+// A write held back until its file is synced.
+type faultyWrite struct {
+	off  int64
+	data []byte
+}
+
+// A file opened on a FaultyFS.
+type faultyFile struct {
+	fs    *FaultyFS
+	inode *faultyInode
+	file  *os.File
+	epoch int // The crash epoch the file was opened in.
+}
+
+// NewFaultyFS returns a FaultyFS whose random choices are drawn from the given seed.
+func NewFaultyFS(seed int64) *FaultyFS {
+	return &FaultyFS{
+		rand:   rand.New(rand.NewSource(seed)),
+		inodes: make(map[string]*faultyInode),
+	}
+}
+
+// FailWrite makes the nth write from now fail without writing anything.
+func (fs *FaultyFS) FailWrite(n int) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.failAt = fs.nWrites + n
+}
+
+// TearWrite makes the nth write from now fail after only its first `offset`
+// bytes reach the disk, as if the power went out halfway through it. The torn
+// part survives a crash even though it was never synced. A negative offset
+// tears the write at a random offset.
+func (fs *FaultyFS) TearWrite(n int, offset int) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.tearAt = fs.nWrites + n
+	fs.tearOffset = offset
+}
+
+// FailSync makes the nth sync from now fail without making anything durable.
+func (fs *FaultyFS) FailSync(n int) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.failSyncAt = fs.nSyncs + n
+}
+
+// SetShortReads makes each read return fewer bytes than asked for with probability p.
+func (fs *FaultyFS) SetShortReads(p float64) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.shortReads = p
+}
+
+// GetNumWrites returns the number of writes made so far, failed ones included.
+func (fs *FaultyFS) GetNumWrites() int {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	return fs.nWrites
+}
+
+// Crash simulates a power failure: every write that wasn't synced is lost,
+// files that were open fail with ErrCrashed from now on, and pending faults
+// are cancelled. Open files should still be closed. Files opened afterwards
+// see what made it to disk.
+func (fs *FaultyFS) Crash() {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.epoch++
+	fs.inodes = make(map[string]*faultyInode)
+	fs.failAt, fs.tearAt, fs.failSyncAt = 0, 0, 0
+}
+
+// OpenFile opens the named file, creating it if it doesn't exist. Faulty files never use direct I/O.
+func (fs *FaultyFS) OpenFile(name string, direct bool) (Storage, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	inode, ok := fs.inodes[name]
+	if !ok {
+		inode = &faultyInode{}
+		fs.inodes[name] = inode
+	}
+	return &faultyFile{fs: fs, inode: inode, file: file, epoch: fs.epoch}, nil
+}
+
+// Remove removes the named file along with its unsynced writes.
+func (fs *FaultyFS) Remove(name string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	delete(fs.inodes, name)
+	return os.Remove(name)
+}
+
+// Rename renames a file along with its unsynced writes.
+func (fs *FaultyFS) Rename(oldname, newname string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if err := os.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if inode, ok := fs.inodes[oldname]; ok {
+		fs.inodes[newname] = inode
+		delete(fs.inodes, oldname)
+	} else {
+		delete(fs.inodes, newname)
+	}
+	return nil
+}
+
+func (f *faultyFile) Name() string {
+	return f.file.Name()
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	fs := f.fs
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if f.epoch != fs.epoch {
+		return 0, ErrCrashed
+	}
+	fs.nWrites++
+	n := len(p)
+	switch fs.nWrites {
+	case fs.failAt:
+		return 0, ErrInjectedFault
+	case fs.tearAt:
+		n = fs.tearOffset
+		if n < 0 {
+			n = fs.rand.Intn(len(p) + 1)
+		} else if n > len(p) {
+			n = len(p)
+		}
+		// The start of a torn write reaches the disk before the rest is lost.
+		if _, err := f.file.WriteAt(p[:n], off); err != nil {
+			return 0, err
+		}
+	}
+	data := make([]byte, n)
+	copy(data, p)
+	f.inode.pending = append(f.inode.pending, faultyWrite{off: off, data: data})
+	if n < len(p) {
+		return n, ErrInjectedFault
+	}
+	return n, nil
+}
+
+func (f *faultyFile) ReadAt(p []byte, off int64) (int, error) {
+	fs := f.fs
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if f.epoch != fs.epoch {
+		return 0, ErrCrashed
+	}
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	// Read what's on disk, then lay the unsynced writes over it in order.
+	for i := range p {
+		p[i] = 0
+	}
+	if _, err := f.file.ReadAt(p, off); err != nil && err != io.EOF {
+		return 0, err
+	}
+	end := off + int64(len(p))
+	for _, w := range f.inode.pending {
+		lo, hi := w.off, w.off+int64(len(w.data))
+		if lo < off {
+			lo = off
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo < hi {
+			copy(p[lo-off:hi-off], w.data[lo-w.off:hi-w.off])
+		}
+	}
+	n, err := len(p), error(nil)
+	if end > size {
+		n, err = 0, io.EOF
+		if size > off {
+			n = int(size - off)
+		}
+	}
+	if n > 0 && fs.shortReads > 0 && fs.rand.Float64() < fs.shortReads {
+		n, err = fs.rand.Intn(n), io.ErrUnexpectedEOF
+		// Callers that ignore the error see a damaged buffer.
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+	}
+	return n, err
+}
+
+func (f *faultyFile) Size() (int64, error) {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if f.epoch != f.fs.epoch {
+		return 0, ErrCrashed
+	}
+	return f.size()
+}
+
+// Get the size of the file, counting unsynced writes. The fs mtx should be locked on entry.
+func (f *faultyFile) size() (int64, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	for _, w := range f.inode.pending {
+		if end := w.off + int64(len(w.data)); end > size {
+			size = end
+		}
+	}
+	return size, nil
+}
+
+func (f *faultyFile) Sync() error {
+	f.fs.mtx.Lock()
+	defer f.fs.mtx.Unlock()
+	if f.epoch != f.fs.epoch {
+		return ErrCrashed
+	}
+	if f.fs.nSyncs++; f.fs.nSyncs == f.fs.failSyncAt {
+		return ErrInjectedFault
+	}
+	for _, w := range f.inode.pending {
+		if _, err := f.file.WriteAt(w.data, w.off); err != nil {
+			return err
+		}
+	}
+	f.inode.pending = nil
+	return f.file.Sync()
+}
+
+func (f *faultyFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,175 @@
+package pager
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+
+	directio "github.com/ncw/directio"
+)
+
+// FlusherOptions configure a buffer pool's background flusher.
+type FlusherOptions struct {
+	Interval  time.Duration // How often the dirty ratio is checked.
+	HighWater float64       // Start writing back once this fraction of frames hold dirty unpinned pages.
+	LowWater  float64       // Stop writing back once the fraction drops to this.
+}
+
+// Default flusher options.
+var DefaultFlusherOptions = FlusherOptions{
+	Interval:  100 * time.Millisecond,
+	HighWater: 0.25,
+	LowWater:  0.1,
+}
+
+// The background flusher writes cold dirty unpinned pages back to disk ahead
+// of eviction, so that evicting them later doesn't require a write. Pages are
+// written outside the ptMtx; while a page is being written it can't be evicted.
+type flusher struct {
+	opts FlusherOptions
+	kick chan struct{} // Wakes the flusher up early.
+	stop chan struct{} // Closed to stop the flusher.
+	done chan struct{} // Closed once the flusher has stopped.
+	buf  []byte        // Aligned buffer that page images are copied into.
+}
+
+// StartFlusher starts the pool's background flusher.
+func (pool *BufferPool) StartFlusher(opts FlusherOptions) error {
+	if opts.Interval <= 0 {
+		return errors.New("flusher interval must be positive")
+	}
+	if opts.HighWater <= 0 || opts.HighWater > 1 || opts.LowWater < 0 || opts.LowWater > opts.HighWater {
+		return errors.New("flusher watermarks must satisfy 0 <= low <= high <= 1 and high > 0")
+	}
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	if pool.flusher != nil {
+		return errors.New("flusher is already running")
+	}
+	f := &flusher{
+		opts: opts,
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		buf:  directio.AlignedBlock(int(pool.frameSize)),
+	}
+	pool.flusher = f
+	go pool.runFlusher(f)
+	return nil
+}
+
+// StopFlusher stops the pool's background flusher, waiting for any write in progress.
+func (pool *BufferPool) StopFlusher() {
+	pool.ptMtx.Lock()
+	f := pool.flusher
+	pool.flusher = nil
+	pool.ptMtx.Unlock()
+	if f != nil {
+		close(f.stop)
+		<-f.done
+	}
+}
+
+// Wake the flusher up early. The ptMtx should be locked on entry.
+func (pool *BufferPool) kickFlusher() {
+	if pool.flusher == nil {
+		return
+	}
+	select {
+	case pool.flusher.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Flusher loop: write pages back whenever the dirty ratio crosses the high-water mark.
+func (pool *BufferPool) runFlusher(f *flusher) {
+	defer close(f.done)
+	ticker := time.NewTicker(f.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		case <-f.kick:
+		}
+		if pool.dirtyRatio() < f.opts.HighWater {
+			continue
+		}
+		for pool.dirtyRatio() > f.opts.LowWater {
+			select {
+			case <-f.stop:
+				return
+			default:
+			}
+			if !pool.writeBackOne(f.buf) {
+				break
+			}
+		}
+	}
+}
+
+// Get the fraction of frames that hold dirty unpinned pages.
+func (pool *BufferPool) dirtyRatio() float64 {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	nDirty := 0
+	pool.unpinnedList.Map(func(link *list.Link) {
+		if link.GetKey().(*Page).dirty {
+			nDirty++
+		}
+	})
+	return float64(nDirty) / float64(pool.nFrames)
+}
+
+// Write back the coldest dirty unpinned page. Returns false if there was none.
+func (pool *BufferPool) writeBackOne(buf []byte) bool {
+	pool.ptMtx.Lock()
+	// Unpinned pages are kept in the order they were released, coldest first.
+	var page *Page
+	for link := pool.unpinnedList.PeekHead(); link != nil; link = link.GetNext() {
+		candidate := link.GetKey().(*Page)
+		if candidate.dirty && candidate.pager.HasFile() && !candidate.pager.closing && !pool.inflight[candidate.key()] {
+			page = candidate
+			break
+		}
+	}
+	if page == nil {
+		pool.ptMtx.Unlock()
+		return false
+	}
+	// Take a copy of the page and keep it from being evicted while it is written.
+	pager, key := page.pager, page.key()
+	image := buf[:pager.pageSize]
+	copy(image, page.seal())
+	page.dirty = false
+	pool.policy.Pin(page)
+	pool.inflight[key] = true
+	// Writes through a double-write side file are synced already.
+	sync := pool.syncMode == SYNC_FLUSH && pager.dwb == nil
+	pool.ptMtx.Unlock()
+
+	err := pager.writeImages([]int64{key.pagenum}, [][]byte{image})
+	if err == nil && sync {
+		err = pager.file.Sync()
+	}
+
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	delete(pool.inflight, key)
+	pool.ioDone.Broadcast()
+	if link, ok := pager.pageTable[key.pagenum]; ok && link.GetKey() == page {
+		if err != nil {
+			page.dirty = true
+		}
+		if link.GetList() == pool.unpinnedList {
+			pool.policy.Unpin(page)
+		}
+	}
+	if err == nil {
+		atomic.AddInt64(&pager.counters.dirtyFlushes, 1)
+	}
+	return err == nil
+}
@@ -0,0 +1,211 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Freed pages are kept on an on-disk freelist so that they can be reused.
+// The file header records the first freelist trunk page and the number of
+// free pages. Each trunk page holds the page number of the next trunk, a
+// count, and that many free page numbers. Once a trunk runs empty, the trunk
+// page itself is handed out. A page handed out from the freelist is dropped
+// from the cache, and reads back zeroed on its next GetPage even if something
+// cached it again in between.
+//
+// The recovery log doesn't record freelist changes: trunk pages and the
+// header reach disk as pages are flushed, and a checkpoint flushes them along
+// with everything else. A crash between checkpoints can leave the freelist
+// out of step with the pages that are in use, so recovery isn't guaranteed to
+// leave a consistent freelist; vacuuming a table rebuilds its file, and its
+// freelist, from scratch.
+
+// Freelist trunk page layout.
+var FREELIST_NEXT_OFFSET int64 = 0
+var FREELIST_NEXT_SIZE int64 = binary.MaxVarintLen64
+var FREELIST_COUNT_OFFSET int64 = FREELIST_NEXT_OFFSET + FREELIST_NEXT_SIZE
+var FREELIST_COUNT_SIZE int64 = binary.MaxVarintLen64
+var FREELIST_PNS_OFFSET int64 = FREELIST_COUNT_OFFSET + FREELIST_COUNT_SIZE
+var FREELIST_PN_SIZE int64 = binary.MaxVarintLen64
+
+// GetNumFreePages returns the number of pages on the freelist.
+func (pager *Pager) GetNumFreePages() int64 {
+	pager.freeMtx.Lock()
+	defer pager.freeMtx.Unlock()
+	return pager.nFree
+}
+
+// GetFreePN returns a page number that is not in use, preferring pages from
+// the freelist over growing the file. The page reads back zeroed on its next GetPage.
+func (pager *Pager) GetFreePN() int64 {
+	pager.freeMtx.Lock()
+	defer pager.freeMtx.Unlock()
+	pagenum, err := pager.popFreePN()
+	pool := pager.pool
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	if err != nil || pagenum == NOPAGE {
+		// Assign the first page number beyond the end of the file.
+		pagenum = pager.nPages
+		pager.nPages++
+	}
+	pager.fresh[pagenum] = true
+	return pagenum
+}
+
+// FreePage puts a page that is no longer in use on the freelist.
+// Its cached contents are discarded without being written back. A page that
+// is still pinned is freed once its last pin is released.
+func (pager *Pager) FreePage(pagenum int64) error {
+	if pagenum < 0 || pagenum >= pager.GetNumPages() {
+		return errors.New("invalid pagenum")
+	}
+	pager.freeMtx.Lock()
+	defer pager.freeMtx.Unlock()
+	if err := pager.discardPage(pagenum, true); err == errPagePinned {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Record the page in the head trunk if it has room.
+	head := pager.freeHead
+	if head != NOPAGE {
+		trunk, err := pager.GetPage(head)
+		if err != nil {
+			return err
+		}
+		defer trunk.Put()
+		count := getTrunkCount(trunk)
+		if FREELIST_PNS_OFFSET+(count+1)*FREELIST_PN_SIZE <= int64(len(*trunk.GetData())) {
+			setTrunkPN(trunk, count, pagenum)
+			setTrunkCount(trunk, count+1)
+			pager.setFreelist(head, pager.nFree+1)
+			return nil
+		}
+	}
+	// Otherwise, the freed page becomes the new head trunk.
+	pager.markFresh(pagenum)
+	trunk, err := pager.GetPage(pagenum)
+	if err != nil {
+		return err
+	}
+	defer trunk.Put()
+	setTrunkNext(trunk, head)
+	setTrunkCount(trunk, 0)
+	pager.setFreelist(pagenum, pager.nFree+1)
+	return nil
+}
+
+// Take a page number off the freelist, or return NOPAGE if it is empty.
+// The freeMtx should be locked on entry.
+func (pager *Pager) popFreePN() (int64, error) {
+	head := pager.freeHead
+	if head == NOPAGE {
+		return NOPAGE, nil
+	}
+	trunk, err := pager.GetPage(head)
+	if err != nil {
+		return NOPAGE, err
+	}
+	count := getTrunkCount(trunk)
+	if count > 0 {
+		pagenum := getTrunkPN(trunk, count-1)
+		if err := pager.discardPage(pagenum, false); err != nil {
+			trunk.Put()
+			return NOPAGE, err
+		}
+		setTrunkCount(trunk, count-1)
+		trunk.Put()
+		pager.setFreelist(head, pager.nFree-1)
+		return pagenum, nil
+	}
+	// The head trunk is empty; hand out the trunk page itself.
+	next := getTrunkNext(trunk)
+	trunk.Put()
+	if err := pager.discardPage(head, false); err != nil {
+		return NOPAGE, err
+	}
+	pager.setFreelist(next, pager.nFree-1)
+	return head, nil
+}
+
+// Update the freelist fields of the file header.
+func (pager *Pager) setFreelist(head int64, nFree int64) {
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
+	pager.freeHead = head
+	pager.nFree = nFree
+	pager.headerDirty = true
+}
+
+// Mark a page so that it reads back zeroed on its next GetPage.
+func (pager *Pager) markFresh(pagenum int64) {
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
+	pager.fresh[pagenum] = true
+}
+
+// Returned when discarding a page that is pinned.
+var errPagePinned = errors.New("cannot free a pinned page")
+
+// Drop a page from the cache without writing it back. If the page is pinned,
+// it is left alone, and if freeLater is set, it is freed once it is unpinned.
+func (pager *Pager) discardPage(pagenum int64, freeLater bool) error {
+	pool := pager.pool
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	key := pageKey{pager: pager, pagenum: pagenum}
+	pool.waitForIO(func(k pageKey) bool { return k == key })
+	link, ok := pager.pageTable[pagenum]
+	if !ok {
+		return nil
+	}
+	if link.GetList() == pool.pinnedList {
+		if freeLater {
+			pager.freeLater[pagenum] = true
+		}
+		return errPagePinned
+	}
+	pool.releaseFrame(link.GetKey().(*Page))
+	return nil
+}
+
+// Get the next trunk page number.
+func getTrunkNext(trunk *Page) int64 {
+	next, _ := binary.Varint((*trunk.data)[FREELIST_NEXT_OFFSET : FREELIST_NEXT_OFFSET+FREELIST_NEXT_SIZE])
+	return next
+}
+
+// Set the next trunk page number.
+func setTrunkNext(trunk *Page, next int64) {
+	data := make([]byte, FREELIST_NEXT_SIZE)
+	binary.PutVarint(data, next)
+	trunk.Update(data, FREELIST_NEXT_OFFSET, FREELIST_NEXT_SIZE)
+}
+
+// Get the number of free page numbers held by the trunk.
+func getTrunkCount(trunk *Page) int64 {
+	count, _ := binary.Varint((*trunk.data)[FREELIST_COUNT_OFFSET : FREELIST_COUNT_OFFSET+FREELIST_COUNT_SIZE])
+	return count
+}
+
+// Set the number of free page numbers held by the trunk.
+func setTrunkCount(trunk *Page, count int64) {
+	data := make([]byte, FREELIST_COUNT_SIZE)
+	binary.PutVarint(data, count)
+	trunk.Update(data, FREELIST_COUNT_OFFSET, FREELIST_COUNT_SIZE)
+}
+
+// Get the free page number at the given index of the trunk.
+func getTrunkPN(trunk *Page, index int64) int64 {
+	pos := FREELIST_PNS_OFFSET + index*FREELIST_PN_SIZE
+	pagenum, _ := binary.Varint((*trunk.data)[pos : pos+FREELIST_PN_SIZE])
+	return pagenum
+}
+
+// Set the free page number at the given index of the trunk.
+func setTrunkPN(trunk *Page, index int64, pagenum int64) {
+	data := make([]byte, FREELIST_PN_SIZE)
+	binary.PutVarint(data, pagenum)
+	trunk.Update(data, FREELIST_PNS_OFFSET+index*FREELIST_PN_SIZE, FREELIST_PN_SIZE)
+}
@@ -0,0 +1,367 @@
+package pager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+
+	directio "github.com/ncw/directio"
+)
+
+// Every file managed by a pager starts with a header block that records how
+// the rest of the file is laid out and what it holds. Page n lives at
+// HEADERSIZE + n*pageSize, so page numbers (and the B+Tree's ROOT_PN) are
+// unaffected by the header.
+const HEADERSIZE = int64(directio.BlockSize)
+
+// Magic bytes identifying a pager file.
+var MAGIC = []byte("BUMBLEDB")
+
+// Files written before pagers kept a header hold pages of PAGESIZE bytes from
+// the start of the file, with no trailer. Nothing in such a file tells it
+// apart from a foreign one, so it is only given a header when it is opened on
+// a pool that was asked to add headers; otherwise it is refused like any other
+// file without one. To give it a header, its pages are copied after a header
+// into a new file, which is then renamed over the old one. Those pages never
+// use their last bytes, so each is sealed with a checksum there. The header
+// records format version 0, as for files written before the version was
+// recorded, so that the index in the file is then upgraded like theirs.
+
+// Suffix of a file without a header that is being given one.
+const HEADERLESS_SUFFIX = ".header"
+
+// The current file format version. Files with a newer version can't be opened.
+// Version 2 added left sibling links to B+tree leaves, version 3 made B+tree
+// nodes slotted pages of variable-length keys and values, version 4 moved
+// large values out to overflow pages, and version 5 made B+tree node fields
+// fixed-width. B+trees with duplicate keys share the current node layout, and
+// are told apart by their index type instead. So are B+trees with compressed
+// keys, whose internal nodes may have a layout of their own: readers that
+// predate them refuse their index type. The node that guards a B+tree's root
+// lives only in memory, so it didn't change the version either. Nor did the
+// header checksum: headers written before it was recorded hold zero there, and
+// are read unchecked.
+const FORMAT_VERSION int64 = 5
+
+// Header layout.
+var HEADER_MAGIC_OFFSET int64 = 0
+var HEADER_MAGIC_SIZE int64 = int64(len(MAGIC))
+var HEADER_PAGESIZE_OFFSET int64 = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+var HEADER_PAGESIZE_SIZE int64 = binary.MaxVarintLen64
+var HEADER_FREELIST_HEAD_OFFSET int64 = HEADER_PAGESIZE_OFFSET + HEADER_PAGESIZE_SIZE
+var HEADER_FREELIST_HEAD_SIZE int64 = binary.MaxVarintLen64
+var HEADER_FREELIST_COUNT_OFFSET int64 = HEADER_FREELIST_HEAD_OFFSET + HEADER_FREELIST_HEAD_SIZE
+var HEADER_FREELIST_COUNT_SIZE int64 = binary.MaxVarintLen64
+var HEADER_CIPHER_OFFSET int64 = HEADER_FREELIST_COUNT_OFFSET + HEADER_FREELIST_COUNT_SIZE
+var HEADER_CIPHER_SIZE int64 = 1
+var HEADER_KEYCHECK_OFFSET int64 = HEADER_CIPHER_OFFSET + HEADER_CIPHER_SIZE
+var HEADER_KEYCHECK_SIZE int64 = ENCRYPTION_TRAILER_SIZE
+var HEADER_VERSION_OFFSET int64 = HEADER_KEYCHECK_OFFSET + HEADER_KEYCHECK_SIZE
+var HEADER_VERSION_SIZE int64 = binary.MaxVarintLen64
+var HEADER_INDEX_TYPE_OFFSET int64 = HEADER_VERSION_OFFSET + HEADER_VERSION_SIZE
+var HEADER_INDEX_TYPE_SIZE int64 = binary.MaxVarintLen64
+var HEADER_HASH_FUNC_OFFSET int64 = HEADER_INDEX_TYPE_OFFSET + HEADER_INDEX_TYPE_SIZE
+var HEADER_HASH_FUNC_SIZE int64 = binary.MaxVarintLen64
+var HEADER_CTIME_OFFSET int64 = HEADER_HASH_FUNC_OFFSET + HEADER_HASH_FUNC_SIZE
+var HEADER_CTIME_SIZE int64 = binary.MaxVarintLen64
+var HEADER_CHECKSUM_OFFSET int64 = HEADER_CTIME_OFFSET + HEADER_CTIME_SIZE
+var HEADER_CHECKSUM_SIZE int64 = CHECKSUM_SIZE
+
+// Ciphers that pages can be encrypted with.
+const (
+	CIPHER_NONE    byte = 0
+	CIPHER_AES_GCM byte = 1
+)
+
+// Kinds of index a file can hold. Files written before the index type was
+// recorded have INDEX_NONE.
+const (
+	INDEX_NONE                        int64 = 0
+	INDEX_BTREE                       int64 = 1
+	INDEX_HASH                        int64 = 2
+	INDEX_HASH_META                   int64 = 3 // The directory of a hash index.
+	INDEX_BTREE_DUPLICATES            int64 = 4 // A B+tree whose entries may share keys.
+	INDEX_BTREE_COMPRESSED            int64 = 5 // A B+tree whose internal nodes compress their keys.
+	INDEX_BTREE_DUPLICATES_COMPRESSED int64 = 6 // A B+tree with both of the above.
+)
+
+// Hash functions that hash indexes can be built with.
+const (
+	HASH_NONE    int64 = 0
+	HASH_XXHASH  int64 = 1
+	HASH_MURMUR3 int64 = 2
+)
+
+var indexTypeNames = map[int64]string{
+	INDEX_NONE:                        "unknown index",
+	INDEX_BTREE:                       "B+tree",
+	INDEX_HASH:                        "hash index",
+	INDEX_HASH_META:                   "hash index directory",
+	INDEX_BTREE_DUPLICATES:            "B+tree with duplicate keys",
+	INDEX_BTREE_COMPRESSED:            "B+tree with compressed keys",
+	INDEX_BTREE_DUPLICATES_COMPRESSED: "B+tree with duplicate, compressed keys",
+}
+
+var hashFuncNames = map[int64]string{
+	HASH_NONE:    "no hash function",
+	HASH_XXHASH:  "xxHash",
+	HASH_MURMUR3: "MurmurHash3",
+}
+
+// FileInfo describes a pager file, as recorded in its header.
+type FileInfo struct {
+	Version    int64     // Format version the file was written with.
+	PageSize   int64     // Size of the file's pages.
+	Encrypted  bool      // Whether the file's pages are encrypted.
+	IndexType  int64     // The kind of index the file holds.
+	HashFunc   int64     // The hash function of a hash index.
+	Created    time.Time // When the file was created.
+	Headerless bool      // Whether the file may have been written before pagers kept a header.
+}
+
+// IndexTypeName returns a readable name for an index type.
+func IndexTypeName(indexType int64) string {
+	if name, ok := indexTypeNames[indexType]; ok {
+		return name
+	}
+	return fmt.Sprintf("index of type %d", indexType)
+}
+
+// HashFuncName returns a readable name for a hash function.
+func HashFuncName(hashFunc int64) string {
+	if name, ok := hashFuncNames[hashFunc]; ok {
+		return name
+	}
+	return fmt.Sprintf("hash function %d", hashFunc)
+}
+
+// ReadFileInfo reads the header of the given file without opening it as a pager.
+// An empty file has no header yet and is described by the zero FileInfo.
+func ReadFileInfo(filename string) (FileInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if stat.Size() == 0 {
+		return FileInfo{}, nil
+	}
+	header := make([]byte, HEADERSIZE)
+	n, err := file.ReadAt(header, 0)
+	if isHeaderless(header[:n], stat.Size()) {
+		return FileInfo{PageSize: PAGESIZE, Headerless: true}, nil
+	}
+	if stat.Size() < HEADERSIZE {
+		return FileInfo{}, errors.New("open: not a database file (missing header)")
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return decodeFileInfo(header)
+}
+
+// Check whether a file of the given size that starts with the given bytes may
+// have been written before pagers kept a header.
+func isHeaderless(start []byte, size int64) bool {
+	return size > 0 && size%PAGESIZE == 0 && !bytes.HasPrefix(start, MAGIC)
+}
+
+// SetAddHeaders sets whether files opened on this pool that may have been
+// written before pagers kept a header are given one. Such files are refused
+// otherwise.
+func (pool *BufferPool) SetAddHeaders(enabled bool) {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	pool.addHeaders = enabled
+}
+
+// GetFileInfo describes the pager's file.
+func (pager *Pager) GetFileInfo() FileInfo {
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
+	info := pager.info
+	info.PageSize = pager.pageSize
+	info.Encrypted = pager.aead != nil
+	return info
+}
+
+// CheckIndexType records the kind of index and hash function of a new file,
+// or checks that an existing file holds that kind of index built with that
+// hash function. Files written before the index type was recorded adopt it.
+func (pager *Pager) CheckIndexType(indexType int64, hashFunc int64) error {
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
+	if pager.info.IndexType == INDEX_NONE {
+		pager.info.IndexType = indexType
+		pager.info.HashFunc = hashFunc
+		pager.headerDirty = true
+		return nil
+	}
+	if pager.info.IndexType != indexType {
+		return fmt.Errorf("open: %s holds a %s, not a %s",
+			pager.GetFileName(), IndexTypeName(pager.info.IndexType), IndexTypeName(indexType))
+	}
+	if pager.info.HashFunc != hashFunc {
+		return fmt.Errorf("open: %s is hashed with %s, but only %s is supported",
+			pager.GetFileName(), HashFuncName(pager.info.HashFunc), HashFuncName(hashFunc))
+	}
+	return nil
+}
+
+// ValidatePageSize checks that pages of the given size can be read and written with direct I/O.
+func ValidatePageSize(pageSize int64) error {
+	if pageSize < PAGESIZE || pageSize%PAGESIZE != 0 {
+		return fmt.Errorf("invalid page size %d: must be a positive multiple of %d", pageSize, PAGESIZE)
+	}
+	return nil
+}
+
+// Get the offset of the given page in the file.
+func (pager *Pager) pageOffset(pagenum int64) int64 {
+	return HEADERSIZE + pagenum*pager.pageSize
+}
+
+// Write the file header for this pager's page size, freelist and encryption.
+func (pager *Pager) writeHeader() error {
+	header := directio.AlignedBlock(int(HEADERSIZE))
+	copy(header[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE], MAGIC)
+	binary.PutVarint(header[HEADER_PAGESIZE_OFFSET:HEADER_PAGESIZE_OFFSET+HEADER_PAGESIZE_SIZE], pager.pageSize)
+	binary.PutVarint(header[HEADER_FREELIST_HEAD_OFFSET:HEADER_FREELIST_HEAD_OFFSET+HEADER_FREELIST_HEAD_SIZE], pager.freeHead)
+	binary.PutVarint(header[HEADER_FREELIST_COUNT_OFFSET:HEADER_FREELIST_COUNT_OFFSET+HEADER_FREELIST_COUNT_SIZE], pager.nFree)
+	binary.PutVarint(header[HEADER_VERSION_OFFSET:HEADER_VERSION_OFFSET+HEADER_VERSION_SIZE], pager.info.Version)
+	binary.PutVarint(header[HEADER_INDEX_TYPE_OFFSET:HEADER_INDEX_TYPE_OFFSET+HEADER_INDEX_TYPE_SIZE], pager.info.IndexType)
+	binary.PutVarint(header[HEADER_HASH_FUNC_OFFSET:HEADER_HASH_FUNC_OFFSET+HEADER_HASH_FUNC_SIZE], pager.info.HashFunc)
+	if !pager.info.Created.IsZero() {
+		binary.PutVarint(header[HEADER_CTIME_OFFSET:HEADER_CTIME_OFFSET+HEADER_CTIME_SIZE], pager.info.Created.UnixNano())
+	}
+	pager.writeEncryptionHeader(header)
+	binary.LittleEndian.PutUint32(header[HEADER_CHECKSUM_OFFSET:], headerChecksum(header))
+	err := pager.writeImages([]int64{DWB_HEADER_PN}, [][]byte{header})
+	if err == nil {
+		pager.headerDirty = false
+	}
+	return err
+}
+
+// Write the file header if it has changed since it was last written.
+// The ptMtx should be locked on entry.
+func (pager *Pager) flushHeader() error {
+	if !pager.HasFile() || !pager.headerDirty {
+		return nil
+	}
+	return pager.writeHeader()
+}
+
+// Give the pager's file, of the given size and written before pagers kept a
+// header, a header. The pager is left with the new file open. The file is
+// left untouched if any of its pages uses its last bytes.
+func (pager *Pager) addHeader(size int64) (err error) {
+	fs := pager.pool.fs
+	filename := pager.file.Name()
+	building := filename + HEADERLESS_SUFFIX
+	fs.Remove(building)
+	old := pager.file
+	if pager.file, err = fs.OpenFile(building, true); err != nil {
+		pager.file = old
+		return err
+	}
+	pager.pageSize = PAGESIZE
+	pager.aead = nil
+	pager.info = FileInfo{}
+	pager.freeHead = NOPAGE
+	pager.nFree = 0
+	err = pager.writeHeader()
+	image := directio.AlignedBlock(int(PAGESIZE))
+	unused := make([]byte, CHECKSUM_SIZE)
+	for pagenum := int64(0); err == nil && pagenum < size/PAGESIZE; pagenum++ {
+		if _, err = old.ReadAt(image, pagenum*PAGESIZE); err != nil {
+			break
+		}
+		// A page that uses its last bytes wasn't written by a pager.
+		if !bytes.Equal(image[PAGESIZE-CHECKSUM_SIZE:], unused) {
+			err = errors.New("open: not a database file (bad magic bytes)")
+			break
+		}
+		sealImage(image)
+		_, err = pager.file.WriteAt(image, pager.pageOffset(pagenum))
+	}
+	if err == nil {
+		err = pager.file.Sync()
+	}
+	if closeErr := pager.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		pager.file = old
+		fs.Remove(building)
+		return err
+	}
+	old.Close()
+	if err = fs.Rename(building, filename); err != nil {
+		return err
+	}
+	pager.file, err = fs.OpenFile(filename, true)
+	return err
+}
+
+// Read the file header and adopt the page size, freelist and encryption it records.
+func (pager *Pager) readHeader() error {
+	header := directio.AlignedBlock(int(HEADERSIZE))
+	if _, err := pager.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	info, err := decodeFileInfo(header)
+	if err != nil {
+		return err
+	}
+	pager.info = info
+	pager.pageSize = info.PageSize
+	pager.freeHead, _ = binary.Varint(header[HEADER_FREELIST_HEAD_OFFSET : HEADER_FREELIST_HEAD_OFFSET+HEADER_FREELIST_HEAD_SIZE])
+	pager.nFree, _ = binary.Varint(header[HEADER_FREELIST_COUNT_OFFSET : HEADER_FREELIST_COUNT_OFFSET+HEADER_FREELIST_COUNT_SIZE])
+	return pager.readEncryptionHeader(header)
+}
+
+// Decode the description of a file from its header, checking that it can be opened.
+func decodeFileInfo(header []byte) (info FileInfo, err error) {
+	if !bytes.Equal(header[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE], MAGIC) {
+		return info, errors.New("open: not a database file (bad magic bytes)")
+	}
+	if sum := binary.LittleEndian.Uint32(header[HEADER_CHECKSUM_OFFSET:]); sum != 0 && sum != headerChecksum(header) {
+		return info, errors.New("open: corrupted file header (checksum mismatch)")
+	}
+	info.Version, _ = binary.Varint(header[HEADER_VERSION_OFFSET : HEADER_VERSION_OFFSET+HEADER_VERSION_SIZE])
+	if info.Version > FORMAT_VERSION {
+		return info, fmt.Errorf("open: file format version %d is newer than the supported version %d", info.Version, FORMAT_VERSION)
+	}
+	info.PageSize, _ = binary.Varint(header[HEADER_PAGESIZE_OFFSET : HEADER_PAGESIZE_OFFSET+HEADER_PAGESIZE_SIZE])
+	if err := ValidatePageSize(info.PageSize); err != nil {
+		return info, fmt.Errorf("open: corrupted file header: %v", err)
+	}
+	info.Encrypted = header[HEADER_CIPHER_OFFSET] != CIPHER_NONE
+	info.IndexType, _ = binary.Varint(header[HEADER_INDEX_TYPE_OFFSET : HEADER_INDEX_TYPE_OFFSET+HEADER_INDEX_TYPE_SIZE])
+	info.HashFunc, _ = binary.Varint(header[HEADER_HASH_FUNC_OFFSET : HEADER_HASH_FUNC_OFFSET+HEADER_HASH_FUNC_SIZE])
+	ctime, _ := binary.Varint(header[HEADER_CTIME_OFFSET : HEADER_CTIME_OFFSET+HEADER_CTIME_SIZE])
+	if ctime != 0 {
+		info.Created = time.Unix(0, ctime)
+	}
+	return info, nil
+}
+
+// Compute the checksum of the header fields that precede it.
+func headerChecksum(header []byte) uint32 {
+	return crc32.Checksum(header[:HEADER_CHECKSUM_OFFSET], crcTable)
+}
+
+// Check whether the header was written whole, with its checksum.
+func headerIntact(header []byte) bool {
+	return bytes.Equal(header[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE], MAGIC) &&
+		binary.LittleEndian.Uint32(header[HEADER_CHECKSUM_OFFSET:]) == headerChecksum(header)
+}
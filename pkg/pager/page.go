@@ -11,13 +11,15 @@ const NOPAGE = -1
 
 // A page is a unit that is read from and written to disk.
 type Page struct {
+	version    uint64       // Bumped when the page is write-locked and unlocked; first, to be 64-bit aligned.
 	pager      *Pager       // Pointer to the pager that this page belongs to.
 	pagenum    int64        // Position of the page in the file.
 	pinCount   int64        // The number of active references to this page.
 	dirty      bool         // Flag on whether data has to be written back.
 	rwlock     sync.RWMutex // Readers-writers lock on the page itself
 	updateLock sync.Mutex   // Mutex for updating data in a page
-	data       *[]byte      // Serialized data.
+	frame      []byte       // The buffer pool frame backing this page.
+	data       *[]byte      // Serialized data; the start of the frame, up to the page's checksum trailer.
 }
 
 // Get the pager.
@@ -45,26 +47,52 @@ func (page *Page) GetData() *[]byte {
 	return page.data
 }
 
+// Zero out the page's data.
+func (page *Page) clear() {
+	data := *page.data
+	for i := range data {
+		data[i] = 0
+	}
+}
+
 // Increment the pincount.
 func (page *Page) Get() {
 	atomic.AddInt64(&page.pinCount, 1)
+	if pins := page.pager.pool.pins; pins != nil {
+		pins.pin(page, 1)
+	}
 }
 
 // Release a reference to the page.
 func (page *Page) Put() {
 	pager := page.pager
-	pager.ptMtx.Lock()
+	pool := pager.pool
+	pool.ptMtx.Lock()
 	ret := atomic.AddInt64(&page.pinCount, -1)
+	pagenum := page.pagenum
+	free := false
 	// Check if we can unpin this page; if so, move from pinned to unpinned list.
 	if ret == 0 {
-		link := pager.pageTable[page.pagenum]
+		link := pager.pageTable[pagenum]
 		link.PopSelf()
-		newLink := pager.unpinnedList.PushTail(page)
-		pager.pageTable[page.pagenum] = newLink
+		newLink := pool.unpinnedList.PushTail(page)
+		pager.pageTable[pagenum] = newLink
+		pool.policy.Unpin(page)
+		free = pager.freeLater[pagenum]
+		delete(pager.freeLater, pagenum)
 	}
-	page.pager.ptMtx.Unlock()
+	pins := pool.pins
+	pool.ptMtx.Unlock()
 	if ret < 0 {
 		fmt.Println("ERROR: pinCount for page is < 0")
+	} else if pins != nil {
+		pins.unpin(page, 1)
+	}
+	// Free the page if that was put off until it was unpinned.
+	if free {
+		if err := pager.FreePage(pagenum); err != nil {
+			fmt.Println("ERROR: failed to free page:", err)
+		}
 	}
 }
 
@@ -79,13 +107,21 @@ func (page *Page) Update(data []byte, offset int64, size int64) {
 // [CONCURRENCY] Grab a writers lock on the page.
 func (page *Page) WLock() {
 	page.rwlock.Lock()
+	atomic.AddUint64(&page.version, 1)
 }
 
 // [CONCURRENCY] Release a writers lock.
 func (page *Page) WUnlock() {
+	atomic.AddUint64(&page.version, 1)
 	page.rwlock.Unlock()
 }
 
+// [CONCURRENCY] Get the page's version, which is odd while it's write-locked.
+// A page whose version hasn't changed hasn't been write-locked in between.
+func (page *Page) GetVersion() uint64 {
+	return atomic.LoadUint64(&page.version)
+}
+
 // [CONCURRENCY] Grab a readers lock on the page.
 func (page *Page) RLock() {
 	page.rwlock.RLock()
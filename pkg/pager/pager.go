@@ -1,6 +1,7 @@
 package pager
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +9,8 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	config "github.com/brown-csci1270/db/pkg/config"
 	list "github.com/brown-csci1270/db/pkg/list"
@@ -15,7 +18,7 @@ import (
 	directio "github.com/ncw/directio"
 )
 
-// Page size - defaults to 4kb.
+// Default page size - 4kb. Page sizes must be multiples of it.
 const PAGESIZE = int64(directio.BlockSize)
 
 // Number of pages.
@@ -23,56 +26,114 @@ const NUMPAGES = config.NumPages
 
 // Pagers manage pages of data read from a file.
 type Pager struct {
-	file         *os.File             // File descriptor.
-	nPages       int64                // The number of pages used by this database.
-	ptMtx        sync.Mutex           // Page table mutex.
-	freeList     *list.List           // Free page list.
-	unpinnedList *list.List           // Unpinned page list.
-	pinnedList   *list.List           // Pinned page list.
-	pageTable    map[int64]*list.Link // Page table.
+	file      Storage              // The database file.
+	spill     *os.File             // Temp file that a memory-only pager evicts pages to.
+	dwb       *doubleWriter        // Double-write side file, if enabled.
+	nPages    int64                // The number of pages used by this database.
+	pageSize  int64                // The size of each page in the file.
+	pool      *BufferPool          // The buffer pool that holds this pager's pages.
+	aead      cipher.AEAD          // Encrypts pages at rest, or nil.
+	pageTable map[int64]*list.Link // Page table.
+	fresh     map[int64]bool       // Allocated pages that should read back zeroed.
+	freeLater map[int64]bool       // Pinned pages to free once they are unpinned.
+	freeMtx   sync.Mutex           // Serializes page allocation and freeing.
+	freeHead  int64                // The first freelist trunk page, or NOPAGE.
+	nFree     int64                // The number of pages on the freelist.
+	info      FileInfo             // What the file holds, as recorded in its header.
+	counters  pagerCounters        // Buffer pool statistics.
+	ownsPool  bool                 // Whether the pool is private to this pager.
+	closing   bool                 // Set once Close starts; keeps background I/O away.
+	lastPN    int64                // The last page requested, to detect sequential access.
+	// The page after the last one scheduled for read-ahead.
+	readAheadEnd int64
+	// Whether the file header has changed since it was last written.
+	headerDirty bool
 }
 
-// Construct a new Pager.
+// Construct a new Pager with a private pool that evicts pages in LRU order.
 func NewPager() *Pager {
-	var pager *Pager = &Pager{}
-	pager.pageTable = make(map[int64]*list.Link)
-	pager.freeList = list.NewList()
-	pager.unpinnedList = list.NewList()
-	pager.pinnedList = list.NewList()
-	frames := directio.AlignedBlock(int(PAGESIZE * NUMPAGES))
-	for i := 0; i < NUMPAGES; i++ {
-		frame := frames[i*int(PAGESIZE) : (i+1)*int(PAGESIZE)]
-		page := Page{
-			pager:    pager,
-			pagenum:  NOPAGE,
-			pinCount: 0,
-			dirty:    false,
-			data:     &frame,
-		}
-		pager.freeList.PushTail(&page)
-	}
+	return NewPagerWithPolicy(NewLRUPolicy())
+}
+
+// Construct a new Pager with a private pool that uses the given replacement policy.
+func NewPagerWithPolicy(policy ReplacementPolicy) *Pager {
+	pager := NewPagerWithPool(NewBufferPool(NUMPAGES, policy))
+	pager.ownsPool = true
 	return pager
 }
 
+// Construct a new Pager with a private LRU pool of `frames` frames of `pageSize` bytes.
+func NewPagerWithOptions(frames int, pageSize int64) (*Pager, error) {
+	pool, err := NewBufferPoolWithOptions(frames, pageSize, NewLRUPolicy())
+	if err != nil {
+		return nil, err
+	}
+	pager := NewPagerWithPool(pool)
+	pager.ownsPool = true
+	return pager, nil
+}
+
+// Construct a new Pager that draws its frames from the given pool.
+// New files are created with the pool's frame size as their page size.
+func NewPagerWithPool(pool *BufferPool) *Pager {
+	return &Pager{
+		pool:      pool,
+		pageSize:  pool.frameSize,
+		aead:      pool.aead,
+		pageTable: make(map[int64]*list.Link),
+		fresh:     make(map[int64]bool),
+		freeLater: make(map[int64]bool),
+		freeHead:  NOPAGE,
+		lastPN:    NOPAGE,
+	}
+}
+
 // HasFile checks if the pager is backed by disk.
 func (pager *Pager) HasFile() bool {
 	return pager.file != nil
 }
 
-// TODO: Replace the following function
-// GetFileName returns the file name.
+// GetFileName returns the file name, or "" if the pager isn't backed by disk.
 func (pager *Pager) GetFileName() string {
+	if pager.file == nil {
+		return ""
+	}
 	return filepath.Base(pager.file.Name())
 }
 
-// GetNumPages returns the number of pages.
-func (pager *Pager) GetNumPages() int64 {
-	return pager.nPages
+// GetFilePath returns the path the file was opened with, or "" if the pager isn't backed by disk.
+func (pager *Pager) GetFilePath() string {
+	if pager.file == nil {
+		return ""
+	}
+	return pager.file.Name()
+}
+
+// GetPool returns the buffer pool that this pager draws from.
+func (pager *Pager) GetPool() *BufferPool {
+	return pager.pool
+}
+
+// GetReadAhead returns how many pages are read ahead of sequential access.
+func (pager *Pager) GetReadAhead() int {
+	return pager.pool.GetReadAhead()
+}
+
+// GetPageSize returns the size of this pager's pages.
+func (pager *Pager) GetPageSize() int64 {
+	return pager.pageSize
+}
+
+// GetDataSize returns the space each of this pager's pages has for data,
+// which is what is left of it after its checksum or encryption trailer.
+func (pager *Pager) GetDataSize() int64 {
+	return pager.dataSize()
 }
 
-// GetFreePN returns the next available page number.
-func (pager *Pager) GetFreePN() int64 {
-	// Assign the first page number beyond the end of the file.
+// GetNumPages returns the number of pages.
+func (pager *Pager) GetNumPages() int64 {
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
 	return pager.nPages
 }
 
@@ -86,73 +147,158 @@ func (pager *Pager) Open(filename string) (err error) {
 		}
 	}
 	// Open or create the db file.
-	pager.file, err = directio.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	file, err := pager.pool.fs.OpenFile(filename, true)
 	if err != nil {
 		return err
 	}
+	pager.file = file
 	// Get info about the size of the pager.
-	var info os.FileInfo
-	var len int64
-	if info, err = pager.file.Stat(); err == nil {
-		len = info.Size()
-		if len%PAGESIZE != 0 {
-			return errors.New("open: DB file has been corrupted")
+	var len, size int64
+	if len, err = pager.file.Size(); err != nil {
+		return err
+	}
+	created := len == 0
+	// New files take the pool's page size; existing files keep the one in their header.
+	if created {
+		pager.pageSize = pager.pool.frameSize
+		pager.aead = pager.pool.aead
+		pager.info = FileInfo{Version: FORMAT_VERSION, Created: time.Now()}
+		pager.freeHead = NOPAGE
+		pager.nFree = 0
+		if err = pager.writeHeader(); err != nil {
+			return err
+		}
+		len = HEADERSIZE
+	} else {
+		if len%PAGESIZE == 0 {
+			start := directio.AlignedBlock(int(PAGESIZE))
+			if _, err = pager.file.ReadAt(start, 0); err != nil {
+				return err
+			}
+			if isHeaderless(start, len) && pager.pool.addHeaders {
+				if err = pager.addHeader(len); err != nil {
+					return err
+				}
+				len += HEADERSIZE
+			}
+		}
+		if len < HEADERSIZE {
+			return errors.New("open: not a database file (missing header)")
+		}
+		if err = pager.restoreTornHeader(); err != nil {
+			return err
+		}
+		if err = pager.readHeader(); err != nil {
+			return err
+		}
+	}
+	// Repair torn pages before looking at the file's length; a torn write may have extended it.
+	if err = pager.openDoubleWrite(!created); err != nil {
+		return err
+	}
+	if size, err = pager.file.Size(); err != nil {
+		return err
+	}
+	if size > len {
+		len = size
+	}
+	if (len-HEADERSIZE)%pager.pageSize != 0 {
+		return errors.New("open: DB file has been corrupted")
+	}
+	// Pages that don't fit in the shared pool's frames get a private pool.
+	if pager.pageSize > pager.pool.frameSize {
+		policy, err := NewPolicy(pager.pool.policy.Name(), NUMPAGES)
+		if err != nil {
+			return err
+		}
+		shared := pager.pool
+		if pager.pool, err = NewBufferPoolWithOptions(NUMPAGES, pager.pageSize, policy); err != nil {
+			return err
 		}
+		pager.pool.inheritSettings(shared)
+		pager.ownsPool = true
 	}
 	// Set the number of pages and hand off initialization to someone else.
-	pager.nPages = len / PAGESIZE
+	pager.nPages = (len - HEADERSIZE) / pager.pageSize
+	pager.pool.register(pager)
 	return nil
 }
 
-// Close signals our pager to flush all dirty pages to disk.
+// Close signals our pager to flush all dirty pages to disk,
+// then hands its unpinned frames back to the pool.
 func (pager *Pager) Close() (err error) {
+	// A private pool's flusher goes away with its pager.
+	if pager.ownsPool {
+		pager.pool.StopFlusher()
+	}
 	// Prevent new data from being paged in.
-	pager.ptMtx.Lock()
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
+	// Let background reads and writes of our pages finish.
+	pager.closing = true
+	pager.pool.waitForIO(func(key pageKey) bool { return key.pager == pager })
 	// Check if all refcounts are 0.
-	curLink := pager.pinnedList.PeekHead()
-	if curLink != nil {
-		fmt.Println("ERROR: pages are still pinned on close")
+	for _, link := range pager.pageTable {
+		if link.GetList() == pager.pool.pinnedList {
+			fmt.Println("ERROR: pages are still pinned on close")
+			if pager.pool.pins != nil {
+				writePins(os.Stdout, pager.pool.pins.outstanding(pager))
+			}
+			break
+		}
+	}
+	// Cleanup. Pages that can't be written back are lost; report why.
+	err = pager.FlushAllPages()
+	if err == nil && pager.HasFile() && pager.pool.syncMode != SYNC_NONE {
+		err = pager.file.Sync()
+	}
+	for _, link := range pager.pageTable {
+		if link.GetList() == pager.pool.unpinnedList {
+			pager.pool.releaseFrame(link.GetKey().(*Page))
+		}
 	}
-	// Cleanup.
-	pager.FlushAllPages()
+	pager.pool.policy.Forget(pager)
 	if pager.file != nil {
-		err = pager.file.Close()
+		pager.pool.unregister(pager)
+		pager.closeDoubleWrite(err == nil)
+		if curErr := pager.file.Close(); err == nil {
+			err = curErr
+		}
+	}
+	// The spill file was unlinked on creation, so closing it deletes it.
+	if pager.spill != nil {
+		pager.spill.Close()
+		pager.spill = nil
 	}
-	pager.ptMtx.Unlock()
 	return err
 }
 
 // Populate a page's data field, given a pagenumber.
 func (pager *Pager) ReadPageFromDisk(page *Page, pagenum int64) error {
-	if _, err := pager.file.Seek(pagenum*PAGESIZE, 0); err != nil {
-		return err
+	file := pager.storage()
+	if file == nil {
+		// A memory-only page that was never spilled reads back zeroed.
+		page.clear()
+		return nil
 	}
-	if _, err := pager.file.Read(*page.data); err != nil && err != io.EOF {
+	if _, err := file.ReadAt(page.image(), pager.pageOffset(pagenum)); err != nil && err != io.EOF {
 		return err
 	}
-	return nil
+	return page.unseal()
 }
 
-// NewPage returns an unused buffer from the free or unpinned list
+// NewPage returns an unused buffer from the pool's free or unpinned list
 // the ptMtx should be locked on entry
 func (pager *Pager) NewPage(pagenum int64) (*Page, error) {
 	/* SOLUTION {{{ */
-	var newPage *Page
-	if freeLink := pager.freeList.PeekHead(); freeLink != nil {
-		// Check the free list first
-		freeLink.PopSelf()
-		newPage = freeLink.GetKey().(*Page)
-	} else if unpinLink := pager.unpinnedList.PeekHead(); pager.HasFile() && unpinLink != nil {
-		// If no page was found, evict a page from the unpinned list.
-		// But skip this if our pager isn't backed by disk.
-		unpinLink.PopSelf()
-		newPage = unpinLink.GetKey().(*Page)
-		pager.FlushPage(newPage)
-		delete(pager.pageTable, newPage.pagenum)
-	} else {
-		// If still no page is found, error.
-		return nil, errors.New("no available pages")
+	newPage, err := pager.pool.newFrame()
+	if err != nil {
+		atomic.AddInt64(&pager.counters.frameFailures, 1)
+		return nil, err
 	}
+	data := newPage.frame[:pager.dataSize()]
+	newPage.data = &data
+	newPage.pager = pager
 	newPage.pagenum = pagenum
 	newPage.dirty = false
 	newPage.pinCount = 1
@@ -169,20 +315,40 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	}
 	// Try to get from page table.
 	var newLink *list.Link
-	pager.ptMtx.Lock()
-	defer pager.ptMtx.Unlock()
+	pool := pager.pool
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
 	link, ok := pager.pageTable[pagenum]
+	// Wait for the page if it is being read ahead.
+	for !ok && pool.loading[pageKey{pager: pager, pagenum: pagenum}] {
+		pool.ioDone.Wait()
+		link, ok = pager.pageTable[pagenum]
+	}
 	if ok {
 		page = link.GetKey().(*Page)
 		// Move the page to the pinned list if needed.
-		if link.GetList() == pager.unpinnedList {
+		if link.GetList() == pool.unpinnedList {
 			link.PopSelf()
-			newLink = pager.pinnedList.PushTail(page)
+			newLink = pool.pinnedList.PushTail(page)
 			pager.pageTable[pagenum] = newLink
+			pool.policy.Pin(page)
+		}
+		atomic.AddInt64(&page.pinCount, 1)
+		if pool.pins != nil {
+			pool.pins.pin(page, 1)
+		}
+		// A page that was handed out again since it was cached reads back zeroed.
+		if pager.fresh[pagenum] {
+			delete(pager.fresh, pagenum)
+			page.clear()
+			page.dirty = true
 		}
-		page.Get()
+		pool.policy.Access(page)
+		atomic.AddInt64(&pager.counters.hits, 1)
+		pager.detectSequential(pagenum)
 		return page, nil
 	}
+	atomic.AddInt64(&pager.counters.misses, 1)
 	// Else, create a buffer to hold the new page in.
 	page, err = pager.NewPage(pagenum)
 	if err != nil {
@@ -190,53 +356,99 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	}
 
 	// Check if we need to create a new page.
-	if pagenum >= pager.nPages {
-		pager.nPages++
+	if pagenum >= pager.nPages || pager.fresh[pagenum] {
+		if pagenum >= pager.nPages {
+			pager.nPages = pagenum + 1
+		}
+		delete(pager.fresh, pagenum)
+		page.clear()
 		page.dirty = true
 	} else {
 		// Read an existing page in.
 		page.dirty = false
 		err = pager.ReadPageFromDisk(page, pagenum)
 		if err != nil {
-			pager.freeList.PushTail(page)
+			pool.releaseFrame(page)
 			return nil, err
 		}
 	}
 	// Insert the page into our list of pages.
-	newLink = pager.pinnedList.PushTail(page)
+	newLink = pool.pinnedList.PushTail(page)
 	pager.pageTable[pagenum] = newLink
+	if pool.pins != nil {
+		pool.pins.pin(page, 1)
+	}
+	pool.policy.Access(page)
+	pager.detectSequential(pagenum)
 	return page, nil
 	/* SOLUTION }}} */
 }
 
-// Flush a particular page to disk.
-func (pager *Pager) FlushPage(page *Page) {
+// Flush a particular page to disk. The page stays dirty if it can't be written.
+func (pager *Pager) FlushPage(page *Page) error {
 	/* SOLUTION {{{ */
-	if pager.HasFile() && page.IsDirty() {
-		pager.file.WriteAt(
-			*page.data,
-			page.pagenum*PAGESIZE,
-		)
-		page.SetDirty(false)
+	if err := pager.writePage(page); err != nil {
+		return err
 	}
+	return pager.syncFlush()
 	/* SOLUTION }}} */
 }
 
-// Flushes all dirty pages.
-func (pager *Pager) FlushAllPages() {
+// Write a dirty page to disk.
+func (pager *Pager) writePage(page *Page) error {
+	return pager.writePages([]*Page{page})
+}
+
+// Write this pager's dirty pages among the given ones to disk as one batch.
+// Only the double-write path syncs.
+func (pager *Pager) writePages(pages []*Page) error {
+	if !pager.HasFile() {
+		return nil
+	}
+	dirty := make([]*Page, 0, len(pages))
+	pns := make([]int64, 0, len(pages))
+	images := make([][]byte, 0, len(pages))
+	for _, page := range pages {
+		if page.IsDirty() {
+			dirty = append(dirty, page)
+			pns = append(pns, page.pagenum)
+			images = append(images, page.seal())
+		}
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	if err := pager.writeImages(pns, images); err != nil {
+		return err
+	}
+	for _, page := range dirty {
+		atomic.AddInt64(&pager.counters.dirtyFlushes, 1)
+		page.SetDirty(false)
+	}
+	return nil
+}
+
+// Flushes all dirty pages, returning the first error.
+func (pager *Pager) FlushAllPages() (err error) {
 	/* SOLUTION {{{ */
-	writer := func(link *list.Link) {
-		page := link.GetKey().(*Page)
-		pager.FlushPage(page)
+	pages := make([]*Page, 0, len(pager.pageTable))
+	for _, link := range pager.pageTable {
+		pages = append(pages, link.GetKey().(*Page))
+	}
+	err = pager.writePages(pages)
+	if curErr := pager.flushHeader(); err == nil {
+		err = curErr
+	}
+	if err != nil {
+		return err
 	}
-	pager.pinnedList.Map(writer)
-	pager.unpinnedList.Map(writer)
+	return pager.syncFlush()
 	/* SOLUTION }}} */
 }
 
 // [RECOVERY] Block all updates.
 func (pager *Pager) LockAllUpdates() {
-	pager.ptMtx.Lock()
+	pager.pool.ptMtx.Lock()
 	for _, page := range pager.pageTable {
 		page.GetKey().(*Page).LockUpdates()
 	}
@@ -247,5 +459,5 @@ func (pager *Pager) UnlockAllUpdates() {
 	for _, page := range pager.pageTable {
 		page.GetKey().(*Page).UnlockUpdates()
 	}
-	pager.ptMtx.Unlock()
+	pager.pool.ptMtx.Unlock()
 }
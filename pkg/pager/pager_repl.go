@@ -11,10 +11,12 @@ import (
 	repl "github.com/brown-csci1270/db/pkg/repl"
 )
 
-// Creates a Pager REPL for testing the Pager with.
-func PagerRepl() (*repl.REPL, error) {
+// Creates a Pager REPL for testing the Pager with. Where pages are pinned is
+// only recorded, for pager_pins, if trackPins is set.
+func PagerRepl(trackPins bool) (*repl.REPL, error) {
 	// Initialize pager.
 	p := NewPager()
+	p.GetPool().SetPinTracking(trackPins)
 	err := p.Open("data/pager.tmp")
 	if err != nil {
 		return nil, err
@@ -48,6 +50,15 @@ func PagerRepl() (*repl.REPL, error) {
 	r.AddCommand("pager_flushall", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePagerFlushAll(p, payload, replConfig.GetWriter())
 	}, "Flush all pages. usage: pager_flushall")
+	r.AddCommand("pager_free", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandlePagerFree(p, payload, replConfig.GetWriter())
+	}, "Put an unpinned page on the freelist. usage: pager_free <page_num>")
+	r.AddCommand("pager_stats", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandlePagerStats(p, payload, replConfig.GetWriter())
+	}, "Print buffer pool statistics. usage: pager_stats")
+	r.AddCommand("pager_pins", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandlePagerPins(p, payload, replConfig.GetWriter())
+	}, "Print outstanding pins and where they were taken; needs -trackpins. usage: pager_pins")
 	return r, nil
 }
 
@@ -59,19 +70,21 @@ func HandlePagerPrint(p *Pager, payload string, w io.Writer) (err error) {
 	if numFields != 1 {
 		return fmt.Errorf("usage: pager_print")
 	}
-	// Print nPages, freeList, unpinnedList, pinnedList, pageTable.
+	// Print policy, nPages, freeList, unpinnedList, pinnedList, pageTable.
+	io.WriteString(w, fmt.Sprintf("policy: %v\n", p.pool.policy.Name()))
 	io.WriteString(w, fmt.Sprintf("nPages: %v\n", p.nPages))
+	io.WriteString(w, fmt.Sprintf("nFree: %v\n", p.nFree))
 	io.WriteString(w, "freeList: ")
-	p.freeList.Map(func(l *list.Link) {
+	p.pool.freeList.Map(func(l *list.Link) {
 		io.WriteString(w, fmt.Sprintf("(pagenum: %v), ", l.GetKey().(*Page).GetPageNum()))
 	})
 	io.WriteString(w, "\nunpinnedList: ")
-	p.unpinnedList.Map(func(l *list.Link) {
+	p.pool.unpinnedList.Map(func(l *list.Link) {
 		page := l.GetKey().(*Page)
 		io.WriteString(w, fmt.Sprintf("(pagenum: %v, pincount: %v), ", page.GetPageNum(), page.pinCount))
 	})
 	io.WriteString(w, "\npinnedList: ")
-	p.pinnedList.Map(func(l *list.Link) {
+	p.pool.pinnedList.Map(func(l *list.Link) {
 		page := l.GetKey().(*Page)
 		io.WriteString(w, fmt.Sprintf("(pagenum: %v, pincount: %v), ", page.GetPageNum(), page.pinCount))
 	})
@@ -112,7 +125,7 @@ func HandlePagerNew(p *Pager, payload string, w io.Writer) (err error) {
 	if numFields != 1 {
 		return fmt.Errorf("usage: pager_new")
 	}
-	p.GetPage(int64(p.nPages))
+	p.GetPage(p.GetFreePN())
 	return nil
 }
 
@@ -189,10 +202,11 @@ func HandlePagerPin(p *Pager, payload string, w io.Writer) (err error) {
 		return errors.New("page not found; did you pager_get it first?")
 	}
 	// Pin.
-	if link.GetList() == p.unpinnedList {
+	if link.GetList() == p.pool.unpinnedList {
 		link.PopSelf()
-		newLink := p.pinnedList.PushHead(link.GetKey())
+		newLink := p.pool.pinnedList.PushHead(link.GetKey())
 		p.pageTable[int64(pNum)] = newLink
+		p.pool.policy.Pin(link.GetKey().(*Page))
 	}
 	page := link.GetKey().(*Page)
 	page.Get()
@@ -245,8 +259,7 @@ func HandlePagerFlush(p *Pager, payload string, w io.Writer) (err error) {
 	}
 	// Flush.
 	page := link.GetKey().(*Page)
-	p.FlushPage(page)
-	return nil
+	return p.FlushPage(page)
 }
 
 // Function to flush all pages.
@@ -258,6 +271,49 @@ func HandlePagerFlushAll(p *Pager, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("usage: pager_flushall")
 	}
 	// Flush all.
-	p.FlushAllPages()
+	return p.FlushAllPages()
+}
+
+// Function to free a page.
+func HandlePagerFree(p *Pager, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: pager_free <page_num>
+	if numFields != 2 {
+		return fmt.Errorf("usage: pager_free <page_num>")
+	}
+	// Get page num.
+	var pNum int
+	if pNum, err = strconv.Atoi(fields[1]); err != nil {
+		return err
+	}
+	// Free.
+	return p.FreePage(int64(pNum))
+}
+
+// Function to print buffer pool statistics.
+func HandlePagerStats(p *Pager, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: pager_stats
+	if numFields != 1 {
+		return fmt.Errorf("usage: pager_stats")
+	}
+	p.Stats().Print(w)
+	return nil
+}
+
+// Print outstanding pins and where they were taken.
+func HandlePagerPins(p *Pager, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: pager_pins
+	if numFields != 1 {
+		return fmt.Errorf("usage: pager_pins")
+	}
+	if !p.GetPool().GetPinTracking() {
+		return errors.New("pin tracking is off; run with -trackpins to record pins")
+	}
+	p.GetPool().DumpPins(w)
 	return nil
 }
@@ -0,0 +1,159 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// With pin tracking on, the pool records the call stack of every pin taken
+// with GetPage or Get, and drops it again on the matching Put, so that leaked
+// pins can be traced back to the code that took them. A Put releases the most
+// recent pin on the page taken by the same function, falling back to the most
+// recent pin. Capturing stacks is slow, so tracking is meant for tests and
+// debugging only.
+
+// PinRecord describes a pin that hasn't been released yet.
+type PinRecord struct {
+	File    string // The file that the pinned page belongs to.
+	PageNum int64  // The pinned page.
+	Stack   string // Where the pin was taken.
+	caller  string // The function that took the pin.
+}
+
+// Outstanding pins of a pool's pages.
+type pinTracker struct {
+	mtx  sync.Mutex
+	pins map[*Page][]PinRecord
+}
+
+// SetPinTracking sets whether the pool records where pins are taken.
+// It should be set before any page is pinned.
+func (pool *BufferPool) SetPinTracking(enabled bool) {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	if !enabled {
+		pool.pins = nil
+	} else if pool.pins == nil {
+		pool.pins = &pinTracker{pins: make(map[*Page][]PinRecord)}
+	}
+}
+
+// GetPinTracking returns whether the pool records where pins are taken.
+func (pool *BufferPool) GetPinTracking() bool {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	return pool.pins != nil
+}
+
+// GetOutstandingPins returns the pins that haven't been released yet, ordered
+// by file and page. It returns nil if pin tracking is off.
+func (pool *BufferPool) GetOutstandingPins() []PinRecord {
+	pool.ptMtx.Lock()
+	pins := pool.pins
+	pool.ptMtx.Unlock()
+	if pins == nil {
+		return nil
+	}
+	return pins.outstanding(nil)
+}
+
+// DumpPins writes the outstanding pins and where they were taken to w.
+func (pool *BufferPool) DumpPins(w io.Writer) {
+	writePins(w, pool.GetOutstandingPins())
+}
+
+// CheckPins returns an error listing the outstanding pins, if there are any.
+func (pool *BufferPool) CheckPins() error {
+	pins := pool.GetOutstandingPins()
+	if len(pins) == 0 {
+		return nil
+	}
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "%d pins were leaked:\n", len(pins))
+	writePins(&dump, pins)
+	return errors.New(dump.String())
+}
+
+// Write a list of pins to w.
+func writePins(w io.Writer, pins []PinRecord) {
+	for _, pin := range pins {
+		fmt.Fprintf(w, "page %d of %s pinned at:\n%s\n", pin.PageNum, pin.File, pin.Stack)
+	}
+}
+
+// Record a pin of the page, taken by the caller `skip` frames above this call.
+func (tracker *pinTracker) pin(page *Page, skip int) {
+	pcs := make([]uintptr, 32)
+	pcs = pcs[:runtime.Callers(skip+2, pcs)]
+	frames := runtime.CallersFrames(pcs)
+	var stack strings.Builder
+	caller := ""
+	for {
+		frame, more := frames.Next()
+		if caller == "" {
+			caller = frame.Function
+		}
+		fmt.Fprintf(&stack, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.pins[page] = append(tracker.pins[page], PinRecord{
+		File:    page.pager.GetFileName(),
+		PageNum: page.pagenum,
+		Stack:   stack.String(),
+		caller:  caller,
+	})
+}
+
+// Drop the record of the pin on the page that the caller `skip` frames above this call releases.
+func (tracker *pinTracker) unpin(page *Page, skip int) {
+	pcs := make([]uintptr, 1)
+	runtime.Callers(skip+2, pcs)
+	frame, _ := runtime.CallersFrames(pcs).Next()
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	pins := tracker.pins[page]
+	if len(pins) == 0 {
+		return
+	}
+	i := len(pins) - 1
+	for j := i; j >= 0; j-- {
+		if pins[j].caller == frame.Function {
+			i = j
+			break
+		}
+	}
+	pins = append(pins[:i], pins[i+1:]...)
+	if len(pins) == 0 {
+		delete(tracker.pins, page)
+	} else {
+		tracker.pins[page] = pins
+	}
+}
+
+// Get the outstanding pins, optionally only those of the given pager.
+func (tracker *pinTracker) outstanding(pager *Pager) []PinRecord {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	var pins []PinRecord
+	for page, records := range tracker.pins {
+		if pager == nil || page.pager == pager {
+			pins = append(pins, records...)
+		}
+	}
+	sort.SliceStable(pins, func(i, j int) bool {
+		if pins[i].File != pins[j].File {
+			return pins[i].File < pins[j].File
+		}
+		return pins[i].PageNum < pins[j].PageNum
+	})
+	return pins
+}
@@ -0,0 +1,131 @@
+package pager
+
+import (
+	"fmt"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+)
+
+// Names of the available replacement policies.
+const (
+	LRU_POLICY   = "lru"
+	CLOCK_POLICY = "clock"
+	LRUK_POLICY  = "lru-k"
+	TWOQ_POLICY  = "2q"
+)
+
+// ReplacementPolicy decides which unpinned page is evicted when the pager
+// runs out of free frames. Policies are not thread-safe; the pager only calls
+// into them while holding its page table mutex.
+type ReplacementPolicy interface {
+	// Name returns the name of the policy.
+	Name() string
+	// Access records a reference to a page, both on cache hits and right after a page is read in.
+	Access(page *Page)
+	// Unpin marks a page as evictable.
+	Unpin(page *Page)
+	// Pin marks a page as no longer evictable.
+	Pin(page *Page)
+	// Victim picks an evictable page and stops tracking it. Returns nil if no page can be evicted.
+	Victim() *Page
+	// Reinstate puts back an evictable page that Victim just returned but that
+	// couldn't be evicted after all, where it was and with the history it had.
+	// Pages are reinstated in the reverse of the order Victim returned them in.
+	Reinstate(page *Page)
+	// Remove stops tracking a page that leaves the pager without being evicted.
+	Remove(page *Page)
+	// Forget drops what the policy remembers of the evicted pages of a pager
+	// that is closing. The pager's resident pages have been removed already.
+	Forget(pager *Pager)
+}
+
+// pageKey identifies a page independently of the frame that currently holds it.
+type pageKey struct {
+	pager   *Pager
+	pagenum int64
+}
+
+// Get the key of the page currently held in this frame.
+func (page *Page) key() pageKey {
+	return pageKey{pager: page.pager, pagenum: page.pagenum}
+}
+
+// NewPolicy constructs a replacement policy by name for a pool of `capacity` frames.
+func NewPolicy(name string, capacity int) (ReplacementPolicy, error) {
+	switch name {
+	case LRU_POLICY:
+		return NewLRUPolicy(), nil
+	case CLOCK_POLICY:
+		return NewClockPolicy(), nil
+	case LRUK_POLICY:
+		return NewLRUKPolicy(2, capacity), nil
+	case TWOQ_POLICY:
+		return NewTwoQPolicy(capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown replacement policy %q", name)
+	}
+}
+
+// LRUPolicy evicts the page that was unpinned the longest time ago.
+type LRUPolicy struct {
+	lru   *list.List           // Evictable pages, least recently used first.
+	links map[*Page]*list.Link // Links into the lru list.
+}
+
+// Construct a new LRUPolicy.
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{lru: list.NewList(), links: make(map[*Page]*list.Link)}
+}
+
+// Get the policy name.
+func (policy *LRUPolicy) Name() string {
+	return LRU_POLICY
+}
+
+// Move a page to the most recently used end if it is being tracked.
+func (policy *LRUPolicy) Access(page *Page) {
+	if link, ok := policy.links[page]; ok {
+		link.PopSelf()
+		policy.links[page] = policy.lru.PushTail(page)
+	}
+}
+
+// Start tracking a page as the most recently used one.
+func (policy *LRUPolicy) Unpin(page *Page) {
+	if link, ok := policy.links[page]; ok {
+		link.PopSelf()
+	}
+	policy.links[page] = policy.lru.PushTail(page)
+}
+
+// Stop tracking a pinned page.
+func (policy *LRUPolicy) Pin(page *Page) {
+	policy.Remove(page)
+}
+
+// Evict the least recently used page.
+func (policy *LRUPolicy) Victim() *Page {
+	link := policy.lru.PeekHead()
+	if link == nil {
+		return nil
+	}
+	page := link.GetKey().(*Page)
+	policy.Remove(page)
+	return page
+}
+
+// Put a page back at the least recently used end, where it was taken from.
+func (policy *LRUPolicy) Reinstate(page *Page) {
+	policy.links[page] = policy.lru.PushHead(page)
+}
+
+// Stop tracking a page.
+func (policy *LRUPolicy) Remove(page *Page) {
+	if link, ok := policy.links[page]; ok {
+		link.PopSelf()
+		delete(policy.links, page)
+	}
+}
+
+// Nothing is remembered of evicted pages.
+func (policy *LRUPolicy) Forget(pager *Pager) {}
@@ -0,0 +1,131 @@
+package pager
+
+// A slot on the clock face.
+type clockSlot struct {
+	page      *Page // The page in this slot; nil if the slot is empty.
+	ref       bool  // Reference bit, set on every access.
+	evictable bool  // Whether the page is currently unpinned.
+}
+
+// ClockPolicy approximates LRU with a reference bit per page and a sweeping hand.
+type ClockPolicy struct {
+	slots      []clockSlot   // The clock face.
+	index      map[*Page]int // Slot index of each tracked page.
+	emptySlots []int         // Slots that can be reused.
+	hand       int           // Current position of the clock hand.
+	nEvictable int           // Number of evictable pages.
+	victims    map[*Page]int // Slot each page returned by Victim was taken from.
+}
+
+// Construct a new ClockPolicy.
+func NewClockPolicy() *ClockPolicy {
+	return &ClockPolicy{index: make(map[*Page]int), victims: make(map[*Page]int)}
+}
+
+// Get the policy name.
+func (policy *ClockPolicy) Name() string {
+	return CLOCK_POLICY
+}
+
+// Get the slot for a page, placing it on the clock face if needed.
+func (policy *ClockPolicy) slot(page *Page) *clockSlot {
+	if i, ok := policy.index[page]; ok {
+		return &policy.slots[i]
+	}
+	var i int
+	if n := len(policy.emptySlots); n > 0 {
+		i = policy.emptySlots[n-1]
+		policy.emptySlots = policy.emptySlots[:n-1]
+	} else {
+		i = len(policy.slots)
+		policy.slots = append(policy.slots, clockSlot{})
+	}
+	policy.slots[i] = clockSlot{page: page}
+	policy.index[page] = i
+	return &policy.slots[i]
+}
+
+// Set the page's reference bit.
+func (policy *ClockPolicy) Access(page *Page) {
+	policy.slot(page).ref = true
+}
+
+// Mark the page as evictable.
+func (policy *ClockPolicy) Unpin(page *Page) {
+	slot := policy.slot(page)
+	if !slot.evictable {
+		slot.evictable = true
+		policy.nEvictable++
+	}
+}
+
+// Mark the page as not evictable.
+func (policy *ClockPolicy) Pin(page *Page) {
+	slot := policy.slot(page)
+	if slot.evictable {
+		slot.evictable = false
+		policy.nEvictable--
+	}
+}
+
+// Sweep the hand until an evictable page with a cleared reference bit is found.
+func (policy *ClockPolicy) Victim() *Page {
+	if policy.nEvictable == 0 {
+		return nil
+	}
+	// Two full sweeps are enough: the first one clears every reference bit.
+	for i := 0; i <= 2*len(policy.slots); i++ {
+		slot := &policy.slots[policy.hand]
+		policy.hand = (policy.hand + 1) % len(policy.slots)
+		if slot.page == nil || !slot.evictable {
+			continue
+		}
+		if slot.ref {
+			slot.ref = false
+			continue
+		}
+		page := slot.page
+		policy.victims[page] = policy.index[page]
+		policy.Remove(page)
+		return page
+	}
+	return nil
+}
+
+// Put a page back into the slot it was taken from, if that is still empty,
+// and turn the hand back to it.
+func (policy *ClockPolicy) Reinstate(page *Page) {
+	i, ok := policy.victims[page]
+	delete(policy.victims, page)
+	if !ok || policy.slots[i].page != nil {
+		policy.Unpin(page)
+		return
+	}
+	for j, empty := range policy.emptySlots {
+		if empty == i {
+			policy.emptySlots = append(policy.emptySlots[:j], policy.emptySlots[j+1:]...)
+			break
+		}
+	}
+	policy.slots[i] = clockSlot{page: page, evictable: true}
+	policy.index[page] = i
+	policy.nEvictable++
+	policy.hand = i
+}
+
+// Stop tracking a page and free its slot.
+func (policy *ClockPolicy) Remove(page *Page) {
+	i, ok := policy.index[page]
+	if !ok {
+		return
+	}
+	if policy.slots[i].evictable {
+		policy.nEvictable--
+	}
+	policy.slots[i] = clockSlot{}
+	policy.emptySlots = append(policy.emptySlots, i)
+	delete(policy.index, page)
+}
+
+// Nothing is remembered of evicted pages.
+func (policy *ClockPolicy) Forget(pager *Pager) {}
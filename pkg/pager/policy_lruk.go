@@ -0,0 +1,186 @@
+package pager
+
+import (
+	"container/heap"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+)
+
+// LRUKPolicy evicts the page whose k-th most recent reference lies furthest in
+// the past. Pages referenced fewer than k times are evicted first, in LRU order.
+// Reference history outlives eviction so that a page that is re-read soon
+// after being evicted keeps its frequency information. Evictable pages are
+// kept in a heap ordered by eviction priority, and the histories of pages
+// that were evicted in a list, oldest first, so that neither picking a victim
+// nor trimming old histories has to look at every page.
+type LRUKPolicy struct {
+	k          int                    // Number of references to track per page.
+	maxHistory int                    // Number of non-resident histories to retain.
+	clock      int64                  // Logical time, advanced on every access.
+	history    map[pageKey][]int64    // Last k access times per page, oldest first.
+	evicted    *list.List             // Keys of non-resident pages with a history, evicted longest ago first.
+	evictedAt  map[pageKey]*list.Link // Link of each non-resident page in evicted.
+	evictable  lrukHeap               // Pages that can be evicted, next victim first.
+	heapIndex  map[*Page]int          // Position of each evictable page in the heap.
+}
+
+// Construct a new LRUKPolicy for a pool of `capacity` frames.
+func NewLRUKPolicy(k int, capacity int) *LRUKPolicy {
+	if k < 1 {
+		k = 1
+	}
+	policy := &LRUKPolicy{
+		k:          k,
+		maxHistory: 2 * capacity,
+		history:    make(map[pageKey][]int64),
+		evicted:    list.NewList(),
+		evictedAt:  make(map[pageKey]*list.Link),
+		heapIndex:  make(map[*Page]int),
+	}
+	policy.evictable.policy = policy
+	return policy
+}
+
+// Get the policy name.
+func (policy *LRUKPolicy) Name() string {
+	return LRUK_POLICY
+}
+
+// Record a reference to the page.
+func (policy *LRUKPolicy) Access(page *Page) {
+	policy.clock++
+	key := page.key()
+	hist := append(policy.history[key], policy.clock)
+	if len(hist) > policy.k {
+		hist = hist[len(hist)-policy.k:]
+	}
+	policy.history[key] = hist
+	policy.setResident(key)
+	if i, ok := policy.heapIndex[page]; ok {
+		heap.Fix(&policy.evictable, i)
+	}
+}
+
+// Mark the page as evictable.
+func (policy *LRUKPolicy) Unpin(page *Page) {
+	if _, ok := policy.heapIndex[page]; !ok {
+		heap.Push(&policy.evictable, page)
+	}
+}
+
+// Mark the page as not evictable.
+func (policy *LRUKPolicy) Pin(page *Page) {
+	if i, ok := policy.heapIndex[page]; ok {
+		heap.Remove(&policy.evictable, i)
+	}
+}
+
+// Pick the evictable page with the largest backward k-distance.
+func (policy *LRUKPolicy) Victim() *Page {
+	if policy.evictable.Len() == 0 {
+		return nil
+	}
+	victim := heap.Pop(&policy.evictable).(*Page)
+	// Trim first, so that the victim's own history is kept if it is reinstated.
+	policy.trimHistory()
+	if key := victim.key(); len(policy.history[key]) > 0 {
+		policy.evictedAt[key] = policy.evicted.PushTail(key)
+	}
+	return victim
+}
+
+// Make the page resident and evictable again, keeping its history.
+func (policy *LRUKPolicy) Reinstate(page *Page) {
+	policy.setResident(page.key())
+	policy.Unpin(page)
+}
+
+// Stop tracking a page, dropping its history.
+func (policy *LRUKPolicy) Remove(page *Page) {
+	key := page.key()
+	policy.Pin(page)
+	policy.setResident(key)
+	delete(policy.history, key)
+}
+
+// Drop the histories of the given pager's pages.
+func (policy *LRUKPolicy) Forget(pager *Pager) {
+	for key, link := range policy.evictedAt {
+		if key.pager == pager {
+			link.PopSelf()
+			delete(policy.evictedAt, key)
+			delete(policy.history, key)
+		}
+	}
+}
+
+// Stop counting the page's history as that of a non-resident page.
+func (policy *LRUKPolicy) setResident(key pageKey) {
+	if link, ok := policy.evictedAt[key]; ok {
+		link.PopSelf()
+		delete(policy.evictedAt, key)
+	}
+}
+
+// Drop the histories of the pages evicted longest ago once there are too many of them.
+func (policy *LRUKPolicy) trimHistory() {
+	for len(policy.evictedAt) > policy.maxHistory {
+		oldest := policy.evicted.PeekHead()
+		key := oldest.GetKey().(pageKey)
+		oldest.PopSelf()
+		delete(policy.evictedAt, key)
+		delete(policy.history, key)
+	}
+}
+
+// Get the backward k-distance of the page as the time it is measured from,
+// and whether the page has been referenced k times. Pages referenced fewer
+// times have an infinite k-distance, and are ordered by their last reference.
+func (policy *LRUKPolicy) distance(page *Page) (full bool, t int64) {
+	hist := policy.history[page.key()]
+	if len(hist) >= policy.k {
+		return true, hist[0]
+	}
+	if len(hist) > 0 {
+		return false, hist[len(hist)-1]
+	}
+	return false, 0
+}
+
+// A heap of evictable pages, ordered by how soon the LRU-K policy evicts them.
+type lrukHeap struct {
+	policy *LRUKPolicy
+	pages  []*Page
+}
+
+func (h *lrukHeap) Len() int {
+	return len(h.pages)
+}
+
+func (h *lrukHeap) Less(i, j int) bool {
+	iFull, iTime := h.policy.distance(h.pages[i])
+	jFull, jTime := h.policy.distance(h.pages[j])
+	if iFull != jFull {
+		return !iFull
+	}
+	return iTime < jTime
+}
+
+func (h *lrukHeap) Swap(i, j int) {
+	h.pages[i], h.pages[j] = h.pages[j], h.pages[i]
+	h.policy.heapIndex[h.pages[i]] = i
+	h.policy.heapIndex[h.pages[j]] = j
+}
+
+func (h *lrukHeap) Push(x interface{}) {
+	page := x.(*Page)
+	h.policy.heapIndex[page] = len(h.pages)
+	h.pages = append(h.pages, page)
+}
+
+func (h *lrukHeap) Pop() interface{} {
+	page := h.pages[len(h.pages)-1]
+	h.pages = h.pages[:len(h.pages)-1]
+	delete(h.policy.heapIndex, page)
+	return page
+}
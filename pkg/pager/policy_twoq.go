@@ -0,0 +1,190 @@
+package pager
+
+import (
+	list "github.com/brown-csci1270/db/pkg/list"
+)
+
+// TwoQPolicy implements the full 2Q algorithm. Pages seen once enter a FIFO
+// queue (A1in); only pages that are referenced again after falling out of it
+// (and are remembered in the A1out ghost queue) are promoted to the main LRU
+// queue (Am). One-off scans therefore cannot flush hot pages out of Am.
+type TwoQPolicy struct {
+	kin       int                    // Target size of A1in.
+	kout      int                    // Maximum size of A1out.
+	a1in      *list.List             // FIFO of resident pages referenced once.
+	am        *list.List             // LRU of resident hot pages.
+	a1out     *list.List             // FIFO of keys recently evicted from A1in.
+	nA1in     int                    // Size of A1in.
+	nA1out    int                    // Size of A1out.
+	queues    map[*Page]*list.Link   // Link of each resident page in A1in or Am.
+	ghosts    map[pageKey]*list.Link // Link of each key in A1out.
+	evictable map[*Page]bool         // Pages that can be evicted.
+	victims   map[*Page]twoQVictim   // How each page returned by Victim was taken out.
+}
+
+// Where a victim of the 2Q policy came from, and which ghosts evicting it dropped.
+type twoQVictim struct {
+	fromA1in bool      // Whether the page was in A1in, and so left a ghost behind.
+	dropped  []pageKey // Ghosts dropped from A1out to make room for its own, oldest first.
+}
+
+// Construct a new TwoQPolicy for a pool of `capacity` frames.
+func NewTwoQPolicy(capacity int) *TwoQPolicy {
+	kin := capacity / 4
+	if kin < 1 {
+		kin = 1
+	}
+	kout := capacity / 2
+	if kout < 1 {
+		kout = 1
+	}
+	return &TwoQPolicy{
+		kin:       kin,
+		kout:      kout,
+		a1in:      list.NewList(),
+		am:        list.NewList(),
+		a1out:     list.NewList(),
+		queues:    make(map[*Page]*list.Link),
+		ghosts:    make(map[pageKey]*list.Link),
+		evictable: make(map[*Page]bool),
+		victims:   make(map[*Page]twoQVictim),
+	}
+}
+
+// Get the policy name.
+func (policy *TwoQPolicy) Name() string {
+	return TWOQ_POLICY
+}
+
+// Record a reference to the page.
+func (policy *TwoQPolicy) Access(page *Page) {
+	// Hits in Am refresh the page; hits in A1in are deliberately ignored.
+	if link, ok := policy.queues[page]; ok {
+		if link.GetList() == policy.am {
+			link.PopSelf()
+			policy.queues[page] = policy.am.PushTail(page)
+		}
+		return
+	}
+	// A newly resident page goes to Am if we evicted it recently, else to A1in.
+	key := page.key()
+	if ghost, ok := policy.ghosts[key]; ok {
+		ghost.PopSelf()
+		delete(policy.ghosts, key)
+		policy.nA1out--
+		policy.queues[page] = policy.am.PushTail(page)
+	} else {
+		policy.queues[page] = policy.a1in.PushTail(page)
+		policy.nA1in++
+	}
+}
+
+// Mark the page as evictable.
+func (policy *TwoQPolicy) Unpin(page *Page) {
+	policy.evictable[page] = true
+}
+
+// Mark the page as not evictable.
+func (policy *TwoQPolicy) Pin(page *Page) {
+	delete(policy.evictable, page)
+}
+
+// Find the first evictable page in the given queue.
+func (policy *TwoQPolicy) firstEvictable(queue *list.List) *Page {
+	for link := queue.PeekHead(); link != nil; link = link.GetNext() {
+		if page := link.GetKey().(*Page); policy.evictable[page] {
+			return page
+		}
+	}
+	return nil
+}
+
+// Evict from A1in while it is over its target size, else from Am.
+func (policy *TwoQPolicy) Victim() *Page {
+	var victim *Page
+	if policy.nA1in > policy.kin {
+		victim = policy.firstEvictable(policy.a1in)
+	}
+	if victim == nil {
+		victim = policy.firstEvictable(policy.am)
+	}
+	if victim == nil {
+		victim = policy.firstEvictable(policy.a1in)
+	}
+	if victim == nil {
+		return nil
+	}
+	// Remember pages evicted from A1in so that a quick re-reference promotes them.
+	record := twoQVictim{fromA1in: policy.queues[victim].GetList() == policy.a1in}
+	key := victim.key()
+	policy.Remove(victim)
+	if record.fromA1in {
+		policy.ghosts[key] = policy.a1out.PushTail(key)
+		policy.nA1out++
+		for policy.nA1out > policy.kout {
+			oldest := policy.a1out.PeekHead()
+			oldest.PopSelf()
+			delete(policy.ghosts, oldest.GetKey().(pageKey))
+			policy.nA1out--
+			record.dropped = append(record.dropped, oldest.GetKey().(pageKey))
+		}
+	}
+	policy.victims[victim] = record
+	return victim
+}
+
+// Put a page back at the head of the queue it was taken from, and undo the
+// changes its eviction made to A1out.
+func (policy *TwoQPolicy) Reinstate(page *Page) {
+	record, ok := policy.victims[page]
+	delete(policy.victims, page)
+	if !ok {
+		policy.Access(page)
+		policy.Unpin(page)
+		return
+	}
+	policy.evictable[page] = true
+	if !record.fromA1in {
+		policy.queues[page] = policy.am.PushHead(page)
+		return
+	}
+	key := page.key()
+	if ghost, ok := policy.ghosts[key]; ok {
+		ghost.PopSelf()
+		delete(policy.ghosts, key)
+		policy.nA1out--
+	}
+	for i := len(record.dropped) - 1; i >= 0; i-- {
+		dropped := record.dropped[i]
+		policy.ghosts[dropped] = policy.a1out.PushHead(dropped)
+		policy.nA1out++
+	}
+	policy.queues[page] = policy.a1in.PushHead(page)
+	policy.nA1in++
+}
+
+// Stop tracking a page.
+func (policy *TwoQPolicy) Remove(page *Page) {
+	delete(policy.evictable, page)
+	link, ok := policy.queues[page]
+	if !ok {
+		return
+	}
+	if link.GetList() == policy.a1in {
+		policy.nA1in--
+	}
+	link.PopSelf()
+	delete(policy.queues, page)
+}
+
+// Drop the ghosts of the given pager's pages.
+func (policy *TwoQPolicy) Forget(pager *Pager) {
+	policy.victims = make(map[*Page]twoQVictim)
+	for key, ghost := range policy.ghosts {
+		if key.pager == pager {
+			ghost.PopSelf()
+			delete(policy.ghosts, key)
+			policy.nA1out--
+		}
+	}
+}
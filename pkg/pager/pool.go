@@ -0,0 +1,235 @@
+package pager
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+
+	directio "github.com/ncw/directio"
+)
+
+// BufferPools own a fixed set of page frames that any number of pagers draw
+// from. Cached pages are keyed by (pager, pagenum): each pager keeps its own
+// page table pointing into the pool's lists.
+type BufferPool struct {
+	ptMtx        sync.Mutex        // Page table mutex, shared by every pager using this pool.
+	nFrames      int               // The number of frames in the pool.
+	frameSize    int64             // The size of each frame; bounds the page size of files in this pool.
+	freeList     *list.List        // Free page list.
+	unpinnedList *list.List        // Unpinned page list.
+	pinnedList   *list.List        // Pinned page list.
+	policy       ReplacementPolicy // Decides which unpinned page to evict.
+	pagers       map[*Pager]bool   // Open file-backed pagers using this pool.
+	inflight     map[pageKey]bool  // Pages being written back by the flusher.
+	loading      map[pageKey]bool  // Pages being read ahead.
+	ioDone       *sync.Cond        // Signalled when background I/O on a page finishes.
+	flusher      *flusher          // The background flusher, if running.
+	readAhead    int               // How many pages to read ahead of sequential access.
+	aead         cipher.AEAD       // Encrypts the pages of files opened on this pool, or nil.
+	syncMode     SyncMode          // When files are fsynced.
+	doubleWrite  bool              // Whether page writes go through a double-write side file.
+	addHeaders   bool              // Whether files without a header are given one.
+	fs           FileSystem        // Opens the files of pagers using this pool.
+	pins         *pinTracker       // Where outstanding pins were taken, if tracking is on.
+}
+
+// Construct a new BufferPool with `frames` frames of the default page size and the given replacement policy.
+func NewBufferPool(frames int, policy ReplacementPolicy) *BufferPool {
+	pool, _ := NewBufferPoolWithOptions(frames, PAGESIZE, policy)
+	return pool
+}
+
+// Construct a new BufferPool with `frames` frames of `pageSize` bytes and the given replacement policy.
+func NewBufferPoolWithOptions(frames int, pageSize int64, policy ReplacementPolicy) (*BufferPool, error) {
+	if frames < 1 {
+		return nil, fmt.Errorf("invalid number of frames %d", frames)
+	}
+	if err := ValidatePageSize(pageSize); err != nil {
+		return nil, err
+	}
+	pool := &BufferPool{
+		nFrames:      frames,
+		frameSize:    pageSize,
+		freeList:     list.NewList(),
+		unpinnedList: list.NewList(),
+		pinnedList:   list.NewList(),
+		policy:       policy,
+		pagers:       make(map[*Pager]bool),
+		inflight:     make(map[pageKey]bool),
+		loading:      make(map[pageKey]bool),
+		syncMode:     SYNC_CHECKPOINT,
+		fs:           OSFileSystem,
+	}
+	pool.ioDone = sync.NewCond(&pool.ptMtx)
+	size := int(pageSize)
+	data := directio.AlignedBlock(size * frames)
+	for i := 0; i < frames; i++ {
+		frame := data[i*size : (i+1)*size]
+		page := Page{
+			pagenum:  NOPAGE,
+			pinCount: 0,
+			dirty:    false,
+			frame:    frame,
+			data:     &frame,
+		}
+		pool.freeList.PushTail(&page)
+	}
+	return pool, nil
+}
+
+// Copy the settings of another pool that affect how files are written.
+func (pool *BufferPool) inheritSettings(other *BufferPool) {
+	pool.aead = other.aead
+	pool.syncMode = other.syncMode
+	pool.doubleWrite = other.doubleWrite
+	pool.addHeaders = other.addHeaders
+	pool.readAhead = other.readAhead
+	pool.fs = other.fs
+	pool.pins = other.pins
+}
+
+// GetNumFrames returns the number of frames in the pool.
+func (pool *BufferPool) GetNumFrames() int {
+	return pool.nFrames
+}
+
+// GetFrameSize returns the size of each frame in the pool.
+func (pool *BufferPool) GetFrameSize() int64 {
+	return pool.frameSize
+}
+
+// GetPolicy returns the pool's replacement policy.
+func (pool *BufferPool) GetPolicy() ReplacementPolicy {
+	return pool.policy
+}
+
+// newFrame returns an unused frame from the free list, or evicts one.
+// The ptMtx should be locked on entry.
+func (pool *BufferPool) newFrame() (*Page, error) {
+	if freeLink := pool.freeList.PeekHead(); freeLink != nil {
+		// Check the free list first
+		freeLink.PopSelf()
+		return freeLink.GetKey().(*Page), nil
+	}
+	// If no page was found, evict the page chosen by the replacement policy,
+	// passing over pages that the flusher is writing back or that can't be
+	// written. Those are put back as they were, without counting as accesses.
+	var skipped []*Page
+	var flushErr error
+	defer func() {
+		for i := len(skipped) - 1; i >= 0; i-- {
+			pool.policy.Reinstate(skipped[i])
+		}
+	}()
+	for victim := pool.policy.Victim(); victim != nil; victim = pool.policy.Victim() {
+		if pool.inflight[victim.key()] {
+			skipped = append(skipped, victim)
+			continue
+		}
+		// Evicting a dirty page means the flusher is falling behind.
+		if victim.dirty {
+			pool.kickFlusher()
+		}
+		owner := victim.pager
+		// Memory-only pagers spill their pages to a temp file.
+		var err error
+		if owner.HasFile() {
+			err = owner.FlushPage(victim)
+		} else {
+			err = owner.spillPage(victim)
+		}
+		if err != nil {
+			skipped = append(skipped, victim)
+			flushErr = err
+			continue
+		}
+		atomic.AddInt64(&owner.counters.evictions, 1)
+		owner.pageTable[victim.pagenum].PopSelf()
+		delete(owner.pageTable, victim.pagenum)
+		return victim, nil
+	}
+	// If still no page is found, error.
+	if flushErr != nil {
+		return nil, fmt.Errorf("no available pages: %v", flushErr)
+	}
+	return nil, errors.New("no available pages")
+}
+
+// releaseFrame drops a page from its pager and returns its frame to the free list.
+// The ptMtx should be locked on entry.
+func (pool *BufferPool) releaseFrame(page *Page) {
+	if link, ok := page.pager.pageTable[page.pagenum]; ok && link.GetKey() == page {
+		link.PopSelf()
+		delete(page.pager.pageTable, page.pagenum)
+	}
+	pool.policy.Remove(page)
+	page.pager = nil
+	page.pagenum = NOPAGE
+	page.dirty = false
+	pool.freeList.PushTail(page)
+}
+
+// Track a pager whose file was opened on this pool.
+func (pool *BufferPool) register(pager *Pager) {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	pool.pagers[pager] = true
+}
+
+// Stop tracking a pager. The ptMtx should be locked on entry.
+func (pool *BufferPool) unregister(pager *Pager) {
+	delete(pool.pagers, pager)
+}
+
+// Apply a function to every page held by the pool.
+func (pool *BufferPool) mapPages(f func(*Page)) {
+	mapper := func(link *list.Link) {
+		f(link.GetKey().(*Page))
+	}
+	pool.pinnedList.Map(mapper)
+	pool.unpinnedList.Map(mapper)
+}
+
+// Flushes all dirty pages held by the pool, across all pagers,
+// followed by the file headers of those pagers. Returns the first error.
+func (pool *BufferPool) FlushAllPages() (err error) {
+	pages := make(map[*Pager][]*Page)
+	pool.mapPages(func(page *Page) {
+		pages[page.pager] = append(pages[page.pager], page)
+	})
+	for pager, batch := range pages {
+		if curErr := pager.writePages(batch); err == nil {
+			err = curErr
+		}
+	}
+	for pager := range pool.pagers {
+		if curErr := pager.flushHeader(); err == nil {
+			err = curErr
+		}
+		if curErr := pager.syncFlush(); err == nil {
+			err = curErr
+		}
+	}
+	return err
+}
+
+// [RECOVERY] Block all updates to pages held by the pool.
+func (pool *BufferPool) LockAllUpdates() {
+	pool.ptMtx.Lock()
+	pool.waitForIO(func(pageKey) bool { return true })
+	pool.mapPages(func(page *Page) {
+		page.LockUpdates()
+	})
+}
+
+// [RECOVERY] Enable updates to pages held by the pool.
+func (pool *BufferPool) UnlockAllUpdates() {
+	pool.mapPages(func(page *Page) {
+		page.UnlockUpdates()
+	})
+	pool.ptMtx.Unlock()
+}
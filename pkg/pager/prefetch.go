@@ -0,0 +1,144 @@
+package pager
+
+import (
+	"sync/atomic"
+)
+
+// Read-ahead brings pages into free frames in the background, either when a
+// pager notices pages being requested in order or when given an explicit
+// hint. It never evicts anything. A GetPage for a page that is still being
+// read waits for the read to finish.
+
+// SetReadAhead sets how many pages are read ahead of sequential access. 0 disables read-ahead.
+func (pool *BufferPool) SetReadAhead(n int) {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	pool.readAhead = n
+}
+
+// GetReadAhead returns how many pages are read ahead of sequential access.
+func (pool *BufferPool) GetReadAhead() int {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	return pool.readAhead
+}
+
+// Prefetch starts reading the given pages into free frames in the background.
+// Pages that are already cached, or don't fit in the free frames, are skipped.
+func (pager *Pager) Prefetch(pns []int64) {
+	pager.pool.ptMtx.Lock()
+	defer pager.pool.ptMtx.Unlock()
+	pager.startPrefetch(pns)
+}
+
+// Wait until no page matching the predicate is being read or written in the background.
+// The ptMtx should be locked on entry; it is released while waiting.
+func (pool *BufferPool) waitForIO(match func(pageKey) bool) {
+	for {
+		busy := false
+		for key := range pool.inflight {
+			busy = busy || match(key)
+		}
+		for key := range pool.loading {
+			busy = busy || match(key)
+		}
+		if !busy {
+			return
+		}
+		pool.ioDone.Wait()
+	}
+}
+
+// Read ahead if the given page continues a run of sequential requests.
+// The ptMtx should be locked on entry.
+func (pager *Pager) detectSequential(pagenum int64) {
+	n := int64(pager.pool.readAhead)
+	sequential := pagenum == pager.lastPN+1
+	pager.lastPN = pagenum
+	if n == 0 || !sequential {
+		pager.readAheadEnd = pagenum + 1
+		return
+	}
+	// Only top the window up once half of it has been consumed.
+	if pager.readAheadEnd-pagenum > n/2 {
+		return
+	}
+	start := pager.readAheadEnd
+	if start <= pagenum {
+		start = pagenum + 1
+	}
+	end := pagenum + 1 + n
+	pns := make([]int64, 0, end-start)
+	for pn := start; pn < end; pn++ {
+		pns = append(pns, pn)
+	}
+	pager.readAheadEnd = end
+	pager.startPrefetch(pns)
+}
+
+// Reserve free frames for the given pages and read them in on another goroutine.
+// The ptMtx should be locked on entry.
+func (pager *Pager) startPrefetch(pns []int64) {
+	if !pager.HasFile() || pager.closing {
+		return
+	}
+	pool := pager.pool
+	batch := make([]*Page, 0, len(pns))
+	// Pages on the freelist may be read ahead too; GetFreePN waits for them
+	// and drops them from the cache before handing them out.
+	for _, pagenum := range pns {
+		key := pageKey{pager: pager, pagenum: pagenum}
+		if pagenum < 0 || pagenum >= pager.nPages || pager.fresh[pagenum] || pool.loading[key] {
+			continue
+		}
+		if _, ok := pager.pageTable[pagenum]; ok {
+			continue
+		}
+		freeLink := pool.freeList.PeekHead()
+		if freeLink == nil {
+			break
+		}
+		freeLink.PopSelf()
+		page := freeLink.GetKey().(*Page)
+		data := page.frame[:pager.dataSize()]
+		page.data = &data
+		page.pager = pager
+		page.pagenum = pagenum
+		page.dirty = false
+		page.pinCount = 0
+		pool.loading[key] = true
+		batch = append(batch, page)
+	}
+	if len(batch) > 0 {
+		go pager.loadPages(batch)
+	}
+}
+
+// Read the reserved pages in and add them to the cache as unpinned pages.
+func (pager *Pager) loadPages(batch []*Page) {
+	errs := make([]error, len(batch))
+	for i, page := range batch {
+		errs[i] = pager.ReadPageFromDisk(page, page.pagenum)
+	}
+	pool := pager.pool
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	for i, page := range batch {
+		delete(pool.loading, page.key())
+		// Pages that can't be read are dropped; a later GetPage reports the error.
+		if errs[i] != nil {
+			page.pager = nil
+			page.pagenum = NOPAGE
+			pool.freeList.PushTail(page)
+			continue
+		}
+		pager.pageTable[page.pagenum] = pool.unpinnedList.PushTail(page)
+		pool.policy.Access(page)
+		pool.policy.Unpin(page)
+		atomic.AddInt64(&pager.counters.readAheads, 1)
+	}
+	pool.ioDone.Broadcast()
+}
@@ -0,0 +1,46 @@
+package pager
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// Pagers that were never opened on a file keep their pages in memory. When
+// such a page has to be evicted, it is written to an anonymous temp file
+// instead, which is created on the first eviction and deleted on Close.
+
+// Get the file that this pager's pages are read from, or nil if there is none.
+func (pager *Pager) storage() io.ReaderAt {
+	if pager.file != nil {
+		return pager.file
+	}
+	if pager.spill != nil {
+		return pager.spill
+	}
+	return nil
+}
+
+// Write a page of a memory-only pager out to its spill file, creating it if needed.
+// The ptMtx should be locked on entry.
+func (pager *Pager) spillPage(page *Page) error {
+	if !page.IsDirty() {
+		return nil
+	}
+	if pager.spill == nil {
+		file, err := ioutil.TempFile("", "bumble-spill-*")
+		if err != nil {
+			return err
+		}
+		// Unlink the file straight away so that it can't outlive the pager.
+		os.Remove(file.Name())
+		pager.spill = file
+	}
+	if _, err := pager.spill.WriteAt(page.seal(), pager.pageOffset(page.pagenum)); err != nil {
+		return err
+	}
+	atomic.AddInt64(&pager.counters.dirtyFlushes, 1)
+	page.SetDirty(false)
+	return nil
+}
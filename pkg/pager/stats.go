@@ -0,0 +1,93 @@
+package pager
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+)
+
+// Running counters kept by each pager. Updated atomically.
+type pagerCounters struct {
+	hits          int64 // GetPage calls served from the pool.
+	misses        int64 // GetPage calls that had to bring the page in.
+	evictions     int64 // Pages of this pager evicted to make room.
+	dirtyFlushes  int64 // Dirty pages written back to disk.
+	frameFailures int64 // Frame requests that failed because no frame could be freed.
+	readAheads    int64 // Pages read in ahead of being requested.
+}
+
+// PagerStats is a snapshot of a pager's buffer pool counters.
+type PagerStats struct {
+	Hits           int64 // GetPage calls served from the pool.
+	Misses         int64 // GetPage calls that had to bring the page in.
+	Evictions      int64 // Pages of this pager evicted to make room.
+	DirtyFlushes   int64 // Dirty pages written back to disk.
+	FrameFailures  int64 // Frame requests that failed because no frame could be freed.
+	ReadAheads     int64 // Pages read in ahead of being requested.
+	PinnedFrames   int64 // Frames currently holding pinned pages of this pager.
+	UnpinnedFrames int64 // Frames currently holding unpinned pages of this pager.
+	FreeFrames     int64 // Unused frames in the pool.
+	PoolFrames     int64 // Total frames in the pool.
+}
+
+// HitRatio returns the fraction of GetPage calls served from the pool.
+func (stats PagerStats) HitRatio() float64 {
+	total := stats.Hits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(total)
+}
+
+// Print writes the statistics, one per line.
+func (stats PagerStats) Print(w io.Writer) {
+	io.WriteString(w, fmt.Sprintf("hits: %v\n", stats.Hits))
+	io.WriteString(w, fmt.Sprintf("misses: %v\n", stats.Misses))
+	io.WriteString(w, fmt.Sprintf("hit ratio: %.3f\n", stats.HitRatio()))
+	io.WriteString(w, fmt.Sprintf("evictions: %v\n", stats.Evictions))
+	io.WriteString(w, fmt.Sprintf("dirty flushes: %v\n", stats.DirtyFlushes))
+	io.WriteString(w, fmt.Sprintf("failed frame requests: %v\n", stats.FrameFailures))
+	io.WriteString(w, fmt.Sprintf("read-aheads: %v\n", stats.ReadAheads))
+	io.WriteString(w, fmt.Sprintf("pinned frames: %v\n", stats.PinnedFrames))
+	io.WriteString(w, fmt.Sprintf("unpinned frames: %v\n", stats.UnpinnedFrames))
+	io.WriteString(w, fmt.Sprintf("free frames: %v/%v\n", stats.FreeFrames, stats.PoolFrames))
+}
+
+// Stats returns a snapshot of the pager's counters and frame usage.
+func (pager *Pager) Stats() PagerStats {
+	stats := PagerStats{
+		Hits:          atomic.LoadInt64(&pager.counters.hits),
+		Misses:        atomic.LoadInt64(&pager.counters.misses),
+		Evictions:     atomic.LoadInt64(&pager.counters.evictions),
+		DirtyFlushes:  atomic.LoadInt64(&pager.counters.dirtyFlushes),
+		FrameFailures: atomic.LoadInt64(&pager.counters.frameFailures),
+		ReadAheads:    atomic.LoadInt64(&pager.counters.readAheads),
+		PoolFrames:    int64(pager.pool.nFrames),
+	}
+	pool := pager.pool
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	for _, link := range pager.pageTable {
+		if link.GetList() == pool.pinnedList {
+			stats.PinnedFrames++
+		} else {
+			stats.UnpinnedFrames++
+		}
+	}
+	pool.freeList.Map(func(*list.Link) {
+		stats.FreeFrames++
+	})
+	return stats
+}
+
+// ResetStats zeroes the pager's counters.
+func (pager *Pager) ResetStats() {
+	atomic.StoreInt64(&pager.counters.hits, 0)
+	atomic.StoreInt64(&pager.counters.misses, 0)
+	atomic.StoreInt64(&pager.counters.evictions, 0)
+	atomic.StoreInt64(&pager.counters.dirtyFlushes, 0)
+	atomic.StoreInt64(&pager.counters.frameFailures, 0)
+	atomic.StoreInt64(&pager.counters.readAheads, 0)
+}
@@ -0,0 +1,106 @@
+package pager
+
+import (
+	"io"
+	"os"
+
+	directio "github.com/ncw/directio"
+)
+
+// Pagers don't talk to the OS directly; they open their database and
+// double-write files through their pool's FileSystem. This lets tests swap in
+// a FileSystem that injects faults.
+
+// Storage is an open file that a pager keeps pages in.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Name() string         // The path the file was opened with.
+	Size() (int64, error) // The current size of the file.
+	Sync() error          // Make every write so far durable.
+	Close() error
+}
+
+// FileSystem opens the files that pagers keep their pages in.
+type FileSystem interface {
+	// OpenFile opens the named file for reading and writing, creating it if
+	// it doesn't exist. Direct files are only ever accessed with aligned
+	// buffers, so they may bypass the OS cache.
+	OpenFile(name string, direct bool) (Storage, error)
+	// Remove removes the named file.
+	Remove(name string) error
+	// Rename renames a file, replacing newname if it exists.
+	Rename(oldname, newname string) error
+}
+
+// OSFileSystem is the FileSystem backed by the OS. Direct files use direct I/O.
+var OSFileSystem FileSystem = osFileSystem{}
+
+type osFileSystem struct{}
+
+// A file opened on the OS FileSystem.
+type osFile struct {
+	*os.File
+}
+
+func (osFileSystem) OpenFile(name string, direct bool) (Storage, error) {
+	var file *os.File
+	var err error
+	if direct {
+		file, err = directio.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	} else {
+		file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return osFile{file}, nil
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (f osFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Read the whole of the named file, creating it if it doesn't exist.
+func readFile(fs FileSystem, name string) ([]byte, error) {
+	file, err := fs.OpenFile(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	contents := make([]byte, size)
+	if _, err := file.ReadAt(contents, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// SetFileSystem sets the FileSystem that files opened on this pool go through.
+func (pool *BufferPool) SetFileSystem(fs FileSystem) {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	pool.fs = fs
+}
+
+// GetFileSystem returns the FileSystem that files opened on this pool go through.
+func (pool *BufferPool) GetFileSystem() FileSystem {
+	pool.ptMtx.Lock()
+	defer pool.ptMtx.Unlock()
+	return pool.fs
+}
@@ -2,7 +2,6 @@ package query
 
 import (
 	"context"
-	"os"
 
 	db "github.com/brown-csci1270/db/pkg/db"
 	hash "github.com/brown-csci1270/db/pkg/hash"
@@ -26,36 +25,34 @@ type pair struct {
 }
 
 // buildHashIndex constructs a temporary hash table for all the entries in the given sourceTable.
+// The table lives in memory, spilling to an anonymous temp file if it outgrows its buffer pool.
 func buildHashIndex(
 	sourceTable db.Index,
 	useKey bool,
-) (tempIndex *hash.HashIndex, dbName string, err error) {
-	// Get a temporary db file.
-	dbName, err = db.GetTempDB()
-	if err != nil {
-		return nil, "", err
-	}
+) (tempIndex *hash.HashIndex, err error) {
 	// Init the temporary hash table.
-	tempIndex, err = hash.OpenTable(dbName)
+	tempIndex, err = hash.OpenTempTable()
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	// Build the hash index.
-	entries, err := sourceTable.Select();
+	entries, err := sourceTable.Select()
 	if err != nil {
-		return nil, "", err
+		tempIndex.Close()
+		return nil, err
 	}
-	for _, e := range entries{
+	for _, e := range entries {
 		if useKey {
-			err = tempIndex.Insert(e.GetKey(), e.GetValue());
+			err = tempIndex.Insert(e.GetKey(), e.GetValue())
 		} else {
-			err = tempIndex.Insert(e.GetValue(), e.GetKey());
+			err = tempIndex.Insert(e.GetValue(), e.GetKey())
 		}
 		if err != nil {
-			return nil, "", err
+			tempIndex.Close()
+			return nil, err
 		}
 	}
-	return tempIndex, dbName, err;
+	return tempIndex, nil
 }
 
 // sendResult attempts to send a single join result to the resultsChan channel as long as the errgroup hasn't been cancelled.
@@ -139,21 +136,18 @@ func Join(
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
 ) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
-	leftHashIndex, leftDbName, err := buildHashIndex(leftTable, joinOnLeftKey)
+	leftHashIndex, err := buildHashIndex(leftTable, joinOnLeftKey)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	rightHashIndex, rightDbName, err := buildHashIndex(rightTable, joinOnRightKey)
+	rightHashIndex, err := buildHashIndex(rightTable, joinOnRightKey)
 	if err != nil {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
+		leftHashIndex.Close()
 		return nil, nil, nil, nil, err
 	}
 	cleanupCallback := func() {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
-		os.Remove(rightDbName)
-		os.Remove(rightDbName + ".meta")
+		leftHashIndex.Close()
+		rightHashIndex.Close()
 	}
 	// Make both hash indices the same global size.
 	leftHashTable := leftHashIndex.GetTable()
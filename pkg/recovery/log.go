@@ -7,14 +7,20 @@ import (
 	"strconv"
 	"strings"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
 	uuid "github.com/google/uuid"
 )
 
 /*
    Logs come in the following forms:
 
+   TABLE log -- creation of a table, which may allow duplicate keys, or compress them:
+   < create btree|hash table name [duplicates] [compressed] >
+
    EDIT log -- actions that modify database state;
    < Tx, table, INSERT|DELETE|UPDATE, key, oldval, newval >
+   In a table with duplicate keys, an edit inserts or deletes the one entry
+   with the key and newval or oldval.
 
    START log -- start of a transaction:
    < Tx start >
@@ -42,7 +48,7 @@ const (
 
 // Convert a textual log to its respective struct.
 func FromString(s string) (Log, error) {
-	tableExp, _ := regexp.Compile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+) >"))
+	tableExp, _ := regexp.Compile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+)(?P<duplicates> duplicates)?(?P<compressed> compressed)? >"))
 	editExp, _ := regexp.Compile(fmt.Sprintf("< (?P<uuid>%s), (?P<table>\\w+), (?P<action>UPDATE|INSERT|DELETE), (?P<key>\\d+), (?P<oldval>\\d+), (?P<newval>\\d+) >", uuidPattern))
 	startExp, _ := regexp.Compile(fmt.Sprintf("< (%s) start >", uuidPattern))
 	commitExp, _ := regexp.Compile(fmt.Sprintf("< (%s) commit >", uuidPattern))
@@ -56,6 +62,7 @@ func FromString(s string) (Log, error) {
 		return &tableLog{
 			tblType: tblType,
 			tblName: tblName,
+			opts:    btree.TableOptions{Duplicates: expStrs[3] != "", CompressKeys: expStrs[4] != ""},
 		}, nil
 	case editExp.MatchString(s):
 		expStrs := editExp.FindStringSubmatch(s)
@@ -91,14 +98,27 @@ func FromString(s string) (Log, error) {
 
 var uuidPattern string = "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
 
-// Log for a transaction edit.
+// Log for a table creation.
 type tableLog struct {
 	tblType string
 	tblName string
+	opts    btree.TableOptions // The options of a B+tree.
 }
 
 func (tl *tableLog) toString() string {
-	return fmt.Sprintf("< create %s table %s >\n", tl.tblType, tl.tblName)
+	return fmt.Sprintf("< %s >\n", tl.payload())
+}
+
+// Get the payload of the command that creates the table.
+func (tl *tableLog) payload() string {
+	payload := fmt.Sprintf("create %s table %s", tl.tblType, tl.tblName)
+	if tl.opts.Duplicates {
+		payload += " duplicates"
+	}
+	if tl.opts.CompressKeys {
+		payload += " compressed"
+	}
+	return payload
 }
 
 // Log for a transaction edit.
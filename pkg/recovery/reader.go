@@ -10,12 +10,8 @@ import (
 
 func (rm *RecoveryManager) getRelevantStrings() (
 	relevantStrings []string, checkpointPos int, err error) {
-	fstats, err := rm.fd.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	scanner := backscanner.New(rm.fd, int(fstats.Size()))
+	// Anything past the end of the last line written is a line that failed to be written.
+	scanner := backscanner.New(rm.log, int(rm.logSize))
 	checkpointTarget := []byte("checkpoint")
 	startTarget := []byte("start")
 	relevantStrings = make([]string, 0)
@@ -30,6 +26,10 @@ func (rm *RecoveryManager) getRelevantStrings() (
 				return nil, 0, err
 			}
 		}
+		line, err = rm.openLine(line)
+		if err != nil {
+			return nil, 0, err
+		}
 		relevantStrings = append([]string{string(line)}, relevantStrings...)
 		checkpointPos += 1
 		if checkpointHit {
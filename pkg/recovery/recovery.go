@@ -1,14 +1,20 @@
 package recovery
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
 	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	config "github.com/brown-csci1270/db/pkg/config"
 	db "github.com/brown-csci1270/db/pkg/db"
+	pager "github.com/brown-csci1270/db/pkg/pager"
 	"github.com/otiai10/copy"
 
 	uuid "github.com/google/uuid"
@@ -19,8 +25,10 @@ type RecoveryManager struct {
 	d       *db.Database
 	tm      *concurrency.TransactionManager
 	txStack map[uuid.UUID]([]Log)
-	fd      *os.File
+	log     pager.Storage // The log file, opened through the database's file system.
+	logSize int64         // Where the next log line is written.
 	mtx     sync.Mutex
+	aead    cipher.AEAD // Encrypts log lines, or nil.
 }
 
 // Construct a recovery manager.
@@ -29,91 +37,195 @@ func NewRecoveryManager(
 	tm *concurrency.TransactionManager,
 	logName string,
 ) (*RecoveryManager, error) {
-	fd, err := os.OpenFile(logName, os.O_APPEND|os.O_RDWR, 0666)
+	log, err := d.GetPool().GetFileSystem().OpenFile(logName, false)
 	if err != nil {
 		return nil, err
 	}
+	logSize, err := log.Size()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
 	return &RecoveryManager{
 		d:       d,
 		tm:      tm,
 		txStack: make(map[uuid.UUID][]Log),
-		fd:      fd,
+		log:     log,
+		logSize: logSize,
 	}, nil
 }
 
+// SetEncryptionKey encrypts the log lines written from now on with AES-GCM, and
+// expects every line read back during recovery to be encrypted with the same key.
+func (rm *RecoveryManager) SetEncryptionKey(key []byte) error {
+	aead, err := pager.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.aead = aead
+	return nil
+}
+
+// Encrypt a log line if a key is set. Encrypted lines hold the nonce
+// followed by the sealed text, in base64.
+func (rm *RecoveryManager) sealLine(s string) (string, error) {
+	if rm.aead == nil {
+		return s, nil
+	}
+	nonce := make([]byte, rm.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := rm.aead.Seal(nonce, nonce, []byte(strings.TrimSuffix(s, "\n")), nil)
+	return base64.StdEncoding.EncodeToString(sealed) + "\n", nil
+}
+
+// Decrypt a log line read from the log file if a key is set.
+func (rm *RecoveryManager) openLine(line []byte) ([]byte, error) {
+	if rm.aead == nil || len(line) == 0 {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil || len(sealed) < rm.aead.NonceSize() {
+		return nil, errors.New("log line is not encrypted")
+	}
+	nonceSize := rm.aead.NonceSize()
+	text, err := rm.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("log line can't be decrypted: wrong key or corrupted log")
+	}
+	return text, nil
+}
+
 // Write the string `s` to the log file. Expects rm.mtx to be locked
 func (rm *RecoveryManager) writeToBuffer(s string) error {
-	_, err := rm.fd.WriteString(s)
+	s, err := rm.sealLine(s)
 	if err != nil {
 		return err
 	}
-	err = rm.fd.Sync()
-	return err
+	// A line that fails to be written is overwritten by the next one.
+	n, err := rm.log.WriteAt([]byte(s), rm.logSize)
+	if err != nil {
+		return err
+	}
+	if err = rm.log.Sync(); err != nil {
+		return err
+	}
+	rm.logSize += int64(n)
+	return nil
 }
 
 // Write a Table log.
-func (rm *RecoveryManager) Table(tblType string, tblName string) {
+func (rm *RecoveryManager) Table(tblType string, tblName string, opts btree.TableOptions) error {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
-	log := tableLog{tblType, tblName}
-	rm.writeToBuffer(log.toString())
+	log := tableLog{tblType, tblName, opts}
+	return rm.writeToBuffer(log.toString())
 }
 
-// Write an Edit log.
-func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Action, key int64, oldval int64, newval int64) {
+// Write an Edit log. The edit is only added to the transaction's stack once
+// it is in the log, and must not be carried out otherwise.
+func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Action, key int64, oldval int64, newval int64) error {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 	log := editLog{clientId, table.GetName(), action, key, oldval, newval}
+	if err := rm.writeToBuffer(log.toString()); err != nil {
+		return err
+	}
 	rm.txStack[clientId] = append(rm.txStack[clientId], &log)
-	rm.writeToBuffer(log.toString())
+	return nil
+}
+
+// Log an edit that cancels out the transaction's last edit, which failed to
+// be carried out, and drop both from its stack.
+func (rm *RecoveryManager) cancelEdit(clientId uuid.UUID, table db.Index, action Action, key int64, oldval int64, newval int64) error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	stack := rm.txStack[clientId]
+	rm.txStack[clientId] = stack[:len(stack)-1]
+	log := editLog{clientId, table.GetName(), action, key, oldval, newval}
+	return rm.writeToBuffer(log.toString())
 }
 
 // Write a transaction start log.
-func (rm *RecoveryManager) Start(clientId uuid.UUID) {
+func (rm *RecoveryManager) Start(clientId uuid.UUID) error {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 	log := startLog{clientId}
+	if err := rm.writeToBuffer(log.toString()); err != nil {
+		return err
+	}
 	rm.txStack[clientId] = append(rm.txStack[clientId], &log)
-	rm.writeToBuffer(log.toString())
+	return nil
 }
 
-// Write a transaction commit log.
-func (rm *RecoveryManager) Commit(clientId uuid.UUID) {
+// Write a transaction commit log. The transaction isn't committed if it
+// can't be written.
+func (rm *RecoveryManager) Commit(clientId uuid.UUID) error {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 	log := commitLog{clientId}
+	if err := rm.writeToBuffer(log.toString()); err != nil {
+		return err
+	}
 	delete(rm.txStack, clientId)
-	rm.writeToBuffer(log.toString())
+	return nil
 }
 
-// Flush all pages to disk and write a checkpoint log.
-func (rm *RecoveryManager) Checkpoint() {
+// Flush all pages to disk and write a checkpoint log. Pages are synced
+// according to each pool's sync mode first; if anything can't be written,
+// no checkpoint is logged.
+func (rm *RecoveryManager) Checkpoint() error {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
+	// Keep tables from being vacuumed while their files are flushed and copied.
+	rm.d.LockFiles()
+	defer rm.d.UnlockFiles()
+	// Tables may share a buffer pool, so lock and flush each pool once.
+	pools := make(map[*pager.BufferPool]bool)
 	for _, tb := range rm.d.GetTables() {
-		tb.GetPager().LockAllUpdates()
-		tb.GetPager().FlushAllPages()
-		defer tb.GetPager().UnlockAllUpdates()
+		pools[tb.GetPager().GetPool()] = true
+	}
+	for pool := range pools {
+		pool.LockAllUpdates()
+		defer pool.UnlockAllUpdates()
+		if err := pool.FlushAllPages(); err != nil {
+			return fmt.Errorf("checkpoint failed: %v", err)
+		}
+		if err := pool.Sync(); err != nil {
+			return fmt.Errorf("checkpoint failed: %v", err)
+		}
 	}
 	activeTxs := make([]uuid.UUID, 0)
 	for tx, _ := range rm.txStack {
 		activeTxs = append(activeTxs, tx)
 	}
 	log := checkpointLog{activeTxs}
-	rm.writeToBuffer(log.toString())
-	rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+	if err := rm.writeToBuffer(log.toString()); err != nil {
+		return err
+	}
+	return rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
 }
 
 // Redo a given log's action.
 func (rm *RecoveryManager) Redo(log Log) error {
 	switch log := log.(type) {
 	case *tableLog:
-		payload := fmt.Sprintf("create %s table %s", log.tblType, log.tblName)
-		err := db.HandleCreateTable(rm.d, payload, os.Stdout)
+		err := db.HandleCreateTable(rm.d, log.payload(), os.Stdout)
 		if err != nil {
 			return err
 		}
 	case *editLog:
+		table, err := rm.d.GetTable(log.tablename)
+		if err != nil {
+			return err
+		}
+		// In a table with duplicate keys, redo the edit of exactly the logged entry.
+		if bt, ok := duplicatesTable(table); ok {
+			return redoPair(bt, log)
+		}
 		switch log.action {
 		case INSERT_ACTION:
 			payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
@@ -150,14 +262,43 @@ func (rm *RecoveryManager) Redo(log Log) error {
 	return nil
 }
 
+// Redo an edit of a table with duplicate keys, which only ever inserts or
+// deletes the one logged entry. An entry that is already there or already
+// gone has been redone.
+func redoPair(bt *btree.BTreeIndex, log *editLog) error {
+	switch log.action {
+	case INSERT_ACTION:
+		found, err := hasPair(bt, log.key, log.newval)
+		if err != nil || found {
+			return err
+		}
+		return bt.Insert(log.key, log.newval)
+	case DELETE_ACTION:
+		found, err := hasPair(bt, log.key, log.oldval)
+		if err != nil || !found {
+			return err
+		}
+		return bt.DeletePair(log.key, log.oldval)
+	}
+	return fmt.Errorf("cannot redo an %s in a table with duplicate keys", strings.ToLower(string(log.action)))
+}
+
 // Undo a given log's action.
 func (rm *RecoveryManager) Undo(log Log) error {
 	switch log := log.(type) {
 	case *editLog:
 		switch log.action {
 		case INSERT_ACTION:
+			// In a table with duplicate keys, only the inserted entry is deleted.
+			table, err := rm.d.GetTable(log.tablename)
+			if err != nil {
+				return err
+			}
+			if bt, ok := duplicatesTable(table); ok {
+				return handleDeletePair(rm.tm, rm, bt, log.key, log.newval, log.id)
+			}
 			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
-			err := HandleDelete(rm.d, rm.tm, rm, payload, log.id)
+			err = HandleDelete(rm.d, rm.tm, rm, payload, log.id)
 			if err != nil {
 				return err
 			}
@@ -180,9 +321,49 @@ func (rm *RecoveryManager) Undo(log Log) error {
 	return nil
 }
 
+// Get a table as a B+tree with duplicate keys, if it is one.
+func duplicatesTable(table db.Index) (*btree.BTreeIndex, bool) {
+	bt, ok := table.(*btree.BTreeIndex)
+	return bt, ok && bt.AllowsDuplicates()
+}
+
+// Get the values of the entries with the given key in a table with duplicate keys.
+func pairValues(bt *btree.BTreeIndex, key int64) ([]int64, error) {
+	it, err := bt.FindAll(key)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	values := make([]int64, 0)
+	for {
+		entry, err := it.Next()
+		if err != nil || entry == nil {
+			return values, err
+		}
+		values = append(values, entry.GetValue())
+	}
+}
+
+// Check whether a table with duplicate keys holds the entry with the given key and value.
+func hasPair(bt *btree.BTreeIndex, key int64, value int64) (bool, error) {
+	values, err := pairValues(bt, key)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if v == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Do a full recovery to the most recent checkpoint on startup.
 func (rm *RecoveryManager) Recover() error {
-	logs, checkPointPos, _ := rm.readLogs()
+	logs, checkPointPos, err := rm.readLogs()
+	if err != nil {
+		return err
+	}
 	undoList := make(map[uuid.UUID]bool, 0)
 	if checkPointPos >= len(logs) || checkPointPos < 0 {
 		checkPointPos = 0
@@ -222,7 +403,9 @@ func (rm *RecoveryManager) Recover() error {
 		case *startLog:
 			if undoList[log.id] == true {
 				err := rm.tm.Commit(log.id)
-				rm.Commit(log.id)
+				if logErr := rm.Commit(log.id); err == nil {
+					err = logErr
+				}
 				if err != nil {
 					return err
 				}
@@ -255,15 +438,19 @@ func (rm *RecoveryManager) Rollback(clientId uuid.UUID) error {
 		return errors.New("Invalid rollback: not begin with no start log")
 	}
 	err := rm.tm.Commit(clientId)
-	rm.Commit(clientId)
-	if err != nil {
-		return err
+	if logErr := rm.Commit(clientId); err == nil {
+		err = logErr
 	}
-	return nil
+	return err
 }
 
 // Primes the database for recovery
 func Prime(folder string) (*db.Database, error) {
+	return PrimeWithPool(folder, pager.NewBufferPool(config.PoolPages, pager.NewLRUPolicy()))
+}
+
+// Primes the database for recovery; all tables cache their pages in the given pool.
+func PrimeWithPool(folder string, pool *pager.BufferPool) (*db.Database, error) {
 	// Ensure folder is of the form */
 	base := strings.TrimSuffix(folder, "/")
 	recoveryFolder := base + "-recovery/"
@@ -274,13 +461,13 @@ func Prime(folder string) (*db.Database, error) {
 			if err != nil {
 				return nil, err
 			}
-			return db.Open(dbFolder)
+			return db.OpenWithPool(dbFolder, pool)
 		}
 		return nil, err
 	}
 	if _, err := os.Stat(recoveryFolder); err != nil {
 		if os.IsNotExist(err) {
-			return db.Open(dbFolder)
+			return db.OpenWithPool(dbFolder, pool)
 		}
 		return nil, err
 	}
@@ -289,7 +476,7 @@ func Prime(folder string) (*db.Database, error) {
 	if err != nil {
 		return nil, err
 	}
-	return db.Open(dbFolder)
+	return db.OpenWithPool(dbFolder, pool)
 }
 
 // Should be called at end of Checkpoint.
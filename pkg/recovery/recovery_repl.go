@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
 	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
 	db "github.com/brown-csci1270/db/pkg/db"
 	query "github.com/brown-csci1270/db/pkg/query"
@@ -20,7 +21,7 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	r := repl.NewRepl()
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Create a table. usage: create table <table>")
+	}, "Create a table. usage: create <btree|hash> table <table>, or create btree table <table> [duplicates] [compressed]")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Find an element. usage: find <key> from <table>")
@@ -35,7 +36,7 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	}, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Select elements from a table. usage: select from <table>")
+	}, "Select elements from a table. usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]")
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Create a table. usage: create table <table>")
@@ -57,6 +58,9 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.AddCommand("vacuum", func(payload string, replConfig *repl.REPLConfig) error {
+		return db.HandleVacuum(d, payload, replConfig.GetWriter())
+	}, "Rebuild a table with densely packed pages. usage: vacuum <table>")
 	return r
 }
 
@@ -70,11 +74,14 @@ func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *R
 	}
 	switch fields[1] {
 	case "begin":
-		rm.Start(clientId)
+		if err = rm.Start(clientId); err != nil {
+			return err
+		}
 		err = tm.Begin(clientId)
 	case "commit":
-		rm.Commit(clientId)
-		err = tm.Commit(clientId)
+		if err = rm.Commit(clientId); err == nil {
+			err = tm.Commit(clientId)
+		}
 	default:
 		return errors.New("internal error in create table handler")
 	}
@@ -89,13 +96,13 @@ func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *R
 
 // Handle create table.
 func HandleCreateTable(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
-	fields := strings.Fields(payload)
-	numFields := len(fields)
-	// Usage: create <type> table <table>
-	if numFields != 4 || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
-		return fmt.Errorf("usage: create <btree|hash> table <table>")
+	tblType, tblName, opts, err := db.ParseCreateTable(payload)
+	if err != nil {
+		return err
+	}
+	if err = rm.Table(tblType, tblName, opts); err != nil {
+		return err
 	}
-	rm.Table(fields[1], fields[3])
 	return db.HandleCreateTable(d, payload, w)
 }
 
@@ -123,26 +130,36 @@ func HandleInsert(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	if table, err = d.GetTable(fields[4]); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
-	// First, check that the desired value doesn't exist.
-	_, err = table.Find(int64(key))
-	if err == nil {
+	// First, check that the desired value doesn't exist; in a table with
+	// duplicate keys, only the entry itself can't.
+	if bt, ok := duplicatesTable(table); ok {
+		found, err := hasPair(bt, int64(key), int64(newval))
+		if err != nil {
+			return fmt.Errorf("insert error: %v", err)
+		}
+		if found {
+			return errors.New("insert error: entry already exists")
+		}
+	} else if _, err = table.Find(int64(key)); err == nil {
 		return errors.New("insert error: key already exists")
 	}
 	// Log.
-	rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, int64(newval))
+	if err = rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, int64(newval)); err != nil {
+		return err
+	}
 	// Run transaction insert.
 	err = concurrency.HandleInsert(d, tm, payload, clientId)
 	if err != nil {
-		// Add a log to mark this insert as a no-op.
-		rm.Edit(clientId, table, DELETE_ACTION, int64(key), int64(newval), int64(0))
-		// Then pop the last two actions from the transaction stack because
-		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		// Add a log to mark this insert as a no-op,
+		// and pop the failed action from the transaction stack.
+		logErr := rm.cancelEdit(clientId, table, DELETE_ACTION, int64(key), int64(newval), int64(0))
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
 		}
+		if logErr != nil {
+			return logErr
+		}
 	}
 	return err
 }
@@ -166,26 +183,32 @@ func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	if table, err = d.GetTable(fields[1]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
+	// Entries of a table with duplicate keys can't be told apart by key.
+	if _, ok := duplicatesTable(table); ok {
+		return errors.New("update error: cannot update by key in a table with duplicate keys")
+	}
 	// First, check that the desired value exists.
 	oldval, err := table.Find(int64(key))
 	if err != nil {
 		return errors.New("update error: key doesn't exists")
 	}
 	// Log.
-	rm.Edit(clientId, table, UPDATE_ACTION, int64(key), oldval.GetValue(), int64(newval))
+	if err = rm.Edit(clientId, table, UPDATE_ACTION, int64(key), oldval.GetValue(), int64(newval)); err != nil {
+		return err
+	}
 	// Run transaction insert.
 	err = concurrency.HandleUpdate(d, tm, payload, clientId)
 	if err != nil {
-		// Add a log to mark this update as a no-op.
-		rm.Edit(clientId, table, UPDATE_ACTION, int64(key), int64(newval), oldval.GetValue())
-		// Then pop the last two actions from the transaction stack because
-		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		// Add a log to mark this update as a no-op,
+		// and pop the failed action from the transaction stack.
+		logErr := rm.cancelEdit(clientId, table, UPDATE_ACTION, int64(key), int64(newval), oldval.GetValue())
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
 		}
+		if logErr != nil {
+			return logErr
+		}
 	}
 	return err
 }
@@ -206,37 +229,105 @@ func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	if table, err = d.GetTable(fields[3]); err != nil {
 		return fmt.Errorf("delete error: %v", err)
 	}
+	if bt, ok := duplicatesTable(table); ok {
+		return handleDeleteAll(d, tm, rm, bt, payload, int64(key), clientId)
+	}
 	// First, check that the desired value exists.
 	oldval, err := table.Find(int64(key))
 	if err != nil {
 		return errors.New("delete error: key doesn't exists")
 	}
 	// Log.
-	rm.Edit(clientId, table, DELETE_ACTION, int64(key), oldval.GetValue(), 0)
+	if err = rm.Edit(clientId, table, DELETE_ACTION, int64(key), oldval.GetValue(), 0); err != nil {
+		return err
+	}
 	// Run transaction insert.
 	err = concurrency.HandleDelete(d, tm, payload, clientId)
 	if err != nil {
-		// Add a log to mark this delete as a no-op.
-		rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, oldval.GetValue())
-		// Then pop the last two actions from the transaction stack because
-		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		// Add a log to mark this delete as a no-op,
+		// and pop the failed action from the transaction stack.
+		logErr := rm.cancelEdit(clientId, table, INSERT_ACTION, int64(key), 0, oldval.GetValue())
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
 		}
+		if logErr != nil {
+			return logErr
+		}
 	}
 	return err
 }
 
+// Delete every entry with the given key from a table with duplicate keys,
+// logging the deletion of each one.
+func handleDeleteAll(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, bt *btree.BTreeIndex, payload string, key int64, clientId uuid.UUID) (err error) {
+	// First, check that the desired values exist.
+	values, err := pairValues(bt, key)
+	if err != nil {
+		return fmt.Errorf("delete error: %v", err)
+	}
+	if len(values) == 0 {
+		return errors.New("delete error: key doesn't exists")
+	}
+	// Log.
+	for i, value := range values {
+		if err = rm.Edit(clientId, bt, DELETE_ACTION, key, value, 0); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				rm.cancelEdit(clientId, bt, INSERT_ACTION, key, 0, values[j])
+			}
+			return err
+		}
+	}
+	// Run transaction delete.
+	err = concurrency.HandleDelete(d, tm, payload, clientId)
+	if err != nil {
+		// Add logs to mark these deletes as no-ops,
+		// and pop the failed actions from the transaction stack.
+		var logErr error
+		for j := len(values) - 1; j >= 0; j-- {
+			if curErr := rm.cancelEdit(clientId, bt, INSERT_ACTION, key, 0, values[j]); logErr == nil {
+				logErr = curErr
+			}
+		}
+		rberr := rm.Rollback(clientId)
+		if rberr != nil {
+			return rberr
+		}
+		if logErr != nil {
+			return logErr
+		}
+	}
+	return err
+}
+
+// Delete the entry with the given key and value from a table with duplicate
+// keys, leaving the key's other entries be. It is only used to undo inserts,
+// so a failure is left to the rollback it is part of.
+func handleDeletePair(tm *concurrency.TransactionManager, rm *RecoveryManager, bt *btree.BTreeIndex, key int64, value int64, clientId uuid.UUID) (err error) {
+	// Log.
+	if err = rm.Edit(clientId, bt, DELETE_ACTION, key, value, 0); err != nil {
+		return err
+	}
+	// Run transaction delete.
+	if err = tm.Lock(clientId, bt, key, concurrency.W_LOCK); err == nil {
+		err = bt.DeletePair(key, value)
+	}
+	if err != nil {
+		// Add a log to mark this delete as a no-op,
+		// and pop the failed action from the transaction stack.
+		rm.cancelEdit(clientId, bt, INSERT_ACTION, key, 0, value)
+		return fmt.Errorf("delete error: %v", err)
+	}
+	return nil
+}
+
 // Handle select.
 func HandleSelect(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: select from <table>
-	if numFields != 3 || fields[1] != "from" {
-		return fmt.Errorf("usage: select from <table>")
+	// Usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]
+	if numFields < 3 || fields[1] != "from" {
+		return fmt.Errorf("usage: select from <table> [where key between <lo> and <hi>] [order by key <asc|desc>]")
 	}
 	// NOTE: Select is unsafe; not locking anything. May provide an inconsistent view of the database.
 	err = db.HandleSelect(d, payload, w)
@@ -269,9 +360,7 @@ func HandleCheckpoint(d *db.Database, tm *concurrency.TransactionManager, rm *Re
 	if numFields != 1 {
 		return fmt.Errorf("usage: checkpoint")
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	rm.Checkpoint()
-	return err
+	return rm.Checkpoint()
 }
 
 // Handle abort.
@@ -71,8 +71,8 @@ func (r *REPL) GetHelp() map[string]string {
 
 // Add a command, along with its help string, to the set of commands.
 func (r *REPL) AddCommand(trigger string, action func(string, *REPLConfig) error, help string) {
+	// Meta commands are reserved, and can't be added.
 	if strings.HasPrefix(trigger, ".") {
-		fmt.Errorf("Cannot add meta commands")
 		return
 	}
 	r.commands[trigger] = action
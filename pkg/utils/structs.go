@@ -13,3 +13,9 @@ type Cursor interface {
 	IsEnd() bool
 	GetEntry() (Entry, error)
 }
+
+// Interface for a cursor that can also traverse a table backwards.
+type BidirectionalCursor interface {
+	Cursor
+	StepBackward() error
+}
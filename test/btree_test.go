@@ -0,0 +1,1390 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+func TestBTree(t *testing.T) {
+	t.Run("TestBTreeDelete", testBTreeDelete)
+	t.Run("TestRangeIterator", testRangeIterator)
+	t.Run("TestReverseCursor", testReverseCursor)
+	t.Run("TestBulkLoad", testBulkLoad)
+	t.Run("TestByteKeys", testByteKeys)
+	t.Run("TestOverflowValues", testOverflowValues)
+	t.Run("TestDuplicateKeys", testDuplicateKeys)
+	t.Run("TestFixedWidthNodes", testFixedWidthNodes)
+	t.Run("TestKeyPrefixes", testKeyPrefixes)
+	t.Run("TestOptimisticLocking", testOptimisticLocking)
+}
+
+// =====================================================================
+// HELPERS
+// =====================================================================
+
+// Open a B+tree with the given options in a new temporary file, which the caller should remove.
+func openTempBTree(t *testing.T, opts btree.TableOptions) (*btree.BTreeIndex, string) {
+	t.Helper()
+	dbName := getTempBTreeDB(t)
+	index, err := btree.OpenTableWithOptions(dbName, nil, opts)
+	if err != nil {
+		os.Remove(dbName)
+		t.Fatal(err)
+	}
+	return index, dbName
+}
+
+// =====================================================================
+// TESTS (B+tree deletion)
+// =====================================================================
+
+func testBTreeDelete(t *testing.T) {
+	index, dbName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(dbName)
+	defer index.Close()
+	n := 20000
+	for _, key := range rand.Perm(n) {
+		if err := index.Insert(int64(key), int64(key*3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Delete all but every 50th key in random order; the tree stays balanced throughout.
+	for i, key := range rand.Perm(n) {
+		if key%50 == 0 {
+			continue
+		}
+		if err := index.Delete(int64(key)); err != nil {
+			t.Fatal(err)
+		}
+		if i%1000 == 0 {
+			if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+				t.Fatalf("tree is not a valid B+tree after %d deletes: %v", i, err)
+			}
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree is not a valid B+tree after deleting: %v", err)
+	}
+	if index.GetPager().GetNumFreePages() == 0 {
+		t.Error("deleting most entries freed no pages")
+	}
+	for key := 0; key < n; key++ {
+		entry, err := index.Find(int64(key))
+		if key%50 != 0 {
+			if err == nil {
+				t.Fatalf("found deleted key %d", key)
+			}
+		} else if err != nil || entry.GetValue() != int64(key*3) {
+			t.Fatalf("lost key %d while deleting others", key)
+		}
+	}
+	if entries, err := index.Select(); err != nil || len(entries) != n/50 {
+		t.Fatalf("select returned %d entries, expected %d: %v", len(entries), n/50, err)
+	}
+	// Emptying the tree shrinks it back to a lone root leaf.
+	for key := 0; key < n; key += 50 {
+		if err := index.Delete(int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := index.GetPager()
+	if p.GetNumFreePages() != p.GetNumPages()-1 {
+		t.Errorf("empty tree still uses %d pages", p.GetNumPages()-p.GetNumFreePages())
+	}
+	if entries, err := index.Select(); err != nil || len(entries) != 0 {
+		t.Fatalf("select on an empty tree returned %d entries: %v", len(entries), err)
+	}
+	// The freed pages are reused as the tree grows again.
+	for key := 0; key < n; key++ {
+		if err := index.Insert(int64(key), int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.GetNumFreePages() != 0 {
+		t.Errorf("refilling the tree left %d pages free", p.GetNumFreePages())
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Errorf("refilled tree is not a valid B+tree: %v", err)
+	}
+}
+
+// =====================================================================
+// TESTS (Range iterators)
+// =====================================================================
+
+// Collect the keys that a range iterator returns.
+func rangeKeys(t *testing.T, index *btree.BTreeIndex, start int64, end int64, opts btree.RangeOptions) []int64 {
+	t.Helper()
+	it, err := index.RangeIterator(start, end, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	keys := make([]int64, 0)
+	for {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return keys
+		}
+		keys = append(keys, entry.GetKey())
+	}
+}
+
+func testRangeIterator(t *testing.T) {
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetPinTracking(true)
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTableWithPool(dbName, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Even keys only, spread over many leaves.
+	n := int64(5000)
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(2*i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evens := func(lo int64, hi int64) []int64 {
+		keys := make([]int64, 0)
+		for k := lo; k <= hi; k += 2 {
+			keys = append(keys, k)
+		}
+		return keys
+	}
+	cases := []struct {
+		name       string
+		start, end int64
+		opts       btree.RangeOptions
+		expected   []int64
+	}{
+		{"inclusive", 100, 200, btree.RangeOptions{}, evens(100, 200)},
+		{"exclusive", 100, 200, btree.RangeOptions{StartExclusive: true, EndExclusive: true}, evens(102, 198)},
+		{"bounds between keys", 101, 199, btree.RangeOptions{}, evens(102, 198)},
+		{"single key", 300, 300, btree.RangeOptions{}, []int64{300}},
+		{"empty", 300, 300, btree.RangeOptions{EndExclusive: true}, []int64{}},
+		{"reversed", 200, 100, btree.RangeOptions{}, []int64{}},
+		{"no start", 0, 10, btree.RangeOptions{NoStart: true}, evens(0, 10)},
+		{"no end", 2*n - 10, 0, btree.RangeOptions{NoEnd: true}, evens(2*n-10, 2*n-2)},
+		{"everything", 0, 0, btree.RangeOptions{NoStart: true, NoEnd: true}, evens(0, 2*n-2)},
+		{"limit", 1000, 0, btree.RangeOptions{NoEnd: true, Limit: 5}, evens(1000, 1008)},
+		{"past the end", 2 * n, 3 * n, btree.RangeOptions{}, []int64{}},
+	}
+	for _, c := range cases {
+		keys := rangeKeys(t, index, c.start, c.end, c.opts)
+		if len(keys) != len(c.expected) {
+			t.Errorf("%s: got %d keys, expected %d", c.name, len(keys), len(c.expected))
+			continue
+		}
+		for i := range keys {
+			if keys[i] != c.expected[i] {
+				t.Errorf("%s: got key %d at %d, expected %d", c.name, keys[i], i, c.expected[i])
+				break
+			}
+		}
+	}
+	checkPinLeaks(t, pool)
+	// The iterator only keeps the leaf it is on pinned, and picks up where it
+	// left off even if the table changes under it.
+	it, err := index.RangeIterator(0, 0, btree.RangeOptions{NoStart: true, NoEnd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int64 = -1
+	for i := 0; ; i++ {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.GetKey() <= last {
+			t.Fatalf("iterator went back from %d to %d", last, entry.GetKey())
+		}
+		last = entry.GetKey()
+		if pins := pool.GetOutstandingPins(); len(pins) != 1 {
+			t.Fatalf("iterator holds %d pins, expected 1", len(pins))
+		}
+		if i == 100 {
+			for k := last + 1; k < last+400; k += 2 {
+				if err := index.Insert(k, k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k := last - 100; k <= last; k += 2 {
+				if err := index.Delete(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if last != 2*n-2 {
+		t.Errorf("iterator stopped at %d, expected %d", last, 2*n-2)
+	}
+	checkPinLeaks(t, pool)
+}
+
+// =====================================================================
+// TESTS (Reverse cursors)
+// =====================================================================
+
+// Walk a B+tree backwards from its last entry, collecting the keys.
+// writeLegacyBTree writes a table holding keys 0 to n-1, each with itself as
+// its value, in the node layout of the given format version from before nodes
+// were slotted pages. Its root points at leaves of 100 entries each.
+func writeLegacyBTree(t *testing.T, filename string, version int64, n int64) {
+	t.Helper()
+	p := pager.NewPager()
+	if err := p.Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	field := btree.LEGACY_FIELD_SIZE
+	putField := func(data []byte, offset int64, x int64) {
+		binary.PutVarint(data[offset:offset+field], x)
+	}
+	leafHeaderSize := btree.LEAF_NODE_HEADER_SIZE_V2
+	if version < btree.LEFT_LINKS_VERSION {
+		leafHeaderSize = btree.LEAF_NODE_HEADER_SIZE_V1
+	}
+	root, err := p.GetPage(p.GetFreePN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootData := *root.GetData()
+	maxKeys := (p.GetPageSize()-btree.LEGACY_NODE_HEADER_SIZE-field)/(2*field) - 1
+	pnsOffset := btree.LEGACY_NODE_HEADER_SIZE + field*(maxKeys+1)
+	nLeaves := (n + 99) / 100
+	putField(rootData, btree.NUM_KEYS_OFFSET, nLeaves-1)
+	for i := int64(0); i < nLeaves; i++ {
+		page, err := p.GetPage(p.GetFreePN())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pn, data := page.GetPageNum(), *page.GetData()
+		first, last := i*100, (i+1)*100
+		if last > n {
+			last = n
+		}
+		data[btree.NODETYPE_OFFSET] = 1
+		putField(data, btree.NUM_KEYS_OFFSET, last-first)
+		if putField(data, btree.LEGACY_NODE_HEADER_SIZE, pn+1); i == nLeaves-1 {
+			putField(data, btree.LEGACY_NODE_HEADER_SIZE, -1)
+		}
+		if version >= btree.LEFT_LINKS_VERSION {
+			if putField(data, btree.LEGACY_NODE_HEADER_SIZE+field, pn-1); i == 0 {
+				putField(data, btree.LEGACY_NODE_HEADER_SIZE+field, -1)
+			}
+		}
+		for key := first; key < last; key++ {
+			pos := leafHeaderSize + (key-first)*btree.LEGACY_ENTRYSIZE
+			putField(data, pos, key)
+			putField(data, pos+field, key)
+		}
+		page.SetDirty(true)
+		page.Put()
+		putField(rootData, pnsOffset+i*field, pn)
+		if i > 0 {
+			putField(rootData, btree.LEGACY_NODE_HEADER_SIZE+(i-1)*field, first)
+		}
+	}
+	root.SetDirty(true)
+	root.Put()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	patchHeaderField(t, filename, pager.HEADER_VERSION_OFFSET, version)
+}
+
+func keysBackward(t *testing.T, index *btree.BTreeIndex) []int64 {
+	t.Helper()
+	cursor, err := index.TableEnd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]int64, 0)
+	if cursor.IsEnd() {
+		return keys
+	}
+	for {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, entry.GetKey())
+		if cursor.StepBackward() != nil {
+			return keys
+		}
+	}
+}
+
+func testReverseCursor(t *testing.T) {
+	index, dbName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(dbName)
+	if keys := keysBackward(t, index); len(keys) != 0 {
+		t.Errorf("empty table has %d keys going backwards", len(keys))
+	}
+	n := 5000
+	for _, key := range rand.Perm(n) {
+		if err := index.Insert(int64(key), int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleting merges leaves, which has to keep the links in both directions intact.
+	for key := 0; key < n; key++ {
+		if key%3 != 0 {
+			if err := index.Delete(int64(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree is not a valid B+tree with sibling links: %v", err)
+	}
+	keys := keysBackward(t, index)
+	if len(keys) != (n+2)/3 {
+		t.Fatalf("got %d keys going backwards, expected %d", len(keys), (n+2)/3)
+	}
+	for i, key := range keys {
+		if expected := int64(3 * (len(keys) - 1 - i)); key != expected {
+			t.Fatalf("got key %d at %d going backwards, expected %d", key, i, expected)
+		}
+	}
+	// A cursor can turn around.
+	cursor, err := index.TableFind(300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		backward bool
+		key      int64
+	}{{true, 297}, {true, 294}, {false, 297}, {false, 300}, {false, 303}} {
+		if step.backward {
+			err = cursor.StepBackward()
+		} else {
+			err = cursor.StepForward()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != step.key {
+			t.Fatalf("cursor is at %v after stepping, expected %d: %v", entry, step.key, err)
+		}
+	}
+	index.Close()
+	// Select stops at the end of the table, and reports any other error.
+	fs := pager.NewFaultyFS(1)
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetFileSystem(fs)
+	faultyName := getTempBTreeDB(t)
+	defer os.Remove(faultyName)
+	if index, err = btree.OpenTableWithPool(faultyName, pool); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10000; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := index.Select(); err != nil || len(entries) != 10000 {
+		t.Fatalf("selected %d entries, expected 10000: %v", len(entries), err)
+	}
+	// Read the first leaf in, so that only a later one fails to be read.
+	if _, err := index.TableStart(); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetShortReads(1)
+	if entries, err := index.Select(); err == nil {
+		t.Errorf("selected %d entries while reads were failing, expected an error", len(entries))
+	}
+	fs.SetShortReads(0)
+	index.Close()
+	// Files written before leaves linked back, or before nodes were slotted
+	// pages, are rebuilt when they're opened.
+	for _, version := range []int64{1, 2} {
+		oldName := getTempBTreeDB(t)
+		defer os.Remove(oldName)
+		writeLegacyBTree(t, oldName, version, int64(n))
+		if index, err = btree.OpenTable(oldName); err != nil {
+			t.Fatalf("opening a version %d table failed: %v", version, err)
+		}
+		if v := index.GetPager().GetFileInfo().Version; v != pager.FORMAT_VERSION {
+			t.Errorf("upgraded table has format version %d, expected %d", v, pager.FORMAT_VERSION)
+		}
+		if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+			t.Fatalf("upgraded table is not a valid B+tree: %v", err)
+		}
+		if upgraded := keysBackward(t, index); len(upgraded) != n || upgraded[0] != int64(n-1) {
+			t.Errorf("upgraded table has %d keys, expected %d", len(upgraded), n)
+		}
+		index.Close()
+	}
+}
+
+// =====================================================================
+// TESTS (Bulk loading)
+// =====================================================================
+
+// An iterator over the keys from next up to end, each with twice its key as its value.
+type keySequence struct {
+	next int64
+	end  int64
+}
+
+func (seq *keySequence) Next() (utils.Entry, error) {
+	if seq.next >= seq.end {
+		return nil, nil
+	}
+	entry := btree.BTreeEntry{}
+	entry.SetKey(seq.next)
+	entry.SetValue(seq.next * 2)
+	seq.next++
+	return entry, nil
+}
+
+// An iterator over the keys from 0 up to end, each with a value of size
+// bytes, that fails once it reaches the key fail.
+type failingSequence struct {
+	next int64
+	end  int64
+	fail int64
+	size int
+}
+
+func (seq *failingSequence) Next() (utils.Entry, error) {
+	if seq.next == seq.fail {
+		return nil, errors.New("failing sequence failed")
+	}
+	if seq.next >= seq.end {
+		return nil, nil
+	}
+	entry := btree.BTreeEntry{}
+	entry.SetKey(seq.next)
+	entry.SetValueBytes(bytes.Repeat([]byte{byte(seq.next)}, seq.size))
+	seq.next++
+	return entry, nil
+}
+
+func testBulkLoad(t *testing.T) {
+	// Build tables of all sizes, packed tightly and loosely; each must hold
+	// up to later deletes as well as one built by inserts would.
+	for _, fill := range []float64{0.5, 0.75, 1} {
+		for _, n := range []int64{0, 1, 150, 203, 204, 405, 20000, 60000} {
+			index, dbName := openTempBTree(t, btree.TableOptions{})
+			if err := btree.BulkLoad(index, &keySequence{end: n}, fill); err != nil {
+				t.Fatalf("bulk loading %d entries at fill %v failed: %v", n, fill, err)
+			}
+			if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+				t.Fatalf("bulk loading %d entries at fill %v made an invalid B+tree: %v", n, fill, err)
+			}
+			if keys := rangeKeys(t, index, 0, 0, btree.RangeOptions{NoStart: true, NoEnd: true}); int64(len(keys)) != n {
+				t.Errorf("bulk loading %d entries at fill %v kept %d", n, fill, len(keys))
+			}
+			for key := int64(0); key < n; key += 7 {
+				if entry, err := index.Find(key); err != nil || entry.GetValue() != key*2 {
+					t.Fatalf("key %d missing after bulk loading at fill %v", key, fill)
+				}
+				if err := index.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+				t.Fatalf("deleting from a bulk-loaded B+tree made it invalid: %v", err)
+			}
+			index.Close()
+			os.Remove(dbName)
+		}
+	}
+	// A densely loaded table takes fewer pages than one built by inserts.
+	loaded, loadedName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(loadedName)
+	defer loaded.Close()
+	inserted, insertedName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(insertedName)
+	defer inserted.Close()
+	if err := btree.BulkLoad(loaded, &keySequence{end: 20000}, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range rand.Perm(20000) {
+		if err := inserted.Insert(int64(key), int64(key)*2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l, i := loaded.GetPager().GetNumPages(), inserted.GetPager().GetNumPages(); l >= i {
+		t.Errorf("bulk loading took %d pages, inserting took %d", l, i)
+	}
+	// Bad fill factors, full tables, and unsorted entries are refused.
+	if err := btree.BulkLoad(inserted, &keySequence{end: 10}, 1); err == nil {
+		t.Error("bulk loaded into a table that isn't empty")
+	}
+	empty, emptyName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(emptyName)
+	defer empty.Close()
+	for _, fill := range []float64{0, 0.3, 1.5} {
+		if err := btree.BulkLoad(empty, &keySequence{end: 10}, fill); err == nil {
+			t.Errorf("bulk loaded with a fill factor of %v", fill)
+		}
+	}
+	it, err := loaded.RangeIterator(100, 0, btree.RangeOptions{NoEnd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := btree.BulkLoad(empty, it, 1); err != nil {
+		t.Errorf("bulk loading from a range iterator failed: %v", err)
+	}
+	it.Close()
+	// A load that fails partway frees what it built, and leaves the table
+	// empty, so it can be loaded again.
+	failed, failedName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(failedName)
+	defer failed.Close()
+	for _, size := range []int{8, 3 * int(pager.PAGESIZE)} {
+		if err := btree.BulkLoad(failed, &failingSequence{end: 5000, fail: 4000, size: size}, 1); err == nil {
+			t.Fatalf("bulk loading with %d byte values didn't fail", size)
+		}
+		p := failed.GetPager()
+		if inUse := p.GetNumPages() - p.GetNumFreePages(); inUse != 1 {
+			t.Errorf("a failed bulk load with %d byte values left %d pages in use", size, inUse)
+		}
+		if keys := rangeKeys(t, failed, 0, 0, btree.RangeOptions{NoStart: true, NoEnd: true}); len(keys) != 0 {
+			t.Errorf("a failed bulk load with %d byte values left %d keys", size, len(keys))
+		}
+	}
+	if err := btree.BulkLoad(failed, &failingSequence{end: 5000, fail: -1, size: 8}, 1); err != nil {
+		t.Fatalf("bulk loading after a failed load failed: %v", err)
+	}
+	if _, _, ok, err := btree.IsBTree(failed); err != nil || !ok {
+		t.Fatalf("bulk loading after a failed load made an invalid B+tree: %v", err)
+	}
+	checkPinLeaks(t, loaded.GetPager().GetPool())
+}
+
+// randomBytes returns a random byte string of length in [min, max).
+func randomBytes(min int, max int) []byte {
+	data := make([]byte, min+rand.Intn(max-min))
+	rand.Read(data)
+	return data
+}
+
+func testByteKeys(t *testing.T) {
+	index, dbName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Keys and values of all lengths go in, and come back out in byte order.
+	entries := make(map[string][]byte)
+	for len(entries) < 5000 {
+		key, value := randomBytes(1, 60), randomBytes(0, 200)
+		if _, ok := entries[string(key)]; ok {
+			continue
+		}
+		if err := index.InsertBytes(key, value); err != nil {
+			t.Fatalf("inserting a %d byte key failed: %v", len(key), err)
+		}
+		entries[string(key)] = value
+	}
+	if err := index.InsertBytes([]byte("dup"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.InsertBytes([]byte("dup"), nil); err == nil {
+		t.Error("inserted a duplicate byte key")
+	}
+	delete(entries, "dup")
+	if err := index.DeleteBytes([]byte("dup")); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range entries {
+		if found, err := index.FindBytes([]byte(key)); err != nil || !bytes.Equal(found, value) {
+			t.Fatalf("key %q has value %q, expected %q (%v)", key, found, value, err)
+		}
+	}
+	checkByteOrder := func() {
+		t.Helper()
+		it, err := index.RangeIteratorBytes(nil, nil, btree.RangeOptions{NoStart: true, NoEnd: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var prev []byte
+		count := 0
+		for {
+			entry, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry == nil {
+				break
+			}
+			key := entry.(btree.BTreeEntry).GetKeyBytes()
+			if count > 0 && bytes.Compare(prev, key) >= 0 {
+				t.Fatalf("key %q came after %q", key, prev)
+			}
+			prev, count = key, count+1
+		}
+		if count != len(entries) {
+			t.Fatalf("range returned %d entries, expected %d", count, len(entries))
+		}
+		if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+			t.Fatalf("table is not a valid B+tree: %v", err)
+		}
+	}
+	checkByteOrder()
+	// Growing values in place splits the leaves they're in.
+	for key := range entries {
+		value := randomBytes(200, 400)
+		if err := index.UpdateBytes([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+		entries[key] = value
+	}
+	checkByteOrder()
+	// Deleting most of the keys rebalances the tree.
+	for key := range entries {
+		if len(entries) <= 100 {
+			break
+		}
+		if err := index.DeleteBytes([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(entries, key)
+	}
+	checkByteOrder()
+	// Keys that can't fit enough to a page are refused.
+	if err := index.InsertBytes(randomBytes(1000, 1001), nil); err == nil {
+		t.Error("inserted a 1000 byte key")
+	}
+	// Integer keys still sort numerically, negative ones included.
+	ints, intName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(intName)
+	defer ints.Close()
+	for _, key := range rand.Perm(1000) {
+		if err := ints.Insert(int64(key)-500, int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := rangeKeys(t, ints, -10, 10, btree.RangeOptions{})
+	if len(keys) != 21 || keys[0] != -10 || keys[20] != 10 {
+		t.Errorf("range [-10, 10] returned %v", keys)
+	}
+}
+
+// writeSlottedBTree writes a table holding keys 0 to n-1, each with three
+// times itself as its value, in a single leaf laid out as in the given format
+// version, 3 or 4. In version 4, key n is also written, with a value kept in
+// two overflow pages, which is returned.
+func writeSlottedBTree(t *testing.T, filename string, n int64, version int64) []byte {
+	t.Helper()
+	p := pager.NewPager()
+	if err := p.Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	page, err := p.GetPage(p.GetFreePN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := *page.GetData()
+	putField := func(data []byte, offset int64, x int64) {
+		binary.PutVarint(data[offset:offset+binary.MaxVarintLen64], x)
+	}
+	putKey := func(cell []byte, key int64) {
+		binary.BigEndian.PutUint64(cell, uint64(key)^(1<<63))
+	}
+	valueField := byte(8)
+	if version >= btree.OVERFLOW_PAGES_VERSION {
+		valueField <<= 1
+	}
+	data[btree.NODETYPE_OFFSET] = 1
+	putField(data, btree.SLOTTED_RIGHT_SIBLING_PN_OFFSET, -1)
+	putField(data, btree.SLOTTED_LEFT_SIBLING_PN_OFFSET, -1)
+	start := int64(len(data))
+	numKeys := int64(0)
+	writeCell := func(cell []byte) {
+		start -= int64(len(cell))
+		copy(data[start:], cell)
+		slot := btree.SLOTTED_LEAF_NODE_HEADER_SIZE + numKeys*btree.SLOT_SIZE
+		binary.BigEndian.PutUint32(data[slot:], uint32(start))
+		numKeys++
+	}
+	for key := int64(0); key < n; key++ {
+		cell := append([]byte{8, valueField}, make([]byte, 16)...)
+		putKey(cell[2:], key)
+		putKey(cell[10:], key*3)
+		writeCell(cell)
+	}
+	var value []byte
+	if version >= btree.OVERFLOW_PAGES_VERSION {
+		// Write the chain back to front, so that each page knows the next one.
+		perPage := p.GetDataSize() - binary.MaxVarintLen64
+		value = randomBytes(int(perPage)+100, int(perPage)+101)
+		nextPN := int64(-1)
+		for _, chunk := range [][]byte{value[perPage:], value[:perPage]} {
+			overflow, err := p.GetPage(p.GetFreePN())
+			if err != nil {
+				t.Fatal(err)
+			}
+			putField(*overflow.GetData(), 0, nextPN)
+			copy((*overflow.GetData())[binary.MaxVarintLen64:], chunk)
+			overflow.SetDirty(true)
+			nextPN = overflow.GetPageNum()
+			overflow.Put()
+		}
+		ref := make([]byte, 2*binary.MaxVarintLen64)
+		putField(ref, 0, int64(len(value)))
+		putField(ref, binary.MaxVarintLen64, nextPN)
+		cell := []byte{8, byte(len(ref))<<1 | 1}
+		cell = append(cell, make([]byte, 8)...)
+		putKey(cell[2:], n)
+		writeCell(append(cell, ref...))
+	}
+	putField(data, btree.SLOTTED_NUM_KEYS_OFFSET, numKeys)
+	putField(data, btree.SLOTTED_CELLS_START_OFFSET, start)
+	page.SetDirty(true)
+	page.Put()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	patchHeaderField(t, filename, pager.HEADER_VERSION_OFFSET, version)
+	return value
+}
+
+func testOverflowValues(t *testing.T) {
+	index, dbName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(dbName)
+	// Values of every size, up to many pages long, come back whole.
+	sizes := []int{0, 100, 500, 1000, 4096, 10000, 100000}
+	values := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		values[key] = randomBytes(sizes[i%len(sizes)], sizes[i%len(sizes)]+1)
+		if err := index.InsertBytes([]byte(key), values[key]); err != nil {
+			t.Fatalf("inserting a %d byte value failed: %v", len(values[key]), err)
+		}
+	}
+	checkValues := func() {
+		t.Helper()
+		for key, value := range values {
+			if found, err := index.FindBytes([]byte(key)); err != nil || !bytes.Equal(found, value) {
+				t.Fatalf("key %s has a %d byte value, expected %d bytes (%v)", key, len(found), len(value), err)
+			}
+		}
+		entries, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(values) {
+			t.Fatalf("select returned %d entries, expected %d", len(entries), len(values))
+		}
+		for _, entry := range entries {
+			entry := entry.(btree.BTreeEntry)
+			if !bytes.Equal(entry.GetValueBytes(), values[string(entry.GetKeyBytes())]) {
+				t.Fatalf("select returned the wrong value for key %s", entry.GetKeyBytes())
+			}
+		}
+		it, err := index.RangeIteratorBytes([]byte("key0100"), []byte("key0199"), btree.RangeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		inRange := 0
+		for key := range values {
+			if key >= "key0100" && key <= "key0199" {
+				inRange++
+			}
+		}
+		for count := 0; ; count++ {
+			entry, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry == nil {
+				if count != inRange {
+					t.Fatalf("range returned %d entries, expected %d", count, inRange)
+				}
+				break
+			}
+			got := entry.(btree.BTreeEntry)
+			if !bytes.Equal(got.GetValueBytes(), values[string(got.GetKeyBytes())]) {
+				t.Fatalf("range returned the wrong value for key %s", got.GetKeyBytes())
+			}
+		}
+		if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+			t.Fatalf("table is not a valid B+tree: %v", err)
+		}
+	}
+	checkValues()
+	// Values survive the table being closed and reopened.
+	index.Close()
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkValues()
+	// Overwriting large values with small ones, and deleting them, frees their pages.
+	p := index.GetPager()
+	numPages, numFree := p.GetNumPages(), p.GetNumFreePages()
+	for key, value := range values {
+		if len(value) < 10000 {
+			continue
+		}
+		if key < "key0150" {
+			values[key] = []byte("small")
+			if err := index.UpdateBytes([]byte(key), values[key]); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			delete(values, key)
+			if err := index.DeleteBytes([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkValues()
+	freed := p.GetNumFreePages() - numFree
+	if freed < 40*(100000/4096) {
+		t.Errorf("overwriting and deleting large values freed %d pages", freed)
+	}
+	// Those pages are reused for new large values, and small values grow into large ones.
+	for key, value := range values {
+		if len(value) == 5 {
+			values[key] = randomBytes(100000, 100001)
+			if err := index.UpdateBytes([]byte(key), values[key]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkValues()
+	if n := p.GetNumPages(); n > numPages {
+		t.Errorf("table grew from %d to %d pages instead of reusing freed ones", numPages, n)
+	}
+	// Large values can be bulk loaded, and carried over when a table is compacted.
+	loaded, loadedName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(loadedName)
+	defer loaded.Close()
+	compactName := getTempBTreeDB(t)
+	defer os.Remove(compactName)
+	it, err := index.RangeIteratorBytes(nil, nil, btree.RangeOptions{NoStart: true, NoEnd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := btree.BulkLoad(loaded, it, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.CompactTo(compactName); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := btree.OpenTable(compactName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compact.Close()
+	for key, value := range values {
+		for _, table := range []*btree.BTreeIndex{loaded, compact} {
+			if found, err := table.FindBytes([]byte(key)); err != nil || !bytes.Equal(found, value) {
+				t.Fatalf("key %s lost its %d byte value when copied (%v)", key, len(value), err)
+			}
+		}
+	}
+	// A table written before values were moved to overflow pages is rebuilt when it's opened.
+	oldName := getTempBTreeDB(t)
+	defer os.Remove(oldName)
+	writeSlottedBTree(t, oldName, 100, btree.SLOTTED_PAGES_VERSION)
+	old, err := btree.OpenTable(oldName)
+	if err != nil {
+		t.Fatalf("opening a version %d table failed: %v", btree.SLOTTED_PAGES_VERSION, err)
+	}
+	defer old.Close()
+	if v := old.GetPager().GetFileInfo().Version; v != pager.FORMAT_VERSION {
+		t.Errorf("upgraded table has format version %d, expected %d", v, pager.FORMAT_VERSION)
+	}
+	for key := int64(0); key < 100; key++ {
+		if entry, err := old.Find(key); err != nil || entry.GetValue() != key*3 {
+			t.Fatalf("key %d missing from the upgraded table", key)
+		}
+	}
+}
+
+// findAll returns the values of the entries with the given key, in the order the table returns them.
+func findAll(t *testing.T, index *btree.BTreeIndex, key []byte) [][]byte {
+	t.Helper()
+	it, err := index.FindAllBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	values := make([][]byte, 0)
+	for {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return values
+		}
+		got := entry.(btree.BTreeEntry)
+		if !bytes.Equal(got.GetKeyBytes(), key) {
+			t.Fatalf("looking for key %q found key %q", key, got.GetKeyBytes())
+		}
+		values = append(values, got.GetValueBytes())
+	}
+}
+
+func testDuplicateKeys(t *testing.T) {
+	index, dbName := openTempBTree(t, btree.TableOptions{Duplicates: true})
+	defer os.Remove(dbName)
+	// Key k gets the values k, k+1000, ..., one for each of the first k%5+1 thousands.
+	for _, i := range rand.Perm(2000 * 5) {
+		key, n := int64(i/5), int64(i%5)
+		if n <= key%5 {
+			if err := index.Insert(key, key+n*1000); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := index.Insert(7, 1007); err == nil {
+		t.Error("inserted the same entry twice")
+	}
+	if err := index.Update(7, 7); err == nil {
+		t.Error("updated a key with more than one entry")
+	}
+	checkKey := func(key int64, expected []int64) {
+		t.Helper()
+		it, err := index.FindAll(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		for _, value := range expected {
+			entry, err := it.Next()
+			if err != nil || entry == nil || entry.GetKey() != key || entry.GetValue() != value {
+				t.Fatalf("key %d is missing value %d (%v)", key, value, err)
+			}
+		}
+		if entry, err := it.Next(); err != nil || entry != nil {
+			t.Fatalf("key %d has more values than %v", key, expected)
+		}
+	}
+	checkKey(3, []int64{3, 1003, 2003, 3003})
+	checkKey(2000, nil)
+	if entry, err := index.Find(4); err != nil || entry.GetValue() != 4 {
+		t.Errorf("find returned %v, expected the smallest value of key 4 (%v)", entry, err)
+	}
+	// Deleting a pair leaves the key's other entries; deleting the key removes them all.
+	if err := index.DeletePair(3, 1003); err != nil {
+		t.Fatal(err)
+	}
+	checkKey(3, []int64{3, 2003, 3003})
+	if err := index.Delete(4); err != nil {
+		t.Fatal(err)
+	}
+	checkKey(4, nil)
+	checkKey(5, []int64{5})
+	if _, err := index.Find(4); err == nil {
+		t.Error("found a key after deleting it")
+	}
+	// Ranges and cursors see every entry, in key order, then value order.
+	keys := rangeKeys(t, index, 10, 13, btree.RangeOptions{StartExclusive: true})
+	if expected := []int64{11, 11, 12, 12, 12, 13, 13, 13, 13}; fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("range (10, 13] returned %v, expected %v", keys, expected)
+	}
+	cursor, err := index.TableFind(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != 12 || entry.GetValue() != 12 {
+		t.Errorf("cursor found %v, expected the first entry of key 12 (%v)", entry, err)
+	}
+	if err := cursor.StepBackward(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != 11 || entry.GetValue() != 1011 {
+		t.Errorf("cursor found %v, expected the last entry of key 11 (%v)", entry, err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2000*3-1-5 {
+		t.Errorf("select returned %d entries, expected %d", len(entries), 2000*3-1-5)
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("table is not a valid B+tree: %v", err)
+	}
+	// Keys that are prefixes of each other, or hold zero bytes, keep their entries apart.
+	byteKeys := [][]byte{[]byte("a"), []byte("a\x00"), []byte("a\x00b"), []byte("a\x01"), []byte("ab"), {0}, {}}
+	for i, key := range byteKeys {
+		for j := 0; j <= i; j++ {
+			if err := index.InsertBytes(key, []byte{byte(j)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, key := range byteKeys {
+		if values := findAll(t, index, key); len(values) != i+1 {
+			t.Errorf("key %q has %d values, expected %d", key, len(values), i+1)
+		}
+	}
+	// The table reopens as one with duplicate keys, and compacts into one.
+	index.Close()
+	if index, err = btree.OpenTable(dbName); err == nil {
+		index.Close()
+		t.Fatal("opened a table with duplicate keys as one without")
+	}
+	if index, err = btree.OpenTableWithOptions(dbName, nil, btree.TableOptions{Duplicates: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	compactName := getTempBTreeDB(t)
+	defer os.Remove(compactName)
+	if err := index.CompactTo(compactName); err != nil {
+		t.Fatal(err)
+	}
+	compact, err := btree.OpenTableWithOptions(compactName, nil, btree.TableOptions{Duplicates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compact.Close()
+	for _, key := range []int64{3, 4, 1999} {
+		if a, b := rangeKeys(t, index, key, key, btree.RangeOptions{}), rangeKeys(t, compact, key, key, btree.RangeOptions{}); len(a) != len(b) {
+			t.Errorf("key %d has %d entries after compacting, expected %d", key, len(b), len(a))
+		}
+	}
+}
+
+func testFixedWidthNodes(t *testing.T) {
+	// A leaf holds as many int64 entries as fit with fixed-width fields.
+	index, dbName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(dbName)
+	defer index.Close()
+	perLeaf := (index.GetPager().GetDataSize() - btree.LEAF_NODE_HEADER_SIZE) / (18 + btree.SLOT_SIZE)
+	for key := int64(0); key < perLeaf; key++ {
+		if err := index.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := index.GetPager().GetNumPages(); n != 1 {
+		t.Errorf("%d entries took %d pages, expected them to fit in the root", perLeaf, n)
+	}
+	// A table written with padded varint fields, and a value in overflow pages, is rebuilt when it's opened.
+	oldName := getTempBTreeDB(t)
+	defer os.Remove(oldName)
+	bigValue := writeSlottedBTree(t, oldName, 100, btree.OVERFLOW_PAGES_VERSION)
+	old, err := btree.OpenTable(oldName)
+	if err != nil {
+		t.Fatalf("opening a version %d table failed: %v", btree.OVERFLOW_PAGES_VERSION, err)
+	}
+	defer old.Close()
+	if v := old.GetPager().GetFileInfo().Version; v != pager.FORMAT_VERSION {
+		t.Errorf("upgraded table has format version %d, expected %d", v, pager.FORMAT_VERSION)
+	}
+	for key := int64(0); key < 100; key++ {
+		if entry, err := old.Find(key); err != nil || entry.GetValue() != key*3 {
+			t.Fatalf("key %d missing from the upgraded table", key)
+		}
+	}
+	bigKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(bigKey, uint64(100)^(1<<63))
+	if found, err := old.FindBytes(bigKey); err != nil || !bytes.Equal(found, bigValue) {
+		t.Errorf("upgraded table has a %d byte value for key 100, expected %d bytes (%v)", len(found), len(bigValue), err)
+	}
+	// Keys with long shared prefixes take fewer pages when compressed, and read the same.
+	plain, plainName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(plainName)
+	defer plain.Close()
+	compressed, compressedName := openTempBTree(t, btree.TableOptions{CompressKeys: true})
+	defer os.Remove(compressedName)
+	defer compressed.Close()
+	prefix := strings.Repeat("/a/long/shared/directory", 6)
+	keyOf := func(i int) []byte {
+		return []byte(fmt.Sprintf("%s/%06d%s", prefix, i, prefix))
+	}
+	for _, i := range rand.Perm(5000) {
+		for _, table := range []*btree.BTreeIndex{plain, compressed} {
+			if err := table.InsertBytes(keyOf(i), []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if p, c := plain.GetPager().GetNumPages(), compressed.GetPager().GetNumPages(); c >= p {
+		t.Errorf("compressed table took %d pages, expected fewer than %d", c, p)
+	}
+	for _, i := range rand.Perm(5000)[:2500] {
+		if err := compressed.DeleteBytes(keyOf(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(compressed); err != nil || !ok {
+		t.Fatalf("compressed table is not a B+tree (%v)", err)
+	}
+	n := 0
+	for i := 0; i < 5000; i++ {
+		if value, err := compressed.FindBytes(keyOf(i)); err == nil {
+			if !bytes.Equal(value, []byte{byte(i)}) {
+				t.Fatalf("key %d has value %v", i, value)
+			}
+			n++
+		}
+	}
+	if n != 2500 {
+		t.Errorf("compressed table holds %d keys, expected 2500", n)
+	}
+	// A bulk-loaded table compresses its keys too.
+	loadedName := getTempBTreeDB(t)
+	defer os.Remove(loadedName)
+	if err := compressed.CompactTo(loadedName); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := btree.OpenTableWithOptions(loadedName, nil, btree.TableOptions{CompressKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if _, _, ok, err := btree.IsBTree(loaded); err != nil || !ok {
+		t.Fatalf("bulk-loaded compressed table is not a B+tree (%v)", err)
+	}
+	for i := 0; i < 5000; i++ {
+		_, want := compressed.FindBytes(keyOf(i))
+		if _, err := loaded.FindBytes(keyOf(i)); (err == nil) != (want == nil) {
+			t.Fatalf("key %d differs between the table and its copy", i)
+		}
+	}
+}
+
+// Get the number of internal nodes in a table that no entries were deleted
+// from, the number of keys they hold, and the number of levels in the tree.
+func internalNodes(t *testing.T, index *btree.BTreeIndex) (nodes int64, keys int64, depth int) {
+	t.Helper()
+	p := index.GetPager()
+	for pn := int64(0); pn < p.GetNumPages(); pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := *page.GetData()
+		if data[btree.NODETYPE_OFFSET]&1 == 0 {
+			nodes++
+			keys += int64(binary.BigEndian.Uint64(data[btree.NUM_KEYS_OFFSET:]))
+		}
+		page.Put()
+	}
+	pn := btree.ROOT_PN
+	for depth = 1; ; depth++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := *page.GetData()
+		leaf := data[btree.NODETYPE_OFFSET]&1 != 0
+		pn = int64(binary.BigEndian.Uint64(data[btree.FIRST_PN_OFFSET:]))
+		page.Put()
+		if leaf {
+			return nodes, keys, depth
+		}
+	}
+}
+
+func testKeyPrefixes(t *testing.T) {
+	// Internal nodes of a table that compresses its keys hold more keys when
+	// the keys share a long prefix, so the tree is shallower.
+	plain, plainName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(plainName)
+	defer plain.Close()
+	compressed, compressedName := openTempBTree(t, btree.TableOptions{CompressKeys: true})
+	defer os.Remove(compressedName)
+	prefix := strings.Repeat("/a/long/shared/directory", 8)
+	keyOf := func(i int) []byte {
+		return []byte(fmt.Sprintf("%s/%06d", prefix, i))
+	}
+	for _, i := range rand.Perm(20000) {
+		for _, table := range []*btree.BTreeIndex{plain, compressed} {
+			if err := table.InsertBytes(keyOf(i), []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	plainNodes, plainKeys, plainDepth := internalNodes(t, plain)
+	nodes, keys, depth := internalNodes(t, compressed)
+	if keys/nodes < 4*(plainKeys/plainNodes) {
+		t.Errorf("compressed internal nodes hold %d keys on average, expected at least four times the %d of uncompressed ones",
+			keys/nodes, plainKeys/plainNodes)
+	}
+	if depth >= plainDepth {
+		t.Errorf("compressed tree has %d levels, expected fewer than %d", depth, plainDepth)
+	}
+	// The table must be reopened as one that compresses its keys, and reads the same.
+	if err := compressed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := btree.OpenTable(compressedName); err == nil {
+		t.Fatal("opened a table with compressed keys as one without")
+	}
+	compressed, err := btree.OpenTableWithOptions(compressedName, nil, btree.TableOptions{CompressKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	for _, i := range rand.Perm(20000)[:10000] {
+		if err := compressed.DeleteBytes(keyOf(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(compressed); err != nil || !ok {
+		t.Fatalf("compressed table is not a B+tree (%v)", err)
+	}
+	n := 0
+	for i := 0; i < 20000; i++ {
+		if value, err := compressed.FindBytes(keyOf(i)); err == nil {
+			if !bytes.Equal(value, []byte{byte(i)}) {
+				t.Fatalf("key %d has value %v", i, value)
+			}
+			n++
+		}
+	}
+	if n != 10000 {
+		t.Errorf("compressed table holds %d keys, expected 10000", n)
+	}
+}
+
+func testOptimisticLocking(t *testing.T) {
+	index, dbName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Writers that share no keys insert, update and delete while readers scan.
+	numWriters, perWriter := int64(8), int64(1000)
+	errs := make(chan error, numWriters+2)
+	stop := make(chan bool)
+	for w := int64(0); w < numWriters; w++ {
+		go func(w int64) {
+			for _, i := range rand.Perm(int(perWriter)) {
+				key := int64(i)*numWriters + w
+				if err := index.Insert(key, key); err != nil {
+					errs <- err
+					return
+				}
+			}
+			for i := int64(0); i < perWriter; i++ {
+				key := i*numWriters + w
+				var err error
+				if i%2 == 0 {
+					err = index.Delete(key)
+				} else {
+					err = index.Update(key, -key)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				it, err := index.RangeIterator(0, 0, btree.RangeOptions{NoStart: true, NoEnd: true})
+				if err != nil {
+					errs <- err
+					return
+				}
+				prev := int64(-1)
+				for {
+					entry, err := it.Next()
+					if err != nil {
+						errs <- err
+						return
+					}
+					if entry == nil {
+						break
+					}
+					if entry.GetKey() <= prev {
+						it.Close()
+						errs <- fmt.Errorf("scan returned key %d after %d", entry.GetKey(), prev)
+						return
+					}
+					prev = entry.GetKey()
+				}
+			}
+		}()
+	}
+	for w := int64(0); w < numWriters; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	for r := 0; r < 2; r++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("table is not a B+tree after concurrent writes (%v)", err)
+	}
+	for key := int64(0); key < numWriters*perWriter; key++ {
+		entry, err := index.Find(key)
+		if deleted := key/numWriters%2 == 0; deleted != (err != nil) || (err == nil && entry.GetValue() != -key) {
+			t.Fatalf("key %d has the wrong entry after concurrent writes (%v)", key, err)
+		}
+	}
+	// Writes that can't split a leaf, and reads, get past a read-locked root.
+	// Leaves filled in key order are left half full.
+	sparse, sparseName := openTempBTree(t, btree.TableOptions{})
+	defer os.Remove(sparseName)
+	defer sparse.Close()
+	for key := int64(0); key < 2000; key += 2 {
+		if err := sparse.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootPage, err := sparse.GetPager().GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rootPage.Put()
+	rootPage.RLock()
+	done := make(chan error)
+	go func() {
+		for key := int64(1); key < 10; key += 2 {
+			if err := sparse.Insert(key, key); err != nil {
+				done <- err
+				return
+			}
+			if _, err := sparse.Find(key); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		rootPage.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		rootPage.RUnlock()
+		t.Fatal("writes waited for a read-locked root")
+	}
+}
@@ -0,0 +1,584 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	db "github.com/brown-csci1270/db/pkg/db"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	recovery "github.com/brown-csci1270/db/pkg/recovery"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestDB(t *testing.T) {
+	t.Run("TestVacuum", testVacuum)
+	t.Run("TestSelectRange", testSelectRange)
+	t.Run("TestSelectDescending", testSelectDescending)
+	t.Run("TestLoad", testLoad)
+	t.Run("TestDuplicateTables", testDuplicateTables)
+	t.Run("TestDuplicateTableRecovery", testDuplicateTableRecovery)
+	t.Run("TestCompressedTables", testCompressedTables)
+}
+
+// =====================================================================
+// HELPERS
+// =====================================================================
+
+// Open a database in a new temporary directory, which the caller should remove.
+func openTempDB(t *testing.T) (*db.Database, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bumble-db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, dir
+}
+
+// =====================================================================
+// TESTS (Vacuum)
+// =====================================================================
+
+func testVacuum(t *testing.T) {
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	// Fill a table of each kind, then delete most of it.
+	for _, kind := range []string{"btree", "hash"} {
+		if err := db.HandleCreateTable(d, "create "+kind+" table "+kind, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		table, err := d.GetTable(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := int64(0); key < 3000; key++ {
+			if err := table.Insert(key, key*2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for key := int64(0); key < 3000; key++ {
+			if key%10 != 0 {
+				if err := table.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		before := table.GetPager().GetNumPages()
+		if err := d.Vacuum(kind); err != nil {
+			t.Fatalf("vacuuming the %s table failed: %v", kind, err)
+		}
+		if table, err = d.GetTable(kind); err != nil {
+			t.Fatal(err)
+		}
+		if after := table.GetPager().GetNumPages(); after >= before {
+			t.Errorf("vacuuming the %s table left it with %d pages, up from %d", kind, after, before)
+		}
+		for key := int64(0); key < 3000; key++ {
+			entry, err := table.Find(key)
+			if key%10 != 0 {
+				if err == nil {
+					t.Errorf("found deleted key %d in the %s table after vacuuming", key, kind)
+				}
+			} else if err != nil || entry.GetValue() != key*2 {
+				t.Errorf("lost key %d of the %s table while vacuuming", key, kind)
+			}
+		}
+	}
+	bt, err := d.GetTable("btree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := btree.IsBTree(bt.(*btree.BTreeIndex)); err != nil || !ok {
+		t.Errorf("vacuumed table is not a valid B+tree: %v", err)
+	}
+	// A table that is in use isn't vacuumed out from under its user.
+	page, err := bt.GetPager().GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Vacuum("btree"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("vacuuming a table with a pinned page gave %v, expected it to be refused", err)
+	}
+	if table, err := d.GetTable("btree"); err != nil || table != bt {
+		t.Errorf("refusing to vacuum a table replaced it: %v", err)
+	}
+	page.Put()
+	if err := d.Vacuum("btree"); err != nil {
+		t.Errorf("vacuuming a table that is no longer in use failed: %v", err)
+	}
+	// Vacuums and checkpoints can run side by side.
+	logName := filepath.Join(dir, "db.log")
+	if err := d.CreateLogFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := rm.Checkpoint(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 3; i++ {
+		if err := d.Vacuum("hash"); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("checkpoint failed alongside a vacuum: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(strings.TrimSuffix(dir, "/") + "-recovery")
+	// A rebuilt table that was committed but not swapped in yet is swapped in on open;
+	// one that wasn't committed is thrown away.
+	path := filepath.Join(dir, "btree")
+	if err := os.Rename(path, path+db.VACUUM_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("stale"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+db.VACUUM_TEMP_SUFFIX, []byte("partial"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if bt, err = d.GetTable("btree"); err != nil {
+		t.Fatalf("finishing an interrupted vacuum failed: %v", err)
+	}
+	if entry, err := bt.Find(2990); err != nil || entry.GetValue() != 5980 {
+		t.Error("lost entries finishing an interrupted vacuum")
+	}
+	for _, leftover := range []string{path + db.VACUUM_SUFFIX, path + db.VACUUM_TEMP_SUFFIX} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be gone", leftover)
+		}
+	}
+}
+
+// =====================================================================
+// TESTS (Range and ordered selects)
+// =====================================================================
+
+func testSelectRange(t *testing.T) {
+	// The REPL selects ranges from both kinds of table.
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	defer d.Close()
+	for _, kind := range []string{"btree", "hash"} {
+		if err := db.HandleCreateTable(d, "create "+kind+" table "+kind, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 100; k++ {
+			if err := db.HandleInsert(d, fmt.Sprintf("insert %d %d into %s", k, k*k, kind)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var out bytes.Buffer
+		if err := db.HandleSelect(d, "select from "+kind+" where key between 10 and 12", &out); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(strings.TrimSpace(out.String()))
+		if len(lines) != 6 || !strings.Contains(out.String(), "(11, 121)") {
+			t.Errorf("selecting a range from the %s table printed:\n%s", kind, out.String())
+		}
+		if err := db.HandleSelect(d, "select from "+kind+" where key between 10", &out); err == nil {
+			t.Error("expected a usage error for an incomplete range")
+		}
+	}
+}
+
+func testSelectDescending(t *testing.T) {
+	// The REPL selects from both kinds of table in descending order.
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	defer d.Close()
+	for _, kind := range []string{"btree", "hash"} {
+		if err := db.HandleCreateTable(d, "create "+kind+" table "+kind, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 1000; k++ {
+			if err := db.HandleInsert(d, fmt.Sprintf("insert %d %d into %s", k, k, kind)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for query, expected := range map[string]string{
+			"select from " + kind + " order by key desc":                             "(999, 999)\n(998, 998)\n",
+			"select from " + kind + " where key between 5 and 500 order by key desc": "(500, 500)\n(499, 499)\n",
+			"select from " + kind + " where key between 5 and 7 order by key desc":   "(7, 7)\n(6, 6)\n(5, 5)\n",
+			"select from " + kind + " where key between 1 and 2 order by key asc":    "(1, 1)\n(2, 2)\n",
+		} {
+			var out bytes.Buffer
+			if err := db.HandleSelect(d, query, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(out.String(), expected) {
+				t.Errorf("%s printed:\n%.40s...", query, out.String())
+			}
+		}
+	}
+	// A leaf that can't be read fails the select, rather than cutting it short.
+	d.Close()
+	file, err := os.OpenFile(filepath.Join(dir, "btree"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := make([]byte, pager.PAGESIZE)
+	pn := btree.ROOT_PN
+	for {
+		if _, err := file.ReadAt(node, pager.HEADERSIZE+pn*pager.PAGESIZE); err != nil {
+			t.Fatal(err)
+		}
+		if node[btree.NODETYPE_OFFSET] != 0 {
+			break
+		}
+		pn = int64(binary.BigEndian.Uint64(node[btree.FIRST_PN_OFFSET:]))
+	}
+	if _, err := file.WriteAt([]byte{node[100] ^ 0xff}, pager.HEADERSIZE+pn*pager.PAGESIZE+100); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if d, err = db.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var out bytes.Buffer
+	if err := db.HandleSelect(d, "select from btree order by key desc", &out); err == nil {
+		t.Errorf("selecting past a corrupt leaf succeeded, printing %d lines", strings.Count(out.String(), "\n"))
+	}
+}
+
+// =====================================================================
+// TESTS (Loading)
+// =====================================================================
+
+func testLoad(t *testing.T) {
+	// The REPL loads unsorted files into either kind of table.
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	defer d.Close()
+	var lines bytes.Buffer
+	lines.WriteString("# key value\n")
+	for _, key := range rand.Perm(5000) {
+		fmt.Fprintf(&lines, "%d %d\n", key, key*2)
+	}
+	inputName := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(inputName, lines.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"btree", "hash"} {
+		if err := db.HandleCreateTable(d, "create "+kind+" table "+kind, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := db.HandleLoad(d, "load "+inputName+" into "+kind, &out); err != nil {
+			t.Fatalf("loading into the %s table failed: %v", kind, err)
+		}
+		if expected := "loaded 5000 entries into " + kind + ".\n"; out.String() != expected {
+			t.Errorf("load printed %q, expected %q", out.String(), expected)
+		}
+		table, err := d.GetTable(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := int64(0); key < 5000; key++ {
+			if entry, err := table.Find(key); err != nil || entry.GetValue() != key*2 {
+				t.Fatalf("key %d missing after loading into the %s table", key, kind)
+			}
+		}
+	}
+	bt, err := d.GetTable("btree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := btree.IsBTree(bt.(*btree.BTreeIndex)); err != nil || !ok {
+		t.Errorf("loaded table is not a valid B+tree: %v", err)
+	}
+	// Loading again into a table that holds the keys already fails.
+	if err := db.HandleLoad(d, "load "+inputName+" into btree", ioutil.Discard); err == nil {
+		t.Error("loaded keys that were already in the table")
+	}
+	if err := ioutil.WriteFile(inputName, []byte("1 1\n2 2\n1 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HandleCreateTable(d, "create btree table dups", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HandleLoad(d, "load "+inputName+" into dups", ioutil.Discard); err == nil {
+		t.Error("loaded a file with a duplicate key")
+	}
+}
+
+// =====================================================================
+// TESTS (Tables with duplicate keys)
+// =====================================================================
+
+// Get the values of the entries with the given key in the named table.
+func duplicateValues(t *testing.T, d *db.Database, name string, key int64) []int64 {
+	t.Helper()
+	table, err := d.GetTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := table.(*btree.BTreeIndex).FindAll(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var values []int64
+	for {
+		entry, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			return values
+		}
+		values = append(values, entry.GetValue())
+	}
+}
+
+func testDuplicateTables(t *testing.T) {
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	// Only B+trees can be created with duplicate keys.
+	if err := db.HandleCreateTable(d, "create hash table hashdups duplicates", ioutil.Discard); err == nil {
+		t.Error("created a hash table with duplicate keys")
+	}
+	if err := db.HandleCreateTable(d, "create btree table dups duplicates", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HandleCreateTable(d, "create btree table loaded duplicates", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for key := int64(0); key < 2000; key++ {
+		for value := int64(0); value < 3; value++ {
+			if err := db.HandleInsert(d, fmt.Sprintf("insert %d %d into dups", key, value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Loading takes repeated keys, but not repeated entries.
+	inputName := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(inputName, []byte("1 1\n2 2\n1 3\n1 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HandleLoad(d, "load "+inputName+" into loaded", ioutil.Discard); err == nil {
+		t.Error("loaded a file with a repeated entry")
+	}
+	if err := ioutil.WriteFile(inputName, []byte("1 3\n2 2\n1 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HandleLoad(d, "load "+inputName+" into loaded", ioutil.Discard); err != nil {
+		t.Fatalf("loading repeated keys failed: %v", err)
+	}
+	// The tables can be vacuumed, and reopened as tables with duplicate keys.
+	if err := d.Vacuum("dups"); err != nil {
+		t.Fatalf("vacuuming a table with duplicate keys failed: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for key := int64(0); key < 2000; key += 7 {
+		if values := duplicateValues(t, d, "dups", key); fmt.Sprint(values) != "[0 1 2]" {
+			t.Fatalf("key %d has values %v after reopening", key, values)
+		}
+	}
+	if values := duplicateValues(t, d, "loaded", 1); fmt.Sprint(values) != "[1 3]" {
+		t.Errorf("loaded key 1 has values %v after reopening", values)
+	}
+}
+
+// Open the database in the given folder, as recovery restores it from its
+// last checkpoint, along with managers that log to the given file.
+func openRecoveryDB(t *testing.T, folder string, logName string) (*db.Database, *concurrency.TransactionManager, *recovery.RecoveryManager) {
+	t.Helper()
+	d, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateLogFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, tm, rm
+}
+
+func testDuplicateTableRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bumble-wal-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	folder, logName := filepath.Join(dir, "data"), filepath.Join(dir, "db.log")
+	open := func() (*db.Database, *concurrency.TransactionManager, *recovery.RecoveryManager) {
+		return openRecoveryDB(t, folder, logName)
+	}
+	d, tm, rm := open()
+	run := func(id uuid.UUID, commands ...string) {
+		t.Helper()
+		for _, command := range commands {
+			var err error
+			switch strings.Fields(command)[0] {
+			case "create":
+				err = recovery.HandleCreateTable(d, tm, rm, command, ioutil.Discard, id)
+			case "transaction":
+				err = recovery.HandleTransaction(d, tm, rm, command, ioutil.Discard, id)
+			case "insert":
+				err = recovery.HandleInsert(d, tm, rm, command, id)
+			case "delete":
+				err = recovery.HandleDelete(d, tm, rm, command, id)
+			case "abort":
+				err = recovery.HandleAbort(d, tm, rm, command, ioutil.Discard, id)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", command, err)
+			}
+		}
+	}
+	expectValues := func(when string, expected string) {
+		t.Helper()
+		if values := duplicateValues(t, d, "dups", 1); fmt.Sprint(values) != expected {
+			t.Errorf("key 1 has values %v %s, expected %s", values, when, expected)
+		}
+	}
+	run(uuid.New(), "create btree table dups duplicates")
+	run(uuid.New(), "transaction begin", "insert 1 10 into dups", "insert 1 11 into dups", "transaction commit")
+	// Aborting an insert removes only the inserted entry.
+	run(uuid.New(), "transaction begin", "insert 1 12 into dups", "abort")
+	expectValues("after aborting an insert", "[10 11]")
+	// Aborting a delete puts back every entry it removed.
+	run(uuid.New(), "transaction begin", "delete 1 from dups", "abort")
+	expectValues("after aborting a delete", "[10 11]")
+	// After a crash, the table is recreated with duplicate keys, committed
+	// entries are redone and uncommitted ones undone.
+	run(uuid.New(), "transaction begin", "insert 1 13 into dups")
+	expectValues("before the crash", "[10 11 13]")
+	d.Close()
+	d, tm, rm = open()
+	defer d.Close()
+	if err := rm.Recover(); err != nil {
+		t.Fatalf("recovering a table with duplicate keys failed: %v", err)
+	}
+	table, err := d.GetTable("dups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !table.(*btree.BTreeIndex).AllowsDuplicates() {
+		t.Error("recovered table doesn't allow duplicate keys")
+	}
+	expectValues("after recovery", "[10 11]")
+}
+
+// =====================================================================
+// TESTS (Compressed keys)
+// =====================================================================
+
+func testCompressedTables(t *testing.T) {
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	// Only B+trees can compress their keys, and each option is given once.
+	for _, command := range []string{"create hash table hashed compressed", "create btree table twice compressed compressed"} {
+		if err := db.HandleCreateTable(d, command, ioutil.Discard); err == nil {
+			t.Errorf("%s succeeded", command)
+		}
+	}
+	for _, command := range []string{"create btree table comp compressed", "create btree table dups compressed duplicates"} {
+		if err := db.HandleCreateTable(d, command, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := int64(0); key < 2000; key++ {
+		for _, name := range []string{"comp", "dups"} {
+			if err := db.HandleInsert(d, fmt.Sprintf("insert %d %d into %s", key, key*2, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.HandleInsert(d, "insert 7 1 into dups"); err != nil {
+		t.Fatal(err)
+	}
+	// The tables are reopened as the kinds of table they were created as.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	expected := map[string]int64{"comp": pager.INDEX_BTREE_COMPRESSED, "dups": pager.INDEX_BTREE_DUPLICATES_COMPRESSED}
+	for name, indexType := range expected {
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info := table.GetPager().GetFileInfo(); info.IndexType != indexType {
+			t.Errorf("table %s holds a %s, expected a %s", name, pager.IndexTypeName(info.IndexType), pager.IndexTypeName(indexType))
+		}
+		if entry, err := table.Find(1999); err != nil || entry.GetValue() != 3998 {
+			t.Errorf("key 1999 missing from table %s after reopening", name)
+		}
+	}
+	if values := duplicateValues(t, d, "dups", 7); fmt.Sprint(values) != "[1 14]" {
+		t.Errorf("key 7 has values %v after reopening", values)
+	}
+	// Recovery recreates a table with the options it was created with.
+	walDir, err := ioutil.TempDir("", "bumble-wal-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(walDir)
+	folder, logName := filepath.Join(walDir, "data"), filepath.Join(walDir, "db.log")
+	rd, tm, rm := openRecoveryDB(t, folder, logName)
+	if err := recovery.HandleCreateTable(rd, tm, rm, "create btree table logged duplicates compressed", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	rd, _, rm = openRecoveryDB(t, folder, logName)
+	defer rd.Close()
+	if err := rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	table, err := rd.GetTable("logged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := table.GetPager().GetFileInfo(); info.IndexType != pager.INDEX_BTREE_DUPLICATES_COMPRESSED {
+		t.Errorf("recovered table holds a %s", pager.IndexTypeName(info.IndexType))
+	}
+}
@@ -0,0 +1,1515 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	recovery "github.com/brown-csci1270/db/pkg/recovery"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestPager(t *testing.T) {
+	t.Run("TestPolicyEviction", testPolicyEviction)
+	t.Run("TestPolicyReinstate", testPolicyReinstate)
+	t.Run("TestLRUKOrder", testLRUKOrder)
+	t.Run("TestSharedPool", testSharedPool)
+	t.Run("TestPageSize", testPageSize)
+	t.Run("TestChecksum", testChecksum)
+	t.Run("TestFreelist", testFreelist)
+	t.Run("TestHashFreesBuckets", testHashFreesBuckets)
+	t.Run("TestStats", testStats)
+	t.Run("TestFlusher", testFlusher)
+	t.Run("TestReadAhead", testReadAhead)
+	t.Run("TestSpill", testSpill)
+	t.Run("TestEncryption", testEncryption)
+	t.Run("TestEncryptedLog", testEncryptedLog)
+	t.Run("TestFileHeader", testFileHeader)
+	t.Run("TestSyncMode", testSyncMode)
+	t.Run("TestDoubleWrite", testDoubleWrite)
+	t.Run("TestTornHeader", testTornHeader)
+	t.Run("TestDoubleWriteSyncMode", testDoubleWriteSyncMode)
+	t.Run("TestFaultInjection", testFaultInjection)
+	t.Run("TestLogFaults", testLogFaults)
+	t.Run("TestPinTracking", testPinTracking)
+}
+
+// =====================================================================
+// HELPERS
+// =====================================================================
+
+func getTempPager(t *testing.T, p *pager.Pager) string {
+	dbName := getTempBTreeDB(t)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	return dbName
+}
+
+func writePageInt(t *testing.T, p *pager.Pager, pn int64, v int64) {
+	page, err := p.GetPage(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(data, v)
+	page.Update(data, 0, int64(len(data)))
+	page.Put()
+}
+
+func readPageInt(t *testing.T, p *pager.Pager, pn int64) int64 {
+	page, err := p.GetPage(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	v, _ := binary.Varint((*page.GetData())[:binary.MaxVarintLen64])
+	return v
+}
+
+// Fail the test if any page of the pool is still pinned, showing where the pins
+// were taken. Pin tracking must be on before the pages are pinned.
+func checkPinLeaks(t *testing.T, pool *pager.BufferPool) {
+	t.Helper()
+	if err := pool.CheckPins(); err != nil {
+		t.Error(err)
+	}
+}
+
+// =====================================================================
+// TESTS (Replacement policies)
+// =====================================================================
+
+func testPolicyEviction(t *testing.T) {
+	for _, name := range []string{pager.LRU_POLICY, pager.CLOCK_POLICY, pager.LRUK_POLICY, pager.TWOQ_POLICY} {
+		policy, err := pager.NewPolicy(name, pager.NUMPAGES)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := pager.NewPagerWithPolicy(policy)
+		dbName := getTempPager(t, p)
+		// Write more pages than fit in the pool, revisiting a hot set in between.
+		nPages := int64(4 * pager.NUMPAGES)
+		for pn := int64(0); pn < nPages; pn++ {
+			writePageInt(t, p, pn, pn*7)
+			readPageInt(t, p, pn%4)
+		}
+		for pn := int64(0); pn < nPages; pn++ {
+			if v := readPageInt(t, p, pn); v != pn*7 {
+				t.Errorf("%s: page %d holds %d, expected %d", name, pn, v, pn*7)
+			}
+		}
+		p.Close()
+		os.Remove(dbName)
+	}
+}
+
+func testPolicyReinstate(t *testing.T) {
+	// Pages that are picked for eviction but put back keep their place, so
+	// the policy picks the same pages again, in the same order.
+	for _, name := range []string{pager.LRU_POLICY, pager.CLOCK_POLICY, pager.LRUK_POLICY, pager.TWOQ_POLICY} {
+		policy, err := pager.NewPolicy(name, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := pager.NewPagerWithPool(pager.NewBufferPool(8, policy))
+		dbName := getTempPager(t, p)
+		for pn := int64(0); pn < 8; pn++ {
+			writePageInt(t, p, pn, pn)
+		}
+		var picked []int64
+		for round := 0; round < 3; round++ {
+			first, second := policy.Victim(), policy.Victim()
+			if first == nil || second == nil {
+				t.Fatalf("%s: no page to evict", name)
+			}
+			pns := []int64{first.GetPageNum(), second.GetPageNum()}
+			policy.Reinstate(second)
+			policy.Reinstate(first)
+			if picked != nil && (pns[0] != picked[0] || pns[1] != picked[1]) {
+				t.Errorf("%s: picked pages %v after putting back pages %v", name, pns, picked)
+			}
+			picked = pns
+		}
+		for pn := int64(0); pn < 16; pn++ {
+			if v := readPageInt(t, p, pn%8); v != pn%8 {
+				t.Errorf("%s: page %d holds %d", name, pn%8, v)
+			}
+		}
+		p.Close()
+		os.Remove(dbName)
+	}
+}
+
+func testLRUKOrder(t *testing.T) {
+	policy := pager.NewLRUKPolicy(2, 8)
+	p := pager.NewPagerWithPool(pager.NewBufferPool(8, policy))
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	defer p.Close()
+	// Pages 4 to 7 are referenced once, and go first, least recently used
+	// first; pages 0 to 3 are referenced twice, and go in the order of their
+	// second to last reference, not of their last.
+	for pn := int64(0); pn < 8; pn++ {
+		writePageInt(t, p, pn, pn)
+	}
+	for _, pn := range []int64{2, 0, 3, 1} {
+		readPageInt(t, p, pn)
+	}
+	var victims []*pager.Page
+	for victim := policy.Victim(); victim != nil; victim = policy.Victim() {
+		victims = append(victims, victim)
+	}
+	for i := len(victims) - 1; i >= 0; i-- {
+		policy.Reinstate(victims[i])
+	}
+	expected := []int64{4, 5, 6, 7, 0, 1, 2, 3}
+	if len(victims) != len(expected) {
+		t.Fatalf("LRU-K picked %d victims, expected %d", len(victims), len(expected))
+	}
+	for i, victim := range victims {
+		if victim.GetPageNum() != expected[i] {
+			t.Errorf("LRU-K picked page %d as victim %d, expected page %d", victim.GetPageNum(), i, expected[i])
+		}
+	}
+}
+
+// =====================================================================
+// TESTS (Shared buffer pool)
+// =====================================================================
+
+func testSharedPool(t *testing.T) {
+	pool := pager.NewBufferPool(16, pager.NewTwoQPolicy(16))
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	bt, err := btree.OpenTableWithPool(btreeName, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht, err := hash.OpenTableWithPool(hashName, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both tables outgrow the pool, so they have to take frames from each other.
+	for i := int64(0); i < 5000; i++ {
+		if err := bt.Insert(i, i*2); err != nil {
+			t.Fatal(err)
+		}
+		if err := ht.Insert(i, i*3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pool.GetNumFrames() != 16 {
+		t.Errorf("pool has %d frames, expected 16", pool.GetNumFrames())
+	}
+	for i := int64(0); i < 5000; i++ {
+		if e, err := bt.Find(i); err != nil || e.GetValue() != i*2 {
+			t.Fatalf("btree lookup of %d failed: %v", i, err)
+		}
+		if e, err := ht.Find(i); err != nil || e.GetValue() != i*3 {
+			t.Fatalf("hash lookup of %d failed: %v", i, err)
+		}
+	}
+	bt.Close()
+	ht.Close()
+	// Reopen the hash table through the same pool and check that it survived.
+	ht, err = hash.OpenTableWithPool(hashName, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	for i := int64(0); i < 5000; i += 97 {
+		if e, err := ht.Find(i); err != nil || e.GetValue() != i*3 {
+			t.Fatalf("hash lookup of %d after reopen failed: %v", i, err)
+		}
+	}
+}
+
+// =====================================================================
+// TESTS (Page sizes)
+// =====================================================================
+
+func testPageSize(t *testing.T) {
+	if _, err := pager.NewPagerWithOptions(8, pager.PAGESIZE+1); err == nil {
+		t.Error("expected an error for a page size that isn't a multiple of the block size")
+	}
+	bigPool, err := pager.NewBufferPoolWithOptions(8, 4*pager.PAGESIZE, pager.NewLRUPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallPool := pager.NewBufferPool(8, pager.NewLRUPolicy())
+	// Create one table of each index type with big pages.
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	bt, err := btree.OpenTableWithPool(btreeName, bigPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht, err := hash.OpenTableWithPool(hashName, bigPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.GetPager().GetPageSize() != 4*pager.PAGESIZE {
+		t.Errorf("new table has page size %d, expected %d", bt.GetPager().GetPageSize(), 4*pager.PAGESIZE)
+	}
+	for i := int64(0); i < 3000; i++ {
+		if err := bt.Insert(i, i+1); err != nil {
+			t.Fatal(err)
+		}
+		if err := ht.Insert(i, i+2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bt.Close()
+	ht.Close()
+	// Reopen them through a pool of small frames; the file header keeps them readable.
+	bt, err = btree.OpenTableWithPool(btreeName, smallPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bt.Close()
+	ht, err = hash.OpenTableWithPool(hashName, smallPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	if bt.GetPager().GetPageSize() != 4*pager.PAGESIZE {
+		t.Errorf("reopened table has page size %d, expected %d", bt.GetPager().GetPageSize(), 4*pager.PAGESIZE)
+	}
+	for i := int64(0); i < 3000; i++ {
+		if e, err := bt.Find(i); err != nil || e.GetValue() != i+1 {
+			t.Fatalf("btree lookup of %d failed: %v", i, err)
+		}
+		if e, err := ht.Find(i); err != nil || e.GetValue() != i+2 {
+			t.Fatalf("hash lookup of %d failed: %v", i, err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(bt); !ok {
+		t.Errorf("reopened table is not a valid B+Tree: %v", err)
+	}
+}
+
+// =====================================================================
+// TESTS (Checksums)
+// =====================================================================
+
+func testChecksum(t *testing.T) {
+	p := pager.NewPager()
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	for pn := int64(0); pn < 4; pn++ {
+		writePageInt(t, p, pn, pn+100)
+	}
+	p.Close()
+	// Flip a byte in the middle of page 2.
+	f, err := os.OpenFile(dbName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, pager.HEADERSIZE+2*pager.PAGESIZE+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Intact pages still read fine; the damaged one is reported.
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if v := readPageInt(t, p, 1); v != 101 {
+		t.Errorf("page 1 holds %d, expected 101", v)
+	}
+	_, err = p.GetPage(2)
+	var corrupt pager.ErrPageCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("expected ErrPageCorrupt, got %v", err)
+	}
+	if corrupt.PageNum != 2 || corrupt.File != p.GetFileName() {
+		t.Errorf("ErrPageCorrupt names page %d of %s", corrupt.PageNum, corrupt.File)
+	}
+}
+
+// =====================================================================
+// TESTS (Freelist)
+// =====================================================================
+
+func testFreelist(t *testing.T) {
+	p := pager.NewPager()
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	// Allocate enough pages that freeing them spills over several trunk pages.
+	nPages := int64(1000)
+	for pn := int64(0); pn < nPages; pn++ {
+		if got := p.GetFreePN(); got != pn {
+			t.Fatalf("allocated page %d, expected %d", got, pn)
+		}
+		writePageInt(t, p, pn, pn+1)
+	}
+	for pn := int64(1); pn < nPages; pn += 2 {
+		if err := p.FreePage(pn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+	// The freelist survives a restart.
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if n := p.GetNumFreePages(); n != nPages/2 {
+		t.Fatalf("freelist holds %d pages after reopen, expected %d", n, nPages/2)
+	}
+	// Freed pages are handed out again, zeroed, before the file grows.
+	seen := make(map[int64]bool)
+	for i := int64(0); i < nPages/2; i++ {
+		pn := p.GetFreePN()
+		if pn >= nPages || pn%2 == 0 || seen[pn] {
+			t.Fatalf("allocated page %d, expected an unused odd page below %d", pn, nPages)
+		}
+		seen[pn] = true
+		if v := readPageInt(t, p, pn); v != 0 {
+			t.Errorf("recycled page %d holds %d, expected it to be zeroed", pn, v)
+		}
+	}
+	if pn := p.GetFreePN(); pn != nPages {
+		t.Errorf("allocated page %d once the freelist was empty, expected %d", pn, nPages)
+	}
+	for pn := int64(0); pn < nPages; pn += 2 {
+		if v := readPageInt(t, p, pn); v != pn+1 {
+			t.Errorf("page %d holds %d, expected %d", pn, v, pn+1)
+		}
+	}
+	// A page that is still pinned is only freed once it is put.
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := p.GetNumFreePages()
+	if err := p.FreePage(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.GetNumFreePages(); n != free {
+		t.Errorf("freeing a pinned page changed the freelist size to %d, expected %d", n, free)
+	}
+	page.Put()
+	if n := p.GetNumFreePages(); n != free+1 {
+		t.Errorf("putting a page freed earlier left the freelist size at %d, expected %d", n, free+1)
+	}
+	// A freed page that is read again before it is reused still reads back zeroed.
+	for _, pn := range []int64{2, 4} {
+		if err := p.FreePage(pn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readPageInt(t, p, 4)
+	if pn := p.GetFreePN(); pn != 4 {
+		t.Fatalf("allocated page %d, expected the last page freed", pn)
+	}
+	if v := readPageInt(t, p, 4); v != 0 {
+		t.Errorf("recycled page 4 holds %d after being read while free, expected it to be zeroed", v)
+	}
+}
+
+func testHashFreesBuckets(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(5000)
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := index.GetPager().GetNumPages()
+	// Emptied buckets are merged into their buddies and their pages freed.
+	for i := int64(0); i < n; i++ {
+		if err := index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.GetPager().GetNumFreePages() == 0 {
+		t.Fatal("deleting every entry freed no pages")
+	}
+	if entries, err := index.Select(); err != nil || len(entries) != 0 {
+		t.Fatalf("select after deleting everything returned %d entries: %v", len(entries), err)
+	}
+	// Refilling the table reuses the freed pages.
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := index.GetPager().GetNumPages(); got > grown {
+		t.Errorf("table grew to %d pages on refill, expected at most %d", got, grown)
+	}
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, err := index.Select()
+	if err != nil || int64(len(entries)) != n {
+		t.Fatalf("select after reopen returned %d entries: %v", len(entries), err)
+	}
+	for _, e := range entries {
+		if e.GetValue() != -e.GetKey() {
+			t.Fatalf("key %d has value %d, expected %d", e.GetKey(), e.GetValue(), -e.GetKey())
+		}
+	}
+}
+
+// =====================================================================
+// TESTS (Statistics)
+// =====================================================================
+
+func testStats(t *testing.T) {
+	p, err := pager.NewPagerWithOptions(8, pager.PAGESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	for pn := int64(0); pn < 16; pn++ {
+		writePageInt(t, p, pn, pn)
+	}
+	readPageInt(t, p, 15)
+	stats := p.Stats()
+	if stats.Misses != 16 || stats.Hits != 1 {
+		t.Errorf("got %d hits and %d misses, expected 1 and 16", stats.Hits, stats.Misses)
+	}
+	if stats.Evictions != 8 || stats.DirtyFlushes != 8 {
+		t.Errorf("got %d evictions and %d dirty flushes, expected 8 and 8", stats.Evictions, stats.DirtyFlushes)
+	}
+	if stats.UnpinnedFrames != 8 || stats.PinnedFrames != 0 || stats.FreeFrames != 0 || stats.PoolFrames != 8 {
+		t.Errorf("unexpected frame counts: %+v", stats)
+	}
+	// Pin every frame, then ask for one more page.
+	pages := make([]*pager.Page, 0)
+	for pn := int64(0); pn < 8; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page)
+	}
+	if _, err := p.GetPage(8); err == nil {
+		t.Error("expected an error with every frame pinned")
+	}
+	stats = p.Stats()
+	if stats.FrameFailures != 1 || stats.PinnedFrames != 8 {
+		t.Errorf("got %d failed frame requests and %d pinned frames, expected 1 and 8", stats.FrameFailures, stats.PinnedFrames)
+	}
+	for _, page := range pages {
+		page.Put()
+	}
+	p.Close()
+}
+
+// =====================================================================
+// TESTS (Background flusher)
+// =====================================================================
+
+func testFlusher(t *testing.T) {
+	pool := pager.NewBufferPool(32, pager.NewLRUPolicy())
+	opts := pager.FlusherOptions{Interval: time.Millisecond, HighWater: 0.2, LowWater: 0}
+	if err := pool.StartFlusher(opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.StartFlusher(opts); err == nil {
+		t.Error("expected an error starting a second flusher")
+	}
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTableWithPool(dbName, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 20000; i++ {
+		if err := index.Insert(i, i%97); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Give the flusher a chance to catch up with the last inserts.
+	deadline := time.Now().Add(2 * time.Second)
+	for index.GetPager().Stats().DirtyFlushes == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if index.GetPager().Stats().DirtyFlushes == 0 {
+		t.Error("flusher wrote no pages")
+	}
+	for i := int64(0); i < 20000; i++ {
+		if e, err := index.Find(i); err != nil || e.GetValue() != i%97 {
+			t.Fatalf("lookup of %d failed: %v", i, err)
+		}
+	}
+	index.Close()
+	pool.StopFlusher()
+	// Everything reached disk in one piece.
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 20000; i++ {
+		if e, err := index.Find(i); err != nil || e.GetValue() != i%97 {
+			t.Fatalf("lookup of %d after reopen failed: %v", i, err)
+		}
+	}
+}
+
+// =====================================================================
+// TESTS (Read-ahead)
+// =====================================================================
+
+func testReadAhead(t *testing.T) {
+	p := pager.NewPager()
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	for pn := int64(0); pn < 200; pn++ {
+		writePageInt(t, p, pn, pn*3)
+	}
+	p.Close()
+	// Scan sequentially on a cold cache.
+	pool := pager.NewBufferPool(64, pager.NewLRUPolicy())
+	pool.SetReadAhead(8)
+	p = pager.NewPagerWithPool(pool)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	for pn := int64(0); pn < 40; pn++ {
+		if v := readPageInt(t, p, pn); v != pn*3 {
+			t.Fatalf("page %d holds %d, expected %d", pn, v, pn*3)
+		}
+	}
+	stats := p.Stats()
+	if stats.ReadAheads == 0 || stats.Misses >= 40 {
+		t.Errorf("got %d read-aheads and %d misses for a sequential scan", stats.ReadAheads, stats.Misses)
+	}
+	// Explicitly prefetched pages are hits.
+	p.Prefetch([]int64{150, 151, 152})
+	hits := p.Stats().Hits
+	for pn := int64(150); pn < 153; pn++ {
+		if v := readPageInt(t, p, pn); v != pn*3 {
+			t.Fatalf("page %d holds %d, expected %d", pn, v, pn*3)
+		}
+	}
+	if got := p.Stats().Hits - hits; got != 3 {
+		t.Errorf("got %d hits on prefetched pages, expected 3", got)
+	}
+	// A free page that is read ahead still reads back zeroed once it is reused,
+	// and keeps what is then written to it.
+	for _, pn := range []int64{5, 6} {
+		if err := p.FreePage(pn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+	p = pager.NewPagerWithPool(pool)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	p.Prefetch([]int64{6})
+	if pn := p.GetFreePN(); pn != 6 {
+		t.Fatalf("allocated page %d, expected the last page freed", pn)
+	}
+	if v := readPageInt(t, p, 6); v != 0 {
+		t.Errorf("recycled page 6 holds %d after being read ahead, expected it to be zeroed", v)
+	}
+	writePageInt(t, p, 6, 100)
+	for pn := int64(100); pn < 200; pn++ {
+		readPageInt(t, p, pn)
+	}
+	if v := readPageInt(t, p, 6); v != 100 {
+		t.Errorf("recycled page 6 holds %d after being evicted, expected 100", v)
+	}
+	p.Close()
+	// Cursor scans with read-ahead see every entry.
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	ht, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 3000; i++ {
+		ht.Insert(i, i)
+	}
+	ht.Close()
+	ht, err = hash.OpenTableWithPool(hashName, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	cursor, err := ht.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := 0
+	for {
+		if !cursor.IsEnd() {
+			seen++
+		}
+		if cursor.StepForward() != nil {
+			break
+		}
+	}
+	if seen != 3000 {
+		t.Errorf("cursor saw %d entries, expected 3000", seen)
+	}
+}
+
+// =====================================================================
+// TESTS (Spilling memory-only pagers)
+// =====================================================================
+
+func testSpill(t *testing.T) {
+	// A memory-only pager can hold more pages than its pool has frames.
+	p := pager.NewPager()
+	for pn := int64(0); pn < 4*pager.NUMPAGES; pn++ {
+		writePageInt(t, p, pn, pn*5)
+	}
+	for pn := int64(0); pn < 4*pager.NUMPAGES; pn++ {
+		if v := readPageInt(t, p, pn); v != pn*5 {
+			t.Fatalf("page %d holds %d, expected %d", pn, v, pn*5)
+		}
+	}
+	if p.HasFile() {
+		t.Error("memory-only pager reports a file after spilling")
+	}
+	if p.Stats().Evictions == 0 {
+		t.Error("expected pages of a memory-only pager to be evicted")
+	}
+	p.Close()
+	// So can a temporary hash table.
+	index, err := hash.OpenTempTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 20000; i++ {
+		if err := index.Insert(i, i%7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 20000; i += 97 {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetValue() != i%7 {
+			t.Fatalf("key %d holds %d, expected %d", i, entry.GetValue(), i%7)
+		}
+	}
+	if index.GetPager().GetNumPages() <= pager.NUMPAGES {
+		t.Error("expected the temporary table to outgrow its pool")
+	}
+}
+
+// =====================================================================
+// TESTS (Encryption)
+// =====================================================================
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func getEncryptedPool(t *testing.T, key []byte) *pager.BufferPool {
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	if key != nil {
+		if err := pool.SetEncryptionKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pool
+}
+
+func testEncryption(t *testing.T) {
+	// Keys can be given in hex.
+	keyFile, err := ioutil.TempFile("", "bumble-key-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString(hex.EncodeToString(testKey) + "\n")
+	keyFile.Close()
+	if key, err := pager.ReadKeyFile(keyFile.Name()); err != nil || !bytes.Equal(key, testKey) {
+		t.Fatalf("failed to read hex key file: %v", err)
+	}
+	secret := []byte("attack at dawn")
+	p := pager.NewPagerWithPool(getEncryptedPool(t, testKey))
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	if !p.IsEncrypted() {
+		t.Fatal("expected pager to encrypt pages")
+	}
+	for pn := int64(0); pn < 3*pager.NUMPAGES; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update(secret, 0, int64(len(secret)))
+		page.Put()
+	}
+	p.Close()
+	// No plaintext should reach the disk.
+	contents, err := ioutil.ReadFile(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, secret) {
+		t.Fatal("found plaintext in an encrypted file")
+	}
+	// The file reads back with the right key only.
+	p = pager.NewPagerWithPool(getEncryptedPool(t, testKey))
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	page, err := p.GetPage(pager.NUMPAGES + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*page.GetData())[:len(secret)], secret) {
+		t.Error("encrypted page did not read back intact")
+	}
+	page.Put()
+	p.Close()
+	if err := pager.NewPagerWithPool(getEncryptedPool(t, nil)).Open(dbName); err == nil {
+		t.Error("expected opening an encrypted file without a key to fail")
+	}
+	wrongKey := []byte("fedcba9876543210fedcba9876543210")
+	if err := pager.NewPagerWithPool(getEncryptedPool(t, wrongKey)).Open(dbName); err == nil {
+		t.Error("expected opening an encrypted file with the wrong key to fail")
+	}
+	// Failed opens don't leave a double-write file behind.
+	if _, err := os.Stat(dbName + pager.DWB_SUFFIX); !os.IsNotExist(err) {
+		t.Errorf("expected no double-write file after failed opens, got %v", err)
+	}
+	// Tampering with a page is detected.
+	file, err := os.OpenFile(dbName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xff}, pager.HEADERSIZE+2*pager.PAGESIZE+100)
+	file.Close()
+	p = pager.NewPagerWithPool(getEncryptedPool(t, testKey))
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.GetPage(2)
+	var corrupt pager.ErrPageCorrupt
+	if !errors.As(err, &corrupt) || corrupt.PageNum != 2 {
+		t.Errorf("expected page 2 to be reported corrupt, got %v", err)
+	}
+	p.Close()
+	// A plaintext file can't be opened with a key.
+	plainName := getTempBTreeDB(t)
+	defer os.Remove(plainName)
+	plain := pager.NewPager()
+	if err := plain.Open(plainName); err != nil {
+		t.Fatal(err)
+	}
+	writePageInt(t, plain, 0, 1)
+	plain.Close()
+	if err := pager.NewPagerWithPool(getEncryptedPool(t, testKey)).Open(plainName); err == nil {
+		t.Error("expected opening a plaintext file with a key to fail")
+	}
+	// Indexes work on top of encrypted pagers.
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	index, err := hash.OpenTableWithPool(hashName, getEncryptedPool(t, testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 5000; i++ {
+		index.Insert(i, i+1)
+	}
+	index.Close()
+	index, err = hash.OpenTableWithPool(hashName, getEncryptedPool(t, testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 5000; i += 11 {
+		entry, err := index.Find(i)
+		if err != nil || entry.GetValue() != i+1 {
+			t.Fatalf("lost key %d in an encrypted hash table: %v", i, err)
+		}
+	}
+}
+
+func testEncryptedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bumble-wal-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	d, err := db.OpenWithPool(filepath.Join(dir, "data"), getEncryptedPool(t, testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.CreateLogFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	newManager := func(key []byte) *recovery.RecoveryManager {
+		tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+		rm, err := recovery.NewRecoveryManager(d, tm, logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.SetEncryptionKey(key); err != nil {
+			t.Fatal(err)
+		}
+		return rm
+	}
+	rm := newManager(testKey)
+	id := uuid.New()
+	rm.Start(id)
+	rm.Commit(id)
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte(id.String())) {
+		t.Fatal("found plaintext in an encrypted log")
+	}
+	if err := newManager(testKey).Recover(); err != nil {
+		t.Errorf("recovering from an encrypted log failed: %v", err)
+	}
+	if err := newManager([]byte("fedcba9876543210fedcba9876543210")).Recover(); err == nil {
+		t.Error("expected recovering with the wrong key to fail")
+	}
+}
+
+// =====================================================================
+// TESTS (File header)
+// =====================================================================
+
+// Overwrite a varint header field of the given file.
+func patchHeaderField(t *testing.T, filename string, offset int64, v int64) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header := make([]byte, pager.HEADER_CHECKSUM_OFFSET+pager.HEADER_CHECKSUM_SIZE)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	binary.PutVarint(header[offset:offset+binary.MaxVarintLen64], v)
+	// Reseal the header, so that it is read as patched rather than torn.
+	sum := crc32.Checksum(header[:pager.HEADER_CHECKSUM_OFFSET], crc32.MakeTable(crc32.Castagnoli))
+	binary.LittleEndian.PutUint32(header[pager.HEADER_CHECKSUM_OFFSET:], sum)
+	if _, err := file.WriteAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFileHeader(t *testing.T) {
+	d, dir := openTempDB(t)
+	defer os.RemoveAll(dir)
+	for _, payload := range []string{"create btree table b", "create hash table h"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"b", "h"} {
+		table, _ := d.GetTable(name)
+		for i := int64(0); i < 1000; i++ {
+			table.Insert(i, i*2)
+		}
+	}
+	d.Close()
+	// The header describes each file.
+	expected := map[string]pager.FileInfo{
+		"b":      {IndexType: pager.INDEX_BTREE, HashFunc: pager.HASH_NONE},
+		"h":      {IndexType: pager.INDEX_HASH, HashFunc: pager.HASH_XXHASH},
+		"h.meta": {IndexType: pager.INDEX_HASH_META, HashFunc: pager.HASH_NONE},
+	}
+	for name, want := range expected {
+		info, err := pager.ReadFileInfo(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != pager.FORMAT_VERSION || info.PageSize != pager.PAGESIZE {
+			t.Errorf("%s: got version %d and page size %d", name, info.Version, info.PageSize)
+		}
+		if info.IndexType != want.IndexType || info.HashFunc != want.HashFunc {
+			t.Errorf("%s: got index type %d and hash function %d", name, info.IndexType, info.HashFunc)
+		}
+		if time.Since(info.Created) > time.Minute {
+			t.Errorf("%s: got creation time %v", name, info.Created)
+		}
+	}
+	// Tables reopen as the kind of index they were created as.
+	d, err := db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.(*hash.HashIndex); !ok {
+		t.Errorf("hash table reopened as %T", table)
+	}
+	if entry, err := table.Find(21); err != nil || entry.GetValue() != 42 {
+		t.Errorf("lost key 21 in reopened hash table: %v", err)
+	}
+	table, err = d.GetTable("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.(*btree.BTreeIndex); !ok {
+		t.Errorf("B+tree reopened as %T", table)
+	}
+	d.Close()
+	// Mismatched index types are rejected.
+	if _, err := btree.OpenTable(filepath.Join(dir, "h")); err == nil {
+		t.Error("expected opening a hash index as a B+tree to fail")
+	}
+	// Foreign and incompatible files give clear errors.
+	ioutil.WriteFile(filepath.Join(dir, "junk"), bytes.Repeat([]byte("junk"), int(pager.HEADERSIZE)/2), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "zeros"), make([]byte, 2*pager.PAGESIZE), 0666)
+	patchHeaderField(t, filepath.Join(dir, "b"), pager.HEADER_VERSION_OFFSET, pager.FORMAT_VERSION+1)
+	patchHeaderField(t, filepath.Join(dir, "h"), pager.HEADER_HASH_FUNC_OFFSET, pager.HASH_MURMUR3)
+	errs := map[string]string{
+		"junk":  "not a database file",
+		"zeros": "not a database file",
+		"b":     "newer than the supported version",
+		"h":     "hashed with MurmurHash3",
+	}
+	d, err = db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for name, msg := range errs {
+		if _, err := d.GetTable(name); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("opening %s: expected an error containing %q, got %v", name, msg, err)
+		}
+	}
+	// Files written before pagers kept a header are given one, then upgraded.
+	oldName := filepath.Join(dir, "old")
+	writeLegacyBTree(t, oldName, 1, 500)
+	image, err := ioutil.ReadFile(oldName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image = image[pager.HEADERSIZE:]
+	for offset := pager.PAGESIZE; offset <= int64(len(image)); offset += pager.PAGESIZE {
+		copy(image[offset-pager.CHECKSUM_SIZE:offset], make([]byte, pager.CHECKSUM_SIZE))
+	}
+	if err := ioutil.WriteFile(oldName, image, 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(oldName + pager.DWB_SUFFIX)
+	if info, err := pager.ReadFileInfo(oldName); err != nil || !info.Headerless || info.Version != 0 || info.PageSize != pager.PAGESIZE {
+		t.Errorf("file without a header is described as %+v: %v", info, err)
+	}
+	// Unless the pool was asked to add headers, they are refused and left untouched.
+	for _, name := range []string{"zeros", "old"} {
+		before, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if _, err := d.GetTable(name); err == nil || !strings.Contains(err.Error(), "not a database file") {
+			t.Errorf("opening %s without adding headers: expected it to be refused, got %v", name, err)
+		}
+		if after, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(before, after) {
+			t.Errorf("refusing to open %s changed it", name)
+		}
+	}
+	d.GetPool().SetAddHeaders(true)
+	table, err = d.GetTable("old")
+	if err != nil {
+		t.Fatalf("opening a file without a header failed: %v", err)
+	}
+	if v := table.GetPager().GetFileInfo().Version; v != pager.FORMAT_VERSION {
+		t.Errorf("upgraded table has format version %d, expected %d", v, pager.FORMAT_VERSION)
+	}
+	for _, key := range []int64{0, 250, 499} {
+		if entry, err := table.Find(key); err != nil || entry.GetValue() != key {
+			t.Errorf("lost key %d in a file without a header: %v", key, err)
+		}
+	}
+}
+
+// =====================================================================
+// TESTS (Flush errors and durability)
+// =====================================================================
+
+func testSyncMode(t *testing.T) {
+	if _, err := pager.ParseSyncMode("sometimes"); err == nil {
+		t.Error("expected an unknown sync mode to be rejected")
+	}
+	for _, name := range []string{"none", "checkpoint", "flush"} {
+		mode, err := pager.ParseSyncMode(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+		if err := pool.SetSyncMode(mode); err != nil {
+			t.Fatal(err)
+		}
+		// Pages written under every mode read back.
+		p := pager.NewPagerWithPool(pool)
+		dbName := getTempPager(t, p)
+		defer os.Remove(dbName)
+		for pn := int64(0); pn < 2*pager.NUMPAGES; pn++ {
+			writePageInt(t, p, pn, pn+7)
+		}
+		if err := p.FlushAllPages(); err != nil {
+			t.Errorf("%s: flush failed: %v", name, err)
+		}
+		if err := p.Close(); err != nil {
+			t.Errorf("%s: close failed: %v", name, err)
+		}
+		p = pager.NewPagerWithPool(pool)
+		if err := p.Open(dbName); err != nil {
+			t.Fatal(err)
+		}
+		if v := readPageInt(t, p, pager.NUMPAGES+3); v != pager.NUMPAGES+10 {
+			t.Errorf("%s: page read back %d", name, v)
+		}
+		p.Close()
+	}
+	// Write errors reach the caller, and the page stays dirty.
+	p := pager.NewPager()
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	page.SetDirty(true)
+	if err := p.FlushPage(page); err == nil {
+		t.Error("expected flushing to a closed file to fail")
+	}
+	if !page.IsDirty() {
+		t.Error("expected a page that failed to flush to stay dirty")
+	}
+	// Checkpoints sync and then log.
+	dir, err := ioutil.TempDir("", "bumble-sync-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetSyncMode(pager.SYNC_CHECKPOINT)
+	d, err := db.OpenWithPool(filepath.Join(dir, "data"), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	logName := filepath.Join(dir, "db.log")
+	d.CreateLogFile(logName)
+	rm, err := recovery.NewRecoveryManager(d, concurrency.NewTransactionManager(concurrency.NewLockManager()), logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, _ := d.GetTable("t")
+	table.Insert(1, 2)
+	if err := rm.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(logName)
+	if !bytes.Contains(contents, []byte("checkpoint")) {
+		t.Error("expected a checkpoint record in the log")
+	}
+}
+
+// =====================================================================
+// TESTS (Double-write)
+// =====================================================================
+
+func testDoubleWrite(t *testing.T) {
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetDoubleWrite(true)
+	p := pager.NewPagerWithPool(pool)
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + pager.DWB_SUFFIX)
+	for pn := int64(0); pn < 10; pn++ {
+		writePageInt(t, p, pn, pn*11)
+	}
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	// Crash halfway through rewriting page 3, without closing the pager.
+	file, err := os.OpenFile(dbName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(bytes.Repeat([]byte{0xab}, int(pager.PAGESIZE/2)), pager.HEADERSIZE+3*pager.PAGESIZE)
+	file.Close()
+	// Opening the file again repairs the page from the side file.
+	pool = pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetDoubleWrite(true)
+	p = pager.NewPagerWithPool(pool)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	for pn := int64(0); pn < 10; pn++ {
+		if v := readPageInt(t, p, pn); v != pn*11 {
+			t.Errorf("page %d holds %d after repair, expected %d", pn, v, pn*11)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dbName + pager.DWB_SUFFIX); !os.IsNotExist(err) {
+		t.Error("expected the side file to be removed on a clean close")
+	}
+	// Without a side file, a torn page is reported as corrupt.
+	file, err = os.OpenFile(dbName, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(bytes.Repeat([]byte{0xab}, int(pager.PAGESIZE/2)), pager.HEADERSIZE+3*pager.PAGESIZE)
+	file.Close()
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var corrupt pager.ErrPageCorrupt
+	if _, err := p.GetPage(3); !errors.As(err, &corrupt) {
+		t.Errorf("expected page 3 to be reported corrupt, got %v", err)
+	}
+}
+
+func testTornHeader(t *testing.T) {
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetDoubleWrite(true)
+	p := pager.NewPagerWithPool(pool)
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + pager.DWB_SUFFIX)
+	writePageInt(t, p, 0, 1)
+	if err := p.CheckIndexType(pager.INDEX_BTREE, pager.HASH_NONE); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	tearHeader := func() {
+		file, err := os.OpenFile(dbName, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteAt(bytes.Repeat([]byte{0xab}, 32), int64(len(pager.MAGIC)))
+		file.Close()
+	}
+	// Crash halfway through rewriting the header, without closing the pager.
+	tearHeader()
+	// Opening the file again repairs the header from the side file.
+	pool = pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetDoubleWrite(true)
+	p = pager.NewPagerWithPool(pool)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	if info := p.GetFileInfo(); info.IndexType != pager.INDEX_BTREE {
+		t.Errorf("header records a %s after repair, expected a B+tree", pager.IndexTypeName(info.IndexType))
+	}
+	if v := readPageInt(t, p, 0); v != 1 {
+		t.Errorf("page 0 holds %d after repair, expected 1", v)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Without a side file, a torn header is reported as corrupt.
+	tearHeader()
+	p = pager.NewPager()
+	if err := p.Open(dbName); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a torn header to fail its checksum, got %v", err)
+	}
+	if _, err := pager.ReadFileInfo(dbName); err == nil {
+		t.Error("expected reading a torn header to fail")
+	}
+}
+
+func testDoubleWriteSyncMode(t *testing.T) {
+	fs := pager.NewFaultyFS(1)
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + pager.DWB_SUFFIX)
+	p := openFaultyPager(t, fs, dbName, true)
+	writePageInt(t, p, 0, 1)
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	// Double-written pages are synced without being asked to.
+	writePageInt(t, p, 0, 2)
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+	p.Close()
+	p = openFaultyPager(t, fs, dbName, true)
+	if v := readPageInt(t, p, 0); v != 2 {
+		t.Errorf("page 0 holds %d after a crash, expected the double-written value 2", v)
+	}
+	// Unless the pool never syncs.
+	p.GetPool().SetSyncMode(pager.SYNC_NONE)
+	writePageInt(t, p, 0, 3)
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+	p.Close()
+	p = openFaultyPager(t, fs, dbName, true)
+	defer p.Close()
+	if v := readPageInt(t, p, 0); v != 2 {
+		t.Errorf("page 0 holds %d after a crash, expected the synced value 2", v)
+	}
+}
+
+// =====================================================================
+// TESTS (Fault injection)
+// =====================================================================
+
+func openFaultyPager(t *testing.T, fs *pager.FaultyFS, dbName string, doubleWrite bool) *pager.Pager {
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetFileSystem(fs)
+	pool.SetDoubleWrite(doubleWrite)
+	p := pager.NewPagerWithPool(pool)
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testFaultInjection(t *testing.T) {
+	fs := pager.NewFaultyFS(1)
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + pager.DWB_SUFFIX)
+	// A failed write is reported, and the page stays dirty until it is written.
+	p := openFaultyPager(t, fs, dbName, false)
+	writePageInt(t, p, 0, 1)
+	writePageInt(t, p, 1, 10)
+	fs.FailWrite(1)
+	if err := p.FlushAllPages(); err != pager.ErrInjectedFault {
+		t.Fatalf("expected an injected fault, got %v", err)
+	}
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.GetPool().Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Writes that weren't synced are lost in a crash.
+	writePageInt(t, p, 0, 2)
+	if err := p.FlushAllPages(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+	if err := p.Close(); err != pager.ErrCrashed {
+		t.Errorf("expected closing a crashed file to fail, got %v", err)
+	}
+	p = openFaultyPager(t, fs, dbName, true)
+	if v := readPageInt(t, p, 0); v != 1 {
+		t.Errorf("page 0 holds %d after a crash, expected the synced value 1", v)
+	}
+	// A torn page is repaired from the double-write file.
+	writePageInt(t, p, 0, 3)
+	fs.TearWrite(2, 100)
+	if err := p.FlushAllPages(); err != pager.ErrInjectedFault {
+		t.Fatalf("expected an injected fault, got %v", err)
+	}
+	fs.Crash()
+	p.Close()
+	p = openFaultyPager(t, fs, dbName, false)
+	if v := readPageInt(t, p, 0); v != 3 {
+		t.Errorf("page 0 holds %d after a torn write, expected 3", v)
+	}
+	// Without the double-write file, it is reported as corrupt.
+	writePageInt(t, p, 0, 4)
+	fs.TearWrite(1, 100)
+	if err := p.FlushAllPages(); err != pager.ErrInjectedFault {
+		t.Fatalf("expected an injected fault, got %v", err)
+	}
+	fs.Crash()
+	p.Close()
+	p = openFaultyPager(t, fs, dbName, false)
+	var corrupt pager.ErrPageCorrupt
+	if _, err := p.GetPage(0); !errors.As(err, &corrupt) {
+		t.Errorf("expected page 0 to be reported corrupt, got %v", err)
+	}
+	// Short reads are reported rather than handing out a partial page.
+	fs.SetShortReads(1)
+	if _, err := p.GetPage(1); err == nil {
+		t.Error("expected a short read to fail")
+	}
+	fs.SetShortReads(0)
+	if v := readPageInt(t, p, 1); v != 10 {
+		t.Errorf("page 1 holds %d, expected 10", v)
+	}
+	p.Close()
+	// The same seed tears the same write in the same place.
+	torn := make([]int, 2)
+	for i := range torn {
+		fs := pager.NewFaultyFS(42)
+		file, err := fs.OpenFile(getTempBTreeDB(t), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		fs.TearWrite(1, -1)
+		torn[i], _ = file.WriteAt(make([]byte, pager.PAGESIZE), 0)
+		file.Close()
+	}
+	if torn[0] != torn[1] {
+		t.Errorf("same seed tore writes at %d and %d", torn[0], torn[1])
+	}
+}
+
+func testLogFaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bumble-wal-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := pager.NewFaultyFS(1)
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetFileSystem(fs)
+	d, err := db.OpenWithPool(filepath.Join(dir, "data"), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	logName := filepath.Join(dir, "db.log")
+	if err := d.CreateLogFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	newManager := func() *recovery.RecoveryManager {
+		tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+		rm, err := recovery.NewRecoveryManager(d, tm, logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rm
+	}
+	rm := newManager()
+	committed, torn := uuid.New(), uuid.New()
+	if err := rm.Start(committed); err != nil {
+		t.Fatal(err)
+	}
+	// Failed log writes and syncs are reported, and the transaction isn't committed.
+	fs.FailWrite(1)
+	if err := rm.Commit(committed); err != pager.ErrInjectedFault {
+		t.Errorf("expected a failed log write to be reported, got %v", err)
+	}
+	fs.FailSync(1)
+	if err := rm.Commit(committed); err != pager.ErrInjectedFault {
+		t.Errorf("expected a failed log sync to be reported, got %v", err)
+	}
+	// A torn log line is overwritten by the next one.
+	fs.TearWrite(1, 5)
+	if err := rm.Start(torn); err != pager.ErrInjectedFault {
+		t.Errorf("expected a torn log write to be reported, got %v", err)
+	}
+	if err := rm.Commit(committed); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+	if err := newManager().Recover(); err != nil {
+		t.Errorf("recovering from a log with failed writes failed: %v", err)
+	}
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(contents, []byte(committed.String())); n != 2 {
+		t.Errorf("found %d log lines for the committed transaction, expected its start and commit", n)
+	}
+	if bytes.Contains(contents, []byte(torn.String())) {
+		t.Error("found the transaction whose start failed to be logged in the log")
+	}
+}
+
+// =====================================================================
+// TESTS (Pin tracking)
+// =====================================================================
+
+func leakPin(t *testing.T, p *pager.Pager, pn int64) *pager.Page {
+	page, err := p.GetPage(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func testPinTracking(t *testing.T) {
+	pool := pager.NewBufferPool(pager.NUMPAGES, pager.NewLRUPolicy())
+	pool.SetPinTracking(true)
+	p := pager.NewPagerWithPool(pool)
+	dbName := getTempPager(t, p)
+	defer os.Remove(dbName)
+	defer p.Close()
+	for pn := int64(0); pn < 4; pn++ {
+		writePageInt(t, p, pn, pn)
+	}
+	checkPinLeaks(t, pool)
+	// A leaked pin is reported with the stack it was taken from.
+	leaked := leakPin(t, p, 2)
+	leaked.Get()
+	leaked.Put()
+	// Releasing a pin taken elsewhere leaves the leaked one on record.
+	page, err := p.GetPage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	pins := pool.GetOutstandingPins()
+	if len(pins) != 1 {
+		t.Fatalf("expected 1 outstanding pin, got %d", len(pins))
+	}
+	if pins[0].PageNum != 2 || !strings.Contains(pins[0].Stack, "leakPin") {
+		t.Errorf("expected the pin of page 2 taken in leakPin, got page %d pinned at:\n%s", pins[0].PageNum, pins[0].Stack)
+	}
+	var dump bytes.Buffer
+	pool.DumpPins(&dump)
+	if !strings.Contains(dump.String(), "page 2 of") {
+		t.Errorf("expected the dump to list page 2, got:\n%s", dump.String())
+	}
+	if err := pool.CheckPins(); err == nil {
+		t.Error("expected the leaked pin to be reported")
+	}
+	leaked.Put()
+	checkPinLeaks(t, pool)
+	// Without pin tracking, the REPL says so instead of listing no pins.
+	pool.SetPinTracking(false)
+	if err := pager.HandlePagerPins(p, "pager_pins", &dump); err == nil {
+		t.Error("expected listing pins without pin tracking to fail")
+	}
+}